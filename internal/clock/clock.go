@@ -6,44 +6,95 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/Azure/metaetcd/internal/membership"
 )
 
-const metaKey = "/meta"
+// defaultMaxResolveDepth is used when Clock.MaxResolveDepth isn't set.
+const defaultMaxResolveDepth = 1000
+
+var tracer = otel.Tracer("github.com/Azure/metaetcd/internal/clock")
 
 var (
 	errMultipleKeysInTx = errors.New("transactions can only involve a single key")
-	errCreateRevCompare = errors.New("create revision comparisons are not supported")
+	errCreateRevCompare = errors.New("create revision comparisons are only supported against 0")
+	errLeaseCompare     = errors.New("lease comparisons must compare a lease id")
 	errPrevKv           = errors.New("previous kv is not supported in transactions")
+	errIgnoreValue      = errors.New("ignore value puts are only supported in the success branch of transactions")
 )
 
+// ErrTickTimeout is returned by Tick when the coordinator doesn't allocate a revision within Clock.TickTimeout.
+var ErrTickTimeout = status.Error(codes.Unavailable, "metaetcd: coordinator didn't allocate a revision in time")
+
 // Clock implements the meta cluster's logic clock.
 // It allows the meta cluster to preserve Happens-Before semantics between keys that span two etcd clusters.
 type Clock struct {
 	Coordinator *membership.CoordinatorClientSet
 	Members     *membership.Pool
+
+	// Scheme names the clock and high-water mark keys. It should match the scheme the clusters were validated with.
+	Scheme membership.Scheme
+
+	// Source stores the clock. Defaults to the coordinator and member clusters.
+	Source Source
+
+	// MaxResolveDepth bounds the number of member reads used to resolve a meta revision to a member revision.
+	// Defaults to 1000.
+	MaxResolveDepth int
+
+	// HighWaterMarkInterval is the number of revisions reserved each time the clock's high-water mark is persisted
+	// to the members. Reconstitution never resumes below the high-water mark, so revisions that were handed out but
+	// never written to a member (e.g. by reads) aren't reused. Disabled if 0.
+	HighWaterMarkInterval int64
+
+	// BypassPrefixes are key prefixes whose writes don't tick the clock (see MungeBypassTxn). Their values are stored
+	// with the clock's current revision, and the proxy serves reads of them at the member's latest revision. Such keys
+	// lose global ordering: writes can share a revision, so compare-and-swap can't tell them apart. Their watch events
+	// are dropped by MungeEvents, since they're stored with a revision that other writes have already used.
+	BypassPrefixes []string
+
+	// TickTimeout bounds the coordinator request that allocates each write's revision, so a slow coordinator fails
+	// writes quickly with ErrTickTimeout instead of consuming their entire deadline. Reconstitution isn't bounded by it.
+	// Disabled if 0.
+	TickTimeout time.Duration
+
+	highWaterMarkMut sync.Mutex
+	highWaterMark    int64 // the latest high-water mark persisted by this process
+
+	// reconstitutionMut serializes reconstitution within this process, since goroutines sharing the
+	// coordinator's session are not excluded by its distributed lock.
+	reconstitutionMut sync.Mutex
 }
 
 func (c *Clock) Init() error {
 	ctx, done := context.WithTimeout(context.Background(), time.Second*15)
 	defer done()
 
-	_, err := c.Coordinator.ClientV3.KV.Txn(ctx).
-		If(clientv3.Compare(clientv3.Version(metaKey), "=", 0)).
-		Then(clientv3.OpPut(metaKey, string(make([]byte, 8)))).
-		Commit()
+	_, err := c.source().Restore(ctx, 1, 0)
 	return err
 }
 
+func (c *Clock) source() Source {
+	if c.Source != nil {
+		return c.Source
+	}
+	return &clusterSource{coordinator: c.Coordinator, members: c.Members, scheme: c.Scheme}
+}
+
 func (c *Clock) MungeRangeResp(resp *etcdserverpb.RangeResponse) {
 	for _, kv := range resp.Kvs {
 		swapModRevision(kv)
@@ -51,6 +102,9 @@ func (c *Clock) MungeRangeResp(resp *etcdserverpb.RangeResponse) {
 }
 
 func (c *Clock) ValidateTxn(req *etcdserverpb.TxnRequest) ([]byte, error) {
+	if keys, ok := c.BulkPutKeys(req); ok {
+		return keys[0], nil
+	}
 	key, err := validateTxComparisons(req.Compare)
 	if err != nil {
 		return nil, err
@@ -62,16 +116,53 @@ func (c *Clock) ValidateTxn(req *etcdserverpb.TxnRequest) ([]byte, error) {
 	return validateTxOps(key, req.Failure)
 }
 
+// BulkPutKeys returns the keys of a transaction that unconditionally puts several keys, or false for any other transaction.
+// Bulk puts are the only transactions allowed to involve more than one key, since they don't compare revisions.
+// Like the ops of an etcd transaction, every put in a bulk put shares a single (meta) revision.
+// The caller is responsible for ensuring that the keys belong to the same member.
+func (c *Clock) BulkPutKeys(req *etcdserverpb.TxnRequest) ([][]byte, bool) {
+	if len(req.Compare) > 0 || len(req.Failure) > 0 || len(req.Success) < 2 {
+		return nil, false
+	}
+	keys := make([][]byte, len(req.Success))
+	for i, op := range req.Success {
+		put := op.GetRequestPut()
+		if put == nil || put.PrevKv || put.IgnoreValue {
+			return nil, false
+		}
+		keys[i] = put.Key
+	}
+	return keys, true
+}
+
+// IsReadOnlyTxn returns true when neither branch of the transaction writes to the keyspace.
+// Read-only transactions don't need to tick the clock, since they can't be observed by watchers.
+func (c *Clock) IsReadOnlyTxn(req *etcdserverpb.TxnRequest) bool {
+	return isReadOnlyOps(req.Success) && isReadOnlyOps(req.Failure)
+}
+
+func isReadOnlyOps(ops []*etcdserverpb.RequestOp) bool {
+	for _, op := range ops {
+		switch r := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			continue
+		case *etcdserverpb.RequestOp_RequestTxn:
+			if isReadOnlyOps(r.RequestTxn.Success) && isReadOnlyOps(r.RequestTxn.Failure) {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
 func (c *Clock) MungeTxn(metaRev int64, req *etcdserverpb.TxnRequest) {
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(buf, uint64(metaRev))
-	transformTxOps(buf, req.Success)
-	transformTxOps(buf, req.Failure)
+	buf := c.MungeBypassTxn(metaRev, req)
 
 	updateClockOp := &etcdserverpb.RequestOp{
 		Request: &etcdserverpb.RequestOp_RequestPut{
 			RequestPut: &etcdserverpb.PutRequest{
-				Key:   []byte(metaKey),
+				Key:   []byte(c.Scheme.ClockKey()),
 				Value: buf,
 			},
 		},
@@ -80,30 +171,61 @@ func (c *Clock) MungeTxn(metaRev int64, req *etcdserverpb.TxnRequest) {
 	req.Failure = append(req.Failure, updateClockOp)
 }
 
+// MungeBypassTxn is MungeTxn without updating the member's clock, for keys that don't participate in the meta clock.
+// The values are still stored with metaRev so they can be read like any other key. Returns the encoded metaRev.
+func (c *Clock) MungeBypassTxn(metaRev int64, req *etcdserverpb.TxnRequest) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(metaRev))
+	transformTxOps(buf, req.Success)
+	transformTxOps(buf, req.Failure)
+	return buf
+}
+
+// StripClockResp removes the response to the clock update appended by MungeTxn,
+// so the client gets one response per op it requested.
+func (c *Clock) StripClockResp(resp *etcdserverpb.TxnResponse) {
+	if n := len(resp.Responses); n > 0 {
+		resp.Responses = resp.Responses[:n-1]
+	}
+}
+
 func (c *Clock) MungeTxnResp(metaRev int64, resp *etcdserverpb.TxnResponse) {
 	for _, r := range resp.Responses {
 		if p := r.GetResponsePut(); p != nil {
 			swapModRevision(p.PrevKv)
-			p.Header.Revision = metaRev
+			p.Header = mungeHeader(metaRev, p.Header)
 		}
 		if p := r.GetResponseRange(); p != nil {
 			for _, kv := range p.Kvs {
 				swapModRevision(kv)
 			}
+			p.Header = mungeHeader(metaRev, p.Header)
 		}
 		if p := r.GetResponseDeleteRange(); p != nil {
 			for _, kv := range p.PrevKvs {
 				swapModRevision(kv)
-				p.Header.Revision = metaRev
 			}
+			p.Header = mungeHeader(metaRev, p.Header)
+		}
+		if p := r.GetResponseTxn(); p != nil {
+			c.MungeTxnResp(metaRev, p)
 		}
 	}
 
 	resp.Header = &etcdserverpb.ResponseHeader{Revision: metaRev}
 }
 
+// mungeHeader replaces the member revision of a response header with the meta revision.
+func mungeHeader(metaRev int64, header *etcdserverpb.ResponseHeader) *etcdserverpb.ResponseHeader {
+	if header == nil {
+		return &etcdserverpb.ResponseHeader{Revision: metaRev}
+	}
+	header.Revision = metaRev
+	return header
+}
+
 func (c *Clock) MungeEvents(events []*clientv3.Event) (int64, []*mvccpb.Event, bool) {
-	meta, ok := findMetaEvent(events)
+	meta, ok := c.findMetaEvent(events)
 	if !ok {
 		return meta, nil, false
 	}
@@ -133,7 +255,7 @@ func (c *Clock) MungeEvents(events []*clientv3.Event) (int64, []*mvccpb.Event, b
 
 	out := []*mvccpb.Event{}
 	for _, event := range events { // TODO: Merge with above
-		if string(event.Kv.Key) == metaKey {
+		if string(event.Kv.Key) == c.Scheme.ClockKey() || c.bypassesClock(event.Kv.Key) {
 			continue
 		}
 		e := mvccpb.Event(*event)
@@ -143,119 +265,391 @@ func (c *Clock) MungeEvents(events []*clientv3.Event) (int64, []*mvccpb.Event, b
 	return meta, out, true
 }
 
+// ReadLatest evaluates a range on a single member at its current revision, rather than at the member revision that
+// corresponds to the meta cluster's clock. The response header holds the meta revision of the member's latest write.
+// This can observe writes that the clock hasn't reached (e.g. while it catches up after a regression), so the result
+// isn't consistent with reads from other members and shouldn't be used as a starting point for watches.
+func (c *Clock) ReadLatest(ctx context.Context, client *membership.ClientSet, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	reqCopy := *req
+	reqCopy.Revision = 0
+	resp, err := client.KV.Txn(ctx, &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{
+		{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &reqCopy}},
+		{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte(c.Scheme.ClockKey())}}},
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	r := resp.Responses[0].GetResponseRange()
+	c.MungeRangeResp(r)
+	r.Header = &etcdserverpb.ResponseHeader{}
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		r.Header.Revision = getRevisionFromValue(kvs[0].Value)
+	}
+	return r, nil
+}
+
 // Reset deletes the coordinator's account of the current time.
 func (c *Clock) Reset(ctx context.Context) error {
-	_, err := c.Coordinator.ClientV3.KV.Delete(ctx, metaKey)
-	return err
+	return c.source().Delete(ctx)
 }
 
 // Now returns the cluster's current timestamp/revision.
 func (c *Clock) Now(ctx context.Context) (int64, error) {
-	resp, err := c.Coordinator.ClientV3.Get(ctx, metaKey)
+	ctx, span := tracer.Start(ctx, "Clock.Now")
+	defer span.End()
+
+	rev, _, found, err := c.source().Get(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("getting clock: %w", err)
+		return 0, err
 	}
-	if len(resp.Kvs) == 0 {
+	if !found {
 		return c.reconstituteClock(ctx, 0)
 	}
-	return getRevisionFromCoordinator(resp.Kvs[0]), nil
+	return rev, nil
 }
 
 // Tick increments and returns the cluster's current timestamp/revision.
+// Every call returns a distinct revision, even when called concurrently by several proxies.
 func (c *Clock) Tick(ctx context.Context) (int64, error) {
-	resp, err := c.Coordinator.ClientV3.KV.Txn(ctx).Then(
-		clientv3.OpPut(metaKey, "", clientv3.WithIgnoreValue()),
-		clientv3.OpGet(metaKey),
-	).Commit()
+	ctx, span := tracer.Start(ctx, "Clock.Tick")
+	defer span.End()
+
+	rev, err := c.increment(ctx)
 	if errors.Is(err, rpctypes.ErrKeyNotFound) {
-		return c.reconstituteClock(ctx, 1)
+		rev, err = c.reconstituteClock(ctx, 1)
 	}
 	if err != nil {
-		return 0, fmt.Errorf("ticking clock: %w", err)
+		return 0, err
 	}
-	return getRevisionFromCoordinator(resp.Responses[1].GetResponseRange().Kvs[0]), nil
+	if err := c.raiseHighWaterMark(ctx, rev); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// increment is Source.Increment, bounded by TickTimeout.
+func (c *Clock) increment(ctx context.Context) (int64, error) {
+	if c.TickTimeout <= 0 {
+		return c.source().Increment(ctx)
+	}
+	tickCtx, cancel := context.WithTimeout(ctx, c.TickTimeout)
+	defer cancel()
+	rev, err := c.source().Increment(tickCtx)
+	if err != nil && ctx.Err() == nil && tickCtx.Err() == context.DeadlineExceeded {
+		tickTimeouts.Inc()
+		zap.L().Warn("coordinator didn't allocate a revision within the tick timeout", zap.Duration("timeout", c.TickTimeout), zap.Error(err))
+		return 0, ErrTickTimeout
+	}
+	return rev, err
 }
 
+// raiseHighWaterMark persists a high-water mark above rev to the members before rev is handed out.
+// HighWaterMarkInterval revisions are reserved at a time so most ticks don't need to write it.
+// Reconstitution reads every member, so the mark only needs to reach one of them.
+func (c *Clock) raiseHighWaterMark(ctx context.Context, rev int64) error {
+	if c.HighWaterMarkInterval <= 0 {
+		return nil
+	}
+	c.highWaterMarkMut.Lock()
+	defer c.highWaterMarkMut.Unlock()
+	if rev <= c.highWaterMark {
+		return nil
+	}
+
+	next := rev + c.HighWaterMarkInterval
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(next)) // big-endian so etcd's byte comparison is numeric
+	put := clientv3.OpPut(c.Scheme.HighWaterMarkKey(), string(val))
+
+	var persisted int32
+	c.Members.IterateMembers(ctx, func(ctx context.Context, client *membership.ClientSet) error {
+		// Only ever raise the mark, since other proxies may have raised it further
+		_, err := client.ClientV3.Txn(ctx).
+			If(clientv3.Compare(clientv3.Version(c.Scheme.HighWaterMarkKey()), "=", 0)).
+			Then(put).
+			Else(clientv3.OpTxn([]clientv3.Cmp{clientv3.Compare(clientv3.Value(c.Scheme.HighWaterMarkKey()), "<", string(val))}, []clientv3.Op{put}, nil)).
+			Commit()
+		if err != nil {
+			zap.L().Warn("failed to persist clock high-water mark to member", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", next), zap.Error(err))
+			return nil
+		}
+		atomic.AddInt32(&persisted, 1)
+		return nil
+	})
+	if persisted == 0 {
+		return fmt.Errorf("persisting clock high-water mark %d: no member is available", next)
+	}
+	c.highWaterMark = next
+	return nil
+}
+
+// reconstituteClock restores the coordinator's clock from the latest meta revision or high-water mark written to any member.
+// Now passes a delta of 0 to resume at that revision, and Tick passes 1 to claim the revision after it.
+// Without a high-water mark, revisions that were ticked but never committed to a member may be handed out again.
 func (c *Clock) reconstituteClock(ctx context.Context, delta int64) (int64, error) {
-	c.Coordinator.ClockReconstitutionLock.Lock(ctx)
-	defer c.Coordinator.ClockReconstitutionLock.Unlock(context.Background())
-	clockReconstitutions.Inc()
+	c.reconstitutionMut.Lock()
+	defer c.reconstitutionMut.Unlock()
+	src := c.source()
+	unlock, err := src.Lock(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquiring clock reconstitution lock: %w", err)
+	}
+	defer unlock()
 
-	resp, err := c.Coordinator.ClientV3.Get(ctx, metaKey)
+	current, _, found, err := src.Get(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("getting clock: %w", err)
+		return 0, err
 	}
-	if len(resp.Kvs) > 0 {
-		return getRevisionFromCoordinator(resp.Kvs[0]), nil
+	if found {
+		// Another caller reconstituted the clock while we waited for the lock
+		if delta > 0 {
+			return src.Increment(ctx) // the reconstituted revision may have already been returned by their tick
+		}
+		return current, nil
 	}
 
 	zap.L().Error("clock was lost - reconstituting from member clusters")
+	latestMetaRev, err := c.latestMemberRev(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rev := latestMetaRev + delta
+	ok, err := c.restoreClock(ctx, rev, 0)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("clock was restored concurrently without holding the reconstitution lock")
+	}
+	return rev, nil
+}
+
+// Reconstitute restores the coordinator's clock from the members even if it hasn't been lost, and returns the restored revision.
+// It's intended for recovering from coordinator data loss, including a clock that was reset to an older revision.
+// The clock never moves backwards.
+func (c *Clock) Reconstitute(ctx context.Context) (int64, error) {
+	c.reconstitutionMut.Lock()
+	defer c.reconstitutionMut.Unlock()
+	src := c.source()
+	unlock, err := src.Lock(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquiring clock reconstitution lock: %w", err)
+	}
+	defer unlock()
+
+	zap.L().Warn("forcing reconstitution of clock from member clusters")
+	latestMetaRev, err := c.latestMemberRev(ctx)
+	if err != nil {
+		return 0, err
+	}
 
+	for {
+		// Ticks that are in flight may have advanced the clock past the members
+		current, version, found, err := src.Get(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if found && current >= latestMetaRev {
+			zap.L().Info("clock is already ahead of the member clusters", zap.Int64("metaRev", current), zap.Int64("memberMetaRev", latestMetaRev))
+			return current, nil
+		}
+
+		ok, err := c.restoreClock(ctx, latestMetaRev, version)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return latestMetaRev, nil
+		}
+		// The clock was ticked since it was read, so its version changed
+	}
+}
+
+// Report describes the consistency of the coordinator's clock with the meta revisions stored by the members.
+type Report struct {
+	// CoordinatorRevision is the coordinator's clock, read after every member.
+	CoordinatorRevision int64          `json:"coordinatorRevision"`
+	Members             []MemberReport `json:"members"`
+
+	// Consistent is false when any member is ahead of the coordinator.
+	Consistent bool `json:"consistent"`
+}
+
+// MemberReport describes the latest meta revision stored by a member.
+type MemberReport struct {
+	Endpoint     string `json:"endpoint"`
+	MetaRevision int64  `json:"metaRevision"`
+
+	// Ahead is true when the member has a meta revision that the coordinator hasn't reached,
+	// which is only possible if the coordinator's clock regressed.
+	Ahead bool `json:"ahead"`
+}
+
+// Verify compares the meta revisions stored by the members with the coordinator's clock.
+// Members are read first, since the coordinator is always ticked before a revision is written to a member.
+func (c *Clock) Verify(ctx context.Context) (*Report, error) {
+	report := &Report{Consistent: true}
 	var mut sync.Mutex
-	var latestMetaRev int64
-	c.Members.IterateMembers(ctx, func(ctx context.Context, client *membership.ClientSet) error {
-		r, err := client.ClientV3.KV.Get(ctx, metaKey)
+	err := c.Members.IterateMembers(ctx, func(ctx context.Context, client *membership.ClientSet) error {
+		resp, err := client.ClientV3.Get(ctx, c.Scheme.ClockKey())
 		if err != nil {
-			return err
+			return fmt.Errorf("getting clock: %w", err)
 		}
-		if len(r.Kvs) == 0 || len(r.Kvs[0].Value) < 8 {
-			return nil
+		member := MemberReport{Endpoint: client.Endpoint}
+		if len(resp.Kvs) > 0 {
+			member.MetaRevision = getRevisionFromValue(resp.Kvs[0].Value)
 		}
-		rev := int64(binary.LittleEndian.Uint64(r.Kvs[0].Value))
 		mut.Lock()
 		defer mut.Unlock()
-		if rev > latestMetaRev {
-			latestMetaRev = rev
-		}
+		report.Members = append(report.Members, member)
 		return nil
 	})
-	latestMetaRev += delta
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(report.Members, func(i, j int) bool { return report.Members[i].Endpoint < report.Members[j].Endpoint })
 
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(buf, uint64(latestMetaRev)-1)
+	report.CoordinatorRevision, _, _, err = c.source().Get(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = c.Coordinator.ClientV3.KV.Put(ctx, metaKey, string(buf))
+	for i, member := range report.Members {
+		memberMetaRevLag.WithLabelValues(member.Endpoint).Set(float64(report.CoordinatorRevision - member.MetaRevision))
+		if member.MetaRevision > report.CoordinatorRevision {
+			report.Members[i].Ahead = true
+			report.Consistent = false
+			zap.L().Error("member clock is ahead of the coordinator", zap.String("endpoint", member.Endpoint), zap.Int64("memberMetaRev", member.MetaRevision), zap.Int64("metaRev", report.CoordinatorRevision))
+		}
+	}
+	return report, nil
+}
+
+// MonitorMemberLag verifies the clock every interval until the context is done, which keeps the
+// metaetcd_member_meta_rev_lag gauge up to date. Members that only receive occasional writes lag further behind the clock.
+func (c *Clock) MonitorMemberLag(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := c.Verify(ctx); err != nil && ctx.Err() == nil {
+			zap.L().Warn("failed to update member meta rev lag", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// latestMemberRev returns the latest meta revision or high-water mark written to any member.
+func (c *Clock) latestMemberRev(ctx context.Context) (int64, error) {
+	latestMetaRev, err := c.source().LatestMemberRev(ctx)
 	if err != nil {
+		// Guessing would risk moving the clock backwards if the unreachable member has the latest revision
 		return 0, err
 	}
-
-	zap.L().Info("reconstituted meta cluster logic clock", zap.Int64("metaRev", latestMetaRev))
+	if latestMetaRev < 1 {
+		latestMetaRev = 1 // nothing has reached the members - start where Init does
+	}
 	return latestMetaRev, nil
 }
 
+// restoreClock sets the coordinator's clock to rev, as long as the clock key still has the given version (0 if missing).
+func (c *Clock) restoreClock(ctx context.Context, rev, version int64) (bool, error) {
+	start := time.Now()
+	ok, err := c.source().Restore(ctx, rev, version)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	clockReconstitutions.Inc()
+	clockReconstitutionDuration.Observe(time.Since(start).Seconds())
+	clockReconstitutedRev.Set(float64(rev))
+	zap.L().Info("reconstituted meta cluster logic clock", zap.Int64("metaRev", rev), zap.Duration("latency", time.Since(start)))
+	return true, nil
+}
+
 // ResolveMetaToMember finds at least the corresponding member revision for a given meta revision.
+// Every transaction writes the meta revision to the member's clock key, so the stored meta revision
+// increases with the member revision. This allows a binary search over the clock key's history.
 func (c *Clock) ResolveMetaToMember(ctx context.Context, client *membership.ClientSet, metaRev int64) (int64, error) {
-	var zeroKeyRev int64
-	i := 0
-	for {
+	ctx, span := tracer.Start(ctx, "Clock.ResolveMetaToMember")
+	defer span.End()
+	span.SetAttributes(attribute.String("endpoint", client.Endpoint), attribute.Int64("metaRev", metaRev))
+
+	maxDepth := c.MaxResolveDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxResolveDepth
+	}
+
+	i := 1
+	resp, err := client.ClientV3.KV.Get(ctx, c.Scheme.ClockKey())
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return resp.Header.Revision, nil
+	}
+	latest := resp.Kvs[0]
+	if getRevisionFromValue(latest.Value) <= metaRev {
+		getMemberRevDepth.Observe(float64(i))
+		return latest.ModRevision, nil
+	}
+
+	// Find the last write of the clock key with a meta revision <= the given one.
+	// Compacted revisions can't be read, so the search continues above them.
+	var found *mvccpb.KeyValue
+	var compactionErr error
+	lo, hi := latest.CreateRevision, latest.ModRevision-1
+	for lo <= hi {
 		i++
-		var opts []clientv3.OpOption
-		if zeroKeyRev > 0 {
-			opts = append(opts, clientv3.WithRev(zeroKeyRev))
+		if i > maxDepth {
+			getMemberRevExhausted.Inc()
+			zap.L().Error("exhausted attempts to resolve member rev", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Int("maxDepth", maxDepth))
+			return 0, fmt.Errorf("unable to resolve meta rev %d to a member rev within %d attempts", metaRev, maxDepth)
+		}
+
+		mid := lo + (hi-lo)/2
+		resp, err := client.ClientV3.KV.Get(ctx, c.Scheme.ClockKey(), clientv3.WithRev(mid))
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			compactionErr = err
+			lo = mid + 1
+			continue
 		}
-		resp, err := client.ClientV3.KV.Get(ctx, metaKey, opts...)
 		if err != nil {
 			return 0, err
 		}
-
 		if len(resp.Kvs) == 0 {
-			return resp.Header.Revision, nil
+			lo = mid + 1
+			continue
 		}
 
-		lastMetaRev := int64(binary.LittleEndian.Uint64(resp.Kvs[0].Value))
-		if lastMetaRev > metaRev {
-			zeroKeyRev = resp.Kvs[0].ModRevision - 1
-			continue
+		if kv := resp.Kvs[0]; getRevisionFromValue(kv.Value) > metaRev {
+			hi = kv.ModRevision - 1
+		} else {
+			found = kv
+			lo = mid + 1
 		}
+	}
 
-		zap.L().Info("resolved member rev", zap.Int("attempts", i))
-		getMemberRevDepth.Observe(float64(i))
-		return resp.Kvs[0].ModRevision, nil
+	span.SetAttributes(attribute.Int("attempts", i))
+	zap.L().Debug("resolved member rev", zap.Int("attempts", i))
+	getMemberRevDepth.Observe(float64(i))
+	if found != nil {
+		return found.ModRevision, nil
+	}
+	if compactionErr != nil {
+		return 0, compactionErr // not wrapped, since clients expect the etcd error
 	}
+	return latest.CreateRevision - 1, nil // the meta rev precedes every write to this member
 }
 
 // ResolveMetaToMemberTxn returns the member revision that corresponds with a given transaction operation.
 // If the given meta revision doesn't match a value's current revision, an error response is returned instead.
+// Only the key's current revision is read, so comparisons on revisions that have since been compacted fail
+// like any other mismatch (as they would in etcd) rather than returning ErrCompacted.
 // If the transaction includes a get operation for the same key, a conforming response is returned.
 // This implements an odd but essential set of behaviors that make Kubernetes's etcd store work.
 func (c *Clock) ResolveMetaToMemberTxn(ctx context.Context, client *membership.ClientSet, key []byte, metaRev int64, req *etcdserverpb.TxnRequest) (int64, *etcdserverpb.TxnResponse, error) {
@@ -276,6 +670,88 @@ func (c *Clock) ResolveMetaToMemberTxn(ctx context.Context, client *membership.C
 	return resp.Kvs[0].ModRevision, nil, nil
 }
 
+// IgnoreValueTxn is the client's transaction, nested by ResolveIgnoreValue in a transaction that guards its
+// ignore-value puts against concurrent writes.
+type IgnoreValueTxn struct {
+	inner   *etcdserverpb.TxnRequest
+	missing bool // the key doesn't exist, so the success branch was removed since its puts can't be applied
+}
+
+// ResolveIgnoreValue rewrites the transaction's ignore-value puts to write the key's current value explicitly,
+// since members would otherwise keep the meta revision stored with the old value.
+// To prevent concurrent writes from being reverted, the transaction is nested in one that compares the key's
+// member revision with the one that was read, so the client's comparisons still choose the branch that's applied.
+// When it returns non-nil, the caller must pass the member's response to UnwrapIgnoreValue.
+func (c *Clock) ResolveIgnoreValue(ctx context.Context, client *membership.ClientSet, key []byte, req *etcdserverpb.TxnRequest) (*IgnoreValueTxn, error) {
+	for _, op := range req.Failure {
+		if put := op.GetRequestPut(); put != nil && put.IgnoreValue {
+			return nil, errIgnoreValue
+		}
+	}
+	var puts []*etcdserverpb.PutRequest
+	for _, op := range req.Success {
+		if put := op.GetRequestPut(); put != nil && put.IgnoreValue {
+			if len(put.Value) > 0 {
+				return nil, rpctypes.ErrGRPCValueProvided
+			}
+			puts = append(puts, put)
+		}
+	}
+	if len(puts) == 0 {
+		return nil, nil
+	}
+
+	resp, err := client.ClientV3.Get(ctx, string(key))
+	if err != nil {
+		return nil, err
+	}
+	inner := &etcdserverpb.TxnRequest{Compare: req.Compare, Success: req.Success, Failure: req.Failure}
+	g := &IgnoreValueTxn{inner: inner}
+	var memberRev int64 // missing keys have a mod revision of 0
+	if len(resp.Kvs) == 0 {
+		// Like etcd, the puts fail with ErrKeyNotFound only if their branch would be applied
+		g.missing = true
+		inner = &etcdserverpb.TxnRequest{Compare: req.Compare, Failure: req.Failure}
+	} else {
+		kv := resp.Kvs[0]
+		memberRev = kv.ModRevision
+		value := kv.Value
+		if len(value) >= 8 {
+			value = value[:len(value)-8]
+		}
+		for _, put := range puts {
+			put.Value = append([]byte{}, value...) // copied since the meta revision is appended to each put
+			put.IgnoreValue = false
+		}
+	}
+
+	req.Compare = []*etcdserverpb.Compare{{
+		Key:         key,
+		Target:      etcdserverpb.Compare_MOD,
+		Result:      etcdserverpb.Compare_EQUAL,
+		TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: memberRev},
+	}}
+	req.Success = []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: inner}}}
+	req.Failure = nil
+	return g, nil
+}
+
+// UnwrapIgnoreValue restores the client's transaction and the member's response to it after ResolveIgnoreValue.
+// It returns false when the key was written concurrently, in which case none of the client's ops were applied.
+// The clock response must already have been stripped.
+func (c *Clock) UnwrapIgnoreValue(g *IgnoreValueTxn, req *etcdserverpb.TxnRequest, resp *etcdserverpb.TxnResponse) (bool, error) {
+	if !resp.Succeeded || len(resp.Responses) == 0 {
+		return false, nil
+	}
+	nested := resp.Responses[0].GetResponseTxn()
+	if g.missing && nested.GetSucceeded() {
+		return true, rpctypes.ErrGRPCKeyNotFound // like etcd
+	}
+	req.Compare, req.Success, req.Failure = g.inner.Compare, g.inner.Success, g.inner.Failure
+	resp.Succeeded, resp.Responses = nested.GetSucceeded(), nested.GetResponses()
+	return true, nil
+}
+
 func (c *Clock) resolveMetaToMemberTxn(metaRev int64, req *etcdserverpb.TxnRequest, current *clientv3.GetResponse) (int64, *etcdserverpb.TxnResponse) {
 	modMetaRev := getRevisionFromValue(current.Kvs[0].Value)
 	if modMetaRev == metaRev {
@@ -303,9 +779,18 @@ func (c *Clock) resolveMetaToMemberTxn(metaRev int64, req *etcdserverpb.TxnReque
 	return modMetaRev, returnVal
 }
 
-func findMetaEvent(events []*clientv3.Event) (int64, bool) {
+func (c *Clock) bypassesClock(key []byte) bool {
+	for _, prefix := range c.BypassPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Clock) findMetaEvent(events []*clientv3.Event) (int64, bool) {
 	for _, event := range events {
-		if string(event.Kv.Key) == metaKey {
+		if string(event.Kv.Key) == c.Scheme.ClockKey() {
 			meta := int64(binary.LittleEndian.Uint64(event.Kv.Value))
 			event.Kv.ModRevision = meta
 			return meta, true
@@ -325,6 +810,22 @@ func validateTxComparisons(ops []*etcdserverpb.Compare) ([]byte, error) {
 		if r := op.GetCreateRevision(); r != 0 {
 			return nil, errCreateRevCompare
 		}
+		if op.Target == etcdserverpb.Compare_CREATE {
+			// Create revisions aren't retained, but members only report a create revision of 0 for missing keys.
+			// So existence checks (e.g. CreateRevision(key) > 0) are evaluated by the key's member as-is.
+			if _, ok := op.TargetUnion.(*etcdserverpb.Compare_CreateRevision); !ok && op.TargetUnion != nil {
+				return nil, errCreateRevCompare
+			}
+		}
+		if op.Target == etcdserverpb.Compare_LEASE {
+			// Every member grants each lease with the same ID, so the key's member can evaluate the comparison as-is
+			if _, ok := op.TargetUnion.(*etcdserverpb.Compare_Lease); !ok {
+				return nil, errLeaseCompare
+			}
+			if len(op.RangeEnd) > 0 {
+				return nil, errMultipleKeysInTx
+			}
+		}
 	}
 	return key, nil
 }
@@ -396,6 +897,15 @@ func getRevisionFromCoordinator(kv *mvccpb.KeyValue) int64 {
 	return offset + kv.Version
 }
 
+// newCoordinatorValue encodes the coordinator's clock value such that it decodes to rev when written to a new key.
+// The value is an offset from the key's version, which is 1 after the key is created.
+// To write an existing key, subtract its current version from rev.
+func newCoordinatorValue(rev int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(rev-1))
+	return buf
+}
+
 func getRevisionFromValue(val []byte) int64 {
 	if len(val) < 8 {
 		return 0
@@ -410,5 +920,9 @@ func transformTxOps(metaRevBytes []byte, ops []*etcdserverpb.RequestOp) {
 			copy(put.Value[len(put.Value)-8:], metaRevBytes)
 			continue
 		}
+		if txn := op.GetRequestTxn(); txn != nil {
+			transformTxOps(metaRevBytes, txn.Success)
+			transformTxOps(metaRevBytes, txn.Failure)
+		}
 	}
 }
@@ -0,0 +1,685 @@
+package clock
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/membership"
+	etcdtestutil "github.com/Azure/metaetcd/internal/testutil"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+var ctx = context.Background()
+
+func TestResolveMetaToMember(t *testing.T) {
+	client, memberRevs := startMemberWithClock(t, 10)
+	c := &Clock{}
+
+	t.Run("latest", func(t *testing.T) {
+		rev, err := c.ResolveMetaToMember(ctx, client, 30)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[9], rev)
+	})
+
+	t.Run("after latest", func(t *testing.T) {
+		rev, err := c.ResolveMetaToMember(ctx, client, 100)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[9], rev)
+	})
+
+	t.Run("oldest", func(t *testing.T) {
+		rev, err := c.ResolveMetaToMember(ctx, client, 3)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[0], rev)
+	})
+
+	t.Run("before first write", func(t *testing.T) {
+		rev, err := c.ResolveMetaToMember(ctx, client, 1)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[0]-1, rev)
+	})
+
+	t.Run("matches linear search", func(t *testing.T) {
+		for metaRev := int64(3); metaRev <= 33; metaRev++ {
+			expected, err := resolveMetaToMemberLinear(client, metaRev)
+			require.NoError(t, err)
+			actual, err := c.ResolveMetaToMember(ctx, client, metaRev)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, "meta rev %d", metaRev)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		before := testutil.ToFloat64(getMemberRevExhausted)
+		c := &Clock{MaxResolveDepth: 2}
+		_, err := c.ResolveMetaToMember(ctx, client, 3)
+		assert.Error(t, err)
+		assert.Equal(t, before+1, testutil.ToFloat64(getMemberRevExhausted))
+
+		rev, err := c.ResolveMetaToMember(ctx, client, 30)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[9], rev)
+	})
+
+	t.Run("compacted", func(t *testing.T) {
+		_, err := client.ClientV3.Compact(ctx, memberRevs[5])
+		require.NoError(t, err)
+
+		_, err = c.ResolveMetaToMember(ctx, client, 6)
+		assert.ErrorIs(t, err, rpctypes.ErrCompacted)
+
+		rev, err := c.ResolveMetaToMember(ctx, client, 21)
+		require.NoError(t, err)
+		assert.Equal(t, memberRevs[6], rev)
+	})
+}
+
+func TestReconstituteClock(t *testing.T) {
+	c := startClock(t, 1)
+
+	// The member has seen meta rev 5, but the coordinator has lost it
+	setMemberClock(t, c.Members.Members()[0], 5)
+	require.NoError(t, c.Reset(ctx))
+
+	before := testutil.ToFloat64(clockReconstitutions)
+	beforeSamples := getSampleCount(t, clockReconstitutionDuration)
+	rev, err := c.Tick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), rev)
+	assert.Equal(t, before+1, testutil.ToFloat64(clockReconstitutions))
+	assert.Equal(t, float64(6), testutil.ToFloat64(clockReconstitutedRev))
+	assert.Equal(t, beforeSamples+1, getSampleCount(t, clockReconstitutionDuration))
+
+	t.Run("not counted when the clock exists", func(t *testing.T) {
+		_, err := c.reconstituteClock(ctx, 0)
+		require.NoError(t, err)
+		assert.Equal(t, before+1, testutil.ToFloat64(clockReconstitutions))
+	})
+}
+
+func TestCustomMetaKey(t *testing.T) {
+	scheme := membership.Scheme{MetaKey: "/other-meta"}
+	c := startClockWithScheme(t, 1, scheme)
+	require.NoError(t, c.Init())
+	member := c.Members.Members()[0]
+
+	// A clock stored at the default key by another instance is ignored
+	setMemberClock(t, member, 100)
+	_, err := c.Coordinator.ClientV3.Put(ctx, membership.DefaultMetaKey, string(newCoordinatorValue(100)))
+	require.NoError(t, err)
+
+	rev, err := c.Tick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rev)
+
+	t.Run("transactions write the custom key", func(t *testing.T) {
+		req := &etcdserverpb.TxnRequest{}
+		c.MungeTxn(rev, req)
+		resp, err := member.KV.Txn(ctx, req)
+		require.NoError(t, err)
+
+		memberRev, err := c.ResolveMetaToMember(ctx, member, rev)
+		require.NoError(t, err)
+		assert.Equal(t, resp.Header.Revision, memberRev)
+	})
+
+	t.Run("reconstitution reads the custom key", func(t *testing.T) {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, 5)
+		_, err := member.ClientV3.Put(ctx, scheme.ClockKey(), string(buf))
+		require.NoError(t, err)
+		require.NoError(t, c.Reset(ctx))
+
+		rev, err := c.Tick(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(6), rev)
+
+		resp, err := c.Coordinator.ClientV3.Get(ctx, membership.DefaultMetaKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(100), getRevisionFromCoordinator(resp.Kvs[0]), "the default key is untouched")
+	})
+}
+
+func TestReconstituteClockRevisions(t *testing.T) {
+	c := startClock(t, 2)
+
+	tests := []struct {
+		name       string
+		memberRevs []int64 // 0 means the member has never been written to
+		tick       bool    // reconstitute from Tick instead of Now
+		expected   int64
+	}{
+		{name: "now", memberRevs: []int64{5, 9}, expected: 9},
+		{name: "tick", memberRevs: []int64{5, 9}, tick: true, expected: 10},
+		{name: "now with latest on first member", memberRevs: []int64{9, 5}, expected: 9},
+		{name: "now with one empty member", memberRevs: []int64{0, 3}, expected: 3},
+		{name: "now with no writes", memberRevs: []int64{0, 0}, expected: 1},
+		{name: "tick with no writes", memberRevs: []int64{0, 0}, tick: true, expected: 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for i, cs := range c.Members.Members() {
+				setMemberClock(t, cs, tc.memberRevs[i])
+			}
+			require.NoError(t, c.Reset(ctx))
+
+			var rev int64
+			var err error
+			if tc.tick {
+				rev, err = c.Tick(ctx)
+			} else {
+				rev, err = c.Now(ctx)
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rev)
+
+			// The stored clock agrees with the returned revision
+			now, err := c.Now(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, now)
+
+			// The next tick doesn't reuse the returned revision
+			next, err := c.Tick(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected+1, next)
+		})
+	}
+
+	t.Run("init matches reconstitution with no writes", func(t *testing.T) {
+		require.NoError(t, c.Reset(ctx))
+		require.NoError(t, c.Init())
+		rev, err := c.Now(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), rev)
+	})
+}
+
+func TestReconstituteClockMonotonic(t *testing.T) {
+	for _, tick := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tick=%t", tick), func(t *testing.T) {
+			c := startClock(t, 2)
+			require.NoError(t, c.Init())
+
+			// Write to the members the same way transactions do
+			seen := map[int64]bool{}
+			for i := 0; i < 10; i++ {
+				rev, err := c.Tick(ctx)
+				require.NoError(t, err)
+				setMemberClock(t, c.Members.Members()[i%2], rev)
+				seen[rev] = true
+			}
+			preLoss, err := c.Now(ctx)
+			require.NoError(t, err)
+
+			require.NoError(t, c.Reset(ctx))
+			var rev int64
+			if tick {
+				rev, err = c.Tick(ctx)
+				require.NoError(t, err)
+				assert.Greater(t, rev, preLoss)
+				assert.False(t, seen[rev], "revision %d was reused", rev)
+			} else {
+				rev, err = c.Now(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, preLoss, rev)
+			}
+
+			next, err := c.Tick(ctx)
+			require.NoError(t, err)
+			assert.Greater(t, next, rev)
+			assert.False(t, seen[next], "revision %d was reused", next)
+		})
+	}
+}
+
+func TestReconstituteClockHighWaterMark(t *testing.T) {
+	const interval = 100
+	c := startClock(t, 2)
+	c.HighWaterMarkInterval = interval
+	require.NoError(t, c.Init())
+
+	// Hand out revisions that never reach the members, as reads and failed transactions do
+	var issued int64
+	for i := 0; i < 5; i++ {
+		var err error
+		issued, err = c.Tick(ctx)
+		require.NoError(t, err)
+	}
+
+	t.Run("all members empty", func(t *testing.T) {
+		for _, cs := range c.Members.Members() {
+			resp, err := cs.ClientV3.Get(ctx, membership.DefaultMetaKey)
+			require.NoError(t, err)
+			require.Empty(t, resp.Kvs)
+		}
+		require.NoError(t, c.Reset(ctx))
+
+		now, err := c.Now(ctx)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, now, issued)
+
+		rev, err := c.Tick(ctx)
+		require.NoError(t, err)
+		assert.Greater(t, rev, issued)
+		issued = rev
+	})
+
+	t.Run("mark is raised as revisions are handed out", func(t *testing.T) {
+		for i := 0; i < interval*2; i++ {
+			var err error
+			issued, err = c.Tick(ctx)
+			require.NoError(t, err)
+		}
+		require.NoError(t, c.Reset(ctx))
+
+		rev, err := c.Tick(ctx)
+		require.NoError(t, err)
+		assert.Greater(t, rev, issued)
+		assert.LessOrEqual(t, rev, issued+interval+1)
+		issued = rev
+	})
+
+	t.Run("one unavailable member", func(t *testing.T) {
+		member := c.Members.Members()[0]
+		original := member.ClientV3
+		unavailable, err := clientv3.New(clientv3.Config{Endpoints: []string{"http://127.0.0.1:1"}})
+		require.NoError(t, err)
+		defer unavailable.Close()
+		member.ClientV3 = unavailable
+		defer func() { member.ClientV3 = original }()
+		c.highWaterMark = 0 // force the mark to be written
+
+		ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+		defer cancel()
+		rev, err := c.Tick(ctx)
+		require.NoError(t, err)
+		assert.Greater(t, rev, issued)
+	})
+}
+
+func TestMemberMetaRevLag(t *testing.T) {
+	c := startClock(t, 3)
+	require.NoError(t, c.Init())
+	var rev int64
+	for rev < 10 {
+		var err error
+		rev, err = c.Tick(ctx)
+		require.NoError(t, err)
+	}
+
+	members := c.Members.Members()
+	setMemberClock(t, members[0], rev)
+	setMemberClock(t, members[1], rev-6)
+	lag := func(cs *membership.ClientSet) float64 {
+		return testutil.ToFloat64(memberMetaRevLag.WithLabelValues(cs.Endpoint))
+	}
+
+	monitorCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.MonitorMemberLag(monitorCtx, time.Millisecond*10)
+
+	require.Eventually(t, func() bool { return lag(members[2]) == float64(rev) }, time.Second*5, time.Millisecond*10, "never written")
+	assert.Equal(t, float64(0), lag(members[0]))
+	assert.Equal(t, float64(6), lag(members[1]))
+
+	setMemberClock(t, members[2], rev)
+	require.Eventually(t, func() bool { return lag(members[2]) == 0 }, time.Second*5, time.Millisecond*10, "caught up")
+}
+
+func TestConcurrentTicks(t *testing.T) {
+	c := startClock(t, 1)
+	require.NoError(t, c.Init())
+
+	const workers = 20
+	const ticksPerWorker = 10
+	tickConcurrently := func(t *testing.T) []int64 {
+		var mut sync.Mutex
+		var all []int64
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var last int64
+				for j := 0; j < ticksPerWorker; j++ {
+					rev, err := c.Tick(ctx)
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Greater(t, rev, last, "ticks are monotonic for each caller")
+					last = rev
+
+					mut.Lock()
+					all = append(all, rev)
+					mut.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		return all
+	}
+
+	t.Run("running clock", func(t *testing.T) {
+		start, err := c.Now(ctx)
+		require.NoError(t, err)
+
+		// Every revision after the start is returned exactly once
+		revs := tickConcurrently(t)
+		assert.Equal(t, etcdtestutil.NewSeq(start+1, start+1+workers*ticksPerWorker), revs)
+	})
+
+	t.Run("lost clock", func(t *testing.T) {
+		start, err := c.Now(ctx)
+		require.NoError(t, err)
+		setMemberClock(t, c.Members.Members()[0], start)
+		require.NoError(t, c.Reset(ctx))
+
+		revs := tickConcurrently(t)
+		assert.Equal(t, etcdtestutil.NewSeq(start+1, start+1+workers*ticksPerWorker), revs)
+	})
+}
+
+func TestIsReadOnlyTxn(t *testing.T) {
+	get := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte("key")}}}
+	put := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key")}}}
+	del := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{Key: []byte("key")}}}
+	nested := func(ops ...*etcdserverpb.RequestOp) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: &etcdserverpb.TxnRequest{Success: ops}}}
+	}
+
+	tests := []struct {
+		name     string
+		req      *etcdserverpb.TxnRequest
+		expected bool
+	}{
+		{name: "empty", req: &etcdserverpb.TxnRequest{}, expected: true},
+		{name: "gets", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{get}, Failure: []*etcdserverpb.RequestOp{get}}, expected: true},
+		{name: "put on success", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{get, put}}},
+		{name: "delete on failure", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{get}, Failure: []*etcdserverpb.RequestOp{del}}},
+		{name: "nested get", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{nested(get)}}, expected: true},
+		{name: "nested put", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{nested(get, put)}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, (&Clock{}).IsReadOnlyTxn(tc.req))
+		})
+	}
+}
+
+func TestMungeTxnResp(t *testing.T) {
+	const metaRev = 10
+	header := func() *etcdserverpb.ResponseHeader { return &etcdserverpb.ResponseHeader{Revision: 3} }
+	resp := &etcdserverpb.TxnResponse{
+		Header: header(),
+		Responses: []*etcdserverpb.ResponseOp{
+			{Response: &etcdserverpb.ResponseOp_ResponsePut{ResponsePut: &etcdserverpb.PutResponse{Header: header()}}},
+			{Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: &etcdserverpb.RangeResponse{Header: header()}}},
+			{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: &etcdserverpb.DeleteRangeResponse{Header: header()}}},
+			{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: &etcdserverpb.DeleteRangeResponse{}}},
+			{Response: &etcdserverpb.ResponseOp_ResponseTxn{ResponseTxn: &etcdserverpb.TxnResponse{
+				Header: header(),
+				Responses: []*etcdserverpb.ResponseOp{
+					{Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: &etcdserverpb.RangeResponse{Header: header()}}},
+				},
+			}}},
+		},
+	}
+	(&Clock{}).MungeTxnResp(metaRev, resp)
+
+	assert.Equal(t, int64(metaRev), resp.Header.Revision)
+	assert.Equal(t, int64(metaRev), resp.Responses[0].GetResponsePut().Header.Revision)
+	assert.Equal(t, int64(metaRev), resp.Responses[1].GetResponseRange().Header.Revision)
+	assert.Equal(t, int64(metaRev), resp.Responses[2].GetResponseDeleteRange().Header.Revision, "no prev kvs")
+	assert.Equal(t, int64(metaRev), resp.Responses[3].GetResponseDeleteRange().Header.Revision, "no header")
+	assert.Equal(t, int64(metaRev), resp.Responses[4].GetResponseTxn().Header.Revision)
+	assert.Equal(t, int64(metaRev), resp.Responses[4].GetResponseTxn().Responses[0].GetResponseRange().Header.Revision)
+}
+
+func TestMungeEventsBypassPrefixes(t *testing.T) {
+	c := &Clock{BypassPrefixes: []string{"heartbeat/"}}
+	stamped := func(value string, metaRev int64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(metaRev))
+		return append([]byte(value), buf...)
+	}
+	put := func(key string, value []byte, rev int64) *clientv3.Event {
+		return &clientv3.Event{Type: clientv3.EventTypePut, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: value, CreateRevision: 1, ModRevision: rev}}
+	}
+	clockValue := make([]byte, 8)
+	binary.LittleEndian.PutUint64(clockValue, 6)
+
+	// A member watch response can hold the events of several member revisions, including bypass writes
+	// that were stamped with an older meta revision
+	meta, events, ok := c.MungeEvents([]*clientv3.Event{
+		put("heartbeat/a", stamped("beat", 5), 2),
+		put("key", stamped("value", 6), 3),
+		put(c.Scheme.ClockKey(), clockValue, 3),
+	})
+	require.True(t, ok)
+	assert.Equal(t, int64(6), meta)
+	require.Len(t, events, 1)
+	assert.Equal(t, "key", string(events[0].Kv.Key))
+	assert.Equal(t, int64(6), events[0].Kv.ModRevision)
+}
+
+func TestBulkPutKeys(t *testing.T) {
+	put := func(key string, prevKv bool) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), PrevKv: prevKv}}}
+	}
+	get := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte("key-1")}}}
+	cmp := &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_MOD, TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 1}}
+
+	tests := []struct {
+		name     string
+		req      *etcdserverpb.TxnRequest
+		expected []string
+	}{
+		{name: "puts", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false), put("key-2", false)}}, expected: []string{"key-1", "key-2"}},
+		{name: "single put", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false)}}},
+		{name: "comparison", req: &etcdserverpb.TxnRequest{Compare: []*etcdserverpb.Compare{cmp}, Success: []*etcdserverpb.RequestOp{put("key-1", false), put("key-2", false)}}},
+		{name: "failure ops", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false), put("key-2", false)}, Failure: []*etcdserverpb.RequestOp{put("key-3", false)}}},
+		{name: "get", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false), get}}},
+		{name: "prev kv", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false), put("key-2", true)}}},
+		{name: "ignore value", req: &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{put("key-1", false), {Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key-2"), IgnoreValue: true}}}}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Clock{}
+			keys, ok := c.BulkPutKeys(tc.req)
+			assert.Equal(t, tc.expected != nil, ok)
+			var actual []string
+			for _, key := range keys {
+				actual = append(actual, string(key))
+			}
+			assert.Equal(t, tc.expected, actual)
+
+			// Multi-key transactions are only valid when they're bulk puts
+			_, err := c.ValidateTxn(tc.req)
+			if ok {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateTxnLeaseComparison(t *testing.T) {
+	put := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key-1")}}}
+	tests := []struct {
+		name string
+		cmp  *etcdserverpb.Compare
+		err  error
+	}{
+		{name: "lease", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_LEASE, TargetUnion: &etcdserverpb.Compare_Lease{Lease: 123}}},
+		{name: "no lease", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_LEASE, TargetUnion: &etcdserverpb.Compare_Lease{}}},
+		{name: "mismatched value", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_LEASE, TargetUnion: &etcdserverpb.Compare_Version{Version: 1}}, err: errLeaseCompare},
+		{name: "range", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), RangeEnd: []byte("key-2"), Target: etcdserverpb.Compare_LEASE, TargetUnion: &etcdserverpb.Compare_Lease{Lease: 123}}, err: errMultipleKeysInTx},
+		{name: "another key", cmp: &etcdserverpb.Compare{Key: []byte("key-2"), Target: etcdserverpb.Compare_LEASE, TargetUnion: &etcdserverpb.Compare_Lease{Lease: 123}}, err: errMultipleKeysInTx},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := (&Clock{}).ValidateTxn(&etcdserverpb.TxnRequest{Compare: []*etcdserverpb.Compare{tc.cmp}, Success: []*etcdserverpb.RequestOp{put}})
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "key-1", string(key))
+		})
+	}
+}
+
+func TestValidateTxnCreateRevisionComparison(t *testing.T) {
+	put := &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key-1")}}}
+	tests := []struct {
+		name string
+		cmp  *etcdserverpb.Compare
+		err  error
+	}{
+		{name: "exists", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_CREATE, Result: etcdserverpb.Compare_GREATER, TargetUnion: &etcdserverpb.Compare_CreateRevision{}}},
+		{name: "not exists", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_CREATE, Result: etcdserverpb.Compare_EQUAL, TargetUnion: &etcdserverpb.Compare_CreateRevision{}}},
+		{name: "nonzero revision", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_CREATE, TargetUnion: &etcdserverpb.Compare_CreateRevision{CreateRevision: 10}}, err: errCreateRevCompare},
+		{name: "mismatched value", cmp: &etcdserverpb.Compare{Key: []byte("key-1"), Target: etcdserverpb.Compare_CREATE, TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 10}}, err: errCreateRevCompare},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := (&Clock{}).ValidateTxn(&etcdserverpb.TxnRequest{Compare: []*etcdserverpb.Compare{tc.cmp}, Success: []*etcdserverpb.RequestOp{put}})
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "key-1", string(key))
+		})
+	}
+}
+
+func TestNewCoordinatorValue(t *testing.T) {
+	for _, rev := range []int64{1, 2, 1000} {
+		kv := &mvccpb.KeyValue{Value: newCoordinatorValue(rev), Version: 1}
+		assert.Equal(t, rev, getRevisionFromCoordinator(kv))
+	}
+}
+
+// startClock returns a clock backed by a new coordinator and n new members.
+func startClock(t *testing.T, n int) *Clock {
+	return startClockWithScheme(t, n, membership.Scheme{})
+}
+
+func startClockWithScheme(t *testing.T, n int, scheme membership.Scheme) *Clock {
+	gc := &membership.GrpcContext{Scheme: scheme}
+	coordinator, err := membership.InitCoordinator(gc, etcdtestutil.StartEtcd(t))
+	require.NoError(t, err)
+	c := &Clock{Coordinator: coordinator, Scheme: scheme}
+	c.Members = membership.NewPool(gc, watch.NewMux(time.Second, 100, &nopTransformer{}))
+	partitions := membership.NewStaticPartitions(n)
+	for i := 0; i < n; i++ {
+		require.NoError(t, c.Members.AddMember(ctx, membership.MemberID(i), etcdtestutil.StartEtcd(t), partitions[i]))
+	}
+	return c
+}
+
+type nopTransformer struct{}
+
+func (*nopTransformer) MungeEvents([]*clientv3.Event) (int64, []*mvccpb.Event, bool) {
+	return 0, nil, false
+}
+
+// setMemberClock writes the member's clock key, or deletes it if rev is 0.
+func setMemberClock(t *testing.T, cs *membership.ClientSet, rev int64) {
+	if rev == 0 {
+		_, err := cs.ClientV3.Delete(ctx, membership.DefaultMetaKey)
+		require.NoError(t, err)
+		return
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(rev))
+	_, err := cs.ClientV3.Put(ctx, membership.DefaultMetaKey, string(buf))
+	require.NoError(t, err)
+}
+
+func getSampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	return m.Histogram.GetSampleCount()
+}
+
+func BenchmarkResolveMetaToMember(b *testing.B) {
+	client, _ := startMemberWithClock(b, 1000)
+	c := &Clock{}
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := c.ResolveMetaToMember(ctx, client, 3)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := resolveMetaToMemberLinear(client, 3)
+			require.NoError(b, err)
+		}
+	})
+}
+
+// startMemberWithClock starts a member cluster and writes the clock n times, as if n transactions had been applied.
+// Meta revisions are spaced out to simulate writes to other members, and unrelated keys are written between ticks.
+// It returns the member revision of each write, indexed by (meta revision / 3) - 1.
+func startMemberWithClock(t testing.TB, n int) (*membership.ClientSet, []int64) {
+	client, err := membership.NewClientSet(&membership.GrpcContext{}, etcdtestutil.StartEtcd(t))
+	require.NoError(t, err)
+
+	revs := make([]int64, n)
+	buf := make([]byte, 8)
+	for i := range revs {
+		for j := 0; j < i%3+1; j++ {
+			_, err := client.ClientV3.Put(ctx, fmt.Sprintf("other-%d", j), "")
+			require.NoError(t, err)
+		}
+
+		binary.LittleEndian.PutUint64(buf, uint64((i+1)*3))
+		resp, err := client.ClientV3.Put(ctx, membership.DefaultMetaKey, string(buf))
+		require.NoError(t, err)
+		revs[i] = resp.Header.Revision
+	}
+	return client, revs
+}
+
+// resolveMetaToMemberLinear is the original implementation of ResolveMetaToMember, which walks back one write at a time.
+func resolveMetaToMemberLinear(client *membership.ClientSet, metaRev int64) (int64, error) {
+	var zeroKeyRev int64
+	for {
+		var opts []clientv3.OpOption
+		if zeroKeyRev > 0 {
+			opts = append(opts, clientv3.WithRev(zeroKeyRev))
+		}
+		resp, err := client.ClientV3.KV.Get(ctx, membership.DefaultMetaKey, opts...)
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Kvs) == 0 {
+			return resp.Header.Revision, nil
+		}
+		if int64(binary.LittleEndian.Uint64(resp.Kvs[0].Value)) > metaRev {
+			zeroKeyRev = resp.Kvs[0].ModRevision - 1
+			continue
+		}
+		return resp.Kvs[0].ModRevision, nil
+	}
+}
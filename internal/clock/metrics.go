@@ -9,14 +9,52 @@ var (
 			Help: "Depth of recursion when mapping meta cluster revision to a specific member cluster.",
 		})
 
+	getMemberRevExhausted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_get_member_rev_exhausted_total",
+			Help: "Total number of times a meta cluster revision couldn't be mapped to a member cluster within the maximum depth.",
+		})
+
 	clockReconstitutions = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "metaetcd_clock_reconstitution",
+			Name: "metaetcd_clock_reconstitutions_total",
 			Help: "Total number of times the meta cluster's clock has been reconstituted from its members.",
 		})
+
+	clockReconstitutedRev = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_clock_reconstituted_rev",
+			Help: "The meta cluster revision set by the most recent clock reconstitution.",
+		})
+
+	clockReconstitutionDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "metaetcd_clock_reconstitution_duration_seconds",
+			Help:    "Time taken to reconstitute the meta cluster's clock from its members.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		})
+
+	tickTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_clock_tick_timeouts_total",
+			Help: "Total number of writes that failed because the coordinator didn't allocate a revision within the tick timeout.",
+		})
+
+	memberMetaRevLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_meta_rev_lag",
+			Help: "Difference between the meta cluster's clock and the latest meta revision written to each member cluster, partitioned by member endpoint.",
+		},
+		[]string{"endpoint"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(getMemberRevDepth)
+	prometheus.MustRegister(getMemberRevExhausted)
 	prometheus.MustRegister(clockReconstitutions)
+	prometheus.MustRegister(clockReconstitutedRev)
+	prometheus.MustRegister(clockReconstitutionDuration)
+	prometheus.MustRegister(tickTimeouts)
+	prometheus.MustRegister(memberMetaRevLag)
 }
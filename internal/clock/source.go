@@ -0,0 +1,121 @@
+package clock
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// Source stores the clock, and the meta revisions that have reached the members it's reconstituted from.
+// Clocks use the coordinator and member clusters unless Clock.Source is set, which allows tests to replace them.
+type Source interface {
+	// Get returns the clock's revision and the version of the clock key, or found=false if the clock has been lost.
+	Get(ctx context.Context) (rev, version int64, found bool, err error)
+
+	// Increment advances the clock and returns the new revision, or rpctypes.ErrKeyNotFound if the clock has been lost.
+	// Concurrent calls, including from other proxies, never return the same revision.
+	Increment(ctx context.Context) (int64, error)
+
+	// Restore sets the clock to rev if the clock key still has the given version (0 if the clock has been lost).
+	Restore(ctx context.Context, rev, version int64) (bool, error)
+
+	// Delete loses the clock.
+	Delete(ctx context.Context) error
+
+	// Lock excludes other proxies from reconstituting the clock until unlock is called.
+	Lock(ctx context.Context) (unlock func(), err error)
+
+	// LatestMemberRev returns the latest meta revision or high-water mark written to any member, or 0 if there are none.
+	LatestMemberRev(ctx context.Context) (int64, error)
+}
+
+// clusterSource keeps the clock in the coordinator cluster.
+type clusterSource struct {
+	coordinator *membership.CoordinatorClientSet
+	members     *membership.Pool
+	scheme      membership.Scheme
+}
+
+func (s *clusterSource) Get(ctx context.Context) (int64, int64, bool, error) {
+	resp, err := s.coordinator.ClientV3.Get(ctx, s.scheme.ClockKey())
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("getting clock: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, 0, false, nil
+	}
+	return getRevisionFromCoordinator(resp.Kvs[0]), resp.Kvs[0].Version, true, nil
+}
+
+// Increment bumps the version of the clock key and reads it back in the same transaction.
+// Etcd serializes transactions and every put increments the key's version, so no two calls can observe the same version.
+func (s *clusterSource) Increment(ctx context.Context) (int64, error) {
+	resp, err := s.coordinator.ClientV3.KV.Txn(ctx).Then(
+		clientv3.OpPut(s.scheme.ClockKey(), "", clientv3.WithIgnoreValue()),
+		clientv3.OpGet(s.scheme.ClockKey()),
+	).Commit()
+	if errors.Is(err, rpctypes.ErrKeyNotFound) {
+		return 0, err // not wrapped, since it signals that the clock has been lost
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ticking clock: %w", err)
+	}
+	return getRevisionFromCoordinator(resp.Responses[1].GetResponseRange().Kvs[0]), nil
+}
+
+func (s *clusterSource) Restore(ctx context.Context, rev, version int64) (bool, error) {
+	resp, err := s.coordinator.ClientV3.KV.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version(s.scheme.ClockKey()), "=", version)).
+		Then(clientv3.OpPut(s.scheme.ClockKey(), string(newCoordinatorValue(rev-version)))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *clusterSource) Delete(ctx context.Context) error {
+	_, err := s.coordinator.ClientV3.KV.Delete(ctx, s.scheme.ClockKey())
+	return err
+}
+
+func (s *clusterSource) Lock(ctx context.Context) (func(), error) {
+	if err := s.coordinator.ClockReconstitutionLock.Lock(ctx); err != nil {
+		return nil, err
+	}
+	return func() { s.coordinator.ClockReconstitutionLock.Unlock(context.Background()) }, nil
+}
+
+func (s *clusterSource) LatestMemberRev(ctx context.Context) (int64, error) {
+	var mut sync.Mutex
+	var latestMetaRev int64
+	err := s.members.IterateMembers(ctx, func(ctx context.Context, client *membership.ClientSet) error {
+		r, err := client.ClientV3.KV.Txn(ctx).Then(clientv3.OpGet(s.scheme.ClockKey()), clientv3.OpGet(s.scheme.HighWaterMarkKey())).Commit()
+		if err != nil {
+			return fmt.Errorf("getting clock: %w", err)
+		}
+		var rev int64
+		if kvs := r.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 && len(kvs[0].Value) >= 8 {
+			rev = int64(binary.LittleEndian.Uint64(kvs[0].Value))
+		}
+		if kvs := r.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 && len(kvs[0].Value) == 8 {
+			if hwm := int64(binary.BigEndian.Uint64(kvs[0].Value)); hwm > rev {
+				rev = hwm
+			}
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		if rev > latestMetaRev {
+			latestMetaRev = rev
+		}
+		return nil
+	})
+	return latestMetaRev, err
+}
@@ -0,0 +1,231 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTickConcurrentFake(t *testing.T) {
+	src := &fakeSource{}
+	c := &Clock{Source: src}
+	require.NoError(t, c.Init())
+
+	const n = 100
+	revs := make([]int64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rev, err := c.Tick(ctx)
+			require.NoError(t, err)
+			revs[i] = rev
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{}
+	for _, rev := range revs {
+		assert.False(t, seen[rev], "revision %d was returned twice", rev)
+		assert.True(t, rev > 1 && rev <= n+1, "revision %d is out of range", rev)
+		seen[rev] = true
+	}
+}
+
+func TestReconstituteClockFake(t *testing.T) {
+	tests := []struct {
+		name              string
+		memberRev         int64
+		tick              bool
+		expected, nextRev int64
+	}{
+		{name: "now with empty members", memberRev: 0, expected: 1, nextRev: 2},
+		{name: "tick with empty members", memberRev: 0, tick: true, expected: 2, nextRev: 3},
+		{name: "now resumes at the latest member rev", memberRev: 5, expected: 5, nextRev: 6},
+		{name: "tick claims the rev after the latest member rev", memberRev: 5, tick: true, expected: 6, nextRev: 7},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &fakeSource{memberRev: tc.memberRev}
+			c := &Clock{Source: src}
+
+			var rev int64
+			var err error
+			if tc.tick {
+				rev, err = c.Tick(ctx)
+			} else {
+				rev, err = c.Now(ctx)
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rev)
+			assert.Equal(t, 1, src.restores)
+
+			next, err := c.Tick(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.nextRev, next)
+		})
+	}
+}
+
+func TestConcurrentReconstitutionFake(t *testing.T) {
+	const memberRev = 10
+	src := &fakeSource{memberRev: memberRev}
+	c := &Clock{Source: src}
+
+	const n = 50
+	var mut sync.Mutex
+	ticks := map[int64]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(tick bool) {
+			defer wg.Done()
+			if !tick {
+				rev, err := c.Now(ctx)
+				require.NoError(t, err)
+				assert.GreaterOrEqual(t, rev, int64(memberRev))
+				return
+			}
+			rev, err := c.Tick(ctx)
+			require.NoError(t, err)
+			assert.Greater(t, rev, int64(memberRev))
+			mut.Lock()
+			defer mut.Unlock()
+			assert.False(t, ticks[rev], "revision %d was returned twice", rev)
+			ticks[rev] = true
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, src.restores, "only the first caller restores the clock")
+}
+
+func TestReconstituteRaceFake(t *testing.T) {
+	src := &fakeSource{memberRev: 10}
+	c := &Clock{Source: src}
+	require.NoError(t, c.Init())
+	src.restores = 0
+
+	// Tick the clock between the first read and restore, as a request handled by another proxy would
+	var once sync.Once
+	src.beforeRestore = func() {
+		once.Do(func() {
+			_, err := src.Increment(ctx)
+			require.NoError(t, err)
+		})
+	}
+	rev, err := c.Reconstitute(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), rev)
+	assert.Equal(t, 2, src.restores, "the first restore fails since the clock's version changed")
+
+	t.Run("clock ahead of members", func(t *testing.T) {
+		src.memberRev = 5
+		rev, err := c.Reconstitute(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), rev, "the clock never moves backwards")
+	})
+}
+
+func TestTickTimeoutFake(t *testing.T) {
+	src := &fakeSource{}
+	c := &Clock{Source: src, TickTimeout: time.Millisecond * 50}
+	require.NoError(t, c.Init())
+
+	rev, err := c.Tick(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rev)
+
+	src.incrementDelay = time.Second * 5
+	start := time.Now()
+	_, err = c.Tick(ctx)
+	assert.Equal(t, ErrTickTimeout, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	t.Run("canceled by the caller", func(t *testing.T) {
+		cctx, cancel := context.WithTimeout(ctx, time.Millisecond*10)
+		defer cancel()
+		_, err := c.Tick(cctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "the caller's own deadline isn't reported as a tick timeout")
+	})
+}
+
+// fakeSource is an in-memory Source. Like the coordinator's clock key, each increment or restore bumps its version,
+// and deleting it resets the version.
+type fakeSource struct {
+	mut       sync.Mutex
+	rev       int64
+	version   int64 // 0 when the clock is lost
+	memberRev int64
+	restores  int // attempts, including those that failed
+
+	// beforeRestore is called at the start of every restore, e.g. to change the clock concurrently
+	beforeRestore func()
+
+	// incrementDelay slows down increments, which give up early if their context is done
+	incrementDelay time.Duration
+
+	lock sync.Mutex
+}
+
+func (f *fakeSource) Get(ctx context.Context) (int64, int64, bool, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.rev, f.version, f.version > 0, nil
+}
+
+func (f *fakeSource) Increment(ctx context.Context) (int64, error) {
+	if f.incrementDelay > 0 {
+		select {
+		case <-time.After(f.incrementDelay):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.version == 0 {
+		return 0, rpctypes.ErrKeyNotFound
+	}
+	f.rev++
+	f.version++
+	return f.rev, nil
+}
+
+func (f *fakeSource) Restore(ctx context.Context, rev, version int64) (bool, error) {
+	if f.beforeRestore != nil {
+		f.beforeRestore()
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.restores++
+	if f.version != version {
+		return false, nil
+	}
+	f.rev = rev
+	f.version++
+	return true, nil
+}
+
+func (f *fakeSource) Delete(ctx context.Context) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.rev, f.version = 0, 0
+	return nil
+}
+
+func (f *fakeSource) Lock(ctx context.Context) (func(), error) {
+	f.lock.Lock()
+	return f.lock.Unlock, nil
+}
+
+func (f *fakeSource) LatestMemberRev(ctx context.Context) (int64, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.memberRev, nil
+}
@@ -8,6 +8,9 @@ import (
 	"math"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
@@ -18,6 +21,7 @@ import (
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	grpcbalancer "google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/keepalive"
 
 	"github.com/Azure/metaetcd/internal/watch"
@@ -35,26 +39,51 @@ func init() {
 
 // ClientSet holds various clients used to access etcd.
 type ClientSet struct {
+	Endpoint    string
 	ClientV3    *clientv3.Client
 	KV          etcdserverpb.KVClient
 	Lease       etcdserverpb.LeaseClient
+	Maintenance etcdserverpb.MaintenanceClient
+	Auth        etcdserverpb.AuthClient
 	GRPC        *grpc.ClientConn
 	WatchStatus *watch.Status
+
+	alarmMut sync.RWMutex
+	alarms   []*etcdserverpb.AlarmMember
+
+	healthy  int32
+	failures int32
+	draining int32
 }
 
-func NewClientSet(gc *GrpcContext, endpointURL string) (*ClientSet, error) {
-	cs := &ClientSet{}
+// NewClientSet returns clients for the cluster at the given endpoints.
+// Requests fail over between endpoints when more than one is given.
+func NewClientSet(gc *GrpcContext, endpointURLs ...string) (*ClientSet, error) {
+	if len(endpointURLs) == 0 {
+		return nil, fmt.Errorf("at least one endpoint is required")
+	}
+	if gc.Balancer != "" && grpcbalancer.Get(gc.Balancer) == nil {
+		return nil, fmt.Errorf("unknown grpc balancer %q", gc.Balancer)
+	}
+	cs := &ClientSet{Endpoint: strings.Join(endpointURLs, ","), healthy: 1} // assume healthy until checked
 	var err error
-	cs.ClientV3, err = clientv3.New(clientv3.Config{
-		Endpoints:   []string{endpointURL},
-		DialTimeout: 5 * time.Second,
-		TLS:         gc.TLS,
-	})
+	cs.ClientV3, err = clientv3.New(gc.clientConfig(endpointURLs))
 	if err != nil {
 		return nil, fmt.Errorf("constructing etcd client: %w", err)
 	}
+	if gc.Scheme.Namespace != "" {
+		applyNamespace(cs.ClientV3, gc.Scheme.Namespace)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	// Share the etcd client's connection when authenticating since it manages the auth token,
+	// and when there are several endpoints since its balancer fails over between them
+	if gc.Username != "" || len(endpointURLs) > 1 {
+		cs.GRPC = cs.ClientV3.ActiveConnection()
+		cs.initGRPCClients(gc.Scheme.Namespace)
+		return cs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gc.dialTimeout())
 	defer cancel()
 
 	var authOption grpc.DialOption
@@ -64,13 +93,17 @@ func NewClientSet(gc *GrpcContext, endpointURL string) (*ClientSet, error) {
 		authOption = grpc.WithTransportCredentials(credentials.NewBundle(credentials.Config{TLSConfig: gc.TLS}).TransportCredentials())
 	}
 
-	u, err := url.Parse(endpointURL)
+	u, err := url.Parse(endpointURLs[0])
 	if err != nil {
 		return nil, fmt.Errorf("parsing endpoint url: %w", err)
 	}
 
+	balancerName := gc.Balancer
+	if balancerName == "" {
+		balancerName = etcdRoundRobinBalancerName
+	}
 	cs.GRPC, err = grpc.DialContext(ctx, u.Host,
-		grpc.WithBalancerName(etcdRoundRobinBalancerName),
+		grpc.WithBalancerName(balancerName),
 		grpc.WithKeepaliveParams(keepalive.ClientParameters{
 			Time:    gc.GrpcKeepaliveInterval,
 			Timeout: gc.GrpcKeepaliveTimeout,
@@ -80,24 +113,106 @@ func NewClientSet(gc *GrpcContext, endpointURL string) (*ClientSet, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dialing grpc connection: %w", err)
 	}
-	cs.KV = etcdserverpb.NewKVClient(cs.GRPC)
-	cs.Lease = etcdserverpb.NewLeaseClient(cs.GRPC)
+	cs.initGRPCClients(gc.Scheme.Namespace)
 
 	return cs, nil
 }
 
+func (c *ClientSet) initGRPCClients(ns string) {
+	c.KV = etcdserverpb.NewKVClient(c.GRPC)
+	c.Lease = etcdserverpb.NewLeaseClient(c.GRPC)
+	if ns != "" {
+		c.KV = &namespaceKV{KVClient: c.KV, prefix: []byte(ns)}
+		c.Lease = &namespaceLease{LeaseClient: c.Lease, prefix: []byte(ns)}
+	}
+	c.Maintenance = etcdserverpb.NewMaintenanceClient(c.GRPC)
+	c.Auth = etcdserverpb.NewAuthClient(c.GRPC)
+}
+
+// HasAlarm returns true when the cluster had raised the given alarm as of the latest RefreshAlarms or SetAlarms.
+// It never makes a request, so writes can check it without adding a round trip to a cluster that may be struggling.
+func (c *ClientSet) HasAlarm(alarm etcdserverpb.AlarmType) bool {
+	c.alarmMut.RLock()
+	defer c.alarmMut.RUnlock()
+	for _, a := range c.alarms {
+		if a.Alarm == alarm {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshAlarms fetches the cluster's alarms for HasAlarm.
+func (c *ClientSet) RefreshAlarms(ctx context.Context) error {
+	resp, err := c.Maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{Action: etcdserverpb.AlarmRequest_GET})
+	if err != nil {
+		return fmt.Errorf("getting alarms: %w", err)
+	}
+	c.SetAlarms(resp.Alarms)
+	return nil
+}
+
+// SetAlarms replaces the alarms returned by HasAlarm e.g. with the response to an alarm request made elsewhere.
+func (c *ClientSet) SetAlarms(alarms []*etcdserverpb.AlarmMember) {
+	c.alarmMut.Lock()
+	defer c.alarmMut.Unlock()
+	c.alarms = alarms
+}
+
+// Healthy returns false if the cluster failed its most recent health check.
+func (c *ClientSet) Healthy() bool {
+	return atomic.LoadInt32(&c.healthy) == 1
+}
+
+func (c *ClientSet) SetHealthy(healthy bool) {
+	var val int32
+	if healthy {
+		val = 1
+		atomic.StoreInt32(&c.failures, 0)
+	} else {
+		atomic.AddInt32(&c.failures, 1)
+	}
+	atomic.StoreInt32(&c.healthy, val)
+}
+
+// HealthCheckFailures returns the number of consecutive health checks the cluster has failed.
+func (c *ClientSet) HealthCheckFailures() int {
+	return int(atomic.LoadInt32(&c.failures))
+}
+
+// Draining returns true while the member is being drained for maintenance. Draining members serve reads but not writes.
+func (c *ClientSet) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+func (c *ClientSet) SetDraining(draining bool) {
+	var val int32
+	if draining {
+		val = 1
+	}
+	atomic.StoreInt32(&c.draining, val)
+}
+
 // CoordinatorClientSet is ClientSet plus extra fields that only pertain to coordinator clusters.
 type CoordinatorClientSet struct {
 	*ClientSet
 	ClockReconstitutionLock *concurrency.Mutex
 }
 
-func InitCoordinator(gc *GrpcContext, endpointURL string) (*CoordinatorClientSet, error) {
-	cs, err := NewClientSet(gc, endpointURL)
+// InitCoordinator returns clients for the coordinator cluster at the given endpoints.
+// Giving every member's endpoint allows the clock to keep working when some of them are down.
+func InitCoordinator(gc *GrpcContext, endpointURLs ...string) (*CoordinatorClientSet, error) {
+	cs, err := NewClientSet(gc, endpointURLs...)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	if err := cs.ValidateScheme(ctx, gc.Scheme); err != nil {
+		return nil, fmt.Errorf("validating scheme: %w", err)
+	}
+
 	sess, err := concurrency.NewSession(cs.ClientV3)
 	if err != nil {
 		return nil, fmt.Errorf("initializing etcd concurrency session: %w", err)
@@ -114,6 +229,45 @@ type GrpcContext struct {
 	GrpcKeepaliveInterval time.Duration
 	GrpcKeepaliveTimeout  time.Duration
 	TLS                   *tls.Config
+
+	// Username and Password are used to authenticate with clusters that have auth enabled.
+	// Auth must be enabled before the clients are constructed.
+	Username, Password string
+
+	// Scheme names the keys validated when clients are constructed, and the namespace their keys are confined to.
+	Scheme Scheme
+
+	// DialTimeout bounds connecting to each cluster. Defaults to 5 seconds.
+	DialTimeout time.Duration
+
+	// AutoSyncInterval is how often the etcd clients replace their endpoints with the cluster's current members,
+	// for clusters whose membership changes. Disabled if 0.
+	AutoSyncInterval time.Duration
+
+	// Balancer names the gRPC balancer of connections that don't share the etcd client's (see NewClientSet),
+	// e.g. "round_robin" or "pick_first". Defaults to etcd's round robin balancer.
+	Balancer string
+}
+
+func (g *GrpcContext) dialTimeout() time.Duration {
+	if g.DialTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return g.DialTimeout
+}
+
+// clientConfig returns the configuration of etcd clients for the given endpoints.
+func (g *GrpcContext) clientConfig(endpointURLs []string) clientv3.Config {
+	return clientv3.Config{
+		Endpoints:            endpointURLs,
+		DialTimeout:          g.dialTimeout(),
+		DialKeepAliveTime:    g.GrpcKeepaliveInterval,
+		DialKeepAliveTimeout: g.GrpcKeepaliveTimeout,
+		AutoSyncInterval:     g.AutoSyncInterval,
+		TLS:                  g.TLS,
+		Username:             g.Username,
+		Password:             g.Password,
+	}
 }
 
 func (g *GrpcContext) LoadPKI(clientCert, clientKey, caCert string) error {
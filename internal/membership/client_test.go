@@ -0,0 +1,91 @@
+package membership
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/testutil"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+func TestInitCoordinatorFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	// The first endpoint is down, so requests have to fail over to the second
+	down, up := "http://127.0.0.1:1", testutil.StartEtcd(t)
+	cs, err := InitCoordinator(&GrpcContext{}, down, up)
+	require.NoError(t, err)
+	defer cs.ClientV3.Close()
+	assert.Equal(t, down+","+up, cs.Endpoint)
+
+	_, err = cs.ClientV3.Put(ctx, "key", "value")
+	require.NoError(t, err)
+
+	// The gRPC clients share the etcd client's connection, so they fail over too
+	resp, err := cs.KV.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("key")})
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "value", string(resp.Kvs[0].Value))
+}
+
+func TestNewClientSetNoEndpoints(t *testing.T) {
+	_, err := NewClientSet(&GrpcContext{})
+	assert.Error(t, err)
+}
+
+func TestNewClientSetDialOptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	t.Run("defaults", func(t *testing.T) {
+		gc := &GrpcContext{GrpcKeepaliveInterval: time.Second, GrpcKeepaliveTimeout: time.Second * 5}
+		conf := gc.clientConfig([]string{"http://localhost:2379"})
+		assert.Equal(t, time.Second*5, conf.DialTimeout)
+		assert.Equal(t, time.Second, conf.DialKeepAliveTime)
+		assert.Equal(t, time.Second*5, conf.DialKeepAliveTimeout)
+		assert.Zero(t, conf.AutoSyncInterval)
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		gc := &GrpcContext{
+			GrpcKeepaliveInterval: time.Second * 2,
+			GrpcKeepaliveTimeout:  time.Second * 3,
+			DialTimeout:           time.Second * 10,
+			AutoSyncInterval:      time.Millisecond * 100,
+			Balancer:              "round_robin",
+		}
+		conf := gc.clientConfig([]string{"http://localhost:2379"})
+		assert.Equal(t, time.Second*10, conf.DialTimeout)
+		assert.Equal(t, time.Second*2, conf.DialKeepAliveTime)
+		assert.Equal(t, time.Second*3, conf.DialKeepAliveTimeout)
+		assert.Equal(t, time.Millisecond*100, conf.AutoSyncInterval)
+
+		pool := NewRingPool(gc, watch.NewMux(time.Second, 100, nil), 10)
+		require.NoError(t, pool.AddMember(ctx, MemberID(0), testutil.StartEtcd(t), nil))
+		cs := pool.GetMemberForKey("key")
+
+		// The connection dialed with the custom balancer serves requests
+		resp, err := cs.KV.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("key")})
+		require.NoError(t, err)
+		assert.Empty(t, resp.Kvs)
+
+		// Auto sync replaces the endpoints with the cluster's advertised client URLs
+		members, err := cs.ClientV3.MemberList(ctx)
+		require.NoError(t, err)
+		require.Len(t, members.Members, 1)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(members.Members[0].ClientURLs, cs.ClientV3.Endpoints())
+		}, time.Second*5, time.Millisecond*50)
+	})
+
+	t.Run("unknown balancer", func(t *testing.T) {
+		_, err := NewClientSet(&GrpcContext{Balancer: "not-a-balancer"}, "http://localhost:2379")
+		assert.Error(t, err)
+	})
+}
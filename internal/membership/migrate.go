@@ -0,0 +1,164 @@
+package membership
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+// migrationPageSize is the number of keys read from a member at once during migration.
+const migrationPageSize = 500
+
+// MigrateKeys moves every key whose owner differs between the two rings from its old owner to its new one.
+// Values are copied byte-for-byte, so the meta revisions encoded in them are preserved. Leases are granted
+// on the destination with the same ID and remaining TTL if they don't already exist there.
+//
+// Keys that have already been written to the destination are not overwritten, since they were written
+// after the membership change. Each copy is read back from the destination before the source copy is
+// removed, and the removal is skipped if the source has been modified concurrently. HashKV can't be used
+// for verification because it covers the entire keyspace of a cluster. Migration writes don't touch the
+// clock, so they aren't visible to watchers.
+//
+// exclude is called for each key, and excluded keys are never migrated (e.g. the clock's own key).
+// The returned count includes only keys that were removed from their source member.
+func (p *Pool) MigrateKeys(ctx context.Context, from, to *Ring, exclude func(key []byte) bool) (int, error) {
+	p.mut.RLock()
+	ids := make([]MemberID, 0, len(p.byMemberID))
+	clients := make(map[MemberID]*ClientSet, len(p.byMemberID))
+	for id, cs := range p.byMemberID {
+		ids = append(ids, id)
+		clients[id] = cs
+	}
+	p.mut.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var migrated int
+	for _, id := range ids {
+		n, err := migrateFromMember(ctx, id, clients, from, to, exclude)
+		migrated += n
+		if err != nil {
+			return migrated, fmt.Errorf("migrating keys from %s: %w", clients[id].Endpoint, err)
+		}
+		zap.L().Info("migrated keys from member", zap.String("endpoint", clients[id].Endpoint), zap.Int("count", n))
+	}
+	return migrated, nil
+}
+
+func migrateFromMember(ctx context.Context, id MemberID, clients map[MemberID]*ClientSet, from, to *Ring, exclude func([]byte) bool) (int, error) {
+	src := clients[id]
+	var migrated int
+	var rev int64
+	start := "\x00"
+	for {
+		opts := []clientv3.OpOption{clientv3.WithFromKey(), clientv3.WithLimit(migrationPageSize)}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		resp, err := src.ClientV3.Get(ctx, start, opts...)
+		if err != nil {
+			return migrated, err
+		}
+		rev = resp.Header.Revision
+
+		for _, kv := range resp.Kvs {
+			if exclude != nil && exclude(kv.Key) {
+				continue
+			}
+			oldID, _ := from.MemberForKey(string(kv.Key))
+			newID, ok := to.MemberForKey(string(kv.Key))
+			if oldID != id || !ok || newID == id {
+				continue
+			}
+			dst, ok := clients[newID]
+			if !ok {
+				return migrated, fmt.Errorf("member %d is not in the pool", newID)
+			}
+			ok, err := migrateKey(ctx, src, dst, kv)
+			if err != nil {
+				return migrated, fmt.Errorf("migrating key %q: %w", kv.Key, err)
+			}
+			if ok {
+				migrated++
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return migrated, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// migrateKey returns false if the key was skipped.
+func migrateKey(ctx context.Context, src, dst *ClientSet, kv *mvccpb.KeyValue) (bool, error) {
+	key := string(kv.Key)
+	var putOpts []clientv3.OpOption
+	if kv.Lease != 0 {
+		ok, err := migrateLease(ctx, src, dst, clientv3.LeaseID(kv.Lease))
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil // the lease has expired, so the key is about to be deleted anyway
+		}
+		putOpts = append(putOpts, clientv3.WithLease(clientv3.LeaseID(kv.Lease)))
+	}
+
+	txn, err := dst.ClientV3.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(kv.Value), putOpts...)).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("copying to destination: %w", err)
+	}
+
+	check, err := dst.ClientV3.Get(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("verifying destination: %w", err)
+	}
+	if len(check.Kvs) == 0 || (txn.Succeeded && !bytes.Equal(check.Kvs[0].Value, kv.Value)) {
+		return false, fmt.Errorf("destination does not match source after copying")
+	}
+
+	del, err := src.ClientV3.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("removing from source: %w", err)
+	}
+	if !del.Succeeded {
+		return false, fmt.Errorf("source was modified during migration")
+	}
+	return true, nil
+}
+
+// migrateLease makes sure the lease exists on the destination. Returns false if the lease has expired on the source.
+func migrateLease(ctx context.Context, src, dst *ClientSet, id clientv3.LeaseID) (bool, error) {
+	existing, err := dst.ClientV3.TimeToLive(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("getting destination lease: %w", err)
+	}
+	if existing.TTL > 0 {
+		return true, nil
+	}
+
+	current, err := src.ClientV3.TimeToLive(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("getting source lease: %w", err)
+	}
+	if current.TTL <= 0 {
+		return false, nil
+	}
+
+	if _, err := dst.Lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: int64(id), TTL: current.TTL}); err != nil {
+		return false, fmt.Errorf("granting destination lease: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package membership
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/testutil"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	wm := watch.NewMux(time.Second, 100, &nopTransformer{})
+	p := NewRingPool(&GrpcContext{}, wm, 50)
+	require.NoError(t, p.AddMember(ctx, MemberID(0), testutil.StartEtcd(t), nil))
+	require.NoError(t, p.AddMember(ctx, MemberID(1), testutil.StartEtcd(t), nil))
+
+	// Values are written the same way the proxy writes them: with a meta revision suffix
+	const n = 100
+	values := map[string]string{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		values[key] = fmt.Sprintf("value-%d\x00\x00\x00\x00\x00\x00\x00%c", i, byte(i+1))
+		_, err := p.GetMemberForKey(key).ClientV3.Put(ctx, key, values[key])
+		require.NoError(t, err)
+	}
+
+	// Attach a lease to a key that will move when the new member is added
+	expectedRing := p.Ring()
+	expectedRing.Add(MemberID(2))
+	var leaseKey string
+	for key := range values {
+		oldID, _ := p.Ring().MemberForKey(key)
+		newID, _ := expectedRing.MemberForKey(key)
+		if oldID != newID {
+			leaseKey = key
+			break
+		}
+	}
+	lease, err := p.GetMemberForKey(leaseKey).ClientV3.Grant(ctx, 60)
+	require.NoError(t, err)
+	_, err = p.GetMemberForKey(leaseKey).ClientV3.Put(ctx, leaseKey, values[leaseKey], clientv3.WithLease(lease.ID))
+	require.NoError(t, err)
+
+	// The clock key should never move
+	originalMembers := p.Members()
+	for _, cs := range originalMembers {
+		_, err := cs.ClientV3.Put(ctx, "/meta", "clock")
+		require.NoError(t, err)
+	}
+
+	before := p.Ring()
+	require.NoError(t, p.AddMember(ctx, MemberID(2), testutil.StartEtcd(t), nil))
+	after := p.Ring()
+
+	var expectedMoves int
+	for key := range values {
+		oldID, _ := before.MemberForKey(key)
+		newID, _ := after.MemberForKey(key)
+		if oldID != newID {
+			expectedMoves++
+		}
+	}
+	require.Greater(t, expectedMoves, 0)
+
+	migrated, err := p.MigrateKeys(ctx, before, after, func(key []byte) bool { return string(key) == "/meta" })
+	require.NoError(t, err)
+	assert.Equal(t, expectedMoves, migrated)
+
+	t.Run("keys are readable from their new members", func(t *testing.T) {
+		for key, value := range values {
+			resp, err := p.GetMemberForKey(key).ClientV3.Get(ctx, key)
+			require.NoError(t, err)
+			require.Len(t, resp.Kvs, 1, key)
+			assert.Equal(t, value, string(resp.Kvs[0].Value))
+		}
+	})
+
+	t.Run("keys are removed from their old members", func(t *testing.T) {
+		var total int64
+		for _, cs := range p.Members() {
+			resp, err := cs.ClientV3.Get(ctx, "key-", clientv3.WithPrefix(), clientv3.WithCountOnly())
+			require.NoError(t, err)
+			total += resp.Count
+		}
+		assert.Equal(t, int64(n), total)
+	})
+
+	t.Run("lease is preserved", func(t *testing.T) {
+		resp, err := p.GetMemberForKey(leaseKey).ClientV3.Get(ctx, leaseKey)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, int64(lease.ID), resp.Kvs[0].Lease)
+	})
+
+	t.Run("clock key is not migrated", func(t *testing.T) {
+		for _, cs := range originalMembers {
+			resp, err := cs.ClientV3.Get(ctx, "/meta")
+			require.NoError(t, err)
+			assert.Len(t, resp.Kvs, 1)
+		}
+	})
+}
+
+type nopTransformer struct{}
+
+func (*nopTransformer) MungeEvents([]*clientv3.Event) (int64, []*mvccpb.Event, bool) {
+	return 0, nil, false
+}
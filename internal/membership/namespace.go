@@ -0,0 +1,187 @@
+package membership
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+)
+
+// applyNamespace wraps the etcd client's KV, watcher, and lease with the namespace.
+// Everything that uses them (the clock, scheme validation, watches, etc.) only sees keys within the namespace.
+func applyNamespace(client *clientv3.Client, ns string) {
+	client.KV = namespace.NewKV(client.KV, ns)
+	client.Watcher = namespace.NewWatcher(client.Watcher, ns)
+	client.Lease = namespace.NewLease(client.Lease, ns)
+}
+
+// namespaceKV prepends the namespace to the keys of requests sent to a member, and strips it from the keys of responses.
+// Requests are copied rather than modified since callers may retry them.
+type namespaceKV struct {
+	etcdserverpb.KVClient
+	prefix []byte
+}
+
+func (n *namespaceKV) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	resp, err := n.KVClient.Range(ctx, n.prefixRange(req), opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.unprefixRange(resp)
+	return resp, nil
+}
+
+func (n *namespaceKV) Put(ctx context.Context, req *etcdserverpb.PutRequest, opts ...grpc.CallOption) (*etcdserverpb.PutResponse, error) {
+	resp, err := n.KVClient.Put(ctx, n.prefixPut(req), opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.unprefixPut(resp)
+	return resp, nil
+}
+
+func (n *namespaceKV) DeleteRange(ctx context.Context, req *etcdserverpb.DeleteRangeRequest, opts ...grpc.CallOption) (*etcdserverpb.DeleteRangeResponse, error) {
+	resp, err := n.KVClient.DeleteRange(ctx, n.prefixDeleteRange(req), opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.unprefixDeleteRange(resp)
+	return resp, nil
+}
+
+func (n *namespaceKV) Txn(ctx context.Context, req *etcdserverpb.TxnRequest, opts ...grpc.CallOption) (*etcdserverpb.TxnResponse, error) {
+	resp, err := n.KVClient.Txn(ctx, n.prefixTxn(req), opts...)
+	if err != nil {
+		return nil, err
+	}
+	n.unprefixTxn(resp)
+	return resp, nil
+}
+
+func (n *namespaceKV) prefixInterval(key, end []byte) ([]byte, []byte) {
+	return prefixInterval(n.prefix, key, end)
+}
+
+func (n *namespaceKV) prefixRange(req *etcdserverpb.RangeRequest) *etcdserverpb.RangeRequest {
+	cp := *req
+	cp.Key, cp.RangeEnd = n.prefixInterval(req.Key, req.RangeEnd)
+	return &cp
+}
+
+func (n *namespaceKV) prefixPut(req *etcdserverpb.PutRequest) *etcdserverpb.PutRequest {
+	cp := *req
+	cp.Key, _ = n.prefixInterval(req.Key, nil)
+	return &cp
+}
+
+func (n *namespaceKV) prefixDeleteRange(req *etcdserverpb.DeleteRangeRequest) *etcdserverpb.DeleteRangeRequest {
+	cp := *req
+	cp.Key, cp.RangeEnd = n.prefixInterval(req.Key, req.RangeEnd)
+	return &cp
+}
+
+func (n *namespaceKV) prefixTxn(req *etcdserverpb.TxnRequest) *etcdserverpb.TxnRequest {
+	cp := &etcdserverpb.TxnRequest{
+		Compare: make([]*etcdserverpb.Compare, len(req.Compare)),
+		Success: n.prefixOps(req.Success),
+		Failure: n.prefixOps(req.Failure),
+	}
+	for i, cmp := range req.Compare {
+		c := *cmp
+		c.Key, c.RangeEnd = n.prefixInterval(cmp.Key, cmp.RangeEnd)
+		cp.Compare[i] = &c
+	}
+	return cp
+}
+
+func (n *namespaceKV) prefixOps(ops []*etcdserverpb.RequestOp) []*etcdserverpb.RequestOp {
+	out := make([]*etcdserverpb.RequestOp, len(ops))
+	for i, op := range ops {
+		switch r := op.Request.(type) {
+		case *etcdserverpb.RequestOp_RequestRange:
+			out[i] = &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: n.prefixRange(r.RequestRange)}}
+		case *etcdserverpb.RequestOp_RequestPut:
+			out[i] = &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: n.prefixPut(r.RequestPut)}}
+		case *etcdserverpb.RequestOp_RequestDeleteRange:
+			out[i] = &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: n.prefixDeleteRange(r.RequestDeleteRange)}}
+		case *etcdserverpb.RequestOp_RequestTxn:
+			out[i] = &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: n.prefixTxn(r.RequestTxn)}}
+		default:
+			out[i] = op
+		}
+	}
+	return out
+}
+
+func (n *namespaceKV) unprefixRange(resp *etcdserverpb.RangeResponse) {
+	n.unprefixKvs(resp.Kvs)
+}
+
+func (n *namespaceKV) unprefixPut(resp *etcdserverpb.PutResponse) {
+	if resp.PrevKv != nil {
+		n.unprefixKvs([]*mvccpb.KeyValue{resp.PrevKv})
+	}
+}
+
+func (n *namespaceKV) unprefixDeleteRange(resp *etcdserverpb.DeleteRangeResponse) {
+	n.unprefixKvs(resp.PrevKvs)
+}
+
+func (n *namespaceKV) unprefixTxn(resp *etcdserverpb.TxnResponse) {
+	for _, r := range resp.Responses {
+		switch {
+		case r.GetResponseRange() != nil:
+			n.unprefixRange(r.GetResponseRange())
+		case r.GetResponsePut() != nil:
+			n.unprefixPut(r.GetResponsePut())
+		case r.GetResponseDeleteRange() != nil:
+			n.unprefixDeleteRange(r.GetResponseDeleteRange())
+		case r.GetResponseTxn() != nil:
+			n.unprefixTxn(r.GetResponseTxn())
+		}
+	}
+}
+
+func (n *namespaceKV) unprefixKvs(kvs []*mvccpb.KeyValue) {
+	for _, kv := range kvs {
+		kv.Key = kv.Key[len(n.prefix):]
+	}
+}
+
+// namespaceLease strips the namespace from the keys attached to leases, and omits keys from other namespaces.
+type namespaceLease struct {
+	etcdserverpb.LeaseClient
+	prefix []byte
+}
+
+func (n *namespaceLease) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	resp, err := n.LeaseClient.LeaseTimeToLive(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	keys := resp.Keys[:0]
+	for _, key := range resp.Keys {
+		if bytes.HasPrefix(key, n.prefix) {
+			keys = append(keys, key[len(n.prefix):])
+		}
+	}
+	resp.Keys = keys
+	return resp, nil
+}
+
+// prefixInterval prepends prefix to a key range the same way clientv3/namespace does, including
+// ranges that end at the edge of the keyspace ("\0"), which end at the edge of the namespace instead.
+func prefixInterval(prefix, key, end []byte) ([]byte, []byte) {
+	pfxKey := append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+	if len(end) == 0 {
+		return pfxKey, nil
+	}
+	if len(end) == 1 && end[0] == 0 {
+		return pfxKey, []byte(clientv3.GetPrefixRangeEnd(string(prefix)))
+	}
+	return pfxKey, append(append(make([]byte, 0, len(prefix)+len(end)), prefix...), end...)
+}
@@ -2,11 +2,12 @@ package membership
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"sync"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/Azure/metaetcd/internal/watch"
@@ -16,6 +17,18 @@ import (
 // It's hardcoded to avoid mismatched values across instances of this process.
 const partitionCount = 16
 
+var tracer = otel.Tracer("github.com/Azure/metaetcd/internal/membership")
+
+var (
+	// ErrNoMembers is returned when the pool would be left without any members to route keys to.
+	ErrNoMembers = errors.New("pool has no members")
+
+	// ErrMemberOwnsKeys is returned when removing a member would leave keys without an owner.
+	ErrMemberOwnsKeys = errors.New("member owns keys that no other member can serve")
+
+	errLastMember = fmt.Errorf("refusing to remove the last member: %w", ErrNoMembers)
+)
+
 // PartitionID references one of the partitions implied by partitionCount.
 type PartitionID int8
 
@@ -27,18 +40,34 @@ type Pool struct {
 	WatchMux    *watch.Mux
 	grpcContext *GrpcContext
 
-	mut           sync.RWMutex
-	clients       []*ClientSet
-	byMemberID    map[MemberID]*ClientSet
-	byPartitionID map[PartitionID]*ClientSet
+	mut        sync.RWMutex
+	clients    []*ClientSet
+	byMemberID map[MemberID]*ClientSet
+	sharder    Sharder
+	ring       *Ring // nil unless using a hash ring
 }
 
+// NewPool returns a pool that places keys on members using static partitions.
 func NewPool(gc *GrpcContext, wm *watch.Mux) *Pool {
+	return NewShardedPool(gc, wm, newPartitionSharder())
+}
+
+// NewRingPool is NewPool but places keys on members using a consistent hash ring instead of static partitions.
+// Partitions passed to AddMember are ignored.
+func NewRingPool(gc *GrpcContext, wm *watch.Mux, vnodes int) *Pool {
+	ring := NewRing(vnodes)
+	p := NewShardedPool(gc, wm, newRingSharder(ring))
+	p.ring = ring
+	return p
+}
+
+// NewShardedPool is NewPool but places keys on members using the given sharder.
+func NewShardedPool(gc *GrpcContext, wm *watch.Mux, sharder Sharder) *Pool {
 	return &Pool{
-		WatchMux:      wm,
-		grpcContext:   gc,
-		byMemberID:    make(map[MemberID]*ClientSet),
-		byPartitionID: make(map[PartitionID]*ClientSet),
+		WatchMux:    wm,
+		grpcContext: gc,
+		byMemberID:  make(map[MemberID]*ClientSet),
+		sharder:     sharder,
 	}
 }
 
@@ -48,6 +77,10 @@ func (p *Pool) AddMember(ctx context.Context, id MemberID, endpointURL string, p
 		return fmt.Errorf("constructing clientset: %w", err)
 	}
 
+	if err := clientset.ValidateScheme(ctx, p.grpcContext.Scheme); err != nil {
+		return fmt.Errorf("validating scheme: %w", err)
+	}
+
 	clientset.WatchStatus, err = p.WatchMux.StartWatch(ctx, clientset.ClientV3)
 	if err != nil {
 		return fmt.Errorf("starting watch connection: %w", err)
@@ -58,47 +91,147 @@ func (p *Pool) AddMember(ctx context.Context, id MemberID, endpointURL string, p
 
 	p.clients = append(p.clients, clientset)
 	p.byMemberID[id] = clientset
-	for _, pid := range partitions {
-		p.byPartitionID[pid] = clientset
+	p.sharder.AddMember(id, clientset, partitions)
+
+	return nil
+}
+
+// RemoveMember stops routing keys to the given member and closes its clients.
+// The last member can't be removed, since its keys would have nowhere to go. Nor can members that own static
+// partitions or key ranges, which returns ErrMemberOwnsKeys.
+func (p *Pool) RemoveMember(id MemberID) error {
+	p.mut.Lock()
+	clientset, ok := p.byMemberID[id]
+	if !ok {
+		p.mut.Unlock()
+		return fmt.Errorf("member %d not found", id)
 	}
+	if len(p.clients) <= 1 {
+		p.mut.Unlock()
+		return errLastMember
+	}
+
+	if err := p.sharder.RemoveMember(id, clientset); err != nil {
+		p.mut.Unlock()
+		return fmt.Errorf("refusing to remove member %d: %w", id, err)
+	}
+	delete(p.byMemberID, id)
+	p.clients = withoutMember(p.clients, clientset)
+	p.mut.Unlock()
 
+	if clientset.WatchStatus != nil {
+		clientset.WatchStatus.Close()
+	}
+	if err := clientset.ClientV3.Close(); err != nil {
+		return fmt.Errorf("closing client: %w", err)
+	}
+	return nil
+}
+
+// Validate returns ErrNoMembers if the pool can't route keys to any member.
+func (p *Pool) Validate() error {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	if len(p.clients) == 0 {
+		return ErrNoMembers
+	}
 	return nil
 }
 
 func (p *Pool) IterateMembers(ctx context.Context, fn func(context.Context, *ClientSet) error) error {
+	return p.IterateMembersWithLimit(ctx, 0, fn)
+}
+
+// IterateMembersWithLimit is IterateMembers but calls fn for at most limit members concurrently.
+// Limits less than 1 are unbounded.
+func (p *Pool) IterateMembersWithLimit(ctx context.Context, limit int, fn func(context.Context, *ClientSet) error) error {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return iterate(ctx, p.clients, limit, fn)
+}
+
+// IterateRangeMembers is IterateMembersWithLimit but skips members that can't own keys in [start, end).
+// See Sharder.MembersForRange for the range conventions.
+func (p *Pool) IterateRangeMembers(ctx context.Context, start, end string, limit int, fn func(context.Context, *ClientSet) error) error {
 	p.mut.RLock()
 	defer p.mut.RUnlock()
+	return iterate(ctx, p.sharder.MembersForRange(start, end), limit, fn)
+}
+
+// IterateClientSets is IterateMembers but only calls fn for the given members.
+func IterateClientSets(ctx context.Context, clients []*ClientSet, fn func(context.Context, *ClientSet) error) error {
+	return iterate(ctx, clients, 0, fn)
+}
+
+// iterate calls fn for each member concurrently. The context passed to fn is canceled when the parent context is done
+// or any call returns an error, and the calls that haven't started by then are skipped.
+// The first error is returned, wrapped with the endpoint of the member that returned it.
+func iterate(ctx context.Context, clients []*ClientSet, limit int, fn func(context.Context, *ClientSet) error) error {
+	ctx, span := tracer.Start(ctx, "Pool.IterateMembers")
+	defer span.End()
+	span.SetAttributes(attribute.Int("members", len(clients)), attribute.Int("limit", limit))
+
 	wg, ctx := errgroup.WithContext(ctx)
-	for _, cs := range p.clients {
+	if limit > 0 {
+		wg.SetLimit(limit)
+	}
+	for _, cs := range clients {
 		cs := cs
-		wg.Go(func() error { return fn(ctx, cs) })
+		wg.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err // canceled while waiting for the limit
+			}
+			if err := fn(ctx, cs); err != nil {
+				return fmt.Errorf("member %s: %w", cs.Endpoint, err)
+			}
+			return nil
+		})
 	}
 	return wg.Wait()
 }
 
-func (p *Pool) GetMemberForKey(key string) *ClientSet {
-	h := fnv.New64()
-	if _, err := io.WriteString(h, key); err != nil {
-		panic(err) // impossible
-	}
-	keyInt := h.Sum64()
-
-	// Adopted from github.com/lithammer/go-jump-consistent-hash
-	var b, j int64
-	for j < int64(partitionCount) {
-		b = j
-		keyInt = keyInt*2862933555777941757 + 1
-		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((keyInt>>33)+1)))
+// Ring returns a copy of the pool's hash ring, or nil when keys are placed using static partitions.
+func (p *Pool) Ring() *Ring {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	if p.ring == nil {
+		return nil
 	}
+	return p.ring.Clone()
+}
 
+// Members returns a copy of the current member clientsets in the order they were added.
+func (p *Pool) Members() []*ClientSet {
 	p.mut.RLock()
 	defer p.mut.RUnlock()
+	return append([]*ClientSet{}, p.clients...)
+}
 
-	if len(p.clients) == 0 {
-		return nil
+// SetDraining marks the member with the given endpoint as draining (or not), see ClientSet.Draining.
+func (p *Pool) SetDraining(endpoint string, draining bool) error {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	for _, cs := range p.clients {
+		if cs.Endpoint == endpoint {
+			cs.SetDraining(draining)
+			return nil
+		}
 	}
+	return fmt.Errorf("member %q not found", endpoint)
+}
 
-	return p.byPartitionID[PartitionID(b)]
+func (p *Pool) GetMemberForKey(key string) *ClientSet {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return p.sharder.MemberForKey(key)
+}
+
+// MembersForRange returns the members that could own keys in [start, end).
+// See Sharder.MembersForRange for the range conventions.
+func (p *Pool) MembersForRange(start, end string) []*ClientSet {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	return append([]*ClientSet{}, p.sharder.MembersForRange(start, end)...)
 }
 
 // NewStaticPartitions naively assigns partitions to a static number of members.
@@ -2,6 +2,8 @@ package membership
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -43,6 +45,102 @@ func TestPoolIntegration(t *testing.T) {
 	})
 }
 
+func TestPoolEmpty(t *testing.T) {
+	p := NewPool(&GrpcContext{}, watch.NewMux(time.Second, 100, nil))
+	assert.ErrorIs(t, p.Validate(), ErrNoMembers)
+}
+
+func TestPoolRemoveMember(t *testing.T) {
+	ctx := context.Background()
+	gc := &GrpcContext{GrpcKeepaliveInterval: time.Second, GrpcKeepaliveTimeout: time.Second * 5}
+	p := NewRingPool(gc, watch.NewMux(time.Second, 100, nil), 10)
+	require.NoError(t, p.AddMember(ctx, MemberID(0), testutil.StartEtcd(t), nil))
+	require.NoError(t, p.AddMember(ctx, MemberID(1), testutil.StartEtcd(t), nil))
+	require.NoError(t, p.Validate())
+
+	t.Run("unknown member", func(t *testing.T) {
+		assert.Error(t, p.RemoveMember(MemberID(2)))
+	})
+
+	t.Run("happy path", func(t *testing.T) {
+		remaining := p.Members()[1]
+		require.NoError(t, p.RemoveMember(MemberID(0)))
+		assert.Equal(t, []*ClientSet{remaining}, p.Members())
+		assert.True(t, p.GetMemberForKey("anything") == remaining)
+		assert.Equal(t, []*ClientSet{remaining}, p.MembersForRange("a", "\x00"))
+	})
+
+	t.Run("last member", func(t *testing.T) {
+		assert.ErrorIs(t, p.RemoveMember(MemberID(1)), ErrNoMembers)
+		assert.Len(t, p.Members(), 1)
+		require.NoError(t, p.Validate())
+	})
+}
+
+func TestPoolRemoveMemberOwningKeys(t *testing.T) {
+	ctx := context.Background()
+	gc := &GrpcContext{GrpcKeepaliveInterval: time.Second, GrpcKeepaliveTimeout: time.Second * 5}
+	p := NewShardedPool(gc, watch.NewMux(time.Second, 100, nil), NewRangeSharder([]string{"m"}))
+	require.NoError(t, p.AddMember(ctx, MemberID(0), testutil.StartEtcd(t), nil))
+	require.NoError(t, p.AddMember(ctx, MemberID(1), testutil.StartEtcd(t), nil))
+	owner := p.GetMemberForKey("apple")
+
+	assert.ErrorIs(t, p.RemoveMember(MemberID(0)), ErrMemberOwnsKeys)
+	assert.Len(t, p.Members(), 2)
+	assert.True(t, p.GetMemberForKey("apple") == owner)
+}
+
+func TestIterateCancellation(t *testing.T) {
+	clients := []*ClientSet{{Endpoint: "a"}, {Endpoint: "b"}, {Endpoint: "c"}}
+
+	t.Run("parent canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int32
+		err := iterate(ctx, clients, 1, func(ctx context.Context, cs *ClientSet) error {
+			atomic.AddInt32(&calls, 1)
+			cancel()
+			<-ctx.Done()
+			return nil
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no calls should start after cancellation")
+	})
+
+	t.Run("sibling failed", func(t *testing.T) {
+		started := make(chan struct{}, len(clients))
+		err := iterate(context.Background(), clients, 0, func(ctx context.Context, cs *ClientSet) error {
+			started <- struct{}{}
+			if cs.Endpoint == "b" {
+				// Fail once every call is in flight
+				for i := 0; i < len(clients); i++ {
+					<-started
+				}
+				return errors.New("test error")
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second * 10):
+				return errors.New("sibling wasn't canceled")
+			}
+		})
+		assert.EqualError(t, err, "member b: test error")
+	})
+}
+
+func TestIterateErrorAttribution(t *testing.T) {
+	clients := []*ClientSet{{Endpoint: "http://a"}, {Endpoint: "http://b"}, {Endpoint: "http://c"}}
+	errTest := errors.New("test error")
+	err := iterate(context.Background(), clients, 0, func(ctx context.Context, cs *ClientSet) error {
+		if cs.Endpoint == "http://c" {
+			return nil
+		}
+		return errTest
+	})
+	require.ErrorIs(t, err, errTest)
+	assert.Regexp(t, `^member http://(a|b): test error$`, err.Error())
+}
+
 func TestNewStaticPartitions(t *testing.T) {
 	partitions := NewStaticPartitions(3)
 	assert.Equal(t, [][]PartitionID{
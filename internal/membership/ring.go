@@ -0,0 +1,104 @@
+package membership
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// Ring places keys on members using consistent hashing.
+// Each member is hashed to several points (virtual nodes) on the ring, and a key belongs to the member
+// that owns the first point at or after the key's hash. Adding or removing a member only moves the keys
+// between its points and their predecessors, roughly 1/N of the keyspace.
+//
+// Rings are not safe for concurrent use.
+type Ring struct {
+	vnodes int
+	points []uint64 // sorted
+	owners map[uint64]MemberID
+}
+
+func NewRing(vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	return &Ring{vnodes: vnodes, owners: make(map[uint64]MemberID)}
+}
+
+func (r *Ring) Add(id MemberID) {
+	for i := 0; i < r.vnodes; i++ {
+		point := hashVirtualNode(id, i)
+		if _, ok := r.owners[point]; ok {
+			continue // collisions are vanishingly unlikely - keep the existing owner
+		}
+		r.owners[point] = id
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) Remove(id MemberID) {
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == id {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// MemberForKey returns the member that owns the given key, or false if the ring is empty.
+func (r *Ring) MemberForKey(key string) (MemberID, bool) {
+	if len(r.points) == 0 {
+		return 0, false
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // wrap around
+	}
+	return r.owners[r.points[i]], true
+}
+
+// Clone returns a copy of the ring, which is useful when comparing placement before and after a membership change.
+func (r *Ring) Clone() *Ring {
+	c := &Ring{
+		vnodes: r.vnodes,
+		points: append([]uint64{}, r.points...),
+		owners: make(map[uint64]MemberID, len(r.owners)),
+	}
+	for point, id := range r.owners {
+		c.owners[point] = id
+	}
+	return c
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	if _, err := io.WriteString(h, key); err != nil {
+		panic(err) // impossible
+	}
+	return mix64(h.Sum64())
+}
+
+func hashVirtualNode(id MemberID, i int) uint64 {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(id))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(i))
+	h := fnv.New64a()
+	h.Write(buf)
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer. FNV alone spreads similar inputs poorly around the ring.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,74 @@
+package membership
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingEmpty(t *testing.T) {
+	_, ok := NewRing(10).MemberForKey("anything")
+	assert.False(t, ok)
+}
+
+func TestRingDeterministic(t *testing.T) {
+	a := NewRing(50)
+	for _, id := range []MemberID{0, 1, 2} {
+		a.Add(id)
+	}
+	b := NewRing(50)
+	for _, id := range []MemberID{2, 0, 1} {
+		b.Add(id)
+	}
+
+	counts := map[MemberID]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		idA, ok := a.MemberForKey(key)
+		require.True(t, ok)
+		idB, _ := b.MemberForKey(key)
+		assert.Equal(t, idA, idB)
+		counts[idA]++
+	}
+	assert.Len(t, counts, 3)
+}
+
+func TestRingRemapFraction(t *testing.T) {
+	const n = 4
+	const keys = 10000
+	before := NewRing(100)
+	for i := 0; i < n; i++ {
+		before.Add(MemberID(i))
+	}
+
+	after := before.Clone()
+	after.Add(MemberID(n))
+
+	var moved int
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("/registry/pods/default/pod-%d", i)
+		oldID, _ := before.MemberForKey(key)
+		newID, _ := after.MemberForKey(key)
+		if oldID != newID {
+			moved++
+			assert.Equal(t, MemberID(n), newID, "keys should only move to the new member")
+		}
+	}
+
+	// Roughly 1/(n+1) of keys should move to the new member
+	fraction := float64(moved) / keys
+	t.Logf("moved %.3f of keys", fraction)
+	assert.InDelta(t, 1.0/(n+1), fraction, 0.07)
+
+	t.Run("remove restores placement", func(t *testing.T) {
+		after.Remove(MemberID(n))
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("/registry/pods/default/pod-%d", i)
+			oldID, _ := before.MemberForKey(key)
+			newID, _ := after.MemberForKey(key)
+			assert.Equal(t, oldID, newID)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/etcd/clientv3"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMetaKey is the clock key used when Scheme.MetaKey isn't set.
+	DefaultMetaKey = "/meta"
+
+	// SchemeVersion is the version of the meta key encoding written by this version of metaetcd.
+	SchemeVersion = "1"
+
+	metaValueLen = 8
+)
+
+// Scheme names the keys that hold metaetcd's state on each cluster.
+type Scheme struct {
+	// MetaKey holds each cluster's clock state: the coordinator's clock offset and each member's latest meta revision.
+	// Both are encoded as 8-byte little-endian integers. The scheme version marker and the clock's high-water mark are
+	// stored next to it, at MetaKey+"-scheme" and MetaKey+"-hwm". Instances that share clusters need different keys,
+	// or different namespaces. Defaults to DefaultMetaKey.
+	MetaKey string
+
+	// Namespace is prepended to every key read or written on the coordinator and members, including MetaKey,
+	// and stripped from the keys returned to clients. Instances with different namespaces can share clusters
+	// without seeing each other's keys.
+	Namespace string
+}
+
+// ClockKey returns the key that holds the clock state.
+func (s Scheme) ClockKey() string {
+	if s.MetaKey == "" {
+		return DefaultMetaKey
+	}
+	return s.MetaKey
+}
+
+// VersionKey returns the key that marks the version of the encoding used by the clock key.
+func (s Scheme) VersionKey() string { return s.ClockKey() + "-scheme" }
+
+// HighWaterMarkKey returns the key that holds the clock's high-water mark on members.
+func (s Scheme) HighWaterMarkKey() string { return s.ClockKey() + "-hwm" }
+
+// InternalKeysInRange returns the keys stored on members by metaetcd itself (the clock, version, and high-water mark keys)
+// that fall within [start, end), using etcd's range conventions. They're hidden from clients.
+func (s Scheme) InternalKeysInRange(start, end string) []string {
+	var keys []string
+	for _, key := range []string{s.ClockKey(), s.VersionKey(), s.HighWaterMarkKey()} {
+		if KeyInRange(key, start, end) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ErrIncompatibleScheme is returned when a cluster's meta keys were written by an incompatible version of metaetcd.
+var ErrIncompatibleScheme = errors.New("incompatible metaetcd scheme")
+
+// ValidateScheme returns ErrIncompatibleScheme if the cluster's clock key isn't encoded as expected, or if the
+// cluster was marked with a different scheme version. Clusters without a marker are marked with SchemeVersion
+// once their clock key (if any) has been validated.
+func (c *ClientSet) ValidateScheme(ctx context.Context, scheme Scheme) error {
+	resp, err := c.ClientV3.Txn(ctx).Then(clientv3.OpGet(scheme.VersionKey()), clientv3.OpGet(scheme.ClockKey())).Commit()
+	if err != nil {
+		return fmt.Errorf("getting meta keys: %w", err)
+	}
+	schemeKvs := resp.Responses[0].GetResponseRange().Kvs
+	metaKvs := resp.Responses[1].GetResponseRange().Kvs
+
+	if len(schemeKvs) > 0 && string(schemeKvs[0].Value) != SchemeVersion {
+		return fmt.Errorf("%w: cluster %s has scheme version %q but %q is expected", ErrIncompatibleScheme, c.Endpoint, schemeKvs[0].Value, SchemeVersion)
+	}
+	if len(metaKvs) > 0 && len(metaKvs[0].Value) != metaValueLen {
+		return fmt.Errorf("%w: cluster %s has a %d byte %s value but %d bytes are expected", ErrIncompatibleScheme, c.Endpoint, len(metaKvs[0].Value), scheme.ClockKey(), metaValueLen)
+	}
+	if len(schemeKvs) > 0 {
+		return nil
+	}
+
+	_, err = c.ClientV3.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version(scheme.VersionKey()), "=", 0)).
+		Then(clientv3.OpPut(scheme.VersionKey(), SchemeVersion)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("writing scheme version: %w", err)
+	}
+	zap.L().Info("marked cluster with scheme version", zap.String("endpoint", c.Endpoint), zap.String("version", SchemeVersion))
+	return nil
+}
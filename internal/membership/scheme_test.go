@@ -0,0 +1,111 @@
+package membership
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/testutil"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+func TestValidateScheme(t *testing.T) {
+	ctx := context.Background()
+	newClientSet := func(t *testing.T) *ClientSet {
+		cs, err := NewClientSet(&GrpcContext{}, testutil.StartEtcd(t))
+		require.NoError(t, err)
+		return cs
+	}
+	getScheme := func(t *testing.T, cs *ClientSet) []string {
+		resp, err := cs.ClientV3.Get(ctx, Scheme{}.VersionKey())
+		require.NoError(t, err)
+		var versions []string
+		for _, kv := range resp.Kvs {
+			versions = append(versions, string(kv.Value))
+		}
+		return versions
+	}
+
+	t.Run("new cluster is marked", func(t *testing.T) {
+		cs := newClientSet(t)
+		require.NoError(t, cs.ValidateScheme(ctx, Scheme{}))
+		assert.Equal(t, []string{SchemeVersion}, getScheme(t, cs))
+
+		require.NoError(t, cs.ValidateScheme(ctx, Scheme{}), "validating twice")
+	})
+
+	t.Run("unmarked cluster with valid meta key", func(t *testing.T) {
+		cs := newClientSet(t)
+		_, err := cs.ClientV3.Put(ctx, DefaultMetaKey, string(make([]byte, 8)))
+		require.NoError(t, err)
+
+		require.NoError(t, cs.ValidateScheme(ctx, Scheme{}))
+		assert.Equal(t, []string{SchemeVersion}, getScheme(t, cs))
+	})
+
+	t.Run("malformed meta key", func(t *testing.T) {
+		cs := newClientSet(t)
+		_, err := cs.ClientV3.Put(ctx, DefaultMetaKey, "clock")
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, cs.ValidateScheme(ctx, Scheme{}), ErrIncompatibleScheme)
+		assert.Empty(t, getScheme(t, cs), "incompatible clusters are not marked")
+	})
+
+	t.Run("different scheme version", func(t *testing.T) {
+		cs := newClientSet(t)
+		_, err := cs.ClientV3.Put(ctx, Scheme{}.VersionKey(), "0")
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, cs.ValidateScheme(ctx, Scheme{}), ErrIncompatibleScheme)
+	})
+
+	t.Run("member with malformed meta key is not added", func(t *testing.T) {
+		cs := newClientSet(t)
+		_, err := cs.ClientV3.Put(ctx, DefaultMetaKey, "\x01\x02\x03")
+		require.NoError(t, err)
+
+		p := NewPool(&GrpcContext{}, watch.NewMux(time.Second, 100, nil))
+		err = p.AddMember(ctx, MemberID(0), cs.Endpoint, NewStaticPartitions(1)[0])
+		assert.ErrorIs(t, err, ErrIncompatibleScheme)
+		assert.Empty(t, p.Members())
+	})
+
+	t.Run("custom meta key", func(t *testing.T) {
+		cs := newClientSet(t)
+		_, err := cs.ClientV3.Put(ctx, DefaultMetaKey, "clock")
+		require.NoError(t, err)
+
+		scheme := Scheme{MetaKey: "/other-meta"}
+		require.NoError(t, cs.ValidateScheme(ctx, scheme), "the default key is ignored")
+		resp, err := cs.ClientV3.Get(ctx, "/other-meta-scheme")
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, SchemeVersion, string(resp.Kvs[0].Value))
+		assert.Empty(t, getScheme(t, cs))
+	})
+}
+
+func TestInternalKeysInRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		expected   []string
+	}{
+		{name: "single key", start: "/meta", expected: []string{"/meta"}},
+		{name: "other single key", start: "/meta-other"},
+		{name: "whole keyspace", start: "\x00", end: "\x00", expected: []string{"/meta", "/meta-scheme", "/meta-hwm"}},
+		{name: "from key", start: "/meta-s", end: "\x00", expected: []string{"/meta-scheme"}},
+		{name: "prefix", start: "/meta-", end: "/meta.", expected: []string{"/meta-scheme", "/meta-hwm"}},
+		{name: "other prefix", start: "key-", end: "key."},
+		{name: "end is exclusive", start: "/", end: "/meta"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Scheme{}.InternalKeysInRange(tc.start, tc.end))
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package membership
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// Sharder places keys on members. Implementations are called with the pool's lock held so they don't need to be
+// safe for concurrent use.
+type Sharder interface {
+	// AddMember makes a member eligible to own keys. Sharders that don't use static partitions ignore them.
+	AddMember(id MemberID, cs *ClientSet, partitions []PartitionID)
+
+	// RemoveMember stops placing keys on a member. It returns ErrMemberOwnsKeys rather than leaving keys without an
+	// owner, when they can't be placed on another member.
+	RemoveMember(id MemberID, cs *ClientSet) error
+
+	// MemberForKey returns the member that owns the given key, or nil if no member owns it.
+	MemberForKey(key string) *ClientSet
+
+	// MembersForRange returns every member that could own a key in [start, end), using etcd's range conventions:
+	// an empty end is a single key and an end of "\x00" is every key >= start.
+	MembersForRange(start, end string) []*ClientSet
+}
+
+// partitionSharder places keys in partitionCount partitions using a jump consistent hash.
+type partitionSharder struct {
+	clients       []*ClientSet
+	byPartitionID map[PartitionID]*ClientSet
+}
+
+func newPartitionSharder() *partitionSharder {
+	return &partitionSharder{byPartitionID: make(map[PartitionID]*ClientSet)}
+}
+
+func (s *partitionSharder) AddMember(id MemberID, cs *ClientSet, partitions []PartitionID) {
+	s.clients = append(s.clients, cs)
+	for _, pid := range partitions {
+		s.byPartitionID[pid] = cs
+	}
+}
+
+// RemoveMember only removes members that don't own any partitions, since partitions are assigned statically.
+func (s *partitionSharder) RemoveMember(id MemberID, cs *ClientSet) error {
+	for pid, owner := range s.byPartitionID {
+		if owner == cs {
+			return fmt.Errorf("%w: partition %d", ErrMemberOwnsKeys, pid)
+		}
+	}
+	s.clients = withoutMember(s.clients, cs)
+	return nil
+}
+
+func (s *partitionSharder) MemberForKey(key string) *ClientSet {
+	h := fnv.New64()
+	if _, err := io.WriteString(h, key); err != nil {
+		panic(err) // impossible
+	}
+	keyInt := h.Sum64()
+
+	// Adopted from github.com/lithammer/go-jump-consistent-hash
+	var b, j int64
+	for j < int64(partitionCount) {
+		b = j
+		keyInt = keyInt*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((keyInt>>33)+1)))
+	}
+
+	if len(s.clients) == 0 {
+		return nil
+	}
+	return s.byPartitionID[PartitionID(b)]
+}
+
+// MembersForRange returns every member unless the range holds a single key, since hashing scatters neighboring keys.
+func (s *partitionSharder) MembersForRange(start, end string) []*ClientSet {
+	if isSingleKey(start, end) {
+		return singleMember(s.MemberForKey(start))
+	}
+	return s.clients
+}
+
+// ringSharder places keys using a consistent hash ring.
+type ringSharder struct {
+	ring       *Ring
+	clients    []*ClientSet
+	byMemberID map[MemberID]*ClientSet
+}
+
+func newRingSharder(ring *Ring) *ringSharder {
+	return &ringSharder{ring: ring, byMemberID: make(map[MemberID]*ClientSet)}
+}
+
+func (s *ringSharder) AddMember(id MemberID, cs *ClientSet, partitions []PartitionID) {
+	s.clients = append(s.clients, cs)
+	s.byMemberID[id] = cs
+	s.ring.Add(id)
+}
+
+// RemoveMember moves the member's keys to its neighbors on the ring. They can be copied there with Pool.MigrateKeys.
+func (s *ringSharder) RemoveMember(id MemberID, cs *ClientSet) error {
+	s.clients = withoutMember(s.clients, cs)
+	delete(s.byMemberID, id)
+	s.ring.Remove(id)
+	return nil
+}
+
+func (s *ringSharder) MemberForKey(key string) *ClientSet {
+	id, ok := s.ring.MemberForKey(key)
+	if !ok {
+		return nil
+	}
+	return s.byMemberID[id]
+}
+
+// MembersForRange returns every member unless the range holds a single key, since hashing scatters neighboring keys.
+func (s *ringSharder) MembersForRange(start, end string) []*ClientSet {
+	if isSingleKey(start, end) {
+		return singleMember(s.MemberForKey(start))
+	}
+	return s.clients
+}
+
+// RangeSharder places keys on members by contiguous, lexically ordered key ranges.
+// Unlike hashing, keys that share a prefix stay together so ranges only need to query the members that own them.
+//
+// The nth member added owns [splits[n-1], splits[n]), where the first member owns every key before splits[0] and
+// the last owns every key from the final split onwards. Keys are unowned until the member for their range is added.
+type RangeSharder struct {
+	splits  []string // sorted
+	clients []*ClientSet
+}
+
+func NewRangeSharder(splits []string) *RangeSharder {
+	splits = append([]string{}, splits...)
+	sort.Strings(splits)
+	return &RangeSharder{splits: splits}
+}
+
+func (s *RangeSharder) AddMember(id MemberID, cs *ClientSet, partitions []PartitionID) {
+	if len(s.clients) > len(s.splits) {
+		return // every range already has an owner
+	}
+	s.clients = append(s.clients, cs)
+}
+
+// RemoveMember refuses to remove the owner of a range, since moving its keys to a neighbor would need a migration.
+// Members added after every range had an owner don't own any keys, so removing them is a no-op.
+func (s *RangeSharder) RemoveMember(id MemberID, cs *ClientSet) error {
+	for i, owner := range s.clients {
+		if owner == cs {
+			return fmt.Errorf("%w: range %d", ErrMemberOwnsKeys, i)
+		}
+	}
+	return nil
+}
+
+func (s *RangeSharder) MemberForKey(key string) *ClientSet {
+	return s.member(s.shard(key))
+}
+
+func (s *RangeSharder) MembersForRange(start, end string) []*ClientSet {
+	if isSingleKey(start, end) {
+		return singleMember(s.MemberForKey(start))
+	}
+
+	first, last := s.shard(start), len(s.splits)
+	if end != "\x00" {
+		if end <= start {
+			return nil
+		}
+		// The last shard is the one holding the greatest key < end i.e. the number of splits < end
+		last = sort.SearchStrings(s.splits, end)
+	}
+
+	var members []*ClientSet
+	for i := first; i <= last; i++ {
+		if cs := s.member(i); cs != nil {
+			members = append(members, cs)
+		}
+	}
+	return members
+}
+
+// shard returns the index of the range holding the key i.e. the number of splits <= key.
+func (s *RangeSharder) shard(key string) int {
+	return sort.Search(len(s.splits), func(i int) bool { return s.splits[i] > key })
+}
+
+func (s *RangeSharder) member(shard int) *ClientSet {
+	if shard >= len(s.clients) {
+		return nil
+	}
+	return s.clients[shard]
+}
+
+// isSingleKey returns true when [start, end) can only contain start.
+func isSingleKey(start, end string) bool {
+	return end == "" || end == start+"\x00"
+}
+
+// KeyInRange returns true when key is within [start, end), using etcd's range conventions:
+// an empty end is a single key and an end of "\x00" is every key >= start.
+func KeyInRange(key, start, end string) bool {
+	switch end {
+	case "":
+		return key == start
+	case "\x00":
+		return key >= start
+	default:
+		return key >= start && key < end
+	}
+}
+
+// withoutMember returns a copy of clients without cs.
+func withoutMember(clients []*ClientSet, cs *ClientSet) []*ClientSet {
+	var ret []*ClientSet
+	for _, c := range clients {
+		if c != cs {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func singleMember(cs *ClientSet) []*ClientSet {
+	if cs == nil {
+		return nil
+	}
+	return []*ClientSet{cs}
+}
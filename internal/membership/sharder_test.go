@@ -0,0 +1,135 @@
+package membership
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSharders(t *testing.T) {
+	partitions := NewStaticPartitions(3)
+	sharders := map[string]Sharder{
+		"partitions": newPartitionSharder(),
+		"ring":       newRingSharder(NewRing(50)),
+	}
+	for name, sharder := range sharders {
+		t.Run(name, func(t *testing.T) {
+			assert.Nil(t, sharder.MemberForKey("key"))
+
+			var clients []*ClientSet
+			for i := 0; i < 3; i++ {
+				cs := &ClientSet{Endpoint: fmt.Sprintf("member-%d", i)}
+				sharder.AddMember(MemberID(i), cs, partitions[i])
+				clients = append(clients, cs)
+			}
+
+			counts := map[*ClientSet]int{}
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				cs := sharder.MemberForKey(key)
+				require.NotNil(t, cs)
+				assert.Equal(t, []*ClientSet{cs}, sharder.MembersForRange(key, ""))
+				assert.Equal(t, []*ClientSet{cs}, sharder.MembersForRange(key, key+"\x00"))
+				counts[cs]++
+			}
+			assert.Len(t, counts, 3)
+
+			// Hashed keys can be anywhere
+			assert.ElementsMatch(t, clients, sharder.MembersForRange("key-", "key."))
+			assert.ElementsMatch(t, clients, sharder.MembersForRange("\x00", "\x00"))
+		})
+	}
+}
+
+func TestRangeSharder(t *testing.T) {
+	s := NewRangeSharder([]string{"m", "g"}) // sorted by the constructor
+	a, b, c := &ClientSet{Endpoint: "a"}, &ClientSet{Endpoint: "b"}, &ClientSet{Endpoint: "c"}
+
+	s.AddMember(0, a, nil)
+	assert.Equal(t, a, s.MemberForKey("apple"))
+	assert.Nil(t, s.MemberForKey("zebra"), "unowned until the third member is added")
+
+	s.AddMember(1, b, nil)
+	s.AddMember(2, c, nil)
+	s.AddMember(3, &ClientSet{Endpoint: "extra"}, nil) // no range left to own
+
+	t.Run("keys", func(t *testing.T) {
+		for key, expected := range map[string]*ClientSet{
+			"":      a,
+			"apple": a,
+			"f~":    a,
+			"g":     b,
+			"grape": b,
+			"m":     c,
+			"zebra": c,
+		} {
+			assert.Equal(t, expected, s.MemberForKey(key), key)
+		}
+	})
+
+	t.Run("ranges", func(t *testing.T) {
+		for _, tc := range []struct {
+			name       string
+			start, end string
+			expected   []*ClientSet
+		}{
+			{name: "single key", start: "h", expected: []*ClientSet{b}},
+			{name: "single key range", start: "f~", end: "f~\x00", expected: []*ClientSet{a}},
+			{name: "prefix within one member", start: "a/", end: "a0", expected: []*ClientSet{a}},
+			{name: "end is exclusive", start: "a", end: "g", expected: []*ClientSet{a}},
+			{name: "spans two members", start: "a", end: "g\x00", expected: []*ClientSet{a, b}},
+			{name: "spans every member", start: "a", end: "z", expected: []*ClientSet{a, b, c}},
+			{name: "open ended", start: "h", end: "\x00", expected: []*ClientSet{b, c}},
+			{name: "everything", start: "\x00", end: "\x00", expected: []*ClientSet{a, b, c}},
+			{name: "empty", start: "z", end: "a", expected: nil},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				assert.Equal(t, tc.expected, s.MembersForRange(tc.start, tc.end))
+			})
+		}
+	})
+}
+
+func TestSharderRemoveMember(t *testing.T) {
+	a, b := &ClientSet{Endpoint: "a"}, &ClientSet{Endpoint: "b"}
+
+	t.Run("partitions", func(t *testing.T) {
+		s := newPartitionSharder()
+		partitions := NewStaticPartitions(2)
+		s.AddMember(0, a, partitions[0])
+		s.AddMember(1, b, partitions[1])
+		assert.ErrorIs(t, s.RemoveMember(0, a), ErrMemberOwnsKeys)
+		assert.Equal(t, []*ClientSet{a, b}, s.MembersForRange("a", "\x00"))
+
+		c := &ClientSet{Endpoint: "c"}
+		s.AddMember(2, c, nil)
+		require.NoError(t, s.RemoveMember(2, c), "owns no partitions")
+		assert.Equal(t, []*ClientSet{a, b}, s.MembersForRange("a", "\x00"))
+	})
+
+	t.Run("ring", func(t *testing.T) {
+		s := newRingSharder(NewRing(10))
+		s.AddMember(0, a, nil)
+		s.AddMember(1, b, nil)
+		require.NoError(t, s.RemoveMember(0, a))
+		assert.Equal(t, []*ClientSet{b}, s.MembersForRange("a", "\x00"))
+		for i := 0; i < 100; i++ {
+			assert.Equal(t, b, s.MemberForKey(fmt.Sprintf("key-%d", i)))
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		s := NewRangeSharder([]string{"m"})
+		s.AddMember(0, a, nil)
+		s.AddMember(1, b, nil)
+		assert.ErrorIs(t, s.RemoveMember(0, a), ErrMemberOwnsKeys)
+		assert.Equal(t, a, s.MemberForKey("apple"), "still owned after the rejected removal")
+		assert.Equal(t, []*ClientSet{a, b}, s.MembersForRange("a", "\x00"))
+
+		c := &ClientSet{Endpoint: "c"}
+		s.AddMember(2, c, nil)
+		require.NoError(t, s.RemoveMember(2, c), "owns no range")
+	})
+}
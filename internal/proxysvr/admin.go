@@ -0,0 +1,165 @@
+package proxysvr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// AdminServiceName is the name of the gRPC service defined in admin.proto.
+const AdminServiceName = "metaetcd.Admin"
+
+// Full names of the admin RPCs, for clients without generated code.
+const (
+	ReconstituteClockMethod = "/" + AdminServiceName + "/ReconstituteClock"
+	VerifyClockMethod       = "/" + AdminServiceName + "/VerifyClock"
+	DrainMemberMethod       = "/" + AdminServiceName + "/DrainMember"
+	UndrainMemberMethod     = "/" + AdminServiceName + "/UndrainMember"
+)
+
+// AdminServer implements administrative RPCs that aren't part of the etcd API.
+// It's registered separately from the etcd services, since it shouldn't be exposed without client authentication.
+type AdminServer interface {
+	// ReconstituteClock restores the coordinator's clock from the member clusters and returns the restored meta revision.
+	ReconstituteClock(context.Context, *emptypb.Empty) (*wrapperspb.Int64Value, error)
+
+	// VerifyClock compares the coordinator's clock with the members' and returns a clock.Report as a struct.
+	VerifyClock(context.Context, *emptypb.Empty) (*structpb.Struct, error)
+
+	// DrainMember stops routing writes to the member with the given endpoint, while still serving its reads.
+	DrainMember(context.Context, *wrapperspb.StringValue) (*emptypb.Empty, error)
+
+	// UndrainMember resumes routing writes to a member drained by DrainMember.
+	UndrainMember(context.Context, *wrapperspb.StringValue) (*emptypb.Empty, error)
+}
+
+// RegisterAdminServer registers the admin service, which is written by hand since the repo doesn't generate code from protos.
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&adminServiceDesc, srv)
+}
+
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: AdminServiceName,
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReconstituteClock",
+			Handler: adminHandler(ReconstituteClockMethod, func(srv AdminServer, ctx context.Context, req *emptypb.Empty) (interface{}, error) {
+				return srv.ReconstituteClock(ctx, req)
+			}),
+		},
+		{
+			MethodName: "VerifyClock",
+			Handler: adminHandler(VerifyClockMethod, func(srv AdminServer, ctx context.Context, req *emptypb.Empty) (interface{}, error) {
+				return srv.VerifyClock(ctx, req)
+			}),
+		},
+		{
+			MethodName: "DrainMember",
+			Handler: adminHandler(DrainMemberMethod, func(srv AdminServer, ctx context.Context, req *wrapperspb.StringValue) (interface{}, error) {
+				return srv.DrainMember(ctx, req)
+			}),
+		},
+		{
+			MethodName: "UndrainMember",
+			Handler: adminHandler(UndrainMemberMethod, func(srv AdminServer, ctx context.Context, req *wrapperspb.StringValue) (interface{}, error) {
+				return srv.UndrainMember(ctx, req)
+			}),
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
+
+// adminRequest is the type of an admin RPC's request, e.g. *emptypb.Empty.
+type adminRequest[T any] interface {
+	*T
+	proto.Message
+}
+
+// adminHandler adapts an admin RPC to the signature of generated gRPC handlers.
+func adminHandler[T any, Req adminRequest[T]](method string, fn func(AdminServer, context.Context, Req) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := Req(new(T))
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return fn(srv.(AdminServer), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: method}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fn(srv.(AdminServer), ctx, req.(Req))
+		})
+	}
+}
+
+// ReconstituteClock takes the clock reconstitution lock, so live traffic that finds the clock missing waits for it.
+func (s *server) ReconstituteClock(ctx context.Context, req *emptypb.Empty) (*wrapperspb.Int64Value, error) {
+	requestCount.WithLabelValues("ReconstituteClock").Inc()
+
+	rev, err := s.clock.Reconstitute(ctx)
+	if err != nil {
+		zap.L().Error("failed to reconstitute clock", zap.Error(err))
+		return nil, err
+	}
+	zap.L().Warn("reconstituted clock by request", zap.Int64("metaRev", rev))
+	return wrapperspb.Int64(rev), nil
+}
+
+func (s *server) VerifyClock(ctx context.Context, req *emptypb.Empty) (*structpb.Struct, error) {
+	requestCount.WithLabelValues("VerifyClock").Inc()
+
+	report, err := s.clock.Verify(ctx)
+	if err != nil {
+		zap.L().Error("failed to verify clock", zap.Error(err))
+		return nil, err
+	}
+
+	// Round trip through JSON so the struct's fields match the report's JSON encoding
+	js, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(js, &fields); err != nil {
+		return nil, err
+	}
+	resp, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, fmt.Errorf("encoding clock report: %w", err)
+	}
+	return resp, nil
+}
+
+func (s *server) DrainMember(ctx context.Context, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	requestCount.WithLabelValues("DrainMember").Inc()
+	return s.setDraining(req.Value, true)
+}
+
+func (s *server) UndrainMember(ctx context.Context, req *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	requestCount.WithLabelValues("UndrainMember").Inc()
+	return s.setDraining(req.Value, false)
+}
+
+func (s *server) setDraining(endpoint string, draining bool) (*emptypb.Empty, error) {
+	if err := s.members.SetDraining(endpoint, draining); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if draining {
+		memberDraining.WithLabelValues(endpoint).Set(1)
+	} else {
+		memberDraining.WithLabelValues(endpoint).Set(0)
+	}
+	zap.L().Warn("changed member drain mode by request", zap.String("endpoint", endpoint), zap.Bool("draining", draining))
+	return &emptypb.Empty{}, nil
+}
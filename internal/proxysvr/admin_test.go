@@ -0,0 +1,182 @@
+package proxysvr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestReconstituteClock(t *testing.T) {
+	client, s := startServer(t)
+	reconstitute := func() int64 {
+		resp := &wrapperspb.Int64Value{}
+		require.NoError(t, client.ActiveConnection().Invoke(ctx, ReconstituteClockMethod, &emptypb.Empty{}, resp))
+		return resp.Value
+	}
+
+	// Write known meta revisions to the members' clocks
+	for i, rev := range []uint64{100, 42} {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, rev)
+		_, err := s.members.Members()[i].ClientV3.Put(ctx, "/meta", string(buf))
+		require.NoError(t, err)
+	}
+
+	t.Run("lost clock", func(t *testing.T) {
+		require.NoError(t, s.clock.Reset(ctx))
+		assert.Equal(t, int64(100), reconstitute())
+
+		now, err := s.clock.Now(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(100), now)
+
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, int64(101), resp.Header.Revision)
+	})
+
+	t.Run("clock ahead of members", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := s.clock.Tick(ctx) // ticks that never reach a member
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int64(104), reconstitute(), "the clock never moves backwards")
+	})
+
+	t.Run("clock behind members", func(t *testing.T) {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, 200)
+		_, err := s.members.Members()[1].ClientV3.Put(ctx, "/meta", string(buf))
+		require.NoError(t, err)
+		assert.Equal(t, int64(200), reconstitute())
+
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", 2), "value")).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, int64(201), resp.Header.Revision)
+	})
+}
+
+func TestVerifyClock(t *testing.T) {
+	client, s := startServer(t)
+	verify := func() map[string]interface{} {
+		resp := &structpb.Struct{}
+		require.NoError(t, client.ActiveConnection().Invoke(ctx, VerifyClockMethod, &emptypb.Empty{}, resp))
+		return resp.AsMap()
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "value")).Commit()
+		require.NoError(t, err)
+	}
+	now, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+
+	t.Run("consistent", func(t *testing.T) {
+		report := verify()
+		assert.Equal(t, true, report["consistent"])
+		assert.Equal(t, float64(now), report["coordinatorRevision"])
+		require.Len(t, report["members"], 2)
+		for _, member := range report["members"].([]interface{}) {
+			assert.Equal(t, false, member.(map[string]interface{})["ahead"])
+		}
+	})
+
+	t.Run("member ahead of coordinator", func(t *testing.T) {
+		member := s.members.Members()[0]
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(now+50))
+		_, err := member.ClientV3.Put(ctx, "/meta", string(buf))
+		require.NoError(t, err)
+
+		report := verify()
+		assert.Equal(t, false, report["consistent"])
+		var flagged []string
+		for _, m := range report["members"].([]interface{}) {
+			if m := m.(map[string]interface{}); m["ahead"] == true {
+				flagged = append(flagged, m["endpoint"].(string))
+				assert.Equal(t, float64(now+50), m["metaRevision"])
+			}
+		}
+		assert.Equal(t, []string{member.Endpoint}, flagged)
+	})
+}
+
+func TestDrainMember(t *testing.T) {
+	client, s := startServer(t)
+	drained := s.members.Members()[0]
+	setDraining := func(method, endpoint string) error {
+		return client.ActiveConnection().Invoke(ctx, method, wrapperspb.String(endpoint), &emptypb.Empty{})
+	}
+
+	// Find a key on each member
+	var drainedKey, otherKey string
+	for i := 0; drainedKey == "" || otherKey == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if s.members.GetMemberForKey(key) == drained {
+			drainedKey = key
+		} else {
+			otherKey = key
+		}
+	}
+	for _, key := range []string{drainedKey, otherKey} {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, setDraining(DrainMemberMethod, drained.Endpoint))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(memberDraining.WithLabelValues(drained.Endpoint)))
+
+	t.Run("writes fail", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(drainedKey, "value-2")).Commit()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "draining")
+
+		_, err = client.Grant(ctx, 60)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("reads succeed", func(t *testing.T) {
+		resp, err := client.Get(ctx, drainedKey)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value", string(resp.Kvs[0].Value))
+
+		resp, err = client.Get(ctx, "key-", clientv3.WithPrefix())
+		require.NoError(t, err)
+		assert.Len(t, resp.Kvs, 2)
+
+		tresp, err := client.Txn(ctx).Then(clientv3.OpGet(drainedKey)).Commit()
+		require.NoError(t, err)
+		assert.Len(t, tresp.Responses[0].GetResponseRange().Kvs, 1)
+	})
+
+	t.Run("other members accept writes", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(otherKey, "value-2")).Commit()
+		require.NoError(t, err)
+	})
+
+	t.Run("unknown member", func(t *testing.T) {
+		err := setDraining(DrainMemberMethod, "http://127.0.0.1:1")
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("undrain", func(t *testing.T) {
+		require.NoError(t, setDraining(UndrainMemberMethod, drained.Endpoint))
+		assert.Equal(t, float64(0), promtestutil.ToFloat64(memberDraining.WithLabelValues(drained.Endpoint)))
+
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(drainedKey, "value-2")).Commit()
+		require.NoError(t, err)
+		_, err = client.Grant(ctx, 60)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,157 @@
+package proxysvr
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.uber.org/zap"
+)
+
+// AuditRecord describes a mutation applied through the proxy.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	// Principal is the authenticated user, or empty if the request didn't present an auth token.
+	Principal string `json:"principal,omitempty"`
+
+	// Operation is the gRPC method e.g. Txn or LeaseGrant.
+	Operation string `json:"operation"`
+
+	// Keys are the keys written or deleted by the branch of the transaction that was applied.
+	Keys []string `json:"keys,omitempty"`
+
+	// Ranges are the key ranges deleted by the branch of the transaction that was applied.
+	Ranges []AuditRange `json:"ranges,omitempty"`
+
+	LeaseID int64 `json:"leaseID,omitempty"`
+
+	// Revision is the meta revision of the mutation, or 0 for operations that don't consume one.
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// AuditRange is the key range [Start, End) using etcd's range conventions: an End of "\x00" is every key >= Start.
+type AuditRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// AuditSink receives a record of every mutation. Records are sent from a single goroutine off the request path,
+// so implementations don't need to be safe for concurrent use.
+type AuditSink interface {
+	Record(AuditRecord) error
+}
+
+// JSONLinesAuditSink writes each record to w as a line of JSON.
+type JSONLinesAuditSink struct {
+	enc *json.Encoder
+}
+
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{enc: json.NewEncoder(w)}
+}
+
+func (j *JSONLinesAuditSink) Record(r AuditRecord) error {
+	return j.enc.Encode(r)
+}
+
+// auditor buffers records for an AuditSink so slow sinks can't block requests.
+// Records are dropped when the buffer is full.
+type auditor struct {
+	sink AuditSink
+	ch   chan AuditRecord
+}
+
+func newAuditor(sink AuditSink, bufLen int) *auditor {
+	return &auditor{sink: sink, ch: make(chan AuditRecord, bufLen)}
+}
+
+// Record queues a record without blocking.
+func (a *auditor) Record(r AuditRecord) {
+	r.Time = time.Now()
+	select {
+	case a.ch <- r:
+	default:
+		auditRecordsDropped.Inc()
+		zap.L().Warn("dropped audit record because the buffer is full", zap.String("operation", r.Operation), zap.Strings("keys", r.Keys))
+	}
+}
+
+// Run sends queued records to the sink until ctx is done, then flushes the records that are still buffered.
+func (a *auditor) Run(ctx context.Context) {
+	for {
+		select {
+		case r := <-a.ch:
+			a.send(r)
+		case <-ctx.Done():
+			for {
+				select {
+				case r := <-a.ch:
+					a.send(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *auditor) send(r AuditRecord) {
+	if err := a.sink.Record(r); err != nil {
+		zap.L().Error("failed to write audit record", zap.String("operation", r.Operation), zap.Strings("keys", r.Keys), zap.Error(err))
+	}
+}
+
+// RunAuditSink sends audit records to ServerConfig.AuditSink until ctx is done. It returns immediately if auditing is disabled.
+func (s *server) RunAuditSink(ctx context.Context) {
+	if s.audit != nil {
+		s.audit.Run(ctx)
+	}
+}
+
+// auditTxn records the keys written by the branch of a transaction that was applied.
+func (s *server) auditTxn(ctx context.Context, req *etcdserverpb.TxnRequest, resp *etcdserverpb.TxnResponse) {
+	if s.audit == nil {
+		return
+	}
+	ops := req.Success
+	if !resp.Succeeded {
+		ops = req.Failure
+	}
+	r := AuditRecord{Principal: s.principal(ctx), Operation: "Txn", Revision: resp.Header.Revision}
+	addMutations(&r, ops, resp.Responses)
+	if len(r.Keys) == 0 && len(r.Ranges) == 0 {
+		return
+	}
+	s.audit.Record(r)
+}
+
+// addMutations adds the keys put or deleted by ops to the record, including the applied branches of nested transactions.
+// Deletes of more than one key are added as ranges. Only ops with a response are considered, which omits the clock
+// update appended to the client's ops.
+func addMutations(r *AuditRecord, ops []*etcdserverpb.RequestOp, resps []*etcdserverpb.ResponseOp) {
+	for i, resp := range resps {
+		if i >= len(ops) {
+			break
+		}
+		switch op := ops[i]; {
+		case op.GetRequestPut() != nil:
+			r.Keys = append(r.Keys, string(op.GetRequestPut().Key))
+		case op.GetRequestDeleteRange() != nil:
+			if del := op.GetRequestDeleteRange(); len(del.RangeEnd) > 0 {
+				r.Ranges = append(r.Ranges, AuditRange{Start: string(del.Key), End: string(del.RangeEnd)})
+			} else {
+				r.Keys = append(r.Keys, string(del.Key))
+			}
+		case op.GetRequestTxn() != nil:
+			txn, nested := op.GetRequestTxn(), resp.GetResponseTxn()
+			if nested.GetSucceeded() {
+				addMutations(r, txn.Success, nested.GetResponses())
+			} else {
+				addMutations(r, txn.Failure, nested.GetResponses())
+			}
+		}
+	}
+}
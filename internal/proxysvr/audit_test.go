@@ -0,0 +1,140 @@
+package proxysvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAuditSink(t *testing.T) {
+	sink := &chanAuditSink{ch: make(chan AuditRecord, 10)}
+	client, s := startServerWithConfig(t, ServerConfig{AuditSink: sink})
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunAuditSink(runCtx)
+
+	next := func() AuditRecord {
+		select {
+		case r := <-sink.ch:
+			return r
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for audit record")
+			return AuditRecord{}
+		}
+	}
+
+	t.Run("txn", func(t *testing.T) {
+		token, err := s.tokens.Issue("test-user")
+		require.NoError(t, err)
+		authCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(rpctypes.TokenFieldNameGRPC, token))
+
+		resp, err := s.Txn(authCtx, &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{
+			{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key"), Value: []byte("value")}}},
+		}})
+		require.NoError(t, err)
+
+		r := next()
+		assert.Equal(t, "test-user", r.Principal)
+		assert.Equal(t, "Txn", r.Operation)
+		assert.Equal(t, []string{"key"}, r.Keys, "the clock's key is omitted")
+		assert.Equal(t, resp.Header.Revision, r.Revision)
+		assert.False(t, r.Time.IsZero())
+	})
+
+	t.Run("applied branch", func(t *testing.T) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Version("key"), "=", 0)).
+			Then(clientv3.OpPut("key", "value-2")).
+			Else(clientv3.OpDelete("key")).
+			Commit()
+		require.NoError(t, err)
+		require.False(t, resp.Succeeded)
+
+		r := next()
+		assert.Empty(t, r.Principal)
+		assert.Equal(t, []string{"key"}, r.Keys)
+		assert.Equal(t, resp.Header.Revision, r.Revision)
+	})
+
+	t.Run("prefix delete", func(t *testing.T) {
+		resp, err := client.Txn(ctx).Then(clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpDelete("key", clientv3.WithPrefix())}, nil)).Commit()
+		require.NoError(t, err)
+
+		r := next()
+		assert.Empty(t, r.Keys)
+		assert.Equal(t, []AuditRange{{Start: "key", End: "kez"}}, r.Ranges)
+		assert.Equal(t, resp.Header.Revision, r.Revision)
+	})
+
+	t.Run("lease grant", func(t *testing.T) {
+		resp, err := client.Grant(ctx, 60)
+		require.NoError(t, err)
+
+		r := next()
+		assert.Equal(t, "LeaseGrant", r.Operation)
+		assert.Equal(t, int64(resp.ID), r.LeaseID)
+	})
+
+	t.Run("reads aren't audited", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpGet("key")).Commit()
+		require.NoError(t, err)
+		_, err = client.Get(ctx, "key")
+		require.NoError(t, err)
+
+		select {
+		case r := <-sink.ch:
+			t.Fatalf("unexpected audit record: %+v", r)
+		case <-time.After(time.Millisecond * 100):
+		}
+	})
+}
+
+func TestAuditorFullBuffer(t *testing.T) {
+	a := newAuditor(&chanAuditSink{ch: make(chan AuditRecord, 10)}, 1)
+	before := promtestutil.ToFloat64(auditRecordsDropped)
+
+	// Nothing is reading from the buffer, so the second record doesn't fit
+	a.Record(AuditRecord{Operation: "Txn", Keys: []string{"key-1"}})
+	a.Record(AuditRecord{Operation: "Txn", Keys: []string{"key-2"}})
+	assert.Equal(t, before+1, promtestutil.ToFloat64(auditRecordsDropped))
+
+	// Buffered records are flushed when the auditor stops
+	runCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Run(runCtx)
+	r := <-a.sink.(*chanAuditSink).ch
+	assert.Equal(t, []string{"key-1"}, r.Keys)
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewJSONLinesAuditSink(buf)
+	require.NoError(t, sink.Record(AuditRecord{Principal: "root", Operation: "Txn", Keys: []string{"key"}, Revision: 10}))
+	require.NoError(t, sink.Record(AuditRecord{Operation: "LeaseGrant", LeaseID: 123}))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	var r AuditRecord
+	require.NoError(t, json.Unmarshal(lines[0], &r))
+	assert.Equal(t, AuditRecord{Principal: "root", Operation: "Txn", Keys: []string{"key"}, Revision: 10}, r)
+	assert.NotContains(t, string(lines[1]), "principal")
+}
+
+type chanAuditSink struct {
+	ch chan AuditRecord
+}
+
+func (c *chanAuditSink) Record(r AuditRecord) error {
+	c.ch <- r
+	return nil
+}
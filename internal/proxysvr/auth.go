@@ -0,0 +1,331 @@
+package proxysvr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+const (
+	authenticateMethod = "/etcdserverpb.Auth/Authenticate"
+	authService        = "/etcdserverpb.Auth/"
+	healthService      = "/grpc.health.v1.Health/" // load balancers can't authenticate
+	rootRole           = "root"
+)
+
+// UnaryInterceptor rejects unary requests without a valid auth token when RequireAuth is set.
+func (s *server) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := s.authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor rejects streams without a valid auth token when RequireAuth is set.
+func (s *server) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := s.authorize(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (s *server) authorize(ctx context.Context, method string) error {
+	if !s.config.RequireAuth || method == authenticateMethod || strings.HasPrefix(method, healthService) {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(rpctypes.TokenFieldNameGRPC)
+	if len(tokens) == 0 {
+		return rpctypes.ErrGRPCUserEmpty
+	}
+	user, ok := s.tokens.Validate(tokens[0])
+	if !ok {
+		return rpctypes.ErrGRPCInvalidAuthToken
+	}
+	if requiresRoot(method) {
+		return s.authorizeRoot(ctx, user)
+	}
+	return nil
+}
+
+// requiresRoot returns true for methods that manage users, roles, or the proxy itself.
+// The proxy calls the clusters as its own user, so it has to check the caller's roles before forwarding them.
+func requiresRoot(method string) bool {
+	return strings.HasPrefix(method, authService) || strings.HasPrefix(method, "/"+AdminServiceName+"/")
+}
+
+// authorizeRoot returns an error unless the user has the root role on the coordinator.
+// Roles are looked up on every call so that revoking them takes effect immediately.
+func (s *server) authorizeRoot(ctx context.Context, user string) error {
+	resp, err := s.coordinator.Auth.UserGet(ctx, &etcdserverpb.AuthUserGetRequest{Name: user})
+	if err != nil {
+		return fmt.Errorf("getting roles of user %q: %w", user, err)
+	}
+	for _, role := range resp.Roles {
+		if role == rootRole {
+			return nil
+		}
+	}
+	zap.L().Warn("rejected request from user without the root role", zap.String("user", user))
+	return rpctypes.ErrGRPCPermissionDenied
+}
+
+// principal returns the user that the request's auth token was issued to, or an empty string if it doesn't have a valid token.
+func (s *server) principal(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(rpctypes.TokenFieldNameGRPC)
+	if len(tokens) == 0 {
+		return ""
+	}
+	user, _ := s.tokens.Validate(tokens[0])
+	return user
+}
+
+// Authenticate verifies the user's credentials against the coordinator, which is the source of truth for users and roles.
+// The coordinator's token is replaced with one issued by the proxy, since it isn't valid for member clusters.
+func (s *server) Authenticate(ctx context.Context, req *etcdserverpb.AuthenticateRequest) (*etcdserverpb.AuthenticateResponse, error) {
+	requestCount.WithLabelValues("Authenticate").Inc()
+	if _, err := s.coordinator.Auth.Authenticate(ctx, req); err != nil {
+		zap.L().Warn("failed to authenticate user", zap.String("user", req.Name), zap.Error(err))
+		return nil, err
+	}
+	token, err := s.tokens.Issue(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	zap.L().Info("authenticated user", zap.String("user", req.Name))
+	return &etcdserverpb.AuthenticateResponse{Header: &etcdserverpb.ResponseHeader{}, Token: token}, nil
+}
+
+// AuthEnable only enables auth on the coordinator since the proxy enforces auth for the member clusters.
+func (s *server) AuthEnable(ctx context.Context, req *etcdserverpb.AuthEnableRequest) (*etcdserverpb.AuthEnableResponse, error) {
+	requestCount.WithLabelValues("AuthEnable").Inc()
+	return s.coordinator.Auth.AuthEnable(ctx, req)
+}
+
+func (s *server) AuthDisable(ctx context.Context, req *etcdserverpb.AuthDisableRequest) (*etcdserverpb.AuthDisableResponse, error) {
+	requestCount.WithLabelValues("AuthDisable").Inc()
+	return s.coordinator.Auth.AuthDisable(ctx, req)
+}
+
+func (s *server) UserGet(ctx context.Context, req *etcdserverpb.AuthUserGetRequest) (*etcdserverpb.AuthUserGetResponse, error) {
+	requestCount.WithLabelValues("UserGet").Inc()
+	return s.coordinator.Auth.UserGet(ctx, req)
+}
+
+func (s *server) UserList(ctx context.Context, req *etcdserverpb.AuthUserListRequest) (*etcdserverpb.AuthUserListResponse, error) {
+	requestCount.WithLabelValues("UserList").Inc()
+	return s.coordinator.Auth.UserList(ctx, req)
+}
+
+func (s *server) RoleGet(ctx context.Context, req *etcdserverpb.AuthRoleGetRequest) (*etcdserverpb.AuthRoleGetResponse, error) {
+	requestCount.WithLabelValues("RoleGet").Inc()
+	return s.coordinator.Auth.RoleGet(ctx, req)
+}
+
+func (s *server) RoleList(ctx context.Context, req *etcdserverpb.AuthRoleListRequest) (*etcdserverpb.AuthRoleListResponse, error) {
+	requestCount.WithLabelValues("RoleList").Inc()
+	return s.coordinator.Auth.RoleList(ctx, req)
+}
+
+func (s *server) UserAdd(ctx context.Context, req *etcdserverpb.AuthUserAddRequest) (*etcdserverpb.AuthUserAddResponse, error) {
+	requestCount.WithLabelValues("UserAdd").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.UserAdd(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserAddResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) UserDelete(ctx context.Context, req *etcdserverpb.AuthUserDeleteRequest) (*etcdserverpb.AuthUserDeleteResponse, error) {
+	requestCount.WithLabelValues("UserDelete").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.UserDelete(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.tokens.RevokeUser(req.Name)
+	return &etcdserverpb.AuthUserDeleteResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) UserChangePassword(ctx context.Context, req *etcdserverpb.AuthUserChangePasswordRequest) (*etcdserverpb.AuthUserChangePasswordResponse, error) {
+	requestCount.WithLabelValues("UserChangePassword").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.UserChangePassword(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.tokens.RevokeUser(req.Name)
+	return &etcdserverpb.AuthUserChangePasswordResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) UserGrantRole(ctx context.Context, req *etcdserverpb.AuthUserGrantRoleRequest) (*etcdserverpb.AuthUserGrantRoleResponse, error) {
+	requestCount.WithLabelValues("UserGrantRole").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.UserGrantRole(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserGrantRoleResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) UserRevokeRole(ctx context.Context, req *etcdserverpb.AuthUserRevokeRoleRequest) (*etcdserverpb.AuthUserRevokeRoleResponse, error) {
+	requestCount.WithLabelValues("UserRevokeRole").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.UserRevokeRole(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserRevokeRoleResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) RoleAdd(ctx context.Context, req *etcdserverpb.AuthRoleAddRequest) (*etcdserverpb.AuthRoleAddResponse, error) {
+	requestCount.WithLabelValues("RoleAdd").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.RoleAdd(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleAddResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) RoleDelete(ctx context.Context, req *etcdserverpb.AuthRoleDeleteRequest) (*etcdserverpb.AuthRoleDeleteResponse, error) {
+	requestCount.WithLabelValues("RoleDelete").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.RoleDelete(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleDeleteResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) RoleGrantPermission(ctx context.Context, req *etcdserverpb.AuthRoleGrantPermissionRequest) (*etcdserverpb.AuthRoleGrantPermissionResponse, error) {
+	requestCount.WithLabelValues("RoleGrantPermission").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.RoleGrantPermission(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleGrantPermissionResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func (s *server) RoleRevokePermission(ctx context.Context, req *etcdserverpb.AuthRoleRevokePermissionRequest) (*etcdserverpb.AuthRoleRevokePermissionResponse, error) {
+	requestCount.WithLabelValues("RoleRevokePermission").Inc()
+	err := s.updateAuth(ctx, func(ctx context.Context, c etcdserverpb.AuthClient) error {
+		_, err := c.RoleRevokePermission(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleRevokePermissionResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+// updateAuth applies a change to the coordinator and then every member so that authorization is consistent across clusters.
+func (s *server) updateAuth(ctx context.Context, fn func(context.Context, etcdserverpb.AuthClient) error) error {
+	if err := fn(ctx, s.coordinator.Auth); err != nil {
+		return err
+	}
+	return s.members.IterateMembers(ctx, func(ctx context.Context, cs *membership.ClientSet) error {
+		return fn(ctx, cs.Auth)
+	})
+}
+
+// tokenStore tracks the tokens issued by the proxy to authenticated users.
+// Tokens expire after they haven't been used for the configured TTL.
+type tokenStore struct {
+	mut    sync.Mutex
+	ttl    time.Duration
+	tokens map[string]*authToken
+}
+
+type authToken struct {
+	user    string
+	expires time.Time
+}
+
+func newTokenStore(ttl time.Duration) *tokenStore {
+	return &tokenStore{ttl: ttl, tokens: make(map[string]*authToken)}
+}
+
+func (t *tokenStore) Issue(user string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	now := time.Now()
+	for key, tok := range t.tokens {
+		if now.After(tok.expires) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = &authToken{user: user, expires: now.Add(t.ttl)}
+	return token, nil
+}
+
+// Validate returns the user a token was issued to and extends its expiration.
+func (t *tokenStore) Validate(token string) (string, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	tok, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if now.After(tok.expires) {
+		delete(t.tokens, token)
+		return "", false
+	}
+	tok.expires = now.Add(t.ttl)
+	return tok.user, true
+}
+
+func (t *tokenStore) RevokeUser(user string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	for key, tok := range t.tokens {
+		if tok.user == user {
+			delete(t.tokens, key)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxysvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Azure/metaetcd/internal/membership"
+	"github.com/Azure/metaetcd/internal/testutil"
+)
+
+func TestAuth(t *testing.T) {
+	coordinatorURL := testutil.StartEtcd(t)
+	memberURLs := []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}
+
+	// Enable auth on the coordinator before the proxy connects to it
+	admin, err := clientv3.New(clientv3.Config{Endpoints: []string{coordinatorURL}, DialTimeout: 2 * time.Second})
+	require.NoError(t, err)
+	_, err = admin.UserAdd(ctx, "root", "password")
+	require.NoError(t, err)
+	_, err = admin.UserGrantRole(ctx, "root", "root")
+	require.NoError(t, err)
+	_, err = admin.AuthEnable(ctx)
+	require.NoError(t, err)
+	admin.Close()
+
+	gc := &membership.GrpcContext{Username: "root", Password: "password"}
+	svr := newServer(t, gc, coordinatorURL, memberURLs, ServerConfig{RequireAuth: true})
+
+	t.Run("range without token", func(t *testing.T) {
+		client := serve(t, svr, clientv3.Config{})
+		_, err := client.Get(ctx, "key")
+		assert.EqualError(t, err, "etcdserver: user name is empty")
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		_, err := svr.Authenticate(ctx, &etcdserverpb.AuthenticateRequest{Name: "root", Password: "wrong"})
+		assert.EqualError(t, err, "rpc error: code = InvalidArgument desc = etcdserver: authentication failed, invalid user ID or password")
+	})
+
+	client := serve(t, svr, clientv3.Config{Username: "root", Password: "password"})
+	t.Run("range with token", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+		require.NoError(t, err)
+
+		resp, err := client.Get(ctx, "key")
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value", string(resp.Kvs[0].Value))
+	})
+
+	t.Run("user add fans out", func(t *testing.T) {
+		_, err := client.UserAdd(ctx, "test-user", "password")
+		require.NoError(t, err)
+
+		for _, memberURL := range memberURLs {
+			member, err := clientv3.New(clientv3.Config{Endpoints: []string{memberURL}, DialTimeout: 2 * time.Second})
+			require.NoError(t, err)
+			_, err = member.UserGet(ctx, "test-user")
+			assert.NoError(t, err)
+			member.Close()
+		}
+	})
+
+	t.Run("non-root user", func(t *testing.T) {
+		client := serve(t, svr, clientv3.Config{Username: "test-user", Password: "password"})
+
+		_, err := client.Get(ctx, "key")
+		require.NoError(t, err)
+
+		_, err = client.UserAdd(ctx, "other-user", "password")
+		assert.EqualError(t, err, "etcdserver: permission denied")
+
+		_, err = client.RoleList(ctx)
+		assert.EqualError(t, err, "etcdserver: permission denied")
+
+		err = client.ActiveConnection().Invoke(ctx, ReconstituteClockMethod, &emptypb.Empty{}, &wrapperspb.Int64Value{})
+		assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = etcdserver: permission denied")
+
+		err = client.ActiveConnection().Invoke(ctx, DrainMemberMethod, wrapperspb.String(memberURLs[0]), &emptypb.Empty{})
+		assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = etcdserver: permission denied")
+	})
+
+	t.Run("root user", func(t *testing.T) {
+		resp := &wrapperspb.Int64Value{}
+		require.NoError(t, client.ActiveConnection().Invoke(ctx, ReconstituteClockMethod, &emptypb.Empty{}, resp))
+	})
+}
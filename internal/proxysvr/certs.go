@@ -0,0 +1,193 @@
+package proxysvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertKeyPair holds the paths of a PEM-encoded cert and its key.
+type CertKeyPair struct {
+	CertPath, KeyPath string
+}
+
+// ParseCertKeyPairs parses comma-separated pairs of the form cert:key e.g. "a.pem:a-key.pem,b.pem:b-key.pem".
+func ParseCertKeyPairs(str string) ([]CertKeyPair, error) {
+	var pairs []CertKeyPair
+	if str == "" {
+		return pairs, nil
+	}
+	for _, chunk := range strings.Split(str, ",") {
+		cert, key, ok := strings.Cut(chunk, ":")
+		if !ok || cert == "" || key == "" {
+			return nil, fmt.Errorf("invalid cert pair %q, expected cert:key", chunk)
+		}
+		pairs = append(pairs, CertKeyPair{CertPath: cert, KeyPath: key})
+	}
+	return pairs, nil
+}
+
+// certManager serves the server certs, choosing between them by the name clients request with SNI,
+// and the CA pool used to verify client certs.
+// When reloadInterval is set, handshakes reload the certs and CA pool if their files have changed since they were loaded,
+// checking at most once per interval. Connections that have already completed their handshake aren't affected.
+type certManager struct {
+	pairs          []CertKeyPair
+	caPath         string
+	reloadInterval time.Duration
+	check          func(tls.Certificate) error
+
+	// base is cloned by GetConfigForClient to verify each client with the current CA pool
+	base *tls.Config
+
+	mut       sync.Mutex
+	certs     []tls.Certificate
+	cas       *x509.CertPool
+	modTimes  []time.Time
+	lastCheck time.Time
+
+	// config is the clone of base returned by GetConfigForClient, rebuilt only when the CA pool changes
+	// instead of on every handshake
+	config    *tls.Config
+	configCAs *x509.CertPool
+}
+
+// newCertManager loads the certs, which are validated with check (if not nil) whenever they're loaded, and the CA pool if caPath is set.
+// The first pair is served to clients that don't use SNI or request a name that none of the certs match.
+func newCertManager(pairs []CertKeyPair, caPath string, reloadInterval time.Duration, check func(tls.Certificate) error) (*certManager, error) {
+	c := &certManager{pairs: pairs, caPath: caPath, reloadInterval: reloadInterval, check: check}
+	if err := c.loadUnlocked(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs, _ := c.current()
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+func (c *certManager) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	_, cas := c.current()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.config == nil || c.configCAs != cas {
+		config := c.base.Clone()
+		config.ClientCAs = cas
+		config.RootCAs = cas
+		c.config = config
+		c.configCAs = cas
+	}
+	return c.config, nil
+}
+
+// current returns the loaded certs and CA pool after reloading them if needed.
+// Reload failures are logged and the previous certs and CA pool are kept.
+func (c *certManager) current() ([]tls.Certificate, *x509.CertPool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.reloadInterval == 0 || time.Since(c.lastCheck) < c.reloadInterval {
+		return c.certs, c.cas
+	}
+	c.lastCheck = time.Now()
+
+	modTimes, err := c.statUnlocked()
+	if err != nil {
+		certReloadCount.WithLabelValues("failure").Inc()
+		zap.L().Error("failed to check server certs for changes", zap.Error(err))
+		return c.certs, c.cas
+	}
+	if equalTimes(modTimes, c.modTimes) {
+		return c.certs, c.cas
+	}
+	if err := c.loadUnlocked(); err != nil {
+		certReloadCount.WithLabelValues("failure").Inc()
+		zap.L().Error("failed to reload server certs - continuing to serve the previous certs", zap.Error(err))
+		return c.certs, c.cas
+	}
+	certReloadCount.WithLabelValues("success").Inc()
+	zap.L().Info("reloaded server certs")
+	return c.certs, c.cas
+}
+
+func (c *certManager) loadUnlocked() error {
+	// Stat first so changes made while loading are picked up by the next check
+	modTimes, err := c.statUnlocked()
+	if err != nil {
+		return err
+	}
+
+	certs := make([]tls.Certificate, len(c.pairs))
+	for i, pair := range c.pairs {
+		certs[i], err = tls.LoadX509KeyPair(pair.CertPath, pair.KeyPath)
+		if err != nil {
+			return err
+		}
+		if c.check != nil {
+			if err := c.check(certs[i]); err != nil {
+				return fmt.Errorf("cert %s: %w", pair.CertPath, err)
+			}
+		}
+	}
+
+	var cas *x509.CertPool
+	if c.caPath != "" {
+		cas = x509.NewCertPool()
+		caPem, err := os.ReadFile(c.caPath)
+		if err != nil {
+			return err
+		}
+		if !cas.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("invalid ca pem")
+		}
+	}
+
+	c.certs = certs
+	c.cas = cas
+	c.modTimes = modTimes
+	return nil
+}
+
+func (c *certManager) statUnlocked() ([]time.Time, error) {
+	var times []time.Time
+	for _, pair := range c.pairs {
+		for _, path := range []string{pair.CertPath, pair.KeyPath} {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			times = append(times, info.ModTime())
+		}
+	}
+	if c.caPath != "" {
+		info, err := os.Stat(c.caPath)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, info.ModTime())
+	}
+	return times, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package proxysvr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/Azure/metaetcd/internal/testutil"
+)
+
+func TestGRPCServerSNI(t *testing.T) {
+	pki := testutil.NewPKI(t)
+	alphaCert, alphaKey := pki.IssueCert(t, "alpha", "alpha.example.com")
+	betaCert, betaKey := pki.IssueCert(t, "beta", "beta.example.com")
+	addr := serveGRPC(t, GRPCServerConfig{
+		CertPath:   pki.ServerCertPath,
+		KeyPath:    pki.ServerKeyPath,
+		ClientAuth: "none",
+		SNICerts:   []CertKeyPair{{CertPath: alphaCert, KeyPath: alphaKey}, {CertPath: betaCert, KeyPath: betaKey}},
+	})
+
+	for _, name := range []string{"alpha.example.com", "beta.example.com", "localhost"} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, []string{name}, servedCert(t, addr, &tls.Config{RootCAs: pki.CAs, ServerName: name}).DNSNames)
+		})
+	}
+
+	t.Run("unknown name", func(t *testing.T) {
+		assert.Equal(t, []string{"localhost"}, servedCert(t, addr, &tls.Config{RootCAs: pki.CAs, ServerName: "gamma.example.com", InsecureSkipVerify: true}).DNSNames)
+	})
+}
+
+func TestGRPCServerCertReload(t *testing.T) {
+	pki := testutil.NewPKI(t)
+	other := testutil.NewPKI(t)
+	addr := serveGRPC(t, GRPCServerConfig{CAPath: pki.CAPath, CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, CertReloadInterval: time.Millisecond})
+	config := &tls.Config{RootCAs: pki.CAs, ServerName: "localhost", Certificates: []tls.Certificate{pki.ClientCert}}
+
+	t.Run("cert", func(t *testing.T) {
+		before := servedCert(t, addr, config).SerialNumber
+		pki.IssueCert(t, "server", "localhost") // overwrites the server's cert and key
+		bumpModTime(t, pki.ServerCertPath, pki.ServerKeyPath)
+
+		require.Eventually(t, func() bool {
+			return servedCert(t, addr, config).SerialNumber.Cmp(before) != 0
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("ca", func(t *testing.T) {
+		otherClient := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pki.CAs, ServerName: "localhost", Certificates: []tls.Certificate{other.ClientCert}}))
+		assert.False(t, canConnect(t, addr, otherClient))
+
+		ca, err := os.ReadFile(other.CAPath)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(pki.CAPath, ca, 0600))
+		bumpModTime(t, pki.CAPath)
+		require.Eventually(t, func() bool { return canConnect(t, addr, otherClient) }, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("invalid files are ignored", func(t *testing.T) {
+		before := servedCert(t, addr, config).SerialNumber
+		require.NoError(t, os.WriteFile(pki.ServerCertPath, []byte("not a cert"), 0600))
+		bumpModTime(t, pki.ServerCertPath)
+
+		assert.Never(t, func() bool {
+			return servedCert(t, addr, config).SerialNumber.Cmp(before) != 0
+		}, time.Millisecond*100, time.Millisecond*10)
+	})
+}
+
+func TestCertManagerConfigCache(t *testing.T) {
+	pki := testutil.NewPKI(t)
+	other := testutil.NewPKI(t)
+	certs, err := newCertManager([]CertKeyPair{{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath}}, pki.CAPath, time.Millisecond, nil)
+	require.NoError(t, err)
+	certs.base = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+
+	first, err := certs.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 2)
+	second, err := certs.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Same(t, first, second, "config is reused while the ca pool is unchanged")
+
+	ca, err := os.ReadFile(other.CAPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pki.CAPath, ca, 0600))
+	bumpModTime(t, pki.CAPath)
+	time.Sleep(time.Millisecond * 2)
+
+	third, err := certs.GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.NotSame(t, first, third, "config is rebuilt when the ca pool is reloaded")
+	assert.Equal(t, tls.RequireAndVerifyClientCert, third.ClientAuth)
+}
+
+func TestParseCertKeyPairs(t *testing.T) {
+	pairs, err := ParseCertKeyPairs("a.pem:a-key.pem,b.pem:b-key.pem")
+	require.NoError(t, err)
+	assert.Equal(t, []CertKeyPair{{CertPath: "a.pem", KeyPath: "a-key.pem"}, {CertPath: "b.pem", KeyPath: "b-key.pem"}}, pairs)
+
+	pairs, err = ParseCertKeyPairs("")
+	require.NoError(t, err)
+	assert.Empty(t, pairs)
+
+	for _, str := range []string{"a.pem", "a.pem:", ":a-key.pem"} {
+		_, err := ParseCertKeyPairs(str)
+		assert.Error(t, err, str)
+	}
+}
+
+// servedCert returns the cert the server presents during a handshake.
+func servedCert(t testing.TB, addr string, config *tls.Config) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+// bumpModTime moves the files' modification times forward, so rewrites are detected regardless of the filesystem's precision.
+func bumpModTime(t testing.TB, paths ...string) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		modTime := info.ModTime().Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+}
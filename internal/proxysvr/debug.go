@@ -0,0 +1,65 @@
+package proxysvr
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/Azure/metaetcd/internal/membership"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+// KeyMemberPath is where KeyMemberHandler is conventionally served.
+const KeyMemberPath = "/debug/key-member"
+
+// WatchMuxPath is where WatchMuxHandler is conventionally served.
+const WatchMuxPath = "/debug/watch-mux"
+
+// KeyMember is the response body of KeyMemberHandler.
+type KeyMember struct {
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint"`
+}
+
+// KeyMemberHandler reports the endpoint of the member that owns the key given by the "key" query parameter,
+// without reading it. Useful when debugging sharding.
+func KeyMemberHandler(members *membership.Pool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !r.URL.Query().Has("key") {
+			http.Error(w, "the key query parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		client := members.GetMemberForKey(key)
+		if client == nil {
+			http.Error(w, "no member owns the key", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&KeyMember{Key: key, Endpoint: client.Endpoint}); err != nil {
+			zap.L().Warn("error writing key member response", zap.Error(err))
+		}
+	})
+}
+
+// WatchMuxHandler reports the watch.MuxState of the mux as JSON. Useful when watch events appear to be stuck.
+func WatchMuxHandler(mux *watch.Mux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(mux.State()); err != nil {
+			zap.L().Warn("error writing watch mux response", zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package proxysvr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+func TestKeyMemberHandler(t *testing.T) {
+	_, s := startServer(t)
+	svr := httptest.NewServer(KeyMemberHandler(s.members))
+	defer svr.Close()
+
+	endpoints := map[string]struct{}{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("/registry/key-%d", i)
+		resp, err := http.Get(svr.URL + "?key=" + url.QueryEscape(key))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body := &KeyMember{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(body))
+		resp.Body.Close()
+		assert.Equal(t, key, body.Key)
+		assert.Equal(t, s.members.GetMemberForKey(key).Endpoint, body.Endpoint)
+		endpoints[body.Endpoint] = struct{}{}
+	}
+	assert.Len(t, endpoints, 2, "keys should be spread across both members")
+
+	t.Run("missing key", func(t *testing.T) {
+		resp, err := http.Get(svr.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestWatchMuxHandler(t *testing.T) {
+	client, s := startServer(t)
+	svr := httptest.NewServer(WatchMuxHandler(s.members.WatchMux))
+	defer svr.Close()
+
+	getState := func() *watch.MuxState {
+		resp, err := http.Get(svr.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		state := &watch.MuxState{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(state))
+		return state
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+	client.Watch(watchCtx, "key-1")
+	require.Eventually(t, func() bool { return len(getState().Watches) == 2 }, time.Second*5, time.Millisecond*10)
+
+	resp, err := client.Txn(ctx).Then(clientv3.OpPut("key-1", "value")).Commit()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for _, w := range getState().Watches {
+			if w.DeliveredRevision != resp.Header.Revision {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*10)
+
+	state := getState()
+	require.Len(t, state.Members, 2)
+	for _, member := range state.Members {
+		assert.Empty(t, member.Err)
+	}
+	assert.Equal(t, 3, state.Members[0].Watches+state.Members[1].Watches, "the prefix watch relies on both members, and the single key watch on one")
+	keys := []string{state.Watches[0].Key, state.Watches[1].Key}
+	assert.ElementsMatch(t, []string{"key-", "key-1"}, keys)
+}
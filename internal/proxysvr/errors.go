@@ -0,0 +1,90 @@
+package proxysvr
+
+import (
+	"context"
+	"errors"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errCoordinatorUnavailable is returned by writes while the coordinator cluster is failing health checks.
+var errCoordinatorUnavailable = status.Error(codes.Unavailable, "metaetcd: coordinator is unavailable")
+
+// errCoordinatorReadOnly is returned by writes while the coordinator cluster has no leader. Followers can still serve
+// the clock's current revision, so reads keep working, but no revision can be allocated for writes.
+var errCoordinatorReadOnly = status.Error(codes.Unavailable, "metaetcd: coordinator has no leader, so writes are rejected until it elects one (reads are still served)")
+
+// errMemberUnavailable is returned by requests for keys that belong to a member cluster that is failing health checks.
+var errMemberUnavailable = status.Error(codes.Unavailable, "metaetcd: member is unavailable")
+
+// errNoMemberForKey is returned by requests for keys that no member cluster owns, e.g. before the member for their
+// key range has been added.
+var errNoMemberForKey = status.Error(codes.Unavailable, "metaetcd: no member owns the key")
+
+// errMemberDraining is returned by writes to a member cluster that is being drained for maintenance.
+var errMemberDraining = status.Error(codes.Unavailable, "metaetcd: member is draining for maintenance and not accepting writes")
+
+// errBulkPutSpansMembers is returned by bulk puts of keys that don't belong to the same member.
+var errBulkPutSpansMembers = errors.New("bulk puts can only involve keys that belong to the same member")
+
+// errIgnoreValueConflict is returned by transactions with ignore-value puts when the key is written concurrently.
+// None of the transaction's ops are applied, so it can be retried.
+var errIgnoreValueConflict = status.Error(codes.Aborted, "metaetcd: key was modified during an ignore value put")
+
+// errFreshestReadRevision is returned by freshest reads that specify a revision, since they always read the latest one.
+var errFreshestReadRevision = status.Error(codes.InvalidArgument, "metaetcd: freshest reads can't specify a revision")
+
+// errWatchSendTimeout closes watch streams whose client didn't receive a response within ServerConfig.WatchSendTimeout.
+var errWatchSendTimeout = status.Error(codes.DeadlineExceeded, "metaetcd: watch client stopped receiving responses")
+
+// isNoLeader returns true if err means that a cluster can't apply writes because it has no leader.
+// Errors caused by a leader change that's already in progress (e.g. ErrLeaderChanged) don't count,
+// since a new leader is usually elected before the next write.
+func isNoLeader(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if rpctypes.Error(err) == rpctypes.ErrNoLeader {
+			return true
+		}
+	}
+	return false
+}
+
+// toGRPCError returns the canonical etcd gRPC error for errors returned by member or coordinator clusters.
+// Etcd clients map errors by their exact code and description, so context added by wrapping is dropped.
+// Errors that don't originate from etcd are returned unchanged.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if ee, ok := rpctypes.Error(e).(rpctypes.EtcdError); ok {
+			if e != err {
+				zap.L().Info("translated wrapped etcd error", zap.String("code", ee.Code().String()), zap.Error(err))
+			}
+			return status.Error(ee.Code(), ee.Error())
+		}
+		if s, ok := status.FromError(e); ok && s.Code() != codes.Unknown {
+			return s.Err()
+		}
+		switch e {
+		case context.Canceled:
+			return status.Error(codes.Canceled, e.Error())
+		case context.DeadlineExceeded:
+			return status.Error(codes.DeadlineExceeded, e.Error())
+		}
+	}
+	return err
+}
+
+func translateUnaryErrors(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, toGRPCError(err)
+}
+
+func translateStreamErrors(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return toGRPCError(handler(srv, ss))
+}
@@ -0,0 +1,60 @@
+package proxysvr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToGRPCError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{name: "nil"},
+		{
+			name:     "wrapped grpc error from member",
+			err:      fmt.Errorf("ranging at member rev 2: %w", rpctypes.ErrGRPCCompacted),
+			expected: rpctypes.ErrGRPCCompacted,
+		},
+		{
+			name:     "wrapped clientv3 error from member",
+			err:      fmt.Errorf("getting clock: %w", rpctypes.ErrFutureRev),
+			expected: rpctypes.ErrGRPCFutureRev,
+		},
+		{
+			name:     "lease not found",
+			err:      fmt.Errorf("revoking lease: %w", rpctypes.ErrGRPCLeaseNotFound),
+			expected: rpctypes.ErrGRPCLeaseNotFound,
+		},
+		{
+			name:     "non-etcd grpc error",
+			err:      fmt.Errorf("dialing: %w", status.Error(codes.Unavailable, "connection refused")),
+			expected: status.Error(codes.Unavailable, "connection refused"),
+		},
+		{
+			name:     "context canceled",
+			err:      fmt.Errorf("ticking clock: %w", context.Canceled),
+			expected: status.Error(codes.Canceled, context.Canceled.Error()),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := toGRPCError(tc.err)
+			assert.Equal(t, status.Code(tc.expected), status.Code(actual))
+			assert.Equal(t, rpctypes.ErrorDesc(tc.expected), rpctypes.ErrorDesc(actual))
+		})
+	}
+
+	t.Run("unknown error", func(t *testing.T) {
+		err := errors.New("something went wrong")
+		assert.Equal(t, err, toGRPCError(err))
+	})
+}
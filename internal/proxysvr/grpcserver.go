@@ -0,0 +1,299 @@
+package proxysvr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	grpcmiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // responses are compressed when clients request gzip
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// GRPCServerConfig configures the gRPC server used to serve proxy clients.
+type GRPCServerConfig struct {
+	// CAPath is used to verify client certs. Only required when ClientAuth verifies them.
+	CAPath string
+
+	// CertPath and KeyPath are presented to clients. Required unless Insecure is set.
+	CertPath, KeyPath string
+
+	// Insecure serves clients over plaintext. Can't be combined with CertPath.
+	Insecure bool
+
+	// SNICerts are presented instead of CertPath to clients that request one of their names with SNI.
+	SNICerts []CertKeyPair
+
+	// CertReloadInterval is how often new connections check the cert, key, and CA files for changes and reload them.
+	// Existing connections keep the certs they were established with. Disabled if 0.
+	CertReloadInterval time.Duration
+
+	// ClientAuth is one of "none", "request", "require", "verify-if-given", or "require-and-verify" (the default).
+	ClientAuth string
+
+	// TLSMinVersion is the oldest TLS version accepted from clients: "1.0", "1.1", "1.2" (the default), or "1.3".
+	TLSMinVersion string
+
+	// TLSCipherSuites limits TLS 1.2 and older connections to these cipher suites, by their IANA names
+	// (e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"). Go's defaults are used if empty.
+	// TLS 1.3 cipher suites aren't configurable, so these can't be set when TLSMinVersion is "1.3".
+	TLSCipherSuites []string
+
+	KeepaliveMaxIdle  time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// KeepaliveMaxAge closes connections after roughly this long, so clients rebalance across proxies.
+	// gRPC adds +/-10% jitter to avoid reconnect storms. Disabled if 0.
+	KeepaliveMaxAge time.Duration
+
+	// KeepaliveMaxAgeGrace is how long in-flight RPCs have to complete after KeepaliveMaxAge. Unlimited if 0.
+	KeepaliveMaxAgeGrace time.Duration
+
+	// KeepaliveMinTime is the minimum interval between client pings. Clients that ping more often are sent
+	// GOAWAY and disconnected. Defaults to 5 minutes (gRPC's default) if 0.
+	KeepaliveMinTime time.Duration
+
+	// KeepalivePermitWithoutStream allows clients to ping when they have no active streams.
+	// Otherwise, those pings count as too frequent.
+	KeepalivePermitWithoutStream bool
+
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+
+	// EnableReflection registers the gRPC reflection service for debugging with tools like grpcurl.
+	EnableReflection bool
+
+	// Health is registered as the gRPC health service when set.
+	Health healthpb.HealthServer
+
+	// RateLimit applies to every request, across all clients. Streams count as one request when opened.
+	RateLimit RateLimit
+
+	// MethodRateLimits apply to individual methods by their full name (e.g. "/etcdserverpb.KV/Range"),
+	// in addition to RateLimit.
+	MethodRateLimits map[string]RateLimit
+}
+
+func NewGRPCServer(config GRPCServerConfig) (*grpc.Server, error) {
+	unary := []grpc.UnaryServerInterceptor{observeUnary, translateUnaryErrors}
+	stream := []grpc.StreamServerInterceptor{observeStream, translateStreamErrors}
+	if limiter := newRateLimiter(config.RateLimit, config.MethodRateLimits); limiter.enabled() {
+		// Rejections are observed, but they happen before any other work
+		unary = append(unary, limiter.unary)
+		stream = append(stream, limiter.stream)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle:     config.KeepaliveMaxIdle,
+			Time:                  config.KeepaliveInterval,
+			Timeout:               config.KeepaliveTimeout,
+			MaxConnectionAge:      config.KeepaliveMaxAge,
+			MaxConnectionAgeGrace: config.KeepaliveMaxAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             config.KeepaliveMinTime,
+			PermitWithoutStream: config.KeepalivePermitWithoutStream,
+		}),
+		// Size limits apply to the decompressed message, so they don't change when clients use compression.
+		grpc.MaxRecvMsgSize(math.MaxInt32),
+		grpc.MaxSendMsgSize(math.MaxInt32),
+		grpc.UnaryInterceptor(grpcmiddleware.ChainUnaryServer(append(unary, config.UnaryInterceptors...)...)),
+		grpc.StreamInterceptor(grpcmiddleware.ChainStreamServer(append(stream, config.StreamInterceptors...)...)),
+	}
+
+	switch {
+	case config.Insecure && config.CertPath != "":
+		return nil, fmt.Errorf("a server cert can't be used when insecure is set")
+	case !config.Insecure && config.CertPath == "":
+		return nil, fmt.Errorf("a server cert is required unless insecure is set")
+	case !config.Insecure:
+		tlsc, err := newServerTLSConfig(&config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsc)))
+	}
+
+	svr := grpc.NewServer(opts...)
+	if config.EnableReflection {
+		reflection.Register(svr)
+	}
+	if config.Health != nil {
+		healthpb.RegisterHealthServer(svr, config.Health)
+	}
+	return svr, nil
+}
+
+func newServerTLSConfig(config *GRPCServerConfig) (*tls.Config, error) {
+	clientAuth := tls.RequireAndVerifyClientCert
+	if config.ClientAuth != "" {
+		var ok bool
+		clientAuth, ok = clientAuthTypes[config.ClientAuth]
+		if !ok {
+			return nil, fmt.Errorf("unknown client auth type %q", config.ClientAuth)
+		}
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if config.TLSMinVersion != "" {
+		var ok bool
+		minVersion, ok = tlsVersions[config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", config.TLSMinVersion)
+		}
+	}
+	suites, err := parseCipherSuites(config.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if len(suites) > 0 && minVersion >= tls.VersionTLS13 {
+		return nil, fmt.Errorf("cipher suites can't be configured for tls 1.3")
+	}
+
+	if config.CAPath == "" && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("a ca cert is required to verify client certs")
+	}
+
+	pairs := append([]CertKeyPair{{CertPath: config.CertPath, KeyPath: config.KeyPath}}, config.SNICerts...)
+	certs, err := newCertManager(pairs, config.CAPath, config.CertReloadInterval, func(cert tls.Certificate) error {
+		return checkCertSupportsTLS(cert, minVersion, suites)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tlsc := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     clientAuth,
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+	}
+	if config.CAPath == "" {
+		return tlsc, nil
+	}
+
+	// The CA pool can't be swapped on a shared config, so each handshake gets a copy with the current pool
+	_, tlsc.ClientCAs = certs.current()
+	tlsc.RootCAs = tlsc.ClientCAs
+	certs.base = tlsc.Clone()
+	tlsc.GetConfigForClient = certs.GetConfigForClient
+	return tlsc, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites returns the IDs of the named cipher suites. Insecure suites aren't allowed.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// checkCertSupportsTLS returns an error if clients couldn't negotiate any of the TLS versions and cipher suites with the cert,
+// which would otherwise only surface as handshake failures.
+func checkCertSupportsTLS(cert tls.Certificate, minVersion uint16, suites []uint16) error {
+	var ecdsaKey bool
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+	case ed25519.PrivateKey:
+		ecdsaKey = true // signs with the ECDSA cipher suites
+	case *ecdsa.PrivateKey:
+		ecdsaKey = true
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			if minVersion >= tls.VersionTLS13 {
+				return fmt.Errorf("the server cert's curve %s isn't supported by tls 1.3", key.Curve.Params().Name)
+			}
+		}
+	default:
+		return fmt.Errorf("the server cert's key type %T isn't supported", key)
+	}
+	if len(suites) == 0 {
+		return nil
+	}
+
+	for _, suite := range tls.CipherSuites() {
+		if !contains(suites, suite.ID) {
+			continue
+		}
+		if strings.Contains(suite.Name, "_ECDSA_") == ecdsaKey {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the configured cipher suites can be used with the server cert's key")
+}
+
+func contains(ids []uint16, id uint16) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// observeUnary records the latency of every unary request and writes an access log.
+func observeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRequest(info.FullMethod, start, err)
+	return resp, err
+}
+
+// observeStream records the lifetime of every stream and writes an access log when it closes.
+func observeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRequest(info.FullMethod, start, err)
+	return err
+}
+
+func observeRequest(method string, start time.Time, err error) {
+	latency := time.Since(start)
+	code := status.Code(err)
+	requestDuration.WithLabelValues(method, code.String()).Observe(latency.Seconds())
+	if err != nil {
+		zap.L().Warn("request failed", zap.String("method", method), zap.String("code", code.String()), zap.Duration("latency", latency), zap.Error(err))
+		return
+	}
+	zap.L().Debug("request completed", zap.String("method", method), zap.Duration("latency", latency))
+}
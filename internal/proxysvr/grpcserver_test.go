@@ -0,0 +1,260 @@
+package proxysvr
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+
+	"github.com/Azure/metaetcd/internal/testutil"
+)
+
+func TestGRPCServerTLSModes(t *testing.T) {
+	pki := testutil.NewPKI(t)
+	serverOnly := credentials.NewTLS(&tls.Config{RootCAs: pki.CAs, ServerName: "localhost"})
+	mutual := credentials.NewTLS(&tls.Config{RootCAs: pki.CAs, ServerName: "localhost", Certificates: []tls.Certificate{pki.ClientCert}})
+
+	t.Run("plaintext", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{Insecure: true})
+		assert.True(t, canConnect(t, addr, grpc.WithInsecure()))
+		assert.False(t, canConnect(t, addr, grpc.WithTransportCredentials(serverOnly)))
+	})
+
+	t.Run("server-only tls", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, ClientAuth: "none"})
+		assert.True(t, canConnect(t, addr, grpc.WithTransportCredentials(serverOnly)))
+		assert.False(t, canConnect(t, addr, grpc.WithInsecure()))
+	})
+
+	t.Run("mutual tls", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{CAPath: pki.CAPath, CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath})
+		assert.True(t, canConnect(t, addr, grpc.WithTransportCredentials(mutual)))
+		assert.False(t, canConnect(t, addr, grpc.WithTransportCredentials(serverOnly)))
+	})
+
+	t.Run("mutual tls without ca", func(t *testing.T) {
+		_, err := NewGRPCServer(GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath})
+		assert.EqualError(t, err, "a ca cert is required to verify client certs")
+	})
+
+	t.Run("no cert without insecure", func(t *testing.T) {
+		_, err := NewGRPCServer(GRPCServerConfig{})
+		assert.EqualError(t, err, "a server cert is required unless insecure is set")
+	})
+
+	t.Run("cert with insecure", func(t *testing.T) {
+		_, err := NewGRPCServer(GRPCServerConfig{Insecure: true, CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath})
+		assert.EqualError(t, err, "a server cert can't be used when insecure is set")
+	})
+}
+
+func TestGRPCServerTLSVersion(t *testing.T) {
+	pki := testutil.NewPKI(t)
+	client := func(min, max uint16) grpc.DialOption {
+		return grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pki.CAs, ServerName: "localhost", MinVersion: min, MaxVersion: max}))
+	}
+
+	t.Run("tls 1.3 only", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, ClientAuth: "none", TLSMinVersion: "1.3"})
+		assert.True(t, canConnect(t, addr, client(tls.VersionTLS13, tls.VersionTLS13)))
+		assert.False(t, canConnect(t, addr, client(tls.VersionTLS12, tls.VersionTLS12)))
+		assert.False(t, canConnect(t, addr, client(tls.VersionTLS11, tls.VersionTLS11)))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, ClientAuth: "none"})
+		assert.True(t, canConnect(t, addr, client(tls.VersionTLS12, tls.VersionTLS12)))
+		assert.False(t, canConnect(t, addr, client(tls.VersionTLS11, tls.VersionTLS11)))
+	})
+
+	t.Run("cipher suites", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, ClientAuth: "none", TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}})
+		suite := func(id uint16) grpc.DialOption {
+			return grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pki.CAs, ServerName: "localhost", MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{id}}))
+		}
+		assert.True(t, canConnect(t, addr, suite(tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)))
+		assert.False(t, canConnect(t, addr, suite(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			version string
+			suites  []string
+			err     string
+		}{
+			"unknown version":                     {version: "1.4", err: `unknown tls version "1.4"`},
+			"unknown suite":                       {suites: []string{"TLS_RSA_WITH_RC4_128_SHA"}, err: `unknown or insecure cipher suite "TLS_RSA_WITH_RC4_128_SHA"`},
+			"suites with tls 1.3":                 {version: "1.3", suites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}, err: "cipher suites can't be configured for tls 1.3"},
+			"suites unusable with the cert's key": {suites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, err: "none of the configured cipher suites can be used with the server cert's key"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := NewGRPCServer(GRPCServerConfig{CertPath: pki.ServerCertPath, KeyPath: pki.ServerKeyPath, ClientAuth: "none", TLSMinVersion: tc.version, TLSCipherSuites: tc.suites})
+				assert.ErrorContains(t, err, tc.err)
+			})
+		}
+	})
+}
+
+func TestGRPCServerRequestDuration(t *testing.T) {
+	addr := serveGRPC(t, GRPCServerConfig{Insecure: true})
+	observer := requestDuration.WithLabelValues("/etcdserverpb.KV/Range", "Unimplemented")
+	before := testutil.GetHistogramCount(t, observer)
+
+	assert.True(t, canConnect(t, addr, grpc.WithInsecure()))
+	assert.Equal(t, before+1, testutil.GetHistogramCount(t, observer))
+}
+
+func TestGRPCServerReflection(t *testing.T) {
+	listServices := func(addr string) ([]string, error) {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		require.NoError(t, err)
+		err = stream.Send(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}})
+		require.NoError(t, err)
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		names := []string{}
+		for _, svc := range resp.GetListServicesResponse().Service {
+			names = append(names, svc.Name)
+		}
+		return names, nil
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		names, err := listServices(serveGRPC(t, GRPCServerConfig{Insecure: true, EnableReflection: true}))
+		require.NoError(t, err)
+		assert.Contains(t, names, "etcdserverpb.KV")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, err := listServices(serveGRPC(t, GRPCServerConfig{Insecure: true}))
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestGRPCServerKeepaliveEnforcement(t *testing.T) {
+	t.Run("pings too often", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{Insecure: true, KeepaliveMinTime: time.Second, KeepalivePermitWithoutStream: true})
+		goAway, acks := pingGRPC(t, addr, 5, time.Millisecond*10)
+		require.NotNil(t, goAway)
+		assert.Equal(t, http2.ErrCodeEnhanceYourCalm, goAway.ErrCode)
+		assert.Less(t, acks, 5)
+	})
+
+	t.Run("compliant", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{Insecure: true, KeepaliveMinTime: time.Millisecond * 50, KeepalivePermitWithoutStream: true})
+		goAway, acks := pingGRPC(t, addr, 5, time.Millisecond*100)
+		assert.Nil(t, goAway)
+		assert.Equal(t, 5, acks)
+	})
+
+	t.Run("without stream", func(t *testing.T) {
+		addr := serveGRPC(t, GRPCServerConfig{Insecure: true, KeepaliveMinTime: time.Millisecond * 50})
+		goAway, _ := pingGRPC(t, addr, 5, time.Millisecond*100)
+		require.NotNil(t, goAway, "pings without streams aren't permitted")
+		assert.Equal(t, http2.ErrCodeEnhanceYourCalm, goAway.ErrCode)
+	})
+}
+
+// pingGRPC sends n HTTP/2 pings to the server at the given interval without opening any streams,
+// since gRPC clients don't allow pinging more often than every 10 seconds.
+// It returns the GOAWAY frame sent by the server, if any, and the number of pings that were acknowledged.
+func pingGRPC(t testing.TB, addr string, n int, interval time.Duration) (*http2.GoAwayFrame, int) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var mut sync.Mutex // serializes writes
+	_, err = conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, err)
+	framer := http2.NewFramer(conn, conn)
+	require.NoError(t, framer.WriteSettings())
+
+	var goAway *http2.GoAwayFrame
+	var acks int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			mut.Lock()
+			switch f := frame.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					framer.WriteSettingsAck()
+				}
+			case *http2.PingFrame:
+				if f.IsAck() {
+					acks++
+				}
+			case *http2.GoAwayFrame:
+				goAway = f
+			}
+			mut.Unlock()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		mut.Lock()
+		err := framer.WritePing(false, [8]byte{byte(i)})
+		mut.Unlock()
+		if err != nil {
+			break // the server closed the connection
+		}
+		time.Sleep(interval)
+	}
+
+	// Give the server time to respond to the last ping
+	time.Sleep(interval)
+	conn.Close()
+	<-done
+	return goAway, acks
+}
+
+func serveGRPC(t testing.TB, config GRPCServerConfig) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	grpcServer, err := NewGRPCServer(config)
+	require.NoError(t, err)
+	etcdserverpb.RegisterKVServer(grpcServer, &etcdserverpb.UnimplementedKVServer{})
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	return lis.Addr().String()
+}
+
+// canConnect returns true when an RPC reaches the server. The server doesn't implement the RPC.
+func canConnect(t testing.TB, addr string, opts ...grpc.DialOption) bool {
+	conn, err := grpc.Dial(addr, opts...)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = etcdserverpb.NewKVClient(conn).Range(ctx, &etcdserverpb.RangeRequest{})
+	return status.Code(err) == codes.Unimplemented
+}
@@ -0,0 +1,148 @@
+package proxysvr
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// HealthServer implements the gRPC health checking protocol.
+// It reports NOT_SERVING until the first round of health checks completes.
+func (s *server) HealthServer() healthpb.HealthServer { return s.health }
+
+// RunHealthChecks probes the coordinator and every member each HealthCheckInterval until the context is done.
+// Member alarms are refreshed at the same time, for writes to check.
+// Requests for keys that belong to a member that failed HealthCheckFailureThreshold consecutive probes fail fast
+// instead of waiting for it to time out.
+func (s *server) RunHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(s.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) checkHealth(ctx context.Context) {
+	probe := func(ctx context.Context, cs *membership.ClientSet) *etcdserverpb.StatusResponse {
+		ctx, cancel := context.WithTimeout(ctx, s.config.HealthCheckTimeout)
+		defer cancel()
+
+		resp, err := cs.Maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+		if err != nil && cs.Healthy() {
+			zap.L().Warn("cluster failed health check", zap.String("endpoint", cs.Endpoint), zap.Error(err))
+		}
+		if err == nil && !cs.Healthy() {
+			zap.L().Warn("cluster passed health check after previously failing", zap.String("endpoint", cs.Endpoint))
+		}
+		cs.SetHealthy(err == nil)
+		return resp
+	}
+	if status := probe(ctx, s.coordinator.ClientSet); status != nil {
+		// Members without a leader still answer, but the coordinator can't tick the clock until one is elected
+		s.setCoordinatorReadOnly(status.Leader == 0)
+	}
+	if s.coordinator.Healthy() {
+		coordinatorHealthy.Set(1)
+	} else {
+		coordinatorHealthy.Set(0)
+	}
+	s.members.IterateMembers(ctx, func(ctx context.Context, cs *membership.ClientSet) error {
+		probe(ctx, cs)
+		if cs.Healthy() {
+			memberHealthy.WithLabelValues(cs.Endpoint).Set(1)
+			s.refreshAlarms(ctx, cs)
+		} else {
+			memberHealthy.WithLabelValues(cs.Endpoint).Set(0)
+		}
+		return nil
+	})
+	s.updateHealth()
+}
+
+// coordinatorReadOnly returns true while the coordinator is known to have no leader, see errCoordinatorReadOnly.
+func (s *server) coordinatorReadOnly() bool {
+	return atomic.LoadInt32(&s.coordReadOnly) == 1
+}
+
+func (s *server) setCoordinatorReadOnly(readOnly bool) {
+	var val int32
+	if readOnly {
+		val = 1
+	}
+	if prev := atomic.SwapInt32(&s.coordReadOnly, val); prev != val {
+		if readOnly {
+			zap.L().Warn("coordinator has no leader - rejecting writes until it elects one")
+		} else {
+			zap.L().Info("coordinator has a leader again - accepting writes")
+		}
+	}
+	coordinatorReadOnly.Set(float64(val))
+}
+
+// refreshAlarms updates the alarms that writes check, so writes to a member that is out of space fail immediately.
+func (s *server) refreshAlarms(ctx context.Context, cs *membership.ClientSet) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.HealthCheckTimeout)
+	defer cancel()
+
+	noSpace := cs.HasAlarm(etcdserverpb.AlarmType_NOSPACE)
+	if err := cs.RefreshAlarms(ctx); err != nil {
+		zap.L().Warn("failed to refresh alarms", zap.String("endpoint", cs.Endpoint), zap.Error(err))
+		return
+	}
+	if !noSpace && cs.HasAlarm(etcdserverpb.AlarmType_NOSPACE) {
+		zap.L().Warn("member raised NOSPACE alarm, rejecting writes", zap.String("endpoint", cs.Endpoint))
+	}
+	if noSpace && !cs.HasAlarm(etcdserverpb.AlarmType_NOSPACE) {
+		zap.L().Warn("member cleared NOSPACE alarm, accepting writes", zap.String("endpoint", cs.Endpoint))
+	}
+}
+
+// checkMemberHealth returns errMemberUnavailable if the member failed HealthCheckFailureThreshold consecutive health checks,
+// so a single dropped probe doesn't fail every request for its keys until the next one.
+func (s *server) checkMemberHealth(cs *membership.ClientSet) error {
+	if n := cs.HealthCheckFailures(); n >= s.config.HealthCheckFailureThreshold {
+		return fmt.Errorf("member %s failed its last %d health checks: %w", cs.Endpoint, n, errMemberUnavailable)
+	}
+	return nil
+}
+
+// updateHealth reports SERVING only when the coordinator and at least MinHealthyMembers members are healthy.
+func (s *server) updateHealth() {
+	members := s.members.Members()
+	minHealthy := s.config.MinHealthyMembers
+	if minHealthy <= 0 {
+		minHealthy = len(members)/2 + 1
+	}
+
+	var healthy int
+	for _, cs := range members {
+		if cs.Healthy() {
+			healthy++
+		}
+	}
+
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if s.coordinator.Healthy() && healthy >= minHealthy {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	s.health.SetServingStatus("", status)
+}
+
+func newHealthServer() *health.Server {
+	h := health.NewServer()
+	h.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
@@ -0,0 +1,332 @@
+package proxysvr
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/Azure/metaetcd/internal/membership"
+	"github.com/Azure/metaetcd/internal/testutil"
+)
+
+func TestHealth(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{MinHealthyMembers: 2})
+	hc := healthpb.NewHealthClient(client.ActiveConnection())
+
+	getStatus := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := hc.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		return resp.Status
+	}
+
+	t.Run("before checks", func(t *testing.T) {
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, getStatus())
+	})
+
+	t.Run("all healthy", func(t *testing.T) {
+		s.checkHealth(ctx)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, getStatus())
+	})
+
+	t.Run("member below threshold", func(t *testing.T) {
+		s.members.Members()[0].SetHealthy(false)
+		s.updateHealth()
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, getStatus())
+	})
+
+	t.Run("member recovered", func(t *testing.T) {
+		s.checkHealth(ctx)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, getStatus())
+	})
+
+	t.Run("coordinator unhealthy", func(t *testing.T) {
+		s.coordinator.SetHealthy(false)
+		s.updateHealth()
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, getStatus())
+	})
+}
+
+func TestMemberHealthPoller(t *testing.T) {
+	const interval = time.Millisecond * 100
+	memberURL, stop := testutil.StartStoppableEtcd(t)
+	svr := newServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), memberURL}, ServerConfig{
+		HealthCheckInterval: interval,
+		HealthCheckTimeout:  interval,
+	})
+	client := serve(t, svr, clientv3.Config{})
+	s := svr.(*server)
+
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.RunHealthChecks(pollCtx)
+
+	// Find a key that belongs to the member that will be killed
+	dead := s.members.Members()[1]
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("key-%d", i); s.members.GetMemberForKey(k) == dead {
+			key = k
+		}
+	}
+	_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(memberHealthy.WithLabelValues(dead.Endpoint)) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	stop()
+	start := time.Now()
+	require.Eventually(t, func() bool {
+		return !dead.Healthy() && promtestutil.ToFloat64(memberHealthy.WithLabelValues(dead.Endpoint)) == 0
+	}, time.Second*5, time.Millisecond*10)
+	assert.Less(t, time.Since(start), interval*3, "marked unhealthy within an interval of the probe that failed")
+
+	t.Run("single failure", func(t *testing.T) {
+		flaky := &membership.ClientSet{Endpoint: "flaky"}
+		flaky.SetHealthy(false)
+		assert.NoError(t, s.checkMemberHealth(flaky), "requests aren't rejected until the threshold is reached")
+		flaky.SetHealthy(true)
+		flaky.SetHealthy(false)
+		assert.NoError(t, s.checkMemberHealth(flaky), "failures must be consecutive")
+	})
+
+	require.Eventually(t, func() bool {
+		return dead.HealthCheckFailures() >= 2
+	}, time.Second*5, time.Millisecond*10)
+
+	t.Run("writes fail fast", func(t *testing.T) {
+		start := time.Now()
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-2")).Commit()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("reads fail", func(t *testing.T) {
+		_, err := client.Get(ctx, key)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestCoordinatorLoss(t *testing.T) {
+	client, s := startServer(t)
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+
+	original := s.coordinator.ClientSet
+	lost, err := membership.NewClientSet(&membership.GrpcContext{}, "http://127.0.0.1:1")
+	require.NoError(t, err)
+	defer lost.ClientV3.Close()
+	s.coordinator.ClientSet = lost
+
+	s.checkHealth(ctx)
+	assert.False(t, s.coordinator.Healthy())
+	assert.Equal(t, float64(0), promtestutil.ToFloat64(coordinatorHealthy))
+
+	t.Run("writes fail fast", func(t *testing.T) {
+		start := time.Now()
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		s.coordinator.ClientSet = original
+		s.checkHealth(ctx)
+		assert.Equal(t, float64(1), promtestutil.ToFloat64(coordinatorHealthy))
+
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		require.NoError(t, err)
+	})
+}
+
+func TestTickTimeout(t *testing.T) {
+	client, s := startServer(t)
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+
+	const timeout = time.Millisecond * 200
+	s.clock.TickTimeout = timeout
+	kv := s.coordinator.ClientV3.KV
+	s.coordinator.ClientV3.KV = &slowTxnKV{KV: kv, delay: time.Second * 10}
+
+	start := time.Now()
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Less(t, time.Since(start), timeout*3)
+
+	t.Run("reads are served", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "value", string(resp.Kvs[0].Value))
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		s.coordinator.ClientV3.KV = kv
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		require.NoError(t, err)
+	})
+}
+
+func TestCoordinatorReadOnly(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{SerializableReadsWithoutCoordinator: true})
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+
+	kv := s.coordinator.ClientV3.KV
+
+	t.Run("leader changes don't reject writes", func(t *testing.T) {
+		s.coordinator.ClientV3.KV = &noLeaderKV{KV: kv, txnErr: rpctypes.ErrLeaderChanged}
+		defer func() { s.coordinator.ClientV3.KV = kv }()
+
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		assert.Error(t, err)
+		assert.NotEqual(t, errCoordinatorReadOnly.Error(), err.Error())
+		assert.False(t, s.coordinatorReadOnly())
+	})
+
+	noLeader := &noLeaderKV{KV: kv}
+	s.coordinator.ClientV3.KV = noLeader
+
+	t.Run("writes fail", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		assert.Equal(t, errCoordinatorReadOnly.Error(), err.Error())
+		assert.True(t, s.coordinatorReadOnly())
+		assert.Equal(t, float64(1), promtestutil.ToFloat64(coordinatorReadOnly))
+
+		// Subsequent writes don't reach the coordinator
+		_, err = client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		assert.Equal(t, errCoordinatorReadOnly.Error(), err.Error())
+		assert.Equal(t, int32(1), atomic.LoadInt32(&noLeader.txns))
+	})
+
+	t.Run("reads are served", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "value", string(resp.Kvs[0].Value))
+
+		resp, err = client.Get(ctx, "", clientv3.WithPrefix())
+		require.NoError(t, err)
+		assert.Len(t, resp.Kvs, 1)
+	})
+
+	t.Run("serializable reads without coordinator", func(t *testing.T) {
+		noLeader.failGets = true
+		defer func() { noLeader.failGets = false }()
+
+		resp, err := client.Get(ctx, "key", clientv3.WithSerializable())
+		require.NoError(t, err)
+		assert.Equal(t, "value", string(resp.Kvs[0].Value))
+
+		_, err = client.Get(ctx, "key")
+		assert.Error(t, err, "linearizable reads still need the coordinator")
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		s.coordinator.ClientV3.KV = kv
+		s.checkHealth(ctx)
+		assert.False(t, s.coordinatorReadOnly())
+		assert.Equal(t, float64(0), promtestutil.ToFloat64(coordinatorReadOnly))
+
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		require.NoError(t, err)
+	})
+}
+
+// noLeaderKV fails transactions as if the cluster had no leader (or with txnErr if set), and optionally gets too.
+type noLeaderKV struct {
+	clientv3.KV
+	txns     int32 // atomic
+	txnErr   error
+	failGets bool
+}
+
+func (n *noLeaderKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if n.failGets {
+		return nil, rpctypes.ErrNoLeader
+	}
+	return n.KV.Get(ctx, key, opts...)
+}
+
+func (n *noLeaderKV) Txn(ctx context.Context) clientv3.Txn {
+	atomic.AddInt32(&n.txns, 1)
+	err := n.txnErr
+	if err == nil {
+		err = rpctypes.ErrNoLeader
+	}
+	return &noLeaderTxn{Txn: n.KV.Txn(ctx), err: err}
+}
+
+type noLeaderTxn struct {
+	clientv3.Txn
+	err error
+}
+
+func (n *noLeaderTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	n.Txn = n.Txn.If(cs...)
+	return n
+}
+
+func (n *noLeaderTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	n.Txn = n.Txn.Then(ops...)
+	return n
+}
+
+func (n *noLeaderTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	n.Txn = n.Txn.Else(ops...)
+	return n
+}
+
+func (n *noLeaderTxn) Commit() (*clientv3.TxnResponse, error) {
+	return nil, n.err
+}
+
+// slowTxnKV delays the commit of every transaction, e.g. the coordinator's clock ticks.
+type slowTxnKV struct {
+	clientv3.KV
+	delay time.Duration
+}
+
+func (s *slowTxnKV) Txn(ctx context.Context) clientv3.Txn {
+	return &slowTxn{Txn: s.KV.Txn(ctx), ctx: ctx, delay: s.delay}
+}
+
+type slowTxn struct {
+	clientv3.Txn
+	ctx   context.Context
+	delay time.Duration
+}
+
+func (s *slowTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	s.Txn = s.Txn.If(cs...)
+	return s
+}
+
+func (s *slowTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	s.Txn = s.Txn.Then(ops...)
+	return s
+}
+
+func (s *slowTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	s.Txn = s.Txn.Else(ops...)
+	return s
+}
+
+func (s *slowTxn) Commit() (*clientv3.TxnResponse, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+	return s.Txn.Commit()
+}
@@ -0,0 +1,156 @@
+package proxysvr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// leaseIndex is a best-effort record of the members that hold keys attached to each lease,
+// so LeaseTimeToLive can list a lease's keys without querying every member.
+// It only knows about the puts made through this proxy since it started, so leases it doesn't know about
+// are looked up on every member, and members that turn out to have no keys for a lease are forgotten.
+//
+// Entries expire ttl after they were last updated, so leases that are no longer written don't accumulate.
+// Leases written by transactions whose outcome is unknown are forgotten, as is the entire index when the set of
+// members changes, since keys may then be migrated between members.
+type leaseIndex struct {
+	ttl time.Duration
+
+	mut       sync.Mutex
+	entries   map[int64]*leaseIndexEntry
+	clients   []*membership.ClientSet
+	lastSweep time.Time
+}
+
+type leaseIndexEntry struct {
+	members map[*membership.ClientSet]struct{}
+	expires time.Time
+}
+
+func newLeaseIndex(ttl time.Duration) *leaseIndex {
+	return &leaseIndex{ttl: ttl, entries: map[int64]*leaseIndexEntry{}, lastSweep: time.Now()}
+}
+
+// AddTxn records the leases of the puts applied by a transaction.
+func (l *leaseIndex) AddTxn(client *membership.ClientSet, req *etcdserverpb.TxnRequest, succeeded bool) {
+	ops := req.Failure
+	if succeeded {
+		ops = req.Success
+	}
+	for _, op := range ops {
+		if put := op.GetRequestPut(); put != nil && put.Lease != 0 {
+			l.Add(put.Lease, client)
+		}
+		// The results of nested transactions aren't tracked, so assume either branch could have been applied
+		if txn := op.GetRequestTxn(); txn != nil {
+			l.AddTxn(client, txn, true)
+			l.AddTxn(client, txn, false)
+		}
+	}
+}
+
+// ForgetTxn forgets the leases of every put in a transaction, for transactions that may or may not have been applied.
+func (l *leaseIndex) ForgetTxn(req *etcdserverpb.TxnRequest) {
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if put := op.GetRequestPut(); put != nil && put.Lease != 0 {
+				l.Set(put.Lease, nil)
+			}
+			if txn := op.GetRequestTxn(); txn != nil {
+				l.ForgetTxn(txn)
+			}
+		}
+	}
+}
+
+func (l *leaseIndex) Add(id int64, client *membership.ClientSet) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	l.sweepUnlocked(now)
+	entry, ok := l.entries[id]
+	if !ok {
+		entry = &leaseIndexEntry{members: map[*membership.ClientSet]struct{}{}}
+		l.entries[id] = entry
+	}
+	entry.members[client] = struct{}{}
+	entry.expires = now.Add(l.ttl)
+}
+
+// Members returns the members known to hold keys attached to the lease, or false if the lease isn't indexed.
+// current is the pool's current members, and the index is reset if they've changed.
+func (l *leaseIndex) Members(id int64, current []*membership.ClientSet) ([]*membership.ClientSet, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.clients == nil {
+		l.clients = current
+	} else if !sameClientSets(l.clients, current) {
+		l.entries = map[int64]*leaseIndexEntry{}
+		l.clients = current
+		return nil, false
+	}
+	entry, ok := l.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(l.entries, id)
+		return nil, false
+	}
+	clients := make([]*membership.ClientSet, 0, len(entry.members))
+	for client := range entry.members {
+		clients = append(clients, client)
+	}
+	return clients, true
+}
+
+// Set replaces the members known to hold keys attached to the lease. The lease is forgotten if there are none.
+func (l *leaseIndex) Set(id int64, clients []*membership.ClientSet) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if len(clients) == 0 {
+		delete(l.entries, id)
+		return
+	}
+	entry := &leaseIndexEntry{members: make(map[*membership.ClientSet]struct{}, len(clients)), expires: time.Now().Add(l.ttl)}
+	for _, client := range clients {
+		entry.members[client] = struct{}{}
+	}
+	l.entries[id] = entry
+}
+
+// Len returns the number of indexed leases, including expired ones that haven't been swept yet.
+func (l *leaseIndex) Len() int {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return len(l.entries)
+}
+
+// sweepUnlocked removes expired entries, at most once per ttl.
+func (l *leaseIndex) sweepUnlocked(now time.Time) {
+	if now.Sub(l.lastSweep) < l.ttl {
+		return
+	}
+	l.lastSweep = now
+	for id, entry := range l.entries {
+		if now.After(entry.expires) {
+			delete(l.entries, id)
+		}
+	}
+}
+
+func sameClientSets(a, b []*membership.ClientSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package proxysvr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+func TestLeaseIndex(t *testing.T) {
+	a, b := &membership.ClientSet{}, &membership.ClientSet{}
+	clients := []*membership.ClientSet{a, b}
+
+	t.Run("expiry", func(t *testing.T) {
+		l := newLeaseIndex(time.Millisecond * 10)
+		l.Add(1, a)
+		members, ok := l.Members(1, clients)
+		assert.True(t, ok)
+		assert.Equal(t, []*membership.ClientSet{a}, members)
+
+		time.Sleep(time.Millisecond * 20)
+		_, ok = l.Members(1, clients)
+		assert.False(t, ok)
+	})
+
+	t.Run("expired entries are swept", func(t *testing.T) {
+		l := newLeaseIndex(time.Millisecond * 10)
+		for id := int64(1); id <= 100; id++ {
+			l.Add(id, a)
+		}
+		time.Sleep(time.Millisecond * 20)
+		l.Add(101, a)
+		assert.Equal(t, 1, l.Len())
+	})
+
+	t.Run("unknown txn outcome", func(t *testing.T) {
+		l := newLeaseIndex(time.Minute)
+		l.Add(1, a)
+		l.Add(2, a)
+		l.ForgetTxn(&etcdserverpb.TxnRequest{Failure: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: &etcdserverpb.TxnRequest{
+			Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("key"), Lease: 1}}}},
+		}}}}})
+
+		_, ok := l.Members(1, clients)
+		assert.False(t, ok)
+		_, ok = l.Members(2, clients)
+		assert.True(t, ok)
+	})
+
+	t.Run("membership change", func(t *testing.T) {
+		l := newLeaseIndex(time.Minute)
+		l.Add(1, a)
+		_, ok := l.Members(1, clients)
+		assert.True(t, ok)
+
+		_, ok = l.Members(1, []*membership.ClientSet{a, b, {}})
+		assert.False(t, ok)
+		assert.Equal(t, 0, l.Len())
+	})
+}
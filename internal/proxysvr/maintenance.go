@@ -0,0 +1,270 @@
+package proxysvr
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// Snapshots are streamed as a sequence of frames. Each frame starts with a 12 byte header
+// containing the segment index (int32, manifestSegment for the manifest) and the payload
+// length (uint64), both little endian. The manifest frame is always sent first.
+const (
+	snapshotFrameHeaderLen = 12
+	manifestSegment        = -1
+
+	// maxSnapshotManifestLen bounds the manifest buffered by SplitSnapshot. Segment payloads are streamed instead.
+	maxSnapshotManifestLen = 1 << 20
+)
+
+// SnapshotManifest describes the segments of a meta cluster snapshot.
+type SnapshotManifest struct {
+	// MetaRevision is the meta cluster's revision when the snapshot was started.
+	// Member snapshots are taken sequentially, so they may include writes after this revision.
+	MetaRevision int64             `json:"metaRevision"`
+	Segments     []SnapshotSegment `json:"segments"`
+}
+
+// SnapshotSegment identifies the cluster that produced a segment of a meta cluster snapshot.
+type SnapshotSegment struct {
+	Cluster  string `json:"cluster"` // "coordinator" or "member"
+	Endpoint string `json:"endpoint"`
+}
+
+func (s *server) Snapshot(req *etcdserverpb.SnapshotRequest, srv etcdserverpb.Maintenance_SnapshotServer) error {
+	requestCount.WithLabelValues("Snapshot").Inc()
+	ctx := srv.Context()
+
+	metaRev, err := s.clock.Now(ctx)
+	if err != nil {
+		return err
+	}
+
+	clients := append([]*membership.ClientSet{s.coordinator.ClientSet}, s.members.Members()...)
+	manifest := &SnapshotManifest{MetaRevision: metaRev}
+	for i, cs := range clients {
+		seg := SnapshotSegment{Cluster: "member", Endpoint: cs.Endpoint}
+		if i == 0 {
+			seg.Cluster = "coordinator"
+		}
+		manifest.Segments = append(manifest.Segments, seg)
+	}
+
+	js, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := sendSnapshotFrame(srv, manifestSegment, js); err != nil {
+		return err
+	}
+
+	for i, cs := range clients {
+		if err := streamSnapshotSegment(ctx, srv, int32(i), cs); err != nil {
+			zap.L().Error("error streaming snapshot", zap.String("endpoint", cs.Endpoint), zap.Int64("metaRev", metaRev), zap.Error(err))
+			return err
+		}
+	}
+
+	zap.L().Info("streamed snapshot successfully", zap.Int64("metaRev", metaRev), zap.Int("segments", len(clients)))
+	return nil
+}
+
+func streamSnapshotSegment(ctx context.Context, srv etcdserverpb.Maintenance_SnapshotServer, index int32, cs *membership.ClientSet) error {
+	stream, err := cs.Maintenance.Snapshot(ctx, &etcdserverpb.SnapshotRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := sendSnapshotFrame(srv, index, resp.Blob); err != nil {
+			return err
+		}
+	}
+}
+
+func sendSnapshotFrame(srv etcdserverpb.Maintenance_SnapshotServer, index int32, payload []byte) error {
+	buf := make([]byte, snapshotFrameHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(index))
+	binary.LittleEndian.PutUint64(buf[4:], uint64(len(payload)))
+	copy(buf[snapshotFrameHeaderLen:], payload)
+	return srv.Send(&etcdserverpb.SnapshotResponse{Blob: buf})
+}
+
+// SplitSnapshot reads a snapshot produced by the Snapshot RPC and writes each segment to the writer returned by open.
+// It's intended for restore tooling that needs to recover each cluster's snapshot individually.
+// Every writer is closed, even when an error is returned, in which case the last segment is incomplete and should be discarded.
+func SplitSnapshot(r io.Reader, open func(SnapshotSegment) (io.WriteCloser, error)) (*SnapshotManifest, error) {
+	var manifest *SnapshotManifest
+	var current io.WriteCloser
+	defer func() {
+		// Only set when returning an error, since current is reset whenever it's closed
+		if current != nil {
+			current.Close()
+		}
+	}()
+	currentIndex := int32(manifestSegment)
+	header := make([]byte, snapshotFrameHeaderLen)
+	for {
+		_, err := io.ReadFull(r, header)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading frame header: %w", err)
+		}
+		index := int32(binary.LittleEndian.Uint32(header))
+		length := binary.LittleEndian.Uint64(header[4:])
+
+		if manifest == nil {
+			if index != manifestSegment {
+				return nil, fmt.Errorf("snapshot does not start with a manifest")
+			}
+			if length > maxSnapshotManifestLen {
+				return nil, fmt.Errorf("manifest length %d exceeds the limit of %d bytes", length, maxSnapshotManifestLen)
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return nil, fmt.Errorf("reading frame payload: %w", err)
+			}
+			manifest = &SnapshotManifest{}
+			if err := json.Unmarshal(payload, manifest); err != nil {
+				return nil, fmt.Errorf("decoding manifest: %w", err)
+			}
+			continue
+		}
+
+		if index < 0 || int(index) >= len(manifest.Segments) {
+			return nil, fmt.Errorf("segment %d is not in the manifest", index)
+		}
+		if length > math.MaxInt64 {
+			return nil, fmt.Errorf("invalid frame length %d", length)
+		}
+		if index != currentIndex {
+			if current != nil {
+				err := current.Close()
+				current = nil
+				if err != nil {
+					return nil, err
+				}
+			}
+			current, err = open(manifest.Segments[index])
+			if err != nil {
+				return nil, err
+			}
+			currentIndex = index
+		}
+		// Copy the payload as it's read, so a corrupt length can't force a large allocation
+		if n, err := io.CopyN(current, r, int64(length)); err != nil {
+			if n < int64(length) && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("reading frame payload: %w", err)
+		}
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("snapshot is empty")
+	}
+	if current != nil {
+		err := current.Close()
+		current = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Defragment defragments every member and then the coordinator.
+// Defrag blocks the cluster while it runs, so at most DefragConcurrency clusters are defragmented at once.
+// Failures are logged and returned, but don't prevent the remaining clusters from being defragmented.
+func (s *server) Defragment(ctx context.Context, req *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	requestCount.WithLabelValues("Defragment").Inc()
+
+	var mut sync.Mutex
+	var errs []error
+	defrag := func(ctx context.Context, cs *membership.ClientSet) error {
+		start := time.Now()
+		_, err := cs.Maintenance.Defragment(ctx, req)
+		observeMember(cs, "Defragment", start, err)
+		if err != nil {
+			zap.L().Error("failed to defragment cluster", zap.String("endpoint", cs.Endpoint), zap.Duration("latency", time.Since(start)), zap.Error(err))
+			mut.Lock()
+			defer mut.Unlock()
+			errs = append(errs, fmt.Errorf("defragmenting %s: %w", cs.Endpoint, err))
+			return nil
+		}
+		zap.L().Info("defragmented cluster", zap.String("endpoint", cs.Endpoint), zap.Duration("latency", time.Since(start)))
+		return nil
+	}
+	s.members.IterateMembersWithLimit(ctx, s.config.DefragConcurrency, defrag)
+	defrag(ctx, s.coordinator.ClientSet)
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%d cluster(s) failed to defragment: %w", len(errs), errs[0])
+	}
+	return &etcdserverpb.DefragmentResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+// Alarm forwards the request to every member and the coordinator, and returns the union of their alarms.
+// Etcd's alarms don't identify the cluster that raised them, so each one is logged with its cluster's endpoint.
+// Failures are logged and don't prevent the remaining clusters from being checked. Listing alarms only fails
+// when no cluster reported one, so an unreachable cluster can't hide the alarms of the others.
+func (s *server) Alarm(ctx context.Context, req *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
+	requestCount.WithLabelValues("Alarm").Inc()
+
+	resp := &etcdserverpb.AlarmResponse{Header: &etcdserverpb.ResponseHeader{}}
+	var mut sync.Mutex
+	var errs []error
+	alarm := func(ctx context.Context, cs *membership.ClientSet) error {
+		start := time.Now()
+		r, err := cs.Maintenance.Alarm(ctx, req)
+		observeMember(cs, "Alarm", start, err)
+		if err != nil {
+			zap.L().Error("failed to forward alarm request to cluster", zap.String("endpoint", cs.Endpoint), zap.String("action", req.Action.String()), zap.Error(err))
+			mut.Lock()
+			defer mut.Unlock()
+			errs = append(errs, fmt.Errorf("forwarding alarm request to %s: %w", cs.Endpoint, err))
+			return nil
+		}
+		// Keep the alarms checked by writes up to date, rather than waiting for the next health check
+		if req.Action == etcdserverpb.AlarmRequest_GET {
+			cs.SetAlarms(r.Alarms)
+		} else if err := cs.RefreshAlarms(ctx); err != nil {
+			zap.L().Warn("failed to refresh alarms after changing them", zap.String("endpoint", cs.Endpoint), zap.Error(err))
+		}
+		for _, a := range r.Alarms {
+			zap.L().Warn("cluster has active alarm", zap.String("endpoint", cs.Endpoint), zap.Uint64("memberID", a.MemberID), zap.String("alarm", a.Alarm.String()))
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		resp.Alarms = append(resp.Alarms, r.Alarms...)
+		return nil
+	}
+	s.members.IterateMembers(ctx, alarm)
+	alarm(ctx, s.coordinator.ClientSet)
+
+	if len(errs) > 0 && (req.Action != etcdserverpb.AlarmRequest_GET || len(resp.Alarms) == 0) {
+		// The cluster is kept in the message, since wrapped errors are otherwise reduced to the etcd error
+		return nil, status.Errorf(status.Code(toGRPCError(errs[0])), "metaetcd: %d cluster(s) failed to handle the alarm request: %s", len(errs), errs[0])
+	}
+	return resp, nil
+}
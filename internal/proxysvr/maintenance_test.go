@@ -0,0 +1,241 @@
+package proxysvr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestSnapshot(t *testing.T) {
+	client, s := startServer(t)
+
+	resp, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+
+	r, err := client.Snapshot(ctx)
+	require.NoError(t, err)
+	defer r.Close()
+
+	segments := map[string]*bytes.Buffer{}
+	manifest, err := SplitSnapshot(r, func(seg SnapshotSegment) (io.WriteCloser, error) {
+		buf := &bytes.Buffer{}
+		segments[seg.Endpoint] = buf
+		return nopCloser{buf}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, resp.Header.Revision, manifest.MetaRevision)
+
+	expected := []SnapshotSegment{{Cluster: "coordinator", Endpoint: s.coordinator.Endpoint}}
+	for _, member := range s.members.Members() {
+		expected = append(expected, SnapshotSegment{Cluster: "member", Endpoint: member.Endpoint})
+	}
+	assert.Equal(t, expected, manifest.Segments)
+	for _, seg := range expected {
+		require.Contains(t, segments, seg.Endpoint)
+		assert.NotZero(t, segments[seg.Endpoint].Len())
+	}
+}
+
+func TestSplitSnapshotCorruptLength(t *testing.T) {
+	frame := func(index int32, length uint64, payload []byte) []byte {
+		buf := make([]byte, snapshotFrameHeaderLen, snapshotFrameHeaderLen+len(payload))
+		binary.LittleEndian.PutUint32(buf, uint32(index))
+		binary.LittleEndian.PutUint64(buf[4:], length)
+		return append(buf, payload...)
+	}
+	manifest := []byte(`{"segments":[{"cluster":"coordinator"}]}`)
+	var opened, closed int
+	open := func(SnapshotSegment) (io.WriteCloser, error) {
+		opened++
+		return &closeCounter{Writer: io.Discard, closes: &closed}, nil
+	}
+
+	t.Run("manifest", func(t *testing.T) {
+		_, err := SplitSnapshot(bytes.NewReader(frame(manifestSegment, math.MaxUint64, manifest)), open)
+		assert.EqualError(t, err, "manifest length 18446744073709551615 exceeds the limit of 1048576 bytes")
+	})
+
+	t.Run("segment", func(t *testing.T) {
+		snap := append(frame(manifestSegment, uint64(len(manifest)), manifest), frame(0, 1<<40, []byte("data"))...)
+		_, err := SplitSnapshot(bytes.NewReader(snap), open)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, opened, closed, "the segment is closed when its payload is truncated")
+	})
+
+	t.Run("unknown segment", func(t *testing.T) {
+		snap := append(frame(manifestSegment, uint64(len(manifest)), manifest), frame(0, 4, []byte("data"))...)
+		snap = append(snap, frame(1, 4, []byte("data"))...)
+		_, err := SplitSnapshot(bytes.NewReader(snap), open)
+		assert.EqualError(t, err, "segment 1 is not in the manifest")
+		assert.Equal(t, opened, closed, "the previous segment is closed")
+	})
+}
+
+// closeCounter counts how many times it was closed.
+type closeCounter struct {
+	io.Writer
+	closes *int
+}
+
+func (c *closeCounter) Close() error {
+	*c.closes++
+	return nil
+}
+
+func TestDefragment(t *testing.T) {
+	client, s := startServer(t)
+
+	clients := append(s.members.Members(), s.coordinator.ClientSet)
+	recorders := make([]*recordingMaintenanceClient, len(clients))
+	for i, cs := range clients {
+		recorders[i] = &recordingMaintenanceClient{MaintenanceClient: cs.Maintenance}
+		cs.Maintenance = recorders[i]
+	}
+
+	_, err := client.Defragment(ctx, client.Endpoints()[0])
+	require.NoError(t, err)
+
+	for _, r := range recorders {
+		assert.Equal(t, int32(1), atomic.LoadInt32(&r.defrags))
+	}
+}
+
+type recordingMaintenanceClient struct {
+	etcdserverpb.MaintenanceClient
+	defrags int32
+}
+
+func (r *recordingMaintenanceClient) Defragment(ctx context.Context, req *etcdserverpb.DefragmentRequest, opts ...grpc.CallOption) (*etcdserverpb.DefragmentResponse, error) {
+	atomic.AddInt32(&r.defrags, 1)
+	return r.MaintenanceClient.Defragment(ctx, req, opts...)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestAlarmNoSpace(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+
+	// Raise a NOSPACE alarm on the member that owns the key
+	member := s.members.GetMemberForKey(key)
+	status, err := member.Maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+	require.NoError(t, err)
+	_, err = member.Maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{
+		Action:   etcdserverpb.AlarmRequest_ACTIVATE,
+		MemberID: status.Header.MemberId,
+		Alarm:    etcdserverpb.AlarmType_NOSPACE,
+	})
+	require.NoError(t, err)
+
+	t.Run("alarm is aggregated", func(t *testing.T) {
+		resp, err := client.AlarmList(ctx)
+		require.NoError(t, err)
+		require.Len(t, resp.Alarms, 1)
+		assert.Equal(t, status.Header.MemberId, resp.Alarms[0].MemberID)
+		assert.Equal(t, etcdserverpb.AlarmType_NOSPACE, resp.Alarms[0].Alarm)
+	})
+
+	t.Run("writes are rejected", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		assert.EqualError(t, err, "etcdserver: mvcc: database space exceeded")
+	})
+
+	t.Run("unreachable cluster", func(t *testing.T) {
+		unreachable := s.coordinator.ClientSet
+		maintenance := unreachable.Maintenance
+		unreachable.Maintenance = &failingAlarmClient{MaintenanceClient: maintenance}
+		defer func() { unreachable.Maintenance = maintenance }()
+
+		resp, err := client.AlarmList(ctx)
+		require.NoError(t, err)
+		require.Len(t, resp.Alarms, 1)
+		assert.Equal(t, status.Header.MemberId, resp.Alarms[0].MemberID)
+
+		_, err = member.Maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{
+			Action:   etcdserverpb.AlarmRequest_DEACTIVATE,
+			MemberID: status.Header.MemberId,
+			Alarm:    etcdserverpb.AlarmType_NOSPACE,
+		})
+		require.NoError(t, err)
+
+		_, err = client.AlarmList(ctx)
+		assert.EqualError(t, err, "rpc error: code = DeadlineExceeded desc = metaetcd: 1 cluster(s) failed to handle the alarm request: forwarding alarm request to "+unreachable.Endpoint+": context deadline exceeded")
+	})
+}
+
+// failingAlarmClient fails alarm requests as if the cluster were unreachable.
+type failingAlarmClient struct {
+	etcdserverpb.MaintenanceClient
+}
+
+func (f *failingAlarmClient) Alarm(ctx context.Context, req *etcdserverpb.AlarmRequest, opts ...grpc.CallOption) (*etcdserverpb.AlarmResponse, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestAlarmNoSpaceFastRejection(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+	member := s.members.GetMemberForKey(key)
+	status, err := member.Maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+	require.NoError(t, err)
+	setAlarm := func(action etcdserverpb.AlarmRequest_AlarmAction) {
+		_, err := member.Maintenance.Alarm(ctx, &etcdserverpb.AlarmRequest{Action: action, MemberID: status.Header.MemberId, Alarm: etcdserverpb.AlarmType_NOSPACE})
+		require.NoError(t, err)
+	}
+
+	// The alarm is only noticed by the health checks, and writes that reach the member hang
+	setAlarm(etcdserverpb.AlarmRequest_ACTIVATE)
+	s.checkHealth(ctx)
+	kv := member.KV
+	member.KV = &hangingKVClient{KVClient: kv}
+
+	now, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+	start := time.Now()
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	_, err = client.Txn(timeoutCtx).Then(clientv3.OpPut(key, "value")).Commit()
+	assert.Equal(t, rpctypes.ErrNoSpace, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	after, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, now, after, "rejected before ticking the clock")
+
+	t.Run("reads are served", func(t *testing.T) {
+		member.KV = kv
+		_, err := client.Get(ctx, key)
+		require.NoError(t, err)
+	})
+
+	t.Run("alarm cleared", func(t *testing.T) {
+		setAlarm(etcdserverpb.AlarmRequest_DEACTIVATE)
+		s.checkHealth(ctx)
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		require.NoError(t, err)
+	})
+}
+
+// hangingKVClient blocks transactions until they're canceled.
+type hangingKVClient struct {
+	etcdserverpb.KVClient
+}
+
+func (h *hangingKVClient) Txn(ctx context.Context, req *etcdserverpb.TxnRequest, opts ...grpc.CallOption) (*etcdserverpb.TxnResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
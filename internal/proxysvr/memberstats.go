@@ -0,0 +1,57 @@
+package proxysvr
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.uber.org/zap"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// RunMemberStats updates the metaetcd_member_key_count and metaetcd_member_db_size_bytes gauges
+// every MemberStatsInterval until the context is done. It returns immediately if collection is disabled.
+func (s *server) RunMemberStats(ctx context.Context) {
+	if s.config.MemberStatsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.MemberStatsInterval)
+	defer ticker.Stop()
+	for {
+		s.collectMemberStats(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectMemberStats reads one member at a time, since counting keys walks a member's entire keyspace.
+// Unhealthy members are skipped, so their gauges keep the last value collected.
+func (s *server) collectMemberStats(ctx context.Context) {
+	s.members.IterateMembersWithLimit(ctx, 1, func(ctx context.Context, cs *membership.ClientSet) error {
+		if !cs.Healthy() {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, s.config.HealthCheckTimeout)
+		defer cancel()
+
+		resp, err := cs.ClientV3.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly(), clientv3.WithSerializable())
+		if err != nil {
+			zap.L().Warn("failed to count member keys", zap.String("endpoint", cs.Endpoint), zap.Error(err))
+		} else {
+			memberKeyCount.WithLabelValues(cs.Endpoint).Set(float64(resp.Count))
+		}
+
+		status, err := cs.Maintenance.Status(ctx, &etcdserverpb.StatusRequest{})
+		if err != nil {
+			zap.L().Warn("failed to get member status", zap.String("endpoint", cs.Endpoint), zap.Error(err))
+		} else {
+			memberDBSize.WithLabelValues(cs.Endpoint).Set(float64(status.DbSize))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,52 @@
+package proxysvr
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+func TestMemberStats(t *testing.T) {
+	client, s := startServer(t)
+	members := s.members.Members()
+	require.Len(t, members, 2)
+
+	// Find keys that belong to each member
+	keysByMember := map[*membership.ClientSet][]string{}
+	for i := 0; len(keysByMember[members[0]]) < 5 || len(keysByMember[members[1]]) < 1; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		cs := s.members.GetMemberForKey(key)
+		keysByMember[cs] = append(keysByMember[cs], key)
+	}
+
+	// Write to both members first, so both have the clock key
+	for _, cs := range members {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(keysByMember[cs][0], "value")).Commit()
+		require.NoError(t, err)
+	}
+	s.collectMemberStats(ctx)
+	count := func(cs *membership.ClientSet) float64 {
+		return promtestutil.ToFloat64(memberKeyCount.WithLabelValues(cs.Endpoint))
+	}
+	before := []float64{count(members[0]), count(members[1])}
+	assert.GreaterOrEqual(t, before[0], float64(1))
+	assert.GreaterOrEqual(t, before[1], float64(1))
+
+	for _, key := range keysByMember[members[0]][1:5] {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		require.NoError(t, err)
+	}
+	s.collectMemberStats(ctx)
+	assert.Equal(t, before[0]+4, count(members[0]))
+	assert.Equal(t, before[1], count(members[1]))
+
+	for _, cs := range members {
+		assert.Greater(t, promtestutil.ToFloat64(memberDBSize.WithLabelValues(cs.Endpoint)), float64(0))
+	}
+}
@@ -11,14 +11,160 @@ var (
 		[]string{"method"},
 	)
 
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "metaetcd_request_duration_seconds",
+			Help:    "Latency of requests partitioned by gRPC method and status code.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"method", "code"},
+	)
+
+	memberRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "metaetcd_member_request_duration_seconds",
+			Help:    "Latency of requests sent to member clusters partitioned by member endpoint and method.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"endpoint", "method"},
+	)
+
+	txnPhaseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "metaetcd_txn_phase_duration_seconds",
+			Help:    "Latency of each phase of transactions: validate, resolve (mod revision comparisons and ignore value puts), tick (coordinator), and member.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{"phase"},
+	)
+
+	memberRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metaetcd_member_request_errors_total",
+			Help: "Number of failed requests sent to member clusters partitioned by member endpoint and method.",
+		},
+		[]string{"endpoint", "method"},
+	)
+
+	strictRangeRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_strict_range_retries_total",
+			Help: "Number of times a strict range re-read a member that received writes during the range.",
+		},
+	)
+
+	auditRecordsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_audit_records_dropped_total",
+			Help: "Number of audit records dropped because the audit sink fell behind.",
+		},
+	)
+
+	rangeTruncationCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_range_truncation_count",
+			Help: "Number of multi-member ranges truncated because their keys exceeded the range response byte budget.",
+		})
+
+	certReloadCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metaetcd_server_cert_reload_count",
+			Help: "Number of times the server certs were reloaded after their files changed, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+
+	memberRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metaetcd_member_retries_total",
+			Help: "Number of requests retried after transient member errors partitioned by member endpoint and method.",
+		},
+		[]string{"endpoint", "method"},
+	)
+
+	rateLimitedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metaetcd_rate_limited_total",
+			Help: "Number of requests rejected by rate limits partitioned by method.",
+		},
+		[]string{"method"},
+	)
+
+	coordinatorHealthy = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_coordinator_healthy",
+			Help: "1 when the coordinator cluster passed its most recent health check, otherwise 0.",
+		})
+
+	coordinatorReadOnly = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_coordinator_read_only",
+			Help: "1 while the coordinator cluster has no leader, so writes are rejected but reads are served, otherwise 0.",
+		})
+
+	memberHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_healthy",
+			Help: "1 when the member cluster passed its most recent health check, otherwise 0, partitioned by member endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	memberDraining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_draining",
+			Help: "1 while the member cluster is drained for maintenance and not accepting writes, otherwise 0, partitioned by member endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	memberKeyCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_key_count",
+			Help: "Number of keys stored by the member cluster as of the most recent collection, partitioned by member endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	memberDBSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_db_size_bytes",
+			Help: "Size of the member cluster's backend database as of the most recent collection, partitioned by member endpoint.",
+		},
+		[]string{"endpoint"},
+	)
+
+	watchSendTimeouts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_watch_send_timeouts_total",
+			Help: "Number of watch streams closed because the client didn't receive a response within the send timeout.",
+		})
+
 	activeWatchCount = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "metaetcd_active_watch_count",
-			Help: "Number of active watch connections.",
+			Help: "Number of active watches across every watch stream.",
 		})
 )
 
 func init() {
 	prometheus.MustRegister(requestCount)
+	prometheus.MustRegister(requestDuration)
 	prometheus.MustRegister(activeWatchCount)
+	prometheus.MustRegister(watchSendTimeouts)
+	prometheus.MustRegister(rateLimitedCount)
+	prometheus.MustRegister(coordinatorHealthy)
+	prometheus.MustRegister(coordinatorReadOnly)
+	prometheus.MustRegister(memberHealthy)
+	prometheus.MustRegister(memberDraining)
+	prometheus.MustRegister(memberKeyCount)
+	prometheus.MustRegister(memberDBSize)
+	prometheus.MustRegister(memberRequestDuration)
+	prometheus.MustRegister(memberRequestErrors)
+	prometheus.MustRegister(txnPhaseDuration)
+	prometheus.MustRegister(memberRetries)
+	prometheus.MustRegister(certReloadCount)
+	prometheus.MustRegister(rangeTruncationCount)
+	prometheus.MustRegister(auditRecordsDropped)
+	prometheus.MustRegister(strictRangeRetries)
 }
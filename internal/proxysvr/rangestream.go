@@ -0,0 +1,245 @@
+package proxysvr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// RangeStreamMethod is the full name of the server-streaming range RPC, for clients without generated code.
+const RangeStreamMethod = "/metaetcd.StreamingKV/RangeStream"
+
+// errRangeStreamSort is returned by streaming ranges that are sorted by anything other than ascending key,
+// since those sorts can't be applied without buffering every key.
+var errRangeStreamSort = status.Error(codes.InvalidArgument, "metaetcd: streaming ranges can only be sorted by ascending key")
+
+// StreamingKVServer implements ranges that stream their keys in chunks instead of buffering every key in memory.
+// It's an opt-in alternative to etcd's unary Range for clients that scan very large keyspaces.
+type StreamingKVServer interface {
+	// RangeStream sends the keys of the range in order, in responses of at most ServerConfig.RangeStreamChunkSize keys.
+	// Every response has the same header revision. All but the last have More set, and the last does too if the limit was reached.
+	RangeStream(*etcdserverpb.RangeRequest, RangeStreamServer) error
+}
+
+// RangeStreamServer is the server side of a RangeStream call.
+type RangeStreamServer interface {
+	Send(*etcdserverpb.RangeResponse) error
+	grpc.ServerStream
+}
+
+// RangeStreamClient is the client side of a RangeStream call.
+type RangeStreamClient interface {
+	Recv() (*etcdserverpb.RangeResponse, error)
+	grpc.ClientStream
+}
+
+// RegisterStreamingKVServer registers the streaming KV service, which is written by hand like the admin service.
+func RegisterStreamingKVServer(s *grpc.Server, srv StreamingKVServer) {
+	s.RegisterService(&streamingKVServiceDesc, srv)
+}
+
+var streamingKVServiceDesc = grpc.ServiceDesc{
+	ServiceName: "metaetcd.StreamingKV",
+	HandlerType: (*StreamingKVServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "RangeStream",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := &etcdserverpb.RangeRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(StreamingKVServer).RangeStream(req, &rangeStreamServer{stream})
+		},
+	}},
+	Metadata: "rangestream.proto",
+}
+
+type rangeStreamServer struct{ grpc.ServerStream }
+
+func (r *rangeStreamServer) Send(resp *etcdserverpb.RangeResponse) error { return r.SendMsg(resp) }
+
+// NewRangeStream starts a RangeStream call on the given connection.
+func NewRangeStream(ctx context.Context, cc *grpc.ClientConn, req *etcdserverpb.RangeRequest) (RangeStreamClient, error) {
+	stream, err := cc.NewStream(ctx, &streamingKVServiceDesc.Streams[0], RangeStreamMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &rangeStreamClient{stream}, nil
+}
+
+type rangeStreamClient struct{ grpc.ClientStream }
+
+func (r *rangeStreamClient) Recv() (*etcdserverpb.RangeResponse, error) {
+	resp := &etcdserverpb.RangeResponse{}
+	if err := r.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RangeStream pages through each member at the member revision that corresponds to the same meta revision,
+// and merges the pages by key. At most one page per member is held in memory at once.
+func (s *server) RangeStream(req *etcdserverpb.RangeRequest, srv RangeStreamServer) error {
+	requestCount.WithLabelValues("RangeStream").Inc()
+	ctx := srv.Context()
+	if req.SortTarget != etcdserverpb.RangeRequest_KEY || req.SortOrder == etcdserverpb.RangeRequest_DESCEND {
+		return errRangeStreamSort
+	}
+	req, err := normalizeRange(req)
+	if err != nil {
+		return err
+	}
+	if req.CountOnly || len(req.RangeEnd) == 0 || isEmptyRange(req) {
+		// Nothing to stream
+		resp, err := s.Range(ctx, req)
+		if err != nil {
+			return err
+		}
+		return srv.Send(resp)
+	}
+
+	metaRev := req.Revision
+	if metaRev == 0 {
+		var err error
+		metaRev, err = s.clock.Now(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	var cursors []*rangeCursor
+	for _, client := range s.members.MembersForRange(string(req.Key), string(req.RangeEnd)) {
+		memberRev, err := s.clock.ResolveMetaToMember(ctx, client, metaRev)
+		if isCompacted(err) {
+			return rpctypes.ErrGRPCCompacted
+		}
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, &rangeCursor{client: client, rev: memberRev, next: req.Key})
+	}
+
+	chunk := &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{Revision: metaRev}}
+	var sent, chunks int64
+	for {
+		kv, err := s.nextRangeStreamKv(ctx, req, cursors)
+		if err != nil {
+			zap.L().Warn("completed streaming range with error", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("sent", sent), zap.Error(err))
+			return err
+		}
+		if kv == nil || (req.Limit > 0 && sent == req.Limit) {
+			chunk.More = kv != nil
+			break
+		}
+		if len(chunk.Kvs) == s.config.RangeStreamChunkSize {
+			chunk.More = true
+			if err := srv.Send(chunk); err != nil {
+				return err
+			}
+			chunks++
+			chunk = &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{Revision: metaRev}}
+		}
+		chunk.Kvs = append(chunk.Kvs, kv)
+		chunk.Count++
+		sent++
+	}
+	if err := srv.Send(chunk); err != nil {
+		return err
+	}
+
+	zap.L().Debug("completed streaming range successfully", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", sent), zap.Int64("chunks", chunks+1))
+	return nil
+}
+
+// rangeCursor holds the unsent keys of a member's current page, and where its next page starts.
+type rangeCursor struct {
+	client *membership.ClientSet
+	rev    int64
+	kvs    []*mvccpb.KeyValue
+	next   []byte
+	done   bool
+}
+
+// nextRangeStreamKv removes and returns the lowest key across every cursor, or nil when they're exhausted.
+// Like Range, only the copy with the greatest ModRevision is kept when members return the same key.
+func (s *server) nextRangeStreamKv(ctx context.Context, req *etcdserverpb.RangeRequest, cursors []*rangeCursor) (*mvccpb.KeyValue, error) {
+	var min *mvccpb.KeyValue
+	for _, c := range cursors {
+		if len(c.kvs) == 0 && !c.done {
+			if err := s.fetchRangeStreamPage(ctx, req, c); err != nil {
+				return nil, err
+			}
+		}
+		if len(c.kvs) == 0 {
+			continue
+		}
+		if min == nil || bytes.Compare(c.kvs[0].Key, min.Key) < 0 {
+			min = c.kvs[0]
+		}
+	}
+	if min == nil {
+		return nil, nil
+	}
+
+	key := min.Key
+	for _, c := range cursors {
+		if len(c.kvs) == 0 || !bytes.Equal(c.kvs[0].Key, key) {
+			continue
+		}
+		if c.kvs[0].ModRevision > min.ModRevision {
+			min = c.kvs[0]
+		}
+		c.kvs = c.kvs[1:]
+	}
+	return min, nil
+}
+
+func (s *server) fetchRangeStreamPage(ctx context.Context, req *etcdserverpb.RangeRequest, c *rangeCursor) (err error) {
+	reqCopy := *req
+	reqCopy.Key = c.next
+	reqCopy.Revision = c.rev
+	reqCopy.Limit = int64(s.config.RangeStreamChunkSize)
+	reqCopy.SortOrder = etcdserverpb.RangeRequest_NONE
+
+	start := time.Now()
+	defer func() { observeMember(c.client, "Range", start, err) }()
+
+	var r *etcdserverpb.RangeResponse
+	err = s.retryMember(ctx, c.client, "Range", func() (err error) {
+		r, err = s.rangeMember(ctx, c.client, &reqCopy)
+		return err
+	})
+	if isCompacted(err) {
+		return rpctypes.ErrGRPCCompacted
+	}
+	if err != nil {
+		return fmt.Errorf("ranging %s at member rev %d: %w", c.client.Endpoint, c.rev, err)
+	}
+
+	s.clock.MungeRangeResp(r)
+	c.kvs = r.Kvs
+	c.done = !r.More || len(r.Kvs) == 0
+	if !c.done {
+		c.next = append(append([]byte{}, r.Kvs[len(r.Kvs)-1].Key...), 0) // the first key after this page
+	}
+	return nil
+}
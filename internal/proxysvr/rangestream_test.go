@@ -0,0 +1,115 @@
+package proxysvr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRangeStream(t *testing.T) {
+	const n = 95
+	client, _ := startServerWithConfig(t, ServerConfig{RangeStreamChunkSize: 10})
+
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))).Commit()
+		require.NoError(t, err)
+	}
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("other", "value")).Commit()
+	require.NoError(t, err)
+
+	expected, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, expected.Kvs, n)
+
+	rangeStream := func(req *etcdserverpb.RangeRequest) ([]*etcdserverpb.RangeResponse, error) {
+		stream, err := NewRangeStream(ctx, client.ActiveConnection(), req)
+		require.NoError(t, err)
+		var resps []*etcdserverpb.RangeResponse
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				return resps, nil
+			}
+			if err != nil {
+				return resps, err
+			}
+			resps = append(resps, resp)
+		}
+	}
+	prefix := &etcdserverpb.RangeRequest{Key: []byte("key-"), RangeEnd: []byte(clientv3.GetPrefixRangeEnd("key-"))}
+
+	t.Run("chunked", func(t *testing.T) {
+		resps, err := rangeStream(prefix)
+		require.NoError(t, err)
+		require.Len(t, resps, 10)
+
+		var count int64
+		for i, resp := range resps {
+			assert.Equal(t, expected.Header.Revision, resp.Header.Revision)
+			assert.Equal(t, i < len(resps)-1, resp.More)
+			assert.LessOrEqual(t, len(resp.Kvs), 10)
+			for _, kv := range resp.Kvs {
+				assert.Equal(t, expected.Kvs[count].Key, kv.Key)
+				assert.Equal(t, expected.Kvs[count].Value, kv.Value)
+				assert.Equal(t, expected.Kvs[count].ModRevision, kv.ModRevision)
+				count++
+			}
+			assert.Equal(t, int64(len(resp.Kvs)), resp.Count)
+		}
+		assert.Equal(t, int64(n), count)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		req := *prefix
+		req.Limit = 25
+		resps, err := rangeStream(&req)
+		require.NoError(t, err)
+		require.Len(t, resps, 3)
+		assert.Len(t, resps[2].Kvs, 5)
+		assert.True(t, resps[2].More, "more keys are beyond the limit")
+		assert.Equal(t, expected.Kvs[24].Key, resps[2].Kvs[4].Key)
+	})
+
+	t.Run("past revision", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key-new", "value")).Commit()
+		require.NoError(t, err)
+
+		req := *prefix
+		req.Revision = expected.Header.Revision
+		resps, err := rangeStream(&req)
+		require.NoError(t, err)
+		var count int
+		for _, resp := range resps {
+			count += len(resp.Kvs)
+		}
+		assert.Equal(t, n, count)
+	})
+
+	t.Run("whole keyspace", func(t *testing.T) {
+		resps, err := rangeStream(&etcdserverpb.RangeRequest{RangeEnd: []byte{0}})
+		require.NoError(t, err)
+		var keys []string
+		for _, resp := range resps {
+			for _, kv := range resp.Kvs {
+				keys = append(keys, string(kv.Key))
+			}
+		}
+		assert.Len(t, keys, n+2, "every key but the clock's")
+		assert.NotContains(t, keys, "/meta")
+	})
+
+	t.Run("unsupported sort", func(t *testing.T) {
+		req := *prefix
+		req.SortOrder = etcdserverpb.RangeRequest_DESCEND
+		_, err := rangeStream(&req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
@@ -0,0 +1,122 @@
+package proxysvr
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+)
+
+// RateLimit configures a token bucket.
+type RateLimit struct {
+	// Rate is the number of requests allowed per second. Disabled if 0.
+	Rate float64
+
+	// Burst is the number of requests allowed at once. Defaults to Rate rounded up.
+	Burst int
+}
+
+// ParseMethodRateLimits parses comma-separated method=rate[:burst] pairs e.g. "/etcdserverpb.KV/Txn=100:200".
+func ParseMethodRateLimits(str string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	if str == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(str, ",") {
+		method, limitStr, ok := strings.Cut(pair, "=")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("invalid method rate limit %q", pair)
+		}
+
+		var limit RateLimit
+		rateStr, burstStr, hasBurst := strings.Cut(limitStr, ":")
+		var err error
+		limit.Rate, err = strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing rate of method %q: %w", method, err)
+		}
+		if hasBurst {
+			limit.Burst, err = strconv.Atoi(burstStr)
+			if err != nil {
+				return nil, fmt.Errorf("parsing burst of method %q: %w", method, err)
+			}
+		}
+		limits[method] = limit
+	}
+	return limits, nil
+}
+
+// rateLimiter rejects requests that exceed the global limit or the limit of their method.
+type rateLimiter struct {
+	global  *rate.Limiter // nil when disabled
+	methods map[string]*rate.Limiter
+}
+
+func newRateLimiter(global RateLimit, methods map[string]RateLimit) *rateLimiter {
+	r := &rateLimiter{global: newLimiter(global), methods: make(map[string]*rate.Limiter)}
+	for method, limit := range methods {
+		if l := newLimiter(limit); l != nil {
+			r.methods[method] = l
+		}
+	}
+	return r
+}
+
+func newLimiter(limit RateLimit) *rate.Limiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(limit.Rate))
+	}
+	return rate.NewLimiter(rate.Limit(limit.Rate), burst)
+}
+
+func (r *rateLimiter) enabled() bool { return r.global != nil || len(r.methods) > 0 }
+
+// healthServicePrefix is the prefix of the gRPC health service's methods, which are never rate limited
+// so the proxy doesn't report itself unhealthy under load.
+const healthServicePrefix = "/grpc.health.v1.Health/"
+
+// allow takes a token for the request. The method's limit is checked first so requests rejected by it
+// don't consume the global limit.
+func (r *rateLimiter) allow(method string) error {
+	if strings.HasPrefix(method, healthServicePrefix) {
+		return nil
+	}
+	if l := r.methods[method]; l != nil && !l.Allow() {
+		return r.reject(method)
+	}
+	if r.global != nil && !r.global.Allow() {
+		return r.reject(method)
+	}
+	return nil
+}
+
+func (r *rateLimiter) reject(method string) error {
+	rateLimitedCount.WithLabelValues(method).Inc()
+	zap.L().Debug("rate limited request", zap.String("method", method))
+	return rpctypes.ErrGRPCRequestTooManyRequests
+}
+
+func (r *rateLimiter) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := r.allow(info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// stream limits the rate at which streams are opened, not the messages sent on them.
+func (r *rateLimiter) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := r.allow(info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,112 @@
+package proxysvr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimit(t *testing.T) {
+	const rangeMethod, txnMethod = "/etcdserverpb.KV/Range", "/etcdserverpb.KV/Txn"
+
+	t.Run("per method", func(t *testing.T) {
+		kv := newRateLimitedKVClient(t, GRPCServerConfig{Insecure: true, MethodRateLimits: map[string]RateLimit{rangeMethod: {Rate: 10, Burst: 3}}})
+		before := promtestutil.ToFloat64(rateLimitedCount.WithLabelValues(rangeMethod))
+
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, codes.Unimplemented, kv.rangeCode(), "within the burst")
+		}
+		assert.Equal(t, codes.ResourceExhausted, kv.rangeCode())
+		assert.Equal(t, codes.Unimplemented, kv.txnCode(), "other methods aren't limited")
+		assert.Equal(t, before+1, promtestutil.ToFloat64(rateLimitedCount.WithLabelValues(rangeMethod)))
+
+		// One token is added every 100ms
+		time.Sleep(time.Millisecond * 150)
+		assert.Equal(t, codes.Unimplemented, kv.rangeCode())
+		assert.Equal(t, codes.ResourceExhausted, kv.rangeCode())
+	})
+
+	t.Run("global", func(t *testing.T) {
+		kv := newRateLimitedKVClient(t, GRPCServerConfig{Insecure: true, RateLimit: RateLimit{Rate: 10, Burst: 2}})
+		before := promtestutil.ToFloat64(rateLimitedCount.WithLabelValues(txnMethod))
+
+		assert.Equal(t, codes.Unimplemented, kv.rangeCode())
+		assert.Equal(t, codes.Unimplemented, kv.txnCode())
+		assert.Equal(t, codes.ResourceExhausted, kv.txnCode())
+		assert.Equal(t, before+1, promtestutil.ToFloat64(rateLimitedCount.WithLabelValues(txnMethod)))
+
+		require.Eventually(t, func() bool { return kv.txnCode() == codes.Unimplemented }, time.Second, time.Millisecond*20)
+	})
+
+	t.Run("health checks are exempt", func(t *testing.T) {
+		conn, err := grpc.Dial(serveGRPC(t, GRPCServerConfig{Insecure: true, RateLimit: RateLimit{Rate: 0.1, Burst: 1}, Health: health.NewServer()}), grpc.WithInsecure())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		kv, hc := &rateLimitedKVClient{KVClient: etcdserverpb.NewKVClient(conn)}, healthpb.NewHealthClient(conn)
+
+		assert.Equal(t, codes.Unimplemented, kv.rangeCode())
+		assert.Equal(t, codes.ResourceExhausted, kv.rangeCode())
+		for i := 0; i < 10; i++ {
+			resp, err := hc.Check(context.Background(), &healthpb.HealthCheckRequest{})
+			require.NoError(t, err)
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		kv := newRateLimitedKVClient(t, GRPCServerConfig{Insecure: true})
+		for i := 0; i < 100; i++ {
+			require.Equal(t, codes.Unimplemented, kv.rangeCode())
+		}
+	})
+}
+
+func TestParseMethodRateLimits(t *testing.T) {
+	limits, err := ParseMethodRateLimits("/etcdserverpb.KV/Txn=100:200,/etcdserverpb.KV/Range=0.5")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]RateLimit{
+		"/etcdserverpb.KV/Txn":   {Rate: 100, Burst: 200},
+		"/etcdserverpb.KV/Range": {Rate: 0.5},
+	}, limits)
+
+	limits, err = ParseMethodRateLimits("")
+	require.NoError(t, err)
+	assert.Empty(t, limits)
+
+	for _, str := range []string{"/etcdserverpb.KV/Txn", "=1", "/etcdserverpb.KV/Txn=fast", "/etcdserverpb.KV/Txn=1:big"} {
+		_, err := ParseMethodRateLimits(str)
+		assert.Error(t, err, str)
+	}
+}
+
+type rateLimitedKVClient struct {
+	etcdserverpb.KVClient
+}
+
+func newRateLimitedKVClient(t testing.TB, config GRPCServerConfig) *rateLimitedKVClient {
+	conn, err := grpc.Dial(serveGRPC(t, config), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &rateLimitedKVClient{KVClient: etcdserverpb.NewKVClient(conn)}
+}
+
+// rangeCode returns the status code of a range, which is Unimplemented unless the request was rate limited.
+func (r *rateLimitedKVClient) rangeCode() codes.Code {
+	_, err := r.Range(context.Background(), &etcdserverpb.RangeRequest{})
+	return status.Code(err)
+}
+
+func (r *rateLimitedKVClient) txnCode() codes.Code {
+	_, err := r.Txn(context.Background(), &etcdserverpb.TxnRequest{})
+	return status.Code(err)
+}
@@ -0,0 +1,48 @@
+package proxysvr
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.uber.org/zap"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+// retryMember calls fn until it succeeds, fails with a non-transient error, or runs out of retries.
+// Retries back off exponentially with full jitter, and stop early when ctx is done.
+func (s *server) retryMember(ctx context.Context, cs *membership.ClientSet, method string, fn func() error) error {
+	backoff := s.config.MemberRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= s.config.MemberRetries || !isTransientMemberError(err) {
+			return err
+		}
+
+		memberRetries.WithLabelValues(cs.Endpoint, method).Inc()
+		delay := time.Duration(rand.Int63n(int64(backoff))) + 1
+		zap.L().Warn("retrying member request after transient error", zap.String("endpoint", cs.Endpoint), zap.String("method", method), zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		if backoff *= 2; backoff > s.config.MemberRetryMaxBackoff {
+			backoff = s.config.MemberRetryMaxBackoff
+		}
+	}
+}
+
+// isTransientMemberError returns true for member errors that are returned before a request is applied,
+// such as during leader elections, so retrying can't apply a request twice.
+func isTransientMemberError(err error) bool {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrNoLeader, rpctypes.ErrNotLeader, rpctypes.ErrLeaderChanged, rpctypes.ErrStopped:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,181 @@
+package proxysvr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/Azure/metaetcd/internal/membership"
+)
+
+func TestMemberRetry(t *testing.T) {
+	const key = "key"
+	client, s := startServerWithConfig(t, ServerConfig{MemberRetries: 2, MemberRetryBackoff: time.Millisecond})
+	_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+	require.NoError(t, err)
+
+	member := s.members.GetMemberForKey(key)
+	flaky := &flakyKVClient{KVClient: member.KV}
+	member.KV = flaky
+
+	t.Run("range", func(t *testing.T) {
+		before := promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Range"))
+		flaky.fail(1, rpctypes.ErrGRPCNoLeader)
+
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, before+1, promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Range")))
+	})
+
+	t.Run("txn", func(t *testing.T) {
+		before := promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Txn"))
+		flaky.fail(1, rpctypes.ErrGRPCLeaderChanged)
+
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-2")).Commit()
+		require.NoError(t, err)
+		assert.True(t, resp.Succeeded)
+		assert.Equal(t, before+1, promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Txn")))
+	})
+
+	t.Run("lease grant", func(t *testing.T) {
+		var leases []*flakyLeaseClient
+		for _, cs := range s.members.Members() {
+			l := &flakyLeaseClient{LeaseClient: cs.Lease}
+			l.fails = 1
+			cs.Lease = l
+			leases = append(leases, l)
+		}
+
+		_, err := s.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60})
+		require.NoError(t, err)
+		for _, l := range leases {
+			assert.Equal(t, int32(2), atomic.LoadInt32(&l.calls))
+		}
+	})
+
+	t.Run("lease rollback", func(t *testing.T) {
+		resp, err := s.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60})
+		require.NoError(t, err)
+
+		var leases []*flakyLeaseClient
+		for _, cs := range s.members.Members() {
+			l := &flakyLeaseClient{LeaseClient: cs.Lease}
+			l.revokeFails = 1
+			cs.Lease = l
+			leases = append(leases, l)
+		}
+		s.rollbackLeaseGrant(resp.ID, s.members.Members())
+
+		for _, l := range leases {
+			assert.Equal(t, int32(2), atomic.LoadInt32(&l.revokes))
+		}
+		ttl, err := s.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: resp.ID})
+		require.NoError(t, err)
+		assert.Equal(t, int64(-1), ttl.TTL)
+	})
+
+	t.Run("out of retries", func(t *testing.T) {
+		flaky.fail(3, rpctypes.ErrGRPCNoLeader)
+		_, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte(key)})
+		assert.ErrorIs(t, err, rpctypes.ErrGRPCNoLeader)
+		flaky.fail(0, nil)
+	})
+
+	t.Run("non-transient errors are not retried", func(t *testing.T) {
+		before := promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Range"))
+		flaky.fail(1, errors.New("not transient"))
+
+		_, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte(key)})
+		assert.Error(t, err)
+		assert.Equal(t, before, promtestutil.ToFloat64(memberRetries.WithLabelValues(member.Endpoint, "Range")))
+	})
+}
+
+func TestMemberRetryContext(t *testing.T) {
+	s := &server{config: ServerConfig{MemberRetries: 10, MemberRetryBackoff: time.Minute, MemberRetryMaxBackoff: time.Minute}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	var calls int
+	start := time.Now()
+	err := s.retryMember(ctx, &membership.ClientSet{Endpoint: "test"}, "Range", func() error {
+		calls++
+		return rpctypes.ErrGRPCNoLeader
+	})
+	assert.Equal(t, rpctypes.ErrGRPCNoLeader, err)
+	assert.Less(t, calls, 10)
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+// flakyKVClient fails the configured number of Range and Txn calls before delegating to the real client.
+type flakyKVClient struct {
+	etcdserverpb.KVClient
+	mut   sync.Mutex
+	fails int
+	err   error
+}
+
+func (f *flakyKVClient) fail(n int, err error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.fails = n
+	f.err = err
+}
+
+func (f *flakyKVClient) shouldFail() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.fails == 0 {
+		return nil
+	}
+	f.fails--
+	return f.err
+}
+
+func (f *flakyKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	if err := f.shouldFail(); err != nil {
+		return nil, err
+	}
+	return f.KVClient.Range(ctx, req, opts...)
+}
+
+func (f *flakyKVClient) Txn(ctx context.Context, req *etcdserverpb.TxnRequest, opts ...grpc.CallOption) (*etcdserverpb.TxnResponse, error) {
+	if err := f.shouldFail(); err != nil {
+		return nil, err
+	}
+	return f.KVClient.Txn(ctx, req, opts...)
+}
+
+type flakyLeaseClient struct {
+	etcdserverpb.LeaseClient
+	fails, calls         int32
+	revokeFails, revokes int32
+}
+
+func (f *flakyLeaseClient) LeaseRevoke(ctx context.Context, req *etcdserverpb.LeaseRevokeRequest, opts ...grpc.CallOption) (*etcdserverpb.LeaseRevokeResponse, error) {
+	atomic.AddInt32(&f.revokes, 1)
+	if atomic.AddInt32(&f.revokeFails, -1) >= 0 {
+		return nil, rpctypes.ErrGRPCNoLeader
+	}
+	return f.LeaseClient.LeaseRevoke(ctx, req, opts...)
+}
+
+func (f *flakyLeaseClient) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest, opts ...grpc.CallOption) (*etcdserverpb.LeaseGrantResponse, error) {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.AddInt32(&f.fails, -1) >= 0 {
+		return nil, rpctypes.ErrGRPCNoLeader
+	}
+	return f.LeaseClient.LeaseGrant(ctx, req, opts...)
+}
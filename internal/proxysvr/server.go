@@ -3,235 +3,1287 @@ package proxysvr
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
-	"os"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/Azure/metaetcd/internal/clock"
 	"github.com/Azure/metaetcd/internal/membership"
+	"github.com/Azure/metaetcd/internal/watch"
+)
+
+var tracer = otel.Tracer("github.com/Azure/metaetcd/internal/proxysvr")
+
+const (
+	// partialRangeHeader is request metadata that overrides ServerConfig.PartialRanges for a single range ("true" or "false").
+	partialRangeHeader = "metaetcd-partial-range"
+
+	// freshestReadHeader is request metadata that makes single-key gets read the member's current revision
+	// instead of the one that corresponds to the meta cluster's clock ("true" or "false"). See Clock.ReadLatest.
+	freshestReadHeader = "metaetcd-freshest-read"
+
+	// skippedMembersTrailer is response metadata listing the endpoints of members skipped by a partial range.
+	skippedMembersTrailer = "metaetcd-skipped-members"
+
+	// watchLimitExceeded is the cancel reason of watches rejected by ServerConfig.MaxWatchesPerStream or MaxWatches.
+	watchLimitExceeded = "watch limit exceeded"
+
+	// maxStrictRangeAttempts is the number of times a strict range reads a member that keeps receiving writes,
+	// see ServerConfig.StrictRanges.
+	maxStrictRangeAttempts = 3
+
+	// futureWatchRevision is the cancel reason of watches that start after the next meta revision
+	// when ServerConfig.CancelFutureWatches is set.
+	futureWatchRevision = "start revision is in the future"
+
+	// duplicateWatchID is the cancel reason of watches created with an ID that's already in use on the stream, like etcd.
+	duplicateWatchID = "duplicate watch ID provided on the WatchStream"
 )
 
 type Server interface {
 	etcdserverpb.KVServer
 	etcdserverpb.WatchServer
 	etcdserverpb.LeaseServer
+	etcdserverpb.MaintenanceServer
+	etcdserverpb.AuthServer
+	AdminServer
+	StreamingKVServer
+
+	UnaryInterceptor() grpc.UnaryServerInterceptor
+	StreamInterceptor() grpc.StreamServerInterceptor
+
+	HealthServer() healthpb.HealthServer
+	RunHealthChecks(ctx context.Context)
+	RunMemberStats(ctx context.Context)
+	RunAuditSink(ctx context.Context)
+
+	Shutdown(ctx context.Context, grpcServer *grpc.Server) error
 }
 
 type server struct {
 	etcdserverpb.UnimplementedKVServer
 	etcdserverpb.UnimplementedWatchServer
 	etcdserverpb.UnimplementedLeaseServer
+	etcdserverpb.UnimplementedMaintenanceServer
+	etcdserverpb.UnimplementedAuthServer
 
 	coordinator *membership.CoordinatorClientSet
 	members     *membership.Pool
 	clock       *clock.Clock
+	config      ServerConfig
+	tokens      *tokenStore
+	health      *health.Server
+	leases      *leaseIndex // nil unless ServerConfig.LeaseIndex is set
+	audit       *auditor    // nil unless ServerConfig.AuditSink is set
+
+	shutdown     chan struct{} // closed when the server starts shutting down
+	shutdownOnce sync.Once
+
+	activeWatches int64 // atomic
+	coordReadOnly int32 // atomic, see coordinatorReadOnly
+}
+
+// ServerConfig contains tunables for the proxy server.
+type ServerConfig struct {
+	// DefragConcurrency is the maximum number of clusters defragmented at once. Defaults to 1.
+	DefragConcurrency int
+
+	// RequireAuth rejects requests that don't present a token issued by Authenticate.
+	RequireAuth bool
+
+	// AuthTokenTTL is how long a token remains valid after its last use. Defaults to 5 minutes.
+	AuthTokenTTL time.Duration
+
+	// HealthCheckInterval is how often the coordinator and members are probed. Defaults to 5 seconds.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout bounds each probe. Defaults to 2 seconds.
+	HealthCheckTimeout time.Duration
+
+	// HealthCheckFailureThreshold is the number of consecutive probes a member must fail before requests for its keys
+	// fail fast. Defaults to 2.
+	HealthCheckFailureThreshold int
+
+	// MemberStatsInterval is how often each member's key count and database size are collected for metrics.
+	// Disabled if 0.
+	MemberStatsInterval time.Duration
+
+	// MinHealthyMembers is the number of healthy members required to report SERVING. Defaults to a majority.
+	MinHealthyMembers int
+
+	// MaxWatchResponseBytes is the size above which watch responses are split into fragments, for watches
+	// that request fragmentation. Defaults to 1.5MiB (etcd's default max request size).
+	MaxWatchResponseBytes int
+
+	// WatchResponseBufferLen is the number of responses buffered for each watch stream before the
+	// slow watch policy applies (see watch.Mux.CancelSlowWatches). Defaults to 100.
+	WatchResponseBufferLen int
+
+	// WatchSendTimeout is how long a watch response can wait for the client to receive it before the stream is closed,
+	// so clients that stopped receiving don't hold up the watch mux indefinitely. Disabled if 0.
+	WatchSendTimeout time.Duration
+
+	// MemberTimeout bounds each member's part of a range, so a single slow member fails the request
+	// quickly instead of consuming the client's entire deadline. Disabled if 0.
+	MemberTimeout time.Duration
+
+	// PartialRanges returns the keys of available members when a multi-member range fails on some of them,
+	// instead of failing the entire range. Skipped members are listed in the response trailer. Requests can
+	// override this with the metaetcd-partial-range metadata header.
+	PartialRanges bool
+
+	// SerializableReadsWithoutCoordinator serves serializable single-key gets from the key's member at its latest
+	// revision when the coordinator can't be read, as freshest reads do, instead of failing them.
+	SerializableReadsWithoutCoordinator bool
+
+	// StrictRanges re-reads members that receive writes at or before a range's revision while they're
+	// being read, so the combined keys include every write up to that revision. This costs two extra clock reads
+	// per member, plus a re-read of each member that was written to during the range.
+	StrictRanges bool
+
+	// RangeConcurrency is the maximum number of members queried at once by a multi-member range. Unbounded if 0.
+	RangeConcurrency int
+
+	// MaxRangeResponseBytes is the approximate maximum size of the keys returned by a range of more than one key.
+	// Larger ranges are truncated at a key and set More, so clients can continue from the last returned key.
+	// At least one key is always returned. Unlimited if 0.
+	MaxRangeResponseBytes int
+
+	// MemberRetries is the number of times a member request is retried after a transient error (e.g. no leader).
+	// Ranges, transactions, and lease grants, revokes, and TTL lookups are retried. Disabled if 0, although the
+	// --member-retries flag defaults to 3.
+	MemberRetries int
+
+	// MemberRetryBackoff is the maximum delay before the first retry, which doubles with each retry. Defaults to 50ms.
+	MemberRetryBackoff time.Duration
+
+	// MemberRetryMaxBackoff caps the maximum delay between retries. Defaults to 2 seconds.
+	MemberRetryMaxBackoff time.Duration
+
+	// MaxWatchesPerStream is the maximum number of watches created on a single watch stream. Unlimited if 0.
+	MaxWatchesPerStream int
+
+	// MaxWatches is the maximum number of watches across every stream. Unlimited if 0.
+	MaxWatches int
+
+	// AuditSink receives a record of every mutation (see RunAuditSink). Disabled if nil.
+	AuditSink AuditSink
+
+	// AuditBufferLen is the number of audit records buffered for a slow AuditSink before they're dropped. Defaults to 1000.
+	AuditBufferLen int
+
+	// CancelFutureWatches cancels watches that start after the next meta revision, since they're usually the result
+	// of a client mixing up revisions. Otherwise they wait for the revision to be reached, like etcd.
+	CancelFutureWatches bool
+
+	// RangeStreamChunkSize is the number of keys sent in each RangeStream response, and read from each member at once.
+	// Defaults to 1000.
+	RangeStreamChunkSize int
+
+	// LeaseIndex tracks which members hold keys attached to each lease, so LeaseTimeToLive only lists keys from those members.
+	// The index only sees writes made through this proxy, so it shouldn't be enabled when other proxies attach keys to the same leases.
+	LeaseIndex bool
+
+	// LeaseIndexTTL is how long the lease index remembers a lease's members after it was last written or listed.
+	// Leases that have been forgotten are looked up on every member again. Defaults to 10 minutes.
+	LeaseIndexTTL time.Duration
+
+	// LeaseGrantConcurrency is the maximum number of members granted a lease at once. Unbounded if 0.
+	LeaseGrantConcurrency int
+
+	// MaxTxnOps should match the members' --max-txn-ops. Transactions that would exceed it once the clock update is
+	// added are rejected with ErrTooManyOps before ticking the clock. Disabled if 0.
+	MaxTxnOps int
 }
 
-func NewServer(coord *membership.CoordinatorClientSet, members *membership.Pool, clock *clock.Clock) Server {
-	return &server{
+func NewServer(coord *membership.CoordinatorClientSet, members *membership.Pool, clock *clock.Clock, config ServerConfig) Server {
+	if config.DefragConcurrency < 1 {
+		config.DefragConcurrency = 1
+	}
+	if config.AuthTokenTTL <= 0 {
+		config.AuthTokenTTL = time.Minute * 5
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = time.Second * 5
+	}
+	if config.HealthCheckTimeout <= 0 {
+		config.HealthCheckTimeout = time.Second * 2
+	}
+	if config.HealthCheckFailureThreshold <= 0 {
+		config.HealthCheckFailureThreshold = 2
+	}
+	if config.WatchResponseBufferLen <= 0 {
+		config.WatchResponseBufferLen = 100
+	}
+	if config.MemberRetryBackoff <= 0 {
+		config.MemberRetryBackoff = time.Millisecond * 50
+	}
+	if config.MemberRetryMaxBackoff <= 0 {
+		config.MemberRetryMaxBackoff = time.Second * 2
+	}
+	if config.MaxWatchResponseBytes <= 0 {
+		config.MaxWatchResponseBytes = 1.5 * 1024 * 1024
+	}
+	if config.RangeStreamChunkSize <= 0 {
+		config.RangeStreamChunkSize = 1000
+	}
+	if config.LeaseIndexTTL <= 0 {
+		config.LeaseIndexTTL = time.Minute * 10
+	}
+	s := &server{
 		coordinator: coord,
 		members:     members,
 		clock:       clock,
+		config:      config,
+		tokens:      newTokenStore(config.AuthTokenTTL),
+		health:      newHealthServer(),
+		shutdown:    make(chan struct{}),
 	}
-}
-
-func NewGRPCServer(ca, cert, key string, maxIdle, interval, timeout time.Duration) (*grpc.Server, error) {
-	parsedCert, err := tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		return nil, err
-	}
-	cas := x509.NewCertPool()
-	caPem, err := os.ReadFile(ca)
-	if err != nil {
-		return nil, err
+	if config.LeaseIndex {
+		s.leases = newLeaseIndex(config.LeaseIndexTTL)
 	}
-	if !cas.AppendCertsFromPEM(caPem) {
-		return nil, fmt.Errorf("invalid ca pem")
+	if config.AuditSink != nil {
+		if config.AuditBufferLen <= 0 {
+			config.AuditBufferLen = 1000
+		}
+		s.audit = newAuditor(config.AuditSink, config.AuditBufferLen)
 	}
-	tlsc := &tls.Config{
-		Certificates: []tls.Certificate{parsedCert},
-		RootCAs:      cas,
-		ClientCAs:    cas,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+	return s
+}
+
+// Shutdown gracefully stops the given gRPC server. New RPCs are rejected, in-flight unary calls are allowed to
+// complete, and active watches are canceled so their streams end cleanly instead of being dropped by the transport.
+// If ctx is done before then, the server is stopped forcefully and the context's error is returned.
+func (s *server) Shutdown(ctx context.Context, grpcServer *grpc.Server) error {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		zap.L().Warn("timed out waiting for in-flight requests - stopping forcefully")
+		grpcServer.Stop()
+		return ctx.Err()
 	}
-	return grpc.NewServer(
-		grpc.Creds(credentials.NewTLS(tlsc)),
-		grpc.KeepaliveParams(keepalive.ServerParameters{
-			MaxConnectionIdle: maxIdle,
-			Time:              interval,
-			Timeout:           timeout,
-		}),
-		grpc.MaxRecvMsgSize(math.MaxInt32),
-		grpc.MaxSendMsgSize(math.MaxInt32),
-	), nil
 }
 
 func (s *server) Range(ctx context.Context, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
-	start := time.Now()
 	if len(req.RangeEnd) == 0 {
 		requestCount.WithLabelValues("Get").Inc()
 	} else {
 		requestCount.WithLabelValues("Range").Inc()
 	}
+	ctx, span := tracer.Start(ctx, "Range")
+	defer span.End()
+
+	req, err := normalizeRange(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.RangeEnd) == 0 && metadataFlag(ctx, freshestReadHeader) {
+		return s.freshestRead(ctx, req)
+	}
 
 	var metaRev int64
 	if req.Revision != 0 {
 		metaRev = req.Revision
 	} else {
-		var err error
 		metaRev, err = s.clock.Now(ctx)
+		if err != nil && req.Serializable && len(req.RangeEnd) == 0 && s.config.SerializableReadsWithoutCoordinator {
+			// Serializable reads can be stale anyway, so read the member's latest revision instead of failing
+			zap.L().Warn("serving serializable get without the coordinator", zap.String("key", string(req.Key)), zap.Error(err))
+			return s.freshestRead(ctx, req)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	resp := &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{Revision: metaRev}}
+	if isEmptyRange(req) {
+		return resp, nil // like etcd, ranges that end before they start are empty rather than invalid
+	}
 	if len(req.RangeEnd) == 0 {
 		client := s.members.GetMemberForKey(string(req.Key))
-		if err := s.rangeWithClient(ctx, req, resp, metaRev, client, nil); err != nil {
-			zap.L().Warn("completed single-key range with error", zap.String("key", string(req.Key)), zap.Int64("metaRev", metaRev), zap.Duration("latency", time.Since(start)), zap.Error(err))
+		if client == nil {
+			return nil, errNoMemberForKey
+		}
+		if err := s.rangeWithClient(ctx, req, resp, metaRev, client, nil, nil); err != nil {
+			zap.L().Warn("completed single-key range with error", zap.String("key", string(req.Key)), zap.Int64("metaRev", metaRev), zap.Error(err))
 			return nil, err
 		}
-		zap.L().Info("completed single-key range successfully", zap.String("key", string(req.Key)), zap.Int64("metaRev", metaRev), zap.Duration("latency", time.Since(start)))
+		zap.L().Debug("completed single-key range successfully", zap.String("key", string(req.Key)), zap.Int64("metaRev", metaRev))
+		return resp, nil
+	}
+	cutoff := newRangeCutoff(req, s.config.MaxRangeResponseBytes)
+	strict := s.config.StrictRanges && (req.Revision != 0 || !s.bypassesClock(req.Key, req.RangeEnd))
+	if members := s.members.MembersForRange(string(req.Key), string(req.RangeEnd)); len(members) == 1 {
+		// The member sorts, limits, and counts the keys itself, so there's nothing to merge
+		if strict {
+			err = s.strictRangeWithClient(ctx, req, resp, metaRev, members[0], nil, cutoff)
+		} else {
+			err = s.rangeWithClient(ctx, req, resp, metaRev, members[0], nil, cutoff)
+		}
+		if err != nil {
+			zap.L().Info("completed single-member range with error", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Error(err))
+			return nil, err
+		}
+		if kvs, truncated := cutoff.Trim(resp.Kvs); truncated {
+			rangeTruncationCount.Inc()
+			resp.Kvs, resp.More = kvs, true
+		}
+		zap.L().Debug("completed single-member range successfully", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", resp.Count), zap.Int64("limit", req.Limit))
 		return resp, nil
 	}
 
+	// Every member is read at the member revision that corresponds to the same meta revision,
+	// so the combined results are a consistent snapshot even while members receive new writes.
 	var mut sync.Mutex
-	err := s.members.IterateMembers(ctx, func(ctx context.Context, client *membership.ClientSet) error {
-		return s.rangeWithClient(ctx, req, resp, metaRev, client, &mut)
+	var skipped []string
+	var served int
+	partial := s.allowPartialRange(ctx)
+	err = s.members.IterateRangeMembers(ctx, string(req.Key), string(req.RangeEnd), s.config.RangeConcurrency, func(ctx context.Context, client *membership.ClientSet) error {
+		var err error
+		if strict {
+			err = s.strictRangeWithClient(ctx, req, resp, metaRev, client, &mut, cutoff)
+		} else {
+			err = s.rangeWithClient(ctx, req, resp, metaRev, client, &mut, cutoff)
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		if err == nil {
+			served++
+			return nil
+		}
+		if !partial || isCompacted(err) || ctx.Err() != nil {
+			return err
+		}
+		zap.L().Warn("skipping member in partial range", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Error(err))
+		skipped = append(skipped, client.Endpoint)
+		return nil
 	})
-	sort.Slice(resp.Kvs, func(i, j int) bool { return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0 })
-	if req.Limit != 0 && int64(len(resp.Kvs)) > req.Limit {
-		resp.Kvs = resp.Kvs[:req.Limit]
-		resp.More = true
+	if err == nil && served == 0 && len(skipped) > 0 {
+		err = fmt.Errorf("every member was skipped during partial range: %s", strings.Join(skipped, ","))
+	}
+	if err == nil && len(skipped) > 0 {
+		sort.Strings(skipped)
+		grpc.SetTrailer(ctx, metadata.Pairs(skippedMembersTrailer, strings.Join(skipped, ",")))
+	}
+	var dups int
+	resp.Kvs, dups = mergeRangeKvs(req, resp.Kvs)
+	if dups > 0 {
+		zap.L().Warn("range returned the same key from multiple members", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int("duplicates", dups))
+		resp.Count -= int64(dups)
+	}
+	if req.CountOnly {
+		// Like etcd, counts ignore the limit and there are never more keys to page through
+		resp.Kvs, resp.More = nil, false
+	} else {
+		// Truncated results are a prefix of the merged keys, which are sorted by key unless the request sorts by something else,
+		// so clients can page through the range by continuing after the last returned key
+		if req.Limit != 0 && int64(len(resp.Kvs)) > req.Limit {
+			resp.Kvs = resp.Kvs[:req.Limit]
+			resp.More = true
+		}
+		var truncated bool
+		resp.Kvs, truncated = cutoff.Trim(resp.Kvs)
+		if truncated {
+			rangeTruncationCount.Inc()
+			resp.More = true
+		}
 	}
 	if err != nil {
-		zap.L().Info("completed range with error", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", resp.Count), zap.Duration("latency", time.Since(start)), zap.Error(err))
+		zap.L().Info("completed range with error", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", resp.Count), zap.Error(err))
 		return nil, err
 	}
-	zap.L().Info("completed range successfully", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", resp.Count), zap.Int64("limit", req.Limit), zap.Duration("latency", time.Since(start)))
+	zap.L().Debug("completed range successfully", zap.String("start", string(req.Key)), zap.String("end", string(req.RangeEnd)), zap.Int64("metaRev", metaRev), zap.Int64("count", resp.Count), zap.Int64("limit", req.Limit))
 
 	return resp, nil
 }
 
-func (s *server) rangeWithClient(ctx context.Context, req *etcdserverpb.RangeRequest, resp *etcdserverpb.RangeResponse, metaRev int64, client *membership.ClientSet, mut *sync.Mutex) error {
-	memberRev, err := s.clock.ResolveMetaToMember(ctx, client, metaRev)
+// mergeRangeKvs sorts the combined results of a multi-member range like etcd would sort a single cluster's results,
+// so trimming them by limit is deterministic. Keys are expected to be unique across members, but a key can briefly
+// exist on more than one member (e.g. during migration). Only the copy with the greatest meta ModRevision is kept in
+// that case, and the number of discarded copies is returned.
+func mergeRangeKvs(req *etcdserverpb.RangeRequest, kvs []*mvccpb.KeyValue) ([]*mvccpb.KeyValue, int) {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		if c := bytes.Compare(kvs[i].Key, kvs[j].Key); c != 0 {
+			return c < 0
+		}
+		if kvs[i].ModRevision != kvs[j].ModRevision {
+			return kvs[i].ModRevision > kvs[j].ModRevision
+		}
+		return bytes.Compare(kvs[i].Value, kvs[j].Value) > 0
+	})
+	unique := kvs[:0]
+	for i, kv := range kvs {
+		if i > 0 && bytes.Equal(kv.Key, kvs[i-1].Key) {
+			continue
+		}
+		unique = append(unique, kv)
+	}
+	dups := len(kvs) - len(unique)
+
+	// Like etcd: results are already sorted by key, and other targets ascend unless told otherwise
+	order := req.SortOrder
+	if req.SortTarget != etcdserverpb.RangeRequest_KEY && order == etcdserverpb.RangeRequest_NONE {
+		order = etcdserverpb.RangeRequest_ASCEND
+	}
+	if order == etcdserverpb.RangeRequest_NONE {
+		return unique, dups
+	}
+	sort.SliceStable(unique, func(i, j int) bool {
+		var c int
+		switch req.SortTarget {
+		case etcdserverpb.RangeRequest_VERSION:
+			c = compareInt64(unique[i].Version, unique[j].Version)
+		case etcdserverpb.RangeRequest_CREATE:
+			c = compareInt64(unique[i].CreateRevision, unique[j].CreateRevision)
+		case etcdserverpb.RangeRequest_MOD:
+			c = compareInt64(unique[i].ModRevision, unique[j].ModRevision)
+		case etcdserverpb.RangeRequest_VALUE:
+			c = bytes.Compare(unique[i].Value, unique[j].Value)
+		}
+		if c == 0 {
+			c = bytes.Compare(unique[i].Key, unique[j].Key) // ties are broken by key for deterministic trimming
+		}
+		if order == etcdserverpb.RangeRequest_DESCEND {
+			return c > 0
+		}
+		return c < 0
+	})
+	return unique, dups
+}
+
+// rangeCutoff applies MaxRangeResponseBytes to a range. Each member's keys are limited to the budget
+// as they're received, and the merged keys are trimmed to the budget again at a key boundary.
+// Keys after the point at which any member was cut off are trimmed too, since that member's later keys are missing.
+// Members only return keys in the order that can be cut off before merging when sorted by ascending key,
+// so other sorts are only trimmed after merging.
+type rangeCutoff struct {
+	budget    int
+	byKey     bool
+	cutoffKey []byte // the lowest key at which a member was cut off
+}
+
+func newRangeCutoff(req *etcdserverpb.RangeRequest, budget int) *rangeCutoff {
+	return &rangeCutoff{
+		budget: budget,
+		byKey:  req.SortTarget == etcdserverpb.RangeRequest_KEY && req.SortOrder != etcdserverpb.RangeRequest_DESCEND,
+	}
+}
+
+// TrimMember limits a member's keys to the budget. Calls must be serialized.
+func (c *rangeCutoff) TrimMember(kvs []*mvccpb.KeyValue) []*mvccpb.KeyValue {
+	if c == nil || c.budget == 0 || !c.byKey {
+		return kvs
+	}
+	n := keysWithinBudget(kvs, c.budget)
+	if n == len(kvs) {
+		return kvs
+	}
+	if last := kvs[n-1].Key; c.cutoffKey == nil || bytes.Compare(last, c.cutoffKey) < 0 {
+		c.cutoffKey = last
+	}
+	return kvs[:n]
+}
+
+// Trim limits the merged and sorted keys to the budget, and returns true if any keys were removed along the way.
+func (c *rangeCutoff) Trim(kvs []*mvccpb.KeyValue) ([]*mvccpb.KeyValue, bool) {
+	if c.budget == 0 {
+		return kvs, false
+	}
+	truncated := c.cutoffKey != nil
+	if truncated {
+		kvs = kvs[:sort.Search(len(kvs), func(i int) bool { return bytes.Compare(kvs[i].Key, c.cutoffKey) > 0 })]
+	}
+	if n := keysWithinBudget(kvs, c.budget); n < len(kvs) {
+		kvs = kvs[:n]
+		truncated = true
+	}
+	return kvs, truncated
+}
+
+// keysWithinBudget returns how many of the keys fit within the budget, which is at least one.
+func keysWithinBudget(kvs []*mvccpb.KeyValue, budget int) int {
+	var size int
+	for i, kv := range kvs {
+		size += kv.Size()
+		if size > budget && i > 0 {
+			return i
+		}
+	}
+	return len(kvs)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// allowPartialRange returns true if a multi-member range should skip members that fail instead of failing entirely.
+func (s *server) allowPartialRange(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(partialRangeHeader); len(values) > 0 {
+		return values[0] == "true"
+	}
+	return s.config.PartialRanges
+}
+
+// metadataFlag returns true if the request metadata sets the given header to "true".
+func metadataFlag(ctx context.Context, header string) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(header)
+	return len(values) > 0 && values[0] == "true"
+}
+
+// freshestRead serves a single-key get from the member's current revision, for debugging replication lag.
+func (s *server) freshestRead(ctx context.Context, req *etcdserverpb.RangeRequest) (resp *etcdserverpb.RangeResponse, err error) {
+	if req.Revision != 0 {
+		return nil, errFreshestReadRevision
+	}
+	client := s.members.GetMemberForKey(string(req.Key))
+	if client == nil {
+		return nil, errNoMemberForKey
+	}
+	start := time.Now()
+	defer func() { observeMember(client, "Range", start, err) }()
+
+	err = s.retryMember(ctx, client, "Range", func() (err error) {
+		resp, err = s.clock.ReadLatest(ctx, client, req)
+		return err
+	})
 	if err != nil {
+		zap.L().Warn("completed freshest read with error", zap.String("key", string(req.Key)), zap.String("endpoint", client.Endpoint), zap.Error(err))
+		return nil, err
+	}
+	zap.L().Debug("completed freshest read successfully", zap.String("key", string(req.Key)), zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", resp.Header.Revision))
+	return resp, nil
+}
+
+// rangeWithClient adds the member's part of the range to resp. mut and cutoff are only needed by multi-member ranges.
+func (s *server) rangeWithClient(ctx context.Context, req *etcdserverpb.RangeRequest, resp *etcdserverpb.RangeResponse, metaRev int64, client *membership.ClientSet, mut *sync.Mutex, cutoff *rangeCutoff) (err error) {
+	ctx, span := tracer.Start(ctx, "rangeWithClient")
+	defer span.End()
+	span.SetAttributes(attribute.String("endpoint", client.Endpoint))
+
+	if err := s.checkMemberHealth(client); err != nil {
 		return err
 	}
 
+	start := time.Now()
+	defer func() { observeMember(client, "Range", start, err) }()
+
+	if s.config.MemberTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.MemberTimeout)
+		defer cancel()
+		defer func() {
+			if err != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("member %s timed out after %s: %w", client.Endpoint, s.config.MemberTimeout, rpctypes.ErrGRPCTimeout)
+			}
+		}()
+	}
+
+	var memberRev int64 // the member's latest revision when reading keys that bypass the clock
+	if req.Revision != 0 || !s.bypassesClock(req.Key, req.RangeEnd) {
+		memberRev, err = s.clock.ResolveMetaToMember(ctx, client, metaRev)
+		if isCompacted(err) {
+			zap.L().Warn("meta rev has been compacted on member", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev))
+			return rpctypes.ErrGRPCCompacted
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	reqCopy := *req
 	reqCopy.Revision = memberRev
-	r, err := client.KV.Range(ctx, &reqCopy)
+	var r *etcdserverpb.RangeResponse
+	err = s.retryMember(ctx, client, "Range", func() (err error) {
+		r, err = s.rangeMember(ctx, client, &reqCopy)
+		return err
+	})
+	if isCompacted(err) {
+		zap.L().Warn("member rev has been compacted", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Int64("memberRev", memberRev))
+		return rpctypes.ErrGRPCCompacted
+	}
 	if err != nil {
 		return fmt.Errorf("ranging at member rev %d: %w", memberRev, err)
 	}
 
+	if !req.CountOnly {
+		s.clock.MungeRangeResp(r)
+	}
+	addMemberRange(req, resp, r, mut, cutoff)
+	return nil
+}
+
+// addMemberRange adds a member's munged range response to the combined response.
+func addMemberRange(req *etcdserverpb.RangeRequest, resp, r *etcdserverpb.RangeResponse, mut *sync.Mutex, cutoff *rangeCutoff) {
 	if mut != nil {
 		mut.Lock()
+		defer mut.Unlock()
 	}
 	resp.Count += r.Count
 	if r.More {
 		resp.More = true
 	}
 	if !req.CountOnly {
-		s.clock.MungeRangeResp(r)
-		resp.Kvs = append(resp.Kvs, r.Kvs...)
+		resp.Kvs = append(resp.Kvs, cutoff.TrimMember(r.Kvs)...)
 	}
-	if mut != nil {
-		mut.Unlock()
+}
+
+// strictRangeWithClient is rangeWithClient, but re-reads the member if writes at or before metaRev were applied to it
+// while it was being read. Each meta revision is allocated before its write is sent to the member, so the member
+// revision that metaRev resolves to can still advance after the range resolved it. Re-reads are attempted
+// maxStrictRangeAttempts times, after which the latest read is used.
+func (s *server) strictRangeWithClient(ctx context.Context, req *etcdserverpb.RangeRequest, resp *etcdserverpb.RangeResponse, metaRev int64, client *membership.ClientSet, mut *sync.Mutex, cutoff *rangeCutoff) error {
+	for attempt := 1; ; attempt++ {
+		before, err := s.clock.ResolveMetaToMember(ctx, client, metaRev)
+		if err != nil {
+			return err
+		}
+		r := &etcdserverpb.RangeResponse{}
+		if err := s.rangeWithClient(ctx, req, r, metaRev, client, nil, nil); err != nil {
+			return err
+		}
+		after, err := s.clock.ResolveMetaToMember(ctx, client, metaRev)
+		if err != nil {
+			return err
+		}
+		if after == before || attempt >= maxStrictRangeAttempts {
+			if after != before {
+				zap.L().Warn("member received writes during every attempt of strict range", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Int("attempts", attempt))
+			}
+			addMemberRange(req, resp, r, mut, cutoff)
+			return nil
+		}
+		strictRangeRetries.Inc()
+		zap.L().Info("retrying member that received writes during strict range", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Int64("memberRev", before), zap.Int64("newMemberRev", after))
+	}
+}
+
+// rangeMember evaluates a range on a member, omitting the keys that metaetcd stores on members (see
+// membership.Scheme.InternalKeysInRange) from both the keys and the count. Ranges that can include them fetch one
+// extra key per internal key so the limit is still filled with the client's keys. Linearizable ranges are sent as a
+// transaction that also counts the internal keys at the same revision. Transactions are always linearizable, so
+// serializable ranges are sent as is and the internal keys are counted separately, see countInternalKeys.
+func (s *server) rangeMember(ctx context.Context, client *membership.ClientSet, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	internal := s.clock.Scheme.InternalKeysInRange(string(req.Key), string(req.RangeEnd))
+	if len(internal) == 0 {
+		return client.KV.Range(ctx, req)
+	}
+
+	reqCopy := *req
+	if reqCopy.Limit > 0 {
+		reqCopy.Limit += int64(len(internal))
+	}
+	var resp *etcdserverpb.RangeResponse
+	if req.Serializable {
+		var err error
+		resp, err = client.KV.Range(ctx, &reqCopy)
+		if err != nil {
+			return nil, err
+		}
+		n, err := countInternalKeys(ctx, client, internal, req, resp)
+		if err != nil {
+			return nil, err
+		}
+		resp.Count -= n
+	} else {
+		ops := []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &reqCopy}}}
+		for _, key := range internal {
+			ops = append(ops, &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{
+				Key:       []byte(key),
+				Revision:  req.Revision,
+				CountOnly: true,
+			}}})
+		}
+		txnResp, err := client.KV.Txn(ctx, &etcdserverpb.TxnRequest{Success: ops})
+		if err != nil {
+			return nil, err
+		}
+		resp = txnResp.Responses[0].GetResponseRange()
+		resp.Header = txnResp.Header
+		for _, r := range txnResp.Responses[1:] {
+			resp.Count -= r.GetResponseRange().Count
+		}
 	}
 
+	kvs := resp.Kvs[:0]
+	for _, kv := range resp.Kvs {
+		if !containsKey(internal, kv.Key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	resp.Kvs = kvs
+	if req.Limit > 0 && int64(len(resp.Kvs)) > req.Limit {
+		resp.Kvs = resp.Kvs[:req.Limit]
+		resp.More = true
+	}
+	return resp, nil
+}
+
+// countInternalKeys returns how many of the internal keys are included in the count of a serializable range response.
+// Keys that the response holds are counted directly. The rest are only looked up when the response could have left
+// them out (count-only or truncated ranges), with serializable reads at the response's revision.
+func countInternalKeys(ctx context.Context, client *membership.ClientSet, internal []string, req *etcdserverpb.RangeRequest, resp *etcdserverpb.RangeResponse) (int64, error) {
+	var n int64
+	for _, key := range internal {
+		if containsKeyValue(resp.Kvs, key) {
+			n++
+			continue
+		}
+		if !req.CountOnly && !resp.More {
+			continue // every key in the range was returned
+		}
+		r, err := client.KV.Range(ctx, &etcdserverpb.RangeRequest{
+			Key:          []byte(key),
+			Revision:     resp.Header.Revision,
+			Serializable: true,
+			CountOnly:    true,
+		})
+		if err != nil {
+			return 0, err
+		}
+		n += r.Count
+	}
+	return n, nil
+}
+
+func containsKeyValue(kvs []*mvccpb.KeyValue, key string) bool {
+	for _, kv := range kvs {
+		if string(kv.Key) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKey(keys []string, key []byte) bool {
+	for _, k := range keys {
+		if k == string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassesClock returns true when every key in [key, end) has one of the clock's BypassPrefixes, using etcd's range conventions.
+// Writes to them since the latest write that ticked the clock aren't visible at the member revision that corresponds
+// to the current meta revision, so they're read at the member's latest revision instead.
+func (s *server) bypassesClock(key, end []byte) bool {
+	for _, prefix := range s.clock.BypassPrefixes {
+		if !bytes.HasPrefix(key, []byte(prefix)) {
+			continue
+		}
+		prefixEnd := clientv3.GetPrefixRangeEnd(prefix)
+		if len(end) == 0 || prefixEnd == "\x00" {
+			return true // a single key, or a prefix that every greater key shares
+		}
+		if !bytes.Equal(end, []byte{0}) && string(end) <= prefixEnd {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTxnOps returns ErrGRPCTooManyOps if any of the transaction's compares or branches, including those of nested
+// transactions, would exceed max like etcd's --max-txn-ops. extra ops are added to each top-level branch.
+func checkTxnOps(req *etcdserverpb.TxnRequest, max, extra int) error {
+	if len(req.Compare) > max || len(req.Success)+extra > max || len(req.Failure)+extra > max {
+		return rpctypes.ErrGRPCTooManyOps
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if txn := op.GetRequestTxn(); txn != nil {
+				if err := checkTxnOps(txn, max, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
+// normalizeRange validates a range's key like etcd does, but also accepts an empty key ending at "\x00" as the
+// entire keyspace. Members reject empty keys, so a copy that starts at "\x00" (the first possible key) is returned instead.
+func normalizeRange(req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeRequest, error) {
+	if len(req.Key) > 0 {
+		return req, nil
+	}
+	if !bytes.Equal(req.RangeEnd, []byte{0}) {
+		return nil, rpctypes.ErrGRPCEmptyKey
+	}
+	reqCopy := *req
+	reqCopy.Key = []byte{0}
+	return &reqCopy, nil
+}
+
+// isEmptyRange returns true when a range ends at or before its key, so it can't hold any keys.
+// Prefix ranges (e.g. "foo" to "fop") and ranges ending at "\x00" (every key from the start onward) are never empty.
+func isEmptyRange(req *etcdserverpb.RangeRequest) bool {
+	if len(req.RangeEnd) == 0 || bytes.Equal(req.RangeEnd, []byte{0}) {
+		return false
+	}
+	return bytes.Compare(req.RangeEnd, req.Key) <= 0
+}
+
 func (s *server) Watch(srv etcdserverpb.Watch_WatchServer) error {
 	requestCount.WithLabelValues("Watch").Inc()
-	activeWatchCount.Inc()
-	defer activeWatchCount.Dec()
 
 	wg, ctx := errgroup.WithContext(srv.Context())
 	id := uuid.Must(uuid.NewRandom()).String()
 	zap.L().Info("starting watch connection", zap.String("watchID", id))
 
-	ch := make(chan *etcdserverpb.WatchResponse)
+	ch := make(chan *etcdserverpb.WatchResponse, s.config.WatchResponseBufferLen)
+	fragmented := &sync.Map{} // IDs of watches that accept fragmented responses
+	watchIDs := &sync.Map{}   // *streamWatch of every watch created on the stream, by ID
+
+	respond := func(resp *etcdserverpb.WatchResponse) error {
+		select {
+		case ch <- resp:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The receive loop and the watches it creates produce the responses sent on ch.
+	// ch is closed once all of them have stopped, since any of them could otherwise send on it after it's closed.
+	var producers sync.WaitGroup
+	producers.Add(1)
 	wg.Go(func() error {
-		defer close(ch)
+		defer producers.Done()
+		var nextWatchID int64
+		var streamWatches int64 // atomic
 		for {
 			msg, err := srv.Recv()
 			if err != nil {
 				return err
 			}
 			if r := msg.GetCreateRequest(); r != nil {
+				// Each watch on the stream needs a unique ID to route its events.
+				// Like etcd, clients can assign their own IDs, and 0 means the proxy assigns the next unused one.
+				if r.WatchId == 0 {
+					for {
+						if _, ok := watchIDs.Load(nextWatchID); !ok {
+							break
+						}
+						nextWatchID++
+					}
+					r.WatchId = nextWatchID
+					nextWatchID++
+				} else if _, ok := watchIDs.Load(r.WatchId); ok {
+					zap.L().Warn("rejected watch with duplicate ID", zap.String("watchID", id), zap.Int64("streamWatchID", r.WatchId))
+					if err := respond(&etcdserverpb.WatchResponse{
+						Header:       &etcdserverpb.ResponseHeader{},
+						WatchId:      r.WatchId,
+						Created:      true,
+						Canceled:     true,
+						CancelReason: duplicateWatchID,
+					}); err != nil {
+						return err
+					}
+					continue
+				}
 				if r.StartRevision == 0 {
 					r.StartRevision, err = s.clock.Now(ctx)
 					if err != nil {
 						return err
 					}
+					r.StartRevision++ // only watch future events
+				} else if s.config.CancelFutureWatches {
+					now, err := s.clock.Now(ctx)
+					if err != nil {
+						return err
+					}
+					if r.StartRevision > now+1 {
+						zap.L().Warn("rejected watch starting at a future revision", zap.String("watchID", id), zap.Int64("metaRev", r.StartRevision), zap.Int64("currentMetaRev", now))
+						if err := respond(&etcdserverpb.WatchResponse{
+							Header:       &etcdserverpb.ResponseHeader{Revision: now},
+							WatchId:      r.WatchId,
+							Created:      true,
+							Canceled:     true,
+							CancelReason: futureWatchRevision,
+						}); err != nil {
+							return err
+						}
+						continue
+					}
+				}
+				limit := s.config.MaxWatchesPerStream
+				if limit > 0 && atomic.LoadInt64(&streamWatches) >= int64(limit) || !s.acquireWatch() {
+					zap.L().Warn("rejected watch over the limit", zap.String("watchID", id), zap.Int64("streamWatches", atomic.LoadInt64(&streamWatches)), zap.Int64("activeWatches", atomic.LoadInt64(&s.activeWatches)))
+					if err := respond(&etcdserverpb.WatchResponse{
+						Header:       &etcdserverpb.ResponseHeader{},
+						WatchId:      r.WatchId,
+						Created:      true, // like etcd, so clients stop waiting for the watch to be created
+						Canceled:     true,
+						CancelReason: watchLimitExceeded,
+					}); err != nil {
+						return err
+					}
+					continue
+				}
+				if r.Fragment {
+					fragmented.Store(r.WatchId, struct{}{})
+				}
+				watchCtx, cancel := context.WithCancel(ctx)
+				sw := &streamWatch{cancel: cancel}
+				watchIDs.Store(r.WatchId, sw)
+				var memberWatches []*watch.Status
+				for _, client := range s.members.MembersForRange(string(r.Key), string(r.RangeEnd)) {
+					memberWatches = append(memberWatches, client.WatchStatus)
+				}
+				future, lowerBound, err := s.members.WatchMux.Watch(watchCtx, r, ch, memberWatches)
+				if err != nil {
+					cancel()
+					s.releaseWatch()
+					fragmented.Delete(r.WatchId)
+					watchIDs.Delete(r.WatchId)
+					// Cancel the whole watch rather than silently missing the failing members' events
+					zap.L().Warn("rejected watch spanning failing member watches", zap.String("watchID", id), zap.String("start", string(r.Key)), zap.String("end", string(r.RangeEnd)), zap.Error(err))
+					if err := respond(&etcdserverpb.WatchResponse{
+						Header:       &etcdserverpb.ResponseHeader{},
+						WatchId:      r.WatchId,
+						Created:      true,
+						Canceled:     true,
+						CancelReason: err.Error(),
+					}); err != nil {
+						return err
+					}
+					continue
 				}
-				future, lowerBound := s.members.WatchMux.Watch(ctx, r, ch)
 				if future == nil {
+					cancel()
+					s.releaseWatch()
+					fragmented.Delete(r.WatchId)
+					watchIDs.Delete(r.WatchId)
+					// Cancel only this watch (like etcd) so the client can restart it from the compaction revision
 					zap.L().Warn("attempted to start watch before buffer", zap.String("watchID", id), zap.Int64("currentLowerBound", lowerBound), zap.Int64("metaRev", r.StartRevision))
-					return rpctypes.ErrGRPCCompacted
+					if err := respond(&etcdserverpb.WatchResponse{
+						Header:          &etcdserverpb.ResponseHeader{},
+						WatchId:         r.WatchId,
+						Canceled:        true,
+						CompactRevision: lowerBound,
+						CancelReason:    rpctypes.ErrCompacted.Error(),
+					}); err != nil {
+						return err
+					}
+					continue
 				}
 				zap.L().Info("added keyspace to watch connection", zap.String("watchID", id), zap.String("start", string(r.Key)), zap.String("end", string(r.RangeEnd)), zap.Int64("metaRev", r.StartRevision))
+				atomic.AddInt64(&streamWatches, 1)
+				watchID := r.WatchId
+				producers.Add(1)
 				wg.Go(func() error {
+					defer producers.Done()
+					defer atomic.AddInt64(&streamWatches, -1)
+					defer s.releaseWatch()
+					defer cancel()
 					future()
+					// The ID can be reused once the watch has stopped
+					fragmented.Delete(watchID)
+					watchIDs.Delete(watchID)
+					if atomic.LoadInt32(&sw.canceled) == 1 {
+						// Sent after the watch's last event, like etcd
+						zap.L().Info("canceled watch by request", zap.String("watchID", id), zap.Int64("streamWatchID", watchID))
+						return respond(&etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: watchID, Canceled: true})
+					}
 					return nil
 				})
 			}
+			if r := msg.GetCancelRequest(); r != nil {
+				// Like etcd, cancellations of unknown watches are ignored
+				if v, ok := watchIDs.Load(r.WatchId); ok {
+					sw := v.(*streamWatch)
+					atomic.StoreInt32(&sw.canceled, 1)
+					sw.cancel()
+				}
+			}
 			// TODO: Handle other types of incoming requests
 		}
 	})
 
-	wg.Go(func() error {
-		for msg := range ch {
-			if err := srv.Send(msg); err != nil {
+	go func() {
+		producers.Wait()
+		close(ch)
+	}()
+
+	stopped := make(chan struct{})
+	sendErr := make(chan error, 1)
+	wg.Go(func() (err error) {
+		defer func() {
+			if err != nil && ctx.Err() == nil {
+				sendErr <- err // the stream is still open, so the receive loop won't stop until the handler returns
+			}
+		}()
+		// Keep draining ch after the sender stops, so producers can't block on it and will stop once ctx is done
+		defer func() {
+			go func() {
+				for range ch {
+				}
+			}()
+		}()
+		send := srv.Send
+		if s.config.WatchSendTimeout > 0 {
+			ws := newWatchSender(srv)
+			defer ws.Close()
+			send = func(resp *etcdserverpb.WatchResponse) error { return ws.Send(ctx, resp, s.config.WatchSendTimeout) }
+		}
+		for {
+			var msg *etcdserverpb.WatchResponse
+			select {
+			case <-s.shutdown:
+				// Only this goroutine sends on the stream, so it's responsible for the cancellations
+				defer close(stopped)
+				return cancelWatches(send, watchIDs)
+			case <-ctx.Done():
+				return ctx.Err() // the stream has ended, so there's no one to send the remaining responses to
+			case m, ok := <-ch:
+				if !ok {
+					return nil
+				}
+				msg = m
+			}
+
+			if _, ok := fragmented.Load(msg.WatchId); ok {
+				for _, frag := range fragmentWatchResponse(msg, s.config.MaxWatchResponseBytes) {
+					if err := send(frag); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := send(msg); err != nil {
 				return err
 			}
 		}
-		return nil
 	})
 
-	if err := wg.Wait(); err != nil {
-		zap.L().Warn("closing watch connection with error", zap.String("watchID", id), zap.Error(err))
+	errCh := make(chan error, 1)
+	go func() { errCh <- wg.Wait() }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			zap.L().Warn("closing watch connection with error", zap.String("watchID", id), zap.Error(err))
+			return err
+		}
+	case <-stopped:
+		// Returning ends the stream, which stops the remaining goroutines
+		zap.L().Info("closing watch connection for shutdown", zap.String("watchID", id))
+		return nil
+	case err := <-sendErr:
+		zap.L().Warn("closing watch connection after failing to send", zap.String("watchID", id), zap.Error(err))
 		return err
 	}
 	zap.L().Info("closing watch connection", zap.String("watchID", id))
 	return nil
 }
 
+// acquireWatch counts a new watch, returning false if it would exceed MaxWatches.
+func (s *server) acquireWatch() bool {
+	n := atomic.AddInt64(&s.activeWatches, 1)
+	if s.config.MaxWatches > 0 && n > int64(s.config.MaxWatches) {
+		atomic.AddInt64(&s.activeWatches, -1)
+		return false
+	}
+	activeWatchCount.Inc()
+	return true
+}
+
+func (s *server) releaseWatch() {
+	atomic.AddInt64(&s.activeWatches, -1)
+	activeWatchCount.Dec()
+}
+
+// streamWatch is a watch created on a watch stream.
+type streamWatch struct {
+	cancel   context.CancelFunc // stops the watch
+	canceled int32              // atomic, 1 once the client has canceled the watch
+}
+
+// cancelWatches tells the client that each watch was canceled because the proxy is shutting down.
+func cancelWatches(send func(*etcdserverpb.WatchResponse) error, watchIDs *sync.Map) (err error) {
+	watchIDs.Range(func(key, value any) bool {
+		err = send(&etcdserverpb.WatchResponse{
+			Header:       &etcdserverpb.ResponseHeader{},
+			WatchId:      key.(int64),
+			Canceled:     true,
+			CancelReason: rpctypes.ErrStopped.Error(),
+		})
+		return err == nil
+	})
+	return err
+}
+
+// watchSender sends responses on a watch stream from its own goroutine, so that sends blocked by a client that
+// stopped receiving (e.g. because gRPC flow control has no window left) can time out.
+type watchSender struct {
+	resps chan *etcdserverpb.WatchResponse
+	errs  chan error
+}
+
+func newWatchSender(srv etcdserverpb.Watch_WatchServer) *watchSender {
+	w := &watchSender{
+		resps: make(chan *etcdserverpb.WatchResponse),
+		errs:  make(chan error, 1),
+	}
+	go func() {
+		for resp := range w.resps {
+			w.errs <- srv.Send(resp)
+		}
+	}()
+	return w
+}
+
+// Send returns errWatchSendTimeout if the response isn't sent within the timeout. The stream must be closed
+// (by returning from the handler) after Send fails, which also ends the blocked send.
+func (w *watchSender) Send(ctx context.Context, resp *etcdserverpb.WatchResponse, timeout time.Duration) error {
+	w.resps <- resp
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.errs:
+		return err
+	case <-timer.C:
+		watchSendTimeouts.Inc()
+		return errWatchSendTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the goroutine once any blocked send returns.
+func (w *watchSender) Close() {
+	close(w.resps)
+}
+
+// fragmentWatchResponse splits a response into fragments no larger than maxBytes, the same way etcd does.
+// Every fragment except the last has Fragment set. A single event is never split, even if it exceeds maxBytes.
+func fragmentWatchResponse(resp *etcdserverpb.WatchResponse, maxBytes int) []*etcdserverpb.WatchResponse {
+	if len(resp.Events) < 2 || resp.Size() <= maxBytes {
+		return []*etcdserverpb.WatchResponse{resp}
+	}
+
+	var frags []*etcdserverpb.WatchResponse
+	events := resp.Events
+	for len(events) > 0 {
+		frag := *resp
+		frag.Events = nil
+		frag.Fragment = true
+		for len(events) > 0 {
+			frag.Events = append(frag.Events, events[0])
+			if len(frag.Events) > 1 && frag.Size() > maxBytes {
+				frag.Events = frag.Events[:len(frag.Events)-1]
+				break
+			}
+			events = events[1:]
+		}
+		frags = append(frags, &frag)
+	}
+	frags[len(frags)-1].Fragment = false
+	return frags
+}
+
 func (s *server) Txn(ctx context.Context, req *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
 	requestCount.WithLabelValues("Txn").Inc()
+	ctx, span := tracer.Start(ctx, "Txn")
+	defer span.End()
 
+	phaseStart := time.Now()
 	key, err := s.clock.ValidateTxn(req)
 	if err != nil {
 		return nil, err
 	}
 
 	client := s.members.GetMemberForKey(string(key))
-	// TODO: Check if client is nil here and in other places too (only matters once clients can be added at runtime)
+	if client == nil {
+		zap.L().Warn("rejecting tx for key without an owner", zap.String("key", string(key)))
+		return nil, errNoMemberForKey
+	}
+	bypass := s.bypassesClock(key, nil)
+	if keys, ok := s.clock.BulkPutKeys(req); ok {
+		// Members can only apply a transaction to their own keys
+		for _, k := range keys[1:] {
+			if s.members.GetMemberForKey(string(k)) != client {
+				return nil, errBulkPutSpansMembers
+			}
+			bypass = bypass && s.bypassesClock(k, nil)
+		}
+	}
+
+	if err := s.checkMemberHealth(client); err != nil {
+		zap.L().Warn("rejecting tx for unhealthy member", zap.String("key", string(key)), zap.String("endpoint", client.Endpoint))
+		return nil, err
+	}
+	readOnly := s.clock.IsReadOnlyTxn(req)
+	if !readOnly && !bypass && !s.coordinator.Healthy() {
+		// Writes can't tick the clock without the coordinator, so fail fast instead of waiting for it
+		zap.L().Warn("rejecting tx while the coordinator is unhealthy", zap.String("key", string(key)))
+		return nil, errCoordinatorUnavailable
+	}
+	if !readOnly && !bypass && s.coordinatorReadOnly() {
+		zap.L().Warn("rejecting tx while the coordinator has no leader", zap.String("key", string(key)))
+		return nil, errCoordinatorReadOnly
+	}
+	if !readOnly && client.Draining() {
+		zap.L().Warn("rejecting tx for draining member", zap.String("key", string(key)), zap.String("endpoint", client.Endpoint))
+		return nil, errMemberDraining
+	}
+	if !readOnly {
+		// Fail fast rather than sending writes to a member that is out of space.
+		// Alarms are refreshed by the health checks, so this doesn't wait on the member.
+		if client.HasAlarm(etcdserverpb.AlarmType_NOSPACE) {
+			zap.L().Warn("rejecting tx for member with NOSPACE alarm", zap.String("key", string(key)), zap.String("endpoint", client.Endpoint))
+			return nil, rpctypes.ErrGRPCNoSpace
+		}
+	}
+	phaseStart = observeTxnPhase("validate", phaseStart)
+
 	for _, op := range req.Compare {
 		r, ok := op.TargetUnion.(*etcdserverpb.Compare_ModRevision)
 		if !ok {
 			continue
 		}
 		if r.ModRevision == 0 {
+			// Missing keys have a ModRevision of 0 on members too, so the "create if not exists" idiom
+			// (ModRevision(key) = 0) is evaluated by the member as-is, just like etcd would evaluate it
 			continue
 		}
 		memberRev, resp, err := s.clock.ResolveMetaToMemberTxn(ctx, client, key, r.ModRevision, req)
@@ -243,22 +1295,90 @@ func (s *server) Txn(ctx context.Context, req *etcdserverpb.TxnRequest) (*etcdse
 		}
 		r.ModRevision = memberRev
 	}
-
-	metaRev, err := s.clock.Tick(ctx)
+	guarded, err := s.clock.ResolveIgnoreValue(ctx, client, key, req)
 	if err != nil {
 		return nil, err
 	}
-	s.clock.MungeTxn(metaRev, req)
+	phaseStart = observeTxnPhase("resolve", phaseStart)
+	if s.config.MaxTxnOps > 0 {
+		// Writes that tick the clock also update it on the member, which counts towards the member's limit
+		var clockOps int
+		if !readOnly && !bypass {
+			clockOps = 1
+		}
+		if err := checkTxnOps(req, s.config.MaxTxnOps, clockOps); err != nil {
+			zap.L().Warn("rejecting tx with too many ops", zap.String("key", string(key)), zap.Int("compares", len(req.Compare)), zap.Int("success", len(req.Success)), zap.Int("failure", len(req.Failure)))
+			return nil, err
+		}
+	}
 
-	resp, err := client.KV.Txn(ctx, req)
+	var metaRev int64
+	if readOnly || bypass {
+		// Read-only transactions are evaluated at the current revision without consuming a new one,
+		// and writes to keys that bypass the clock are stored with it
+		metaRev, err = s.clock.Now(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !readOnly {
+			s.clock.MungeBypassTxn(metaRev, req)
+		} else if !bypass {
+			if err := s.pinReadOnlyTxn(ctx, client, metaRev, req.Success, req.Failure); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		metaRev, err = s.clock.Tick(ctx)
+		if isNoLeader(err) {
+			s.setCoordinatorReadOnly(true) // until the next health check finds a leader
+			return nil, errCoordinatorReadOnly
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.clock.MungeTxn(metaRev, req)
+	}
+	phaseStart = observeTxnPhase("tick", phaseStart)
+
+	var resp *etcdserverpb.TxnResponse
+	err = s.retryMember(ctx, client, "Txn", func() (err error) {
+		resp, err = client.KV.Txn(ctx, req)
+		return err
+	})
+	observeMember(client, "Txn", phaseStart, err)
+	observeTxnPhase("member", phaseStart)
 	if err != nil {
-		zap.L().Error("error sending tx", zap.String("key", string(key)), zap.Int64("metaRev", metaRev), zap.Error(err))
+		if s.leases != nil && !readOnly {
+			s.leases.ForgetTxn(req) // the txn may have been applied
+		}
+		zap.L().Error("error sending tx", zap.String("key", string(key)), zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", metaRev), zap.Error(err))
 		return nil, err
 	}
+	if !readOnly && !bypass {
+		s.clock.StripClockResp(resp)
+	}
+	if guarded != nil {
+		ok, err := s.clock.UnwrapIgnoreValue(guarded, req, resp)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			zap.L().Warn("key was modified during ignore value put", zap.String("key", string(key)), zap.Int64("metaRev", metaRev))
+			return nil, errIgnoreValueConflict
+		}
+	}
 	s.clock.MungeTxnResp(metaRev, resp)
+	if s.leases != nil && !readOnly {
+		s.leases.AddTxn(client, req, resp.Succeeded)
+	}
+	if !readOnly {
+		s.auditTxn(ctx, req, resp)
+	}
 
-	if resp.Succeeded {
-		zap.L().Info("tx applied successfully", zap.String("key", string(key)), zap.Int64("metaRev", metaRev))
+	if readOnly {
+		zap.L().Debug("evaluated read-only tx", zap.String("key", string(key)), zap.Int64("metaRev", metaRev), zap.Bool("succeeded", resp.Succeeded))
+	} else if resp.Succeeded {
+		zap.L().Debug("tx applied successfully", zap.String("key", string(key)), zap.Int64("metaRev", metaRev))
 	} else {
 		revs := make([]int64, len(req.Compare))
 		for i, cmp := range req.Compare {
@@ -270,56 +1390,334 @@ func (s *server) Txn(ctx context.Context, req *etcdserverpb.TxnRequest) (*etcdse
 	return resp, nil
 }
 
+// pinReadOnlyTxn reads the ranges of a read-only transaction at the member revision that corresponds to metaRev,
+// or to the meta revision requested by the range, the same way Range is pinned. Compares are still evaluated
+// against the member's latest keys, since etcd can't evaluate them at a past revision.
+func (s *server) pinReadOnlyTxn(ctx context.Context, client *membership.ClientSet, metaRev int64, branches ...[]*etcdserverpb.RequestOp) error {
+	memberRevs := map[int64]int64{}
+	var pin func(ops []*etcdserverpb.RequestOp) error
+	pin = func(ops []*etcdserverpb.RequestOp) error {
+		for _, op := range ops {
+			if txn := op.GetRequestTxn(); txn != nil {
+				if err := pin(txn.Success); err != nil {
+					return err
+				}
+				if err := pin(txn.Failure); err != nil {
+					return err
+				}
+				continue
+			}
+			r := op.GetRequestRange()
+			if r == nil {
+				continue
+			}
+			rev := r.Revision
+			if rev == 0 {
+				rev = metaRev
+			}
+			if rev > metaRev {
+				return rpctypes.ErrGRPCFutureRev
+			}
+			memberRev, ok := memberRevs[rev]
+			if !ok {
+				var err error
+				memberRev, err = s.clock.ResolveMetaToMember(ctx, client, rev)
+				if isCompacted(err) {
+					zap.L().Warn("meta rev has been compacted on member", zap.String("endpoint", client.Endpoint), zap.Int64("metaRev", rev))
+					return rpctypes.ErrGRPCCompacted
+				}
+				if err != nil {
+					return err
+				}
+				memberRevs[rev] = memberRev
+			}
+			r.Revision = memberRev
+		}
+		return nil
+	}
+	for _, ops := range branches {
+		if err := pin(ops); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *server) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
 	requestCount.WithLabelValues("LeaseGrant").Inc()
-	if req.ID == 0 {
-		req.ID = rand.Int63()
+	generated := req.ID == 0
+	if generated {
+		var err error
+		req.ID, err = newLeaseID()
+		if err != nil {
+			return nil, fmt.Errorf("generating lease id: %w", err)
+		}
 	}
-	err := s.members.IterateMembers(ctx, func(ctx context.Context, cs *membership.ClientSet) error {
-		resp, err := cs.Lease.LeaseGrant(ctx, req)
+
+	// Members are granted the lease concurrently. The first failure skips the members that haven't started,
+	// then the grants this request made are rolled back. Grants in flight use the request's context rather than
+	// being canceled with the others, so it's known whether they were applied.
+	var mut sync.Mutex
+	var granted []*membership.ClientSet
+	ttls := map[string]int64{} // by endpoint, since members may clamp the TTL to their minimum
+	err := s.members.IterateMembersWithLimit(ctx, s.config.LeaseGrantConcurrency, func(_ context.Context, cs *membership.ClientSet) (err error) {
+		if cs.Draining() {
+			// Leases are granted on every member, so keys on any member can be attached to them
+			return errMemberDraining
+		}
+		start := time.Now()
+		defer func() { observeMember(cs, "LeaseGrant", start, err) }()
+
+		var resp *etcdserverpb.LeaseGrantResponse
+		err = s.retryMember(ctx, cs, "LeaseGrant", func() (err error) {
+			resp, err = cs.Lease.LeaseGrant(ctx, req)
+			return err
+		})
+		if rpctypes.Error(err) == rpctypes.ErrLeaseExist {
+			// Retries of a partially failed grant should succeed on the members that already have the lease
+			if err := s.leaseMatches(ctx, cs, req); err != nil {
+				return err
+			}
+			mut.Lock()
+			defer mut.Unlock()
+			ttls[cs.Endpoint] = req.TTL
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 		if resp.Error != "" {
 			return fmt.Errorf("lease error: %s", resp.Error)
 		}
+		mut.Lock()
+		defer mut.Unlock()
+		granted = append(granted, cs)
+		ttls[cs.Endpoint] = resp.TTL
 		return nil
 	})
 	if err != nil {
+		zap.L().Warn("failed to grant lease", zap.Int64("id", req.ID), zap.Int("granted", len(granted)), zap.Error(err))
+		rollback := granted
+		if generated {
+			// Nobody else can hold a lease with a new ID, so it's revoked everywhere in case a grant the client canceled was applied
+			rollback = s.members.Members()
+		}
+		s.rollbackLeaseGrant(req.ID, rollback)
 		return nil, err
 	}
-	zap.L().Info("granted lease successfully", zap.Int64("id", req.ID), zap.Duration("ttl", time.Duration(req.TTL)*time.Second))
+
+	ttl := reconcileLeaseTTL(req, ttls)
+	if s.audit != nil {
+		s.audit.Record(AuditRecord{Principal: s.principal(ctx), Operation: "LeaseGrant", LeaseID: req.ID})
+	}
+	zap.L().Debug("granted lease successfully", zap.Int64("id", req.ID), zap.Duration("ttl", time.Duration(ttl)*time.Second))
 	return &etcdserverpb.LeaseGrantResponse{
 		Header: &etcdserverpb.ResponseHeader{},
 		ID:     req.ID,
-		TTL:    req.TTL,
+		TTL:    ttl,
 	}, nil
 }
 
-func (s *server) Compact(ctx context.Context, req *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
-	err := s.members.IterateMembers(ctx, func(ctx context.Context, cs *membership.ClientSet) (err error) {
-		reqCopy := *req
-		reqCopy.Revision, err = s.clock.ResolveMetaToMember(ctx, cs, req.Revision)
-		if err != nil {
+// reconcileLeaseTTL returns the greatest TTL granted by any member, which is when the lease will have expired everywhere.
+// Members clamp TTLs to their minimum, so they can disagree with the requested TTL and each other.
+func reconcileLeaseTTL(req *etcdserverpb.LeaseGrantRequest, ttls map[string]int64) int64 {
+	var ttl int64
+	agree := true
+	for _, t := range ttls {
+		if t > ttl {
+			ttl = t
+		}
+		agree = agree && t == req.TTL
+	}
+	if !agree {
+		zap.L().Warn("members granted lease with different ttls", zap.Int64("id", req.ID), zap.Int64("ttl", req.TTL), zap.Any("memberTTLs", ttls))
+	}
+	return ttl
+}
+
+// rollbackLeaseGrant revokes a partially granted lease from the given members, so failed grants don't leave leases
+// behind that only expire after their TTL. Leases that existed before the grant are never passed in, since keys may
+// be attached to them. Failures are only logged: the lease still expires on its own.
+func (s *server) rollbackLeaseGrant(id int64, members []*membership.ClientSet) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.HealthCheckTimeout)
+	defer cancel()
+	err := membership.IterateClientSets(ctx, members, func(ctx context.Context, cs *membership.ClientSet) error {
+		err := s.retryMember(ctx, cs, "LeaseRevoke", func() error {
+			_, err := cs.Lease.LeaseRevoke(ctx, &etcdserverpb.LeaseRevokeRequest{ID: id})
 			return err
+		})
+		if rpctypes.Error(err) == rpctypes.ErrLeaseNotFound {
+			return nil
 		}
+		return err
+	})
+	if err != nil {
+		zap.L().Warn("failed to roll back partially granted lease", zap.Int64("id", id), zap.Error(err))
+		return
+	}
+	zap.L().Info("rolled back partially granted lease", zap.Int64("id", id), zap.Int("members", len(members)))
+}
 
-		_, err = cs.KV.Compact(ctx, &reqCopy)
+// newLeaseID returns a random positive lease ID. IDs are random rather than sequential so multiple proxies
+// can grant leases on the same members without coordinating.
+func newLeaseID() (int64, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, err
+		}
+		// Clear the high bit to keep the ID positive. Zero means "unset" to etcd.
+		if id := int64(binary.BigEndian.Uint64(buf) &^ (1 << 63)); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// leaseMatches returns nil if the member's existing lease was granted with the requested TTL,
+// otherwise the lease exists error.
+func (s *server) leaseMatches(ctx context.Context, cs *membership.ClientSet, req *etcdserverpb.LeaseGrantRequest) error {
+	var ttl *etcdserverpb.LeaseTimeToLiveResponse
+	err := s.retryMember(ctx, cs, "LeaseTimeToLive", func() (err error) {
+		ttl, err = cs.Lease.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: req.ID})
 		return err
 	})
 	if err != nil {
+		return fmt.Errorf("getting existing lease: %w", err)
+	}
+	if ttl.GrantedTTL != req.TTL {
+		zap.L().Warn("lease already exists with a different ttl", zap.String("endpoint", cs.Endpoint), zap.Int64("id", req.ID), zap.Int64("ttl", req.TTL), zap.Int64("existingTTL", ttl.GrantedTTL))
+		return rpctypes.ErrGRPCLeaseExist
+	}
+	return nil
+}
+
+// LeaseTimeToLive reports the lowest remaining TTL across members, since each member expires the lease independently.
+// A TTL of -1 means that at least one member doesn't have the lease.
+func (s *server) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	requestCount.WithLabelValues("LeaseTimeToLive").Inc()
+	clients := s.members.Members()
+	if req.Keys && s.leases != nil {
+		if indexed, ok := s.leases.Members(req.ID, clients); ok {
+			clients = indexed
+		}
+	}
+
+	var mut sync.Mutex
+	var holders []*membership.ClientSet
+	resp := &etcdserverpb.LeaseTimeToLiveResponse{Header: &etcdserverpb.ResponseHeader{}, ID: req.ID, TTL: -1}
+	var found bool
+	err := membership.IterateClientSets(ctx, clients, func(ctx context.Context, cs *membership.ClientSet) (err error) {
+		start := time.Now()
+		defer func() { observeMember(cs, "LeaseTimeToLive", start, err) }()
+
+		var r *etcdserverpb.LeaseTimeToLiveResponse
+		err = s.retryMember(ctx, cs, "LeaseTimeToLive", func() (err error) {
+			r, err = cs.Lease.LeaseTimeToLive(ctx, req)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		mut.Lock()
+		defer mut.Unlock()
+		if !found || r.TTL < resp.TTL {
+			resp.TTL = r.TTL
+		}
+		if r.GrantedTTL > resp.GrantedTTL {
+			resp.GrantedTTL = r.GrantedTTL
+		}
+		found = true
+		if len(r.Keys) > 0 {
+			resp.Keys = append(resp.Keys, r.Keys...)
+			holders = append(holders, cs)
+		}
+		return nil
+	})
+	if err != nil {
+		zap.L().Warn("failed to get lease ttl", zap.Int64("id", req.ID), zap.Error(err))
 		return nil, err
 	}
+	sort.Slice(resp.Keys, func(i, j int) bool { return bytes.Compare(resp.Keys[i], resp.Keys[j]) < 0 })
 
-	reqCopy := *req
-	reqCopy.Revision, err = s.clock.ResolveMetaToMember(ctx, s.coordinator.ClientSet, req.Revision)
+	if req.Keys && s.leases != nil {
+		// Correct the index with what the members reported
+		if resp.TTL == -1 {
+			holders = nil
+		}
+		s.leases.Set(req.ID, holders)
+	}
+	zap.L().Debug("got lease ttl successfully", zap.Int64("id", req.ID), zap.Int64("ttl", resp.TTL), zap.Int("members", len(clients)), zap.Int("keys", len(resp.Keys)))
+	return resp, nil
+}
+
+// Compact compacts each member at the member revision that corresponds to the meta revision, then the coordinator.
+// Physical is forwarded with the rest of the request, so physical compactions don't return until every cluster has
+// removed the compacted keys from its backend.
+//
+// Compaction is idempotent: clusters that were already compacted at or beyond their revision by an earlier attempt are skipped.
+func (s *server) Compact(ctx context.Context, req *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	// Writes allocated a revision at or below the clock's are already ordered in each member by their meta revision,
+	// so the resolved member revisions are consistent even while some of those writes are still in flight: they land
+	// above the resolved revision and aren't compacted. That isn't true of revisions the clock hasn't reached yet.
+	now, err := s.clock.Now(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if req.Revision > now {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
 
-	if _, err = s.coordinator.KV.Compact(ctx, &reqCopy); err != nil {
+	compact := func(ctx context.Context, cs *membership.ClientSet) (err error) {
+		reqCopy := *req // including Physical
+		reqCopy.Revision, err = s.clock.ResolveMetaToMember(ctx, cs, req.Revision)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		_, err = cs.KV.Compact(ctx, &reqCopy)
+		if cs != s.coordinator.ClientSet {
+			observeMember(cs, "Compact", start, err)
+		}
+		if isCompacted(err) {
+			zap.L().Info("cluster was already compacted", zap.String("endpoint", cs.Endpoint), zap.Int64("metaRev", req.Revision), zap.Int64("memberRev", reqCopy.Revision))
+			return nil
+		}
+		return err
+	}
+	if err := s.members.IterateMembers(ctx, compact); err != nil {
+		return nil, err
+	}
+	if err := compact(ctx, s.coordinator.ClientSet); err != nil {
 		return nil, err
 	}
 
-	return &etcdserverpb.CompactionResponse{}, nil
+	return &etcdserverpb.CompactionResponse{Header: &etcdserverpb.ResponseHeader{Revision: now}}, nil
+}
+
+// observeMember records the latency and outcome of a request sent to a member cluster.
+func observeMember(cs *membership.ClientSet, method string, start time.Time, err error) {
+	memberRequestDuration.WithLabelValues(cs.Endpoint, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		memberRequestErrors.WithLabelValues(cs.Endpoint, method).Inc()
+	}
+}
+
+// observeTxnPhase records the duration of a transaction phase that began at start, returning when the next phase begins.
+func observeTxnPhase(phase string, start time.Time) time.Time {
+	now := time.Now()
+	txnPhaseDuration.WithLabelValues(phase).Observe(now.Sub(start).Seconds())
+	return now
+}
+
+// isCompacted returns true if err is a member's compaction error, from either the clientv3 or gRPC clients.
+// Compaction errors should be returned to clients as rpctypes.ErrGRPCCompacted (without wrapping) so their retry logic works.
+func isCompacted(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if rpctypes.Error(err) == rpctypes.ErrCompacted {
+			return true
+		}
+	}
+	return false
 }
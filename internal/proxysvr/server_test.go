@@ -2,17 +2,38 @@ package proxysvr
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/Azure/metaetcd/internal/clock"
 	"github.com/Azure/metaetcd/internal/membership"
@@ -108,169 +129,2756 @@ func TestWatchHappyPath(t *testing.T) {
 		}
 	}
 
+	// Prove all events created after the watch started are eventually receieved
+	events := testutil.CollectEvents(t, watch, n)
+	assert.Equal(t, testutil.NewSeq(12, 22), testutil.GetRevisions(events))
+}
+
+func TestWatchFromRev(t *testing.T) {
+	client, _ := startServer(t)
+
+	// Create some events
+	n := 10
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		require.NoError(t, err)
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := client.Watch(watchCtx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithPrevKV(), clientv3.WithRev(5))
+
 	// Prove all events are eventually receieved
-	events := testutil.CollectEvents(t, watch, 20)
-	assert.Equal(t, testutil.NewSeq(2, 22), testutil.GetRevisions(events))
+	events := testutil.CollectEvents(t, watch, 5)
+	assert.Equal(t, testutil.NewSeq(5, 10), testutil.GetRevisions(events))
+}
+
+func TestWatchFutureRevision(t *testing.T) {
+	t.Run("canceled", func(t *testing.T) {
+		client, _ := startServerWithConfig(t, ServerConfig{CancelFutureWatches: true})
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut("key-1", "")).Commit()
+		require.NoError(t, err)
+
+		watchCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The next revision is not in the future
+		next := client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+
+		wresp := <-client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+10))
+		assert.True(t, wresp.Canceled)
+		assert.Contains(t, wresp.Err().Error(), futureWatchRevision)
+
+		resp, err = client.Txn(ctx).Then(clientv3.OpPut("key-2", "")).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, []int64{resp.Header.Revision}, testutil.GetRevisions(testutil.CollectEvents(t, next, 1)))
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		client, _ := startServer(t)
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut("key-1", "")).Commit()
+		require.NoError(t, err)
+
+		watchCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		start := resp.Header.Revision + 3
+		watch := client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(start))
+
+		// Only events at or after the start revision are delivered
+		for i := 0; i < 4; i++ {
+			_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+			require.NoError(t, err)
+		}
+		assert.Equal(t, testutil.NewSeq(start, start+2), testutil.GetRevisions(testutil.CollectEvents(t, watch, 2)))
+	})
+}
+
+func TestWatchOverlappingOnOneStream(t *testing.T) {
+	client, _ := startServer(t)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+		require.NoError(t, err)
+	}
+
+	// Both watches share a context, so they're multiplexed onto the same stream
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(3))
+	subset := client.Watch(watchCtx, "key-5", clientv3.WithRange("key-9"), clientv3.WithRev(8))
+
+	allEvents := testutil.CollectEvents(t, all, n-1)
+	assert.Equal(t, testutil.NewSeq(3, 12), testutil.GetRevisions(allEvents))
+
+	subsetEvents := testutil.CollectEvents(t, subset, 3)
+	assert.Equal(t, []string{"key-6", "key-7", "key-8"}, testutil.GetKeys(subsetEvents))
+	assert.Equal(t, testutil.NewSeq(8, 11), testutil.GetRevisions(subsetEvents))
+
+	// New events are routed to every matching watch exactly once
+	resp, err := client.Txn(ctx).Then(clientv3.OpPut("key-8", "")).Commit()
+	require.NoError(t, err)
+	assert.Equal(t, []int64{resp.Header.Revision}, testutil.GetRevisions(testutil.CollectEvents(t, all, 1)))
+	assert.Equal(t, []int64{resp.Header.Revision}, testutil.GetRevisions(testutil.CollectEvents(t, subset, 1)))
+}
+
+func TestWatchIDs(t *testing.T) {
+	client, _ := startServer(t)
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(watchCtx)
+	require.NoError(t, err)
+	create := func(key string, id int64) *etcdserverpb.WatchResponse {
+		require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{
+			Key:     []byte(key),
+			WatchId: id,
+		}}}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, resp.Created)
+		return resp
+	}
+
+	assert.Equal(t, int64(1), create("key-a", 1).WatchId, "client-assigned")
+	assert.Equal(t, int64(0), create("key-b", 0).WatchId, "auto-assigned")
+	assert.Equal(t, int64(2), create("key-b", 0).WatchId, "auto-assigned IDs skip client-assigned IDs")
+
+	dup := create("key-b", 1)
+	assert.Equal(t, int64(1), dup.WatchId)
+	assert.True(t, dup.Canceled)
+	assert.Equal(t, duplicateWatchID, dup.CancelReason)
+
+	// Events carry the ID of every watch they match
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("key-a", "")).Commit()
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.WatchId)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, "key-a", string(resp.Events[0].Kv.Key))
+
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("key-b", "")).Commit()
+	require.NoError(t, err)
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, resp.Events, 1)
+		assert.Equal(t, "key-b", string(resp.Events[0].Kv.Key))
+		ids = append(ids, resp.WatchId)
+	}
+	assert.ElementsMatch(t, []int64{0, 2}, ids)
+}
+
+func TestWatchCancel(t *testing.T) {
+	client, s := startServer(t)
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(watchCtx)
+	require.NoError(t, err)
+	create := func(key string, id int64) {
+		require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{
+			Key:     []byte(key),
+			WatchId: id,
+		}}}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, resp.Created)
+		require.False(t, resp.Canceled)
+	}
+	cancelWatch := func(id int64) {
+		require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CancelRequest{CancelRequest: &etcdserverpb.WatchCancelRequest{WatchId: id}}}))
+	}
+	put := func(key string) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		require.NoError(t, err)
+	}
+	recvEvent := func() (int64, string) {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Len(t, resp.Events, 1)
+		return resp.WatchId, string(resp.Events[0].Kv.Key)
+	}
+
+	create("key-a", 1)
+	create("key-b", 2)
+	before := atomic.LoadInt64(&s.activeWatches)
+
+	cancelWatch(1)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Canceled)
+	assert.Equal(t, int64(1), resp.WatchId)
+	assert.Empty(t, resp.CancelReason)
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&s.activeWatches) == before-1 }, time.Second*5, time.Millisecond*10)
+
+	t.Run("canceled watch stops", func(t *testing.T) {
+		put("key-a")
+		put("key-b")
+		id, key := recvEvent()
+		assert.Equal(t, int64(2), id)
+		assert.Equal(t, "key-b", key)
+	})
+
+	t.Run("id is reusable", func(t *testing.T) {
+		create("key-a", 1)
+		put("key-a")
+		id, key := recvEvent()
+		assert.Equal(t, int64(1), id)
+		assert.Equal(t, "key-a", key)
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		cancelWatch(9)
+		put("key-b")
+		id, _ := recvEvent()
+		assert.Equal(t, int64(2), id, "no response to the cancellation")
+	})
+}
+
+func TestWatchFragment(t *testing.T) {
+	client, _ := startServerWithConfig(t, ServerConfig{MaxWatchResponseBytes: 1024})
+
+	// Write a batch larger than the limit and wait for it to be visible to watchers
+	n := 10
+	watchCtx, cancel := context.WithCancel(context.Background())
+	watch := client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), strings.Repeat("a", 256))).Commit()
+		require.NoError(t, err)
+	}
+	testutil.CollectEvents(t, watch, n)
+	cancel()
+
+	// Use the raw stream since the client reassembles fragments
+	watchCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(watchCtx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{
+		Key:           []byte("key-"),
+		RangeEnd:      []byte(clientv3.GetPrefixRangeEnd("key-")),
+		StartRevision: 2,
+		Fragment:      true,
+	}}}))
+
+	created, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, created.Created)
+
+	var frags []*etcdserverpb.WatchResponse
+	var events []*testutil.Item
+	for len(events) < n {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		frags = append(frags, resp)
+		for _, event := range resp.Events {
+			events = append(events, &testutil.Item{KeyValue: event.Kv})
+		}
+	}
+	require.Greater(t, len(frags), 1)
+	for i, frag := range frags {
+		assert.LessOrEqual(t, frag.Size(), 1024)
+		assert.Equal(t, i < len(frags)-1, frag.Fragment, "fragment %d", i)
+	}
+	assert.Equal(t, testutil.NewSeq(2, 12), testutil.GetRevisions(events))
+}
+
+func TestFragmentWatchResponse(t *testing.T) {
+	resp := &etcdserverpb.WatchResponse{WatchId: 1, Header: &etcdserverpb.ResponseHeader{}}
+	for i := 0; i < 5; i++ {
+		resp.Events = append(resp.Events, &mvccpb.Event{Kv: &mvccpb.KeyValue{Key: []byte(fmt.Sprintf("key-%d", i)), Value: make([]byte, 100)}})
+	}
+
+	t.Run("under limit", func(t *testing.T) {
+		assert.Equal(t, []*etcdserverpb.WatchResponse{resp}, fragmentWatchResponse(resp, resp.Size()))
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		frags := fragmentWatchResponse(resp, 250)
+		require.Len(t, frags, 3)
+		var keys []string
+		for _, frag := range frags {
+			for _, event := range frag.Events {
+				keys = append(keys, string(event.Kv.Key))
+			}
+		}
+		assert.Equal(t, []bool{true, true, false}, []bool{frags[0].Fragment, frags[1].Fragment, frags[2].Fragment})
+		assert.Equal(t, []string{"key-0", "key-1", "key-2", "key-3", "key-4"}, keys)
+		assert.False(t, resp.Fragment, "original response is not modified")
+	})
+
+	t.Run("single event over limit", func(t *testing.T) {
+		frags := fragmentWatchResponse(resp, 10)
+		assert.Len(t, frags, 5)
+	})
+}
+
+func TestActiveWatchCount(t *testing.T) {
+	client, _ := startServer(t)
+	before := promtestutil.ToFloat64(activeWatchCount)
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == before+1 }, time.Second*5, time.Millisecond*10)
+
+	cancel()
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == before }, time.Second*5, time.Millisecond*10)
+}
+
+func TestWatchClientDisconnect(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{WatchResponseBufferLen: 1})
+	before := promtestutil.ToFloat64(activeWatchCount)
+
+	watcher, err := clientv3.New(clientv3.Config{Endpoints: client.Endpoints(), DialTimeout: 2 * time.Second})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		watcher.Watch(ctx, fmt.Sprintf("key-%d", i))
+	}
+	watcher.Watch(ctx, "key-", clientv3.WithPrefix()) // not received, so its responses back up
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == before+4 }, time.Second*5, time.Millisecond*10)
+
+	// Disconnect while events are being delivered
+	writeCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; writeCtx.Err() == nil; i++ {
+			client.Txn(writeCtx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i%3), "value")).Commit()
+		}
+	}()
+	time.Sleep(time.Millisecond * 200)
+	require.NoError(t, watcher.Close())
+	time.Sleep(time.Millisecond * 200)
+	cancel()
+	wg.Wait()
+
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == before }, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, s.members.WatchMux.State().Watches)
+
+	// The mux isn't blocked by the closed stream
+	watch := client.Watch(ctx, "key-0")
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("key-0", "value-2")).Commit()
+	require.NoError(t, err)
+	select {
+	case resp := <-watch:
+		require.Len(t, resp.Events, 1)
+		assert.Equal(t, "value-2", string(resp.Events[0].Kv.Value))
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for watch event")
+	}
+}
+
+func TestWatchStreamClose(t *testing.T) {
+	_, s := startServer(t)
+	before := promtestutil.ToFloat64(activeWatchCount)
+
+	stream := &fakeWatchServer{ctx: ctx, recv: make(chan *etcdserverpb.WatchRequest), sent: make(chan *etcdserverpb.WatchResponse, 10)}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Watch(stream) }()
+
+	stream.recv <- &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("key")}}}
+	assert.True(t, (<-stream.sent).Created)
+	assert.Equal(t, before+1, promtestutil.ToFloat64(activeWatchCount))
+
+	// Watch only returns once every goroutine it started, including the sender, has exited
+	close(stream.recv)
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, io.EOF)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the watch stream to close")
+	}
+	assert.Equal(t, before, promtestutil.ToFloat64(activeWatchCount))
+}
+
+// fakeWatchServer is a watch stream that receives from recv until it's closed, then returns io.EOF like a client that closed its end.
+type fakeWatchServer struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *etcdserverpb.WatchRequest
+	sent chan *etcdserverpb.WatchResponse
+}
+
+func (f *fakeWatchServer) Context() context.Context { return f.ctx }
+
+func (f *fakeWatchServer) Send(resp *etcdserverpb.WatchResponse) error {
+	f.sent <- resp
+	return nil
+}
+
+func (f *fakeWatchServer) Recv() (*etcdserverpb.WatchRequest, error) {
+	req, ok := <-f.recv
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func TestWatchSendTimeout(t *testing.T) {
+	client, _ := startServerWithConfig(t, ServerConfig{WatchResponseBufferLen: 1, WatchSendTimeout: time.Millisecond * 200})
+	watchClient := etcdserverpb.NewWatchClient(client.ActiveConnection())
+	beforeWatches := promtestutil.ToFloat64(activeWatchCount)
+	beforeTimeouts := promtestutil.ToFloat64(watchSendTimeouts)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := watchClient.Watch(streamCtx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("key")}}}))
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == beforeWatches+1 }, time.Second*5, time.Millisecond*10)
+
+	// The client stops receiving, so the responses fill gRPC's flow control window and block the sender
+	value := strings.Repeat("a", 256*1024)
+	for i := 0; i < 10; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key", value)).Commit()
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(watchSendTimeouts) == beforeTimeouts+1 }, time.Second*5, time.Millisecond*10)
+	require.Eventually(t, func() bool { return promtestutil.ToFloat64(activeWatchCount) == beforeWatches }, time.Second*5, time.Millisecond*10)
+
+	// The stream was closed instead of hanging
+	for {
+		_, err := stream.Recv()
+		if err != nil {
+			assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+			break
+		}
+	}
+}
+
+func TestWatchLimits(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{MaxWatchesPerStream: 2, MaxWatches: 3})
+	watchClient := etcdserverpb.NewWatchClient(client.ActiveConnection())
+
+	newStream := func() (etcdserverpb.Watch_WatchClient, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(ctx)
+		stream, err := watchClient.Watch(ctx)
+		require.NoError(t, err)
+		return stream, cancel
+	}
+	watch := func(stream etcdserverpb.Watch_WatchClient) *etcdserverpb.WatchResponse {
+		require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("key")}}}))
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.True(t, resp.Created)
+		return resp
+	}
+
+	before := promtestutil.ToFloat64(activeWatchCount)
+	stream1, cancel1 := newStream()
+	assert.False(t, watch(stream1).Canceled)
+	assert.False(t, watch(stream1).Canceled)
+	assert.Equal(t, before+2, promtestutil.ToFloat64(activeWatchCount))
+
+	t.Run("per stream", func(t *testing.T) {
+		resp := watch(stream1)
+		assert.True(t, resp.Canceled)
+		assert.Equal(t, watchLimitExceeded, resp.CancelReason)
+	})
+
+	stream2, cancel2 := newStream()
+	defer cancel2()
+	assert.False(t, watch(stream2).Canceled)
+
+	t.Run("global", func(t *testing.T) {
+		resp := watch(stream2)
+		assert.True(t, resp.Canceled)
+		assert.Equal(t, watchLimitExceeded, resp.CancelReason)
+		assert.Equal(t, int64(3), atomic.LoadInt64(&s.activeWatches))
+		assert.Equal(t, before+3, promtestutil.ToFloat64(activeWatchCount))
+	})
+
+	t.Run("released when the stream closes", func(t *testing.T) {
+		cancel1()
+		require.Eventually(t, func() bool { return atomic.LoadInt64(&s.activeWatches) == 1 }, time.Second*5, time.Millisecond*10)
+		assert.False(t, watch(stream2).Canceled)
+	})
+}
+
+func TestMemberRequestMetrics(t *testing.T) {
+	client, s := startServer(t)
+
+	getSampleCount := func(endpoint, method string) uint64 {
+		m := &dto.Metric{}
+		require.NoError(t, memberRequestDuration.WithLabelValues(endpoint, method).(prometheus.Histogram).Write(m))
+		return m.Histogram.GetSampleCount()
+	}
+
+	t.Run("range", func(t *testing.T) {
+		_, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+		require.NoError(t, err)
+		for _, cs := range s.members.Members() {
+			assert.Equal(t, uint64(1), getSampleCount(cs.Endpoint, "Range"), cs.Endpoint)
+		}
+	})
+
+	t.Run("lease grant error", func(t *testing.T) {
+		_, err := s.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60, ID: 123})
+		require.NoError(t, err)
+		_, err = s.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 30, ID: 123})
+		require.Error(t, err)
+
+		for _, cs := range s.members.Members() {
+			assert.Equal(t, uint64(2), getSampleCount(cs.Endpoint, "LeaseGrant"), cs.Endpoint)
+			assert.Equal(t, float64(1), promtestutil.ToFloat64(memberRequestErrors.WithLabelValues(cs.Endpoint, "LeaseGrant")), cs.Endpoint)
+		}
+	})
+}
+
+func TestTxnPhaseMetrics(t *testing.T) {
+	client, _ := startServer(t)
+	put, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-1")).Commit()
+	require.NoError(t, err)
+
+	phases := []string{"validate", "resolve", "tick", "member"}
+	before := map[string]uint64{}
+	for _, phase := range phases {
+		before[phase] = testutil.GetHistogramCount(t, txnPhaseDuration.WithLabelValues(phase))
+	}
+
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision("key"), "=", put.Header.Revision)).
+		Then(clientv3.OpPut("key", "value-2")).
+		Commit()
+	require.NoError(t, err)
+	require.True(t, resp.Succeeded)
+
+	for _, phase := range phases {
+		assert.Equal(t, before[phase]+1, testutil.GetHistogramCount(t, txnPhaseDuration.WithLabelValues(phase)), phase)
+	}
+}
+
+func TestNewLeaseID(t *testing.T) {
+	seen := map[int64]struct{}{}
+	for i := 0; i < 10000; i++ {
+		id, err := newLeaseID()
+		require.NoError(t, err)
+		require.Positive(t, id)
+		require.NotContains(t, seen, id)
+		seen[id] = struct{}{}
+	}
+}
+
+func TestLeaseGrantIdempotent(t *testing.T) {
+	client, s := startServer(t)
+	lease := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+
+	t.Run("same id twice", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 456, TTL: 60})
+			require.NoError(t, err)
+			assert.Equal(t, int64(456), resp.ID)
+		}
+	})
+
+	t.Run("retry after partial failure", func(t *testing.T) {
+		_, err := s.members.Members()[0].Lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 789, TTL: 60})
+		require.NoError(t, err)
+
+		_, err = lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 789, TTL: 60})
+		require.NoError(t, err)
+		for _, cs := range s.members.Members() {
+			resp, err := cs.Lease.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: 789})
+			require.NoError(t, err)
+			assert.Equal(t, int64(60), resp.GrantedTTL, cs.Endpoint)
+		}
+	})
+
+	t.Run("different ttl", func(t *testing.T) {
+		_, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 456, TTL: 30})
+		assert.Equal(t, rpctypes.ErrGRPCLeaseExist.Error(), err.Error())
+	})
+}
+
+func TestLeaseGrantClampedTTL(t *testing.T) {
+	client, s := startServer(t)
+	members := s.members.Members()
+	members[1].Lease = &clampingLeaseClient{LeaseClient: members[1].Lease, minTTL: 30}
+
+	resp, err := client.Grant(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(30), resp.TTL, "the greatest ttl granted by any member")
+
+	for i, expected := range []int64{10, 30} {
+		ttl, err := members[i].Lease.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: int64(resp.ID)})
+		require.NoError(t, err)
+		assert.Equal(t, expected, ttl.GrantedTTL, members[i].Endpoint)
+	}
+
+	t.Run("agreeing members", func(t *testing.T) {
+		resp, err := client.Grant(ctx, 60)
+		require.NoError(t, err)
+		assert.Equal(t, int64(60), resp.TTL)
+	})
+}
+
+// clampingLeaseClient grants leases with at least minTTL, like etcd's minimum lease TTL.
+type clampingLeaseClient struct {
+	etcdserverpb.LeaseClient
+	minTTL int64
+}
+
+func (c *clampingLeaseClient) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest, opts ...grpc.CallOption) (*etcdserverpb.LeaseGrantResponse, error) {
+	if req.TTL < c.minTTL {
+		clamped := *req
+		clamped.TTL = c.minTTL
+		req = &clamped
+	}
+	return c.LeaseClient.LeaseGrant(ctx, req, opts...)
+}
+
+func TestLeaseGrantParallel(t *testing.T) {
+	const members = 4
+	urls := make([]string, members)
+	for i := range urls {
+		urls[i] = testutil.StartEtcd(t)
+	}
+	svr := newServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), urls, ServerConfig{LeaseGrantConcurrency: 2})
+	client := serve(t, svr, clientv3.Config{})
+	s := svr.(*server)
+	lease := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+
+	tracker := &concurrencyTracker{}
+	for _, cs := range s.members.Members() {
+		cs.Lease = &slowLeaseClient{LeaseClient: cs.Lease, delay: time.Millisecond * 50, tracker: tracker}
+	}
+	ttl := func(cs *membership.ClientSet, id int64) int64 {
+		resp, err := cs.Lease.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: id})
+		require.NoError(t, err)
+		return resp.GrantedTTL
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		resp, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60})
+		require.NoError(t, err)
+		for _, cs := range s.members.Members() {
+			assert.Equal(t, int64(60), ttl(cs, resp.ID), cs.Endpoint)
+		}
+		assert.Equal(t, int64(2), tracker.max())
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		failing := s.members.Members()[members-1]
+		failing.Lease.(*slowLeaseClient).err = errors.New("member is unavailable")
+		defer func() { failing.Lease.(*slowLeaseClient).err = nil }()
+
+		_, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 1001, TTL: 60})
+		require.Error(t, err)
+		for _, cs := range s.members.Members() {
+			assert.Equal(t, int64(0), ttl(cs, 1001), "%s still has the lease", cs.Endpoint)
+		}
+	})
+
+	t.Run("existing lease isn't rolled back", func(t *testing.T) {
+		_, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 1002, TTL: 60})
+		require.NoError(t, err)
+
+		failing := s.members.Members()[0]
+		failing.Lease.(*slowLeaseClient).err = errors.New("member is unavailable")
+		defer func() { failing.Lease.(*slowLeaseClient).err = nil }()
+
+		_, err = lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{ID: 1002, TTL: 60})
+		require.Error(t, err)
+		for _, cs := range s.members.Members() {
+			assert.Equal(t, int64(60), ttl(cs, 1002), cs.Endpoint)
+		}
+	})
+}
+
+func TestLeaseTimeToLive(t *testing.T) {
+	coordinatorURL := testutil.StartEtcd(t)
+	memberURLs := []string{testutil.StartEtcd(t), testutil.StartEtcd(t), testutil.StartEtcd(t)}
+
+	for _, indexed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("indexed %t", indexed), func(t *testing.T) {
+			svr := newServer(t, &membership.GrpcContext{}, coordinatorURL, memberURLs, ServerConfig{LeaseIndex: indexed})
+			client, s := serve(t, svr, clientv3.Config{}), svr.(*server)
+
+			lease, err := client.Grant(ctx, 60)
+			require.NoError(t, err)
+
+			// Attach keys to the lease on only one of the three members
+			holder := s.members.Members()[1]
+			var keys []string
+			for i := 0; len(keys) < 3; i++ {
+				if key := fmt.Sprintf("lease-%t-key-%d", indexed, i); s.members.GetMemberForKey(key) == holder {
+					keys = append(keys, key)
+					_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value", clientv3.WithLease(lease.ID))).Commit()
+					require.NoError(t, err)
+				}
+			}
+
+			before := map[string]uint64{}
+			for _, cs := range s.members.Members() {
+				before[cs.Endpoint] = testutil.GetHistogramCount(t, memberRequestDuration.WithLabelValues(cs.Endpoint, "LeaseTimeToLive"))
+			}
+			resp, err := client.TimeToLive(ctx, lease.ID, clientv3.WithAttachedKeys())
+			require.NoError(t, err)
+			assert.Equal(t, int64(60), resp.GrantedTTL)
+			assert.Greater(t, resp.TTL, int64(0))
+			var attached []string
+			for _, key := range resp.Keys {
+				attached = append(attached, string(key))
+			}
+			sort.Strings(keys)
+			assert.Equal(t, keys, attached)
+
+			for _, cs := range s.members.Members() {
+				queried := testutil.GetHistogramCount(t, memberRequestDuration.WithLabelValues(cs.Endpoint, "LeaseTimeToLive")) > before[cs.Endpoint]
+				assert.Equal(t, !indexed || cs == holder, queried, cs.Endpoint)
+			}
+		})
+	}
+
+	t.Run("missing lease", func(t *testing.T) {
+		svr := newServer(t, &membership.GrpcContext{}, coordinatorURL, memberURLs, ServerConfig{LeaseIndex: true})
+		client := serve(t, svr, clientv3.Config{})
+		resp, err := client.TimeToLive(ctx, 12345, clientv3.WithAttachedKeys())
+		require.NoError(t, err)
+		assert.Equal(t, int64(-1), resp.TTL)
+		assert.Empty(t, resp.Keys)
+	})
+}
+
+func TestWatchCompacted(t *testing.T) {
+	client, _ := startServer(t)
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := client.Watch(watchCtx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithPrevKV(), clientv3.WithRev(-2))
+	event := <-watch
+	assert.EqualError(t, event.Err(), "etcdserver: mvcc: required revision has been compacted")
+}
+
+func TestWatchBeforeBuffer(t *testing.T) {
+	client, _ := startServer(t)
+
+	// Write enough events to trim the watch buffer, and wait for them to be visible to watchers
+	n := 250
+	watchCtx, cancel := context.WithCancel(context.Background())
+	watch := client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+		require.NoError(t, err)
+	}
+	testutil.CollectEvents(t, watch, n)
+	cancel()
+
+	watchCtx, cancel = context.WithCancel(context.Background())
+	resp := <-client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(1))
+	cancel()
+	assert.True(t, resp.Canceled)
+	assert.Equal(t, rpctypes.ErrCompacted, resp.Err())
+	compactRev := resp.CompactRevision
+	require.Greater(t, compactRev, int64(1))
+
+	t.Run("restart from compaction revision", func(t *testing.T) {
+		watchCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watch := client.Watch(watchCtx, "key-", clientv3.WithPrefix(), clientv3.WithRev(compactRev))
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("key-new", "")).Commit()
+		require.NoError(t, err)
+
+		resp := <-watch
+		require.NoError(t, resp.Err())
+		require.NotEmpty(t, resp.Events)
+		assert.GreaterOrEqual(t, resp.Events[0].Kv.ModRevision, compactRev)
+	})
+}
+
+func TestWatchFailingMember(t *testing.T) {
+	client, s := startServer(t)
+	members := s.members.MembersForRange("key-", "key.")
+	require.Len(t, members, 2)
+	failing := members[1]
+	failing.WatchStatus.Close()
+	activeWatches := atomic.LoadInt64(&s.activeWatches)
+
+	t.Run("range watch is canceled", func(t *testing.T) {
+		watchCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		resp := <-client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+		assert.True(t, resp.Canceled)
+		assert.ErrorContains(t, resp.Err(), failing.Endpoint)
+		assert.Equal(t, activeWatches, atomic.LoadInt64(&s.activeWatches))
+	})
+
+	t.Run("single key of a healthy member", func(t *testing.T) {
+		var key string
+		for i := 0; key == ""; i++ {
+			if k := fmt.Sprintf("key-%d", i); s.members.GetMemberForKey(k) != failing {
+				key = k
+			}
+		}
+
+		watchCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		watch := client.Watch(watchCtx, key)
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		require.NoError(t, err)
+		resp := <-watch
+		require.NoError(t, resp.Err())
+		require.Len(t, resp.Events, 1)
+		assert.Equal(t, key, string(resp.Events[0].Kv.Key))
+	})
+}
+
+func TestTxModRevisionComparisonHappyPath(t *testing.T) {
+	const key = "key"
+	client, _ := startServer(t)
+
+	// Create
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+
+	// Update
+	txnResp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision)).
+		Then(clientv3.OpPut(key, "value-2")).Commit()
+	require.NoError(t, err)
+	assert.Equal(t, txnResp.Header.Revision, txnResp.Responses[0].GetResponsePut().Header.Revision)
+	assert.NotEqual(t, createResp.Header.Revision, txnResp.Header.Revision)
+}
+
+func TestClockBypassPrefixes(t *testing.T) {
+	coordinatorURL := testutil.StartEtcd(t)
+	memberURLs := []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}
+	svr := newServerWithClock(t, &membership.GrpcContext{}, coordinatorURL, memberURLs, ServerConfig{}, nil, func(c *clock.Clock) {
+		c.BypassPrefixes = []string{"heartbeat/"}
+	})
+	client, s := serve(t, svr, clientv3.Config{}), svr.(*server)
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+
+	now, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut("heartbeat/a", fmt.Sprintf("value-%d", i)), clientv3.OpGet("heartbeat/a")).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, now, resp.Header.Revision)
+		kvs := resp.Responses[1].GetResponseRange().Kvs
+		require.Len(t, kvs, 1, "the clock update's response is only stripped when it was added")
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(kvs[0].Value))
+	}
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("heartbeat/b", "value")).Commit()
+	require.NoError(t, err)
+
+	after, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, now, after, "writes to bypass keys don't tick the clock")
+
+	t.Run("get", func(t *testing.T) {
+		resp, err := client.Get(ctx, "heartbeat/a")
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-2", string(resp.Kvs[0].Value), "the latest write is visible even though the clock hasn't moved")
+		assert.Equal(t, now, resp.Kvs[0].ModRevision)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		resp, err := client.Get(ctx, "heartbeat/", clientv3.WithPrefix())
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 2)
+		assert.Equal(t, "value-2", string(resp.Kvs[0].Value))
+		assert.Equal(t, "value", string(resp.Kvs[1].Value))
+	})
+
+	t.Run("coordinator marked unhealthy", func(t *testing.T) {
+		s.coordinator.SetHealthy(false)
+		defer s.coordinator.SetHealthy(true)
+
+		_, err := client.Txn(ctx).Then(clientv3.OpPut("heartbeat/a", "value-2")).Commit()
+		require.NoError(t, err)
+
+		_, err = client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("other keys tick the clock", func(t *testing.T) {
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value-2")).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, now+1, resp.Header.Revision)
+
+		getResp, err := client.Get(ctx, "", clientv3.WithFromKey())
+		require.NoError(t, err)
+		var keys []string
+		for _, kv := range getResp.Kvs {
+			keys = append(keys, string(kv.Key)+"="+string(kv.Value))
+		}
+		assert.Equal(t, []string{"heartbeat/a=value-2", "heartbeat/b=value", "key=value-2"}, keys)
+	})
+}
+
+func TestMaxTxnOps(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{MaxTxnOps: 4})
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
+	gets := func(n int) []clientv3.Op {
+		ops := make([]clientv3.Op, n)
+		for i := range ops {
+			ops[i] = clientv3.OpGet("key")
+		}
+		return ops
+	}
+	now, err := s.clock.Now(ctx)
+	require.NoError(t, err)
+
+	t.Run("write at limit", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(append([]clientv3.Op{clientv3.OpPut("key", "value-2")}, gets(2)...)...).Commit()
+		require.NoError(t, err, "3 ops plus the clock update")
+		now++
+	})
+
+	t.Run("write above limit", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(append([]clientv3.Op{clientv3.OpPut("key", "value-3")}, gets(3)...)...).Commit()
+		assert.Equal(t, rpctypes.ErrTooManyOps, err)
+
+		_, err = client.Txn(ctx).Then(clientv3.OpPut("key", "value-3")).Else(append([]clientv3.Op{clientv3.OpPut("key", "value-3")}, gets(3)...)...).Commit()
+		assert.Equal(t, rpctypes.ErrTooManyOps, err)
+
+		current, err := s.clock.Now(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, now, current, "rejected before ticking the clock")
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(gets(4)...).Commit()
+		require.NoError(t, err, "read-only txns don't update the clock")
+
+		_, err = client.Txn(ctx).Then(gets(5)...).Commit()
+		assert.Equal(t, rpctypes.ErrTooManyOps, err)
+	})
+
+	t.Run("compares", func(t *testing.T) {
+		cmps := make([]clientv3.Cmp, 5)
+		for i := range cmps {
+			cmps[i] = clientv3.Compare(clientv3.Value("key"), "=", "value-2")
+		}
+		_, err := client.Txn(ctx).If(cmps[:4]...).Then(clientv3.OpPut("key", "value-3")).Commit()
+		require.NoError(t, err)
+
+		_, err = client.Txn(ctx).If(cmps...).Then(clientv3.OpPut("key", "value-3")).Commit()
+		assert.Equal(t, rpctypes.ErrTooManyOps, err)
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpTxn(nil, gets(5), nil)).Commit()
+		assert.Equal(t, rpctypes.ErrTooManyOps, err)
+	})
+}
+
+func TestTxnResponseOps(t *testing.T) {
+	const key = "key"
+	client, _ := startServer(t)
+
+	t.Run("success", func(t *testing.T) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value-1"), clientv3.OpGet(key)).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		require.True(t, resp.Succeeded)
+		require.Len(t, resp.Responses, 2)
+		assert.NotNil(t, resp.Responses[0].GetResponsePut())
+		assert.Equal(t, []string{key}, testutil.GetKeys(testutil.NewItems(resp.Responses[1].GetResponseRange().Kvs)))
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, "value-2")).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		require.False(t, resp.Succeeded)
+		require.Len(t, resp.Responses, 1)
+		assert.Equal(t, []string{key}, testutil.GetKeys(testutil.NewItems(resp.Responses[0].GetResponseRange().Kvs)))
+	})
+
+	t.Run("no ops", func(t *testing.T) {
+		resp, err := client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).Commit()
+		require.NoError(t, err)
+		assert.Empty(t, resp.Responses)
+	})
+}
+
+func TestTxnBulkPut(t *testing.T) {
+	client, s := startServer(t)
+	members := s.members.Members()
+
+	// Find keys that belong to each member
+	byMember := map[*membership.ClientSet][]string{}
+	for i := 0; len(byMember[members[0]]) < 5 || len(byMember[members[1]]) < 1; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		cs := s.members.GetMemberForKey(key)
+		byMember[cs] = append(byMember[cs], key)
+	}
+	keys := byMember[members[0]][:5]
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch := client.Watch(watchCtx, "key-", clientv3.WithPrefix())
+
+	ops := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		ops[i] = clientv3.OpPut(key, "value-"+key)
+	}
+	resp, err := client.Txn(ctx).Then(ops...).Commit()
+	require.NoError(t, err)
+	require.True(t, resp.Succeeded)
+	rev := resp.Header.Revision
+
+	t.Run("puts share one revision", func(t *testing.T) {
+		get, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+		require.NoError(t, err)
+		require.Len(t, get.Kvs, len(keys))
+		for _, kv := range get.Kvs {
+			assert.Equal(t, "value-"+string(kv.Key), string(kv.Value))
+			assert.Equal(t, rev, kv.ModRevision, string(kv.Key))
+		}
+
+		events := testutil.CollectEvents(t, watch, len(keys))
+		assert.ElementsMatch(t, keys, testutil.GetKeys(events))
+		assert.Equal(t, []int64{rev, rev, rev, rev, rev}, testutil.GetRevisions(events))
+	})
+
+	t.Run("one tick per bulk put", func(t *testing.T) {
+		resp, err := client.Txn(ctx).Then(ops...).Commit()
+		require.NoError(t, err)
+		assert.Equal(t, rev+1, resp.Header.Revision)
+	})
+
+	t.Run("keys of several members", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(keys[0], "value"), clientv3.OpPut(byMember[members[1]][0], "value")).Commit()
+		assert.ErrorContains(t, err, errBulkPutSpansMembers.Error())
+	})
+}
+
+func TestTxnDeleteHeaderRevision(t *testing.T) {
+	client, _ := startServer(t)
+
+	// Write to other keys so the meta and member revisions diverge
+	for i := 0; i < 5; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("other-%d", i), "value")).Commit()
+		require.NoError(t, err)
+	}
+
+	for _, prevKv := range []bool{true, false} {
+		t.Run(fmt.Sprintf("prev kv %t", prevKv), func(t *testing.T) {
+			key := fmt.Sprintf("key-%t", prevKv)
+			putResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+			require.NoError(t, err)
+
+			opts := []clientv3.OpOption{}
+			if prevKv {
+				opts = append(opts, clientv3.WithPrevKV())
+			}
+			resp, err := client.Txn(ctx).Then(clientv3.OpDelete(key, opts...)).Commit()
+			require.NoError(t, err)
+
+			del := resp.Responses[0].GetResponseDeleteRange()
+			assert.Equal(t, int64(1), del.Deleted)
+			assert.Equal(t, resp.Header.Revision, del.Header.Revision)
+			if prevKv {
+				require.Len(t, del.PrevKvs, 1)
+				assert.Equal(t, putResp.Header.Revision, del.PrevKvs[0].ModRevision)
+			} else {
+				assert.Empty(t, del.PrevKvs)
+			}
+		})
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		resp, err := client.Txn(ctx).Then(clientv3.OpDelete("missing", clientv3.WithPrevKV())).Commit()
+		require.NoError(t, err)
+
+		del := resp.Responses[0].GetResponseDeleteRange()
+		assert.Zero(t, del.Deleted)
+		assert.Empty(t, del.PrevKvs)
+		assert.Equal(t, resp.Header.Revision, del.Header.Revision)
+	})
+}
+
+func TestTxnIgnoreValue(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue())).Commit()
+		assert.Equal(t, rpctypes.ErrKeyNotFound, err)
+	})
+
+	t.Run("missing key in a branch that isn't applied", func(t *testing.T) {
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(key), "=", "other")).
+			Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue())).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		assert.False(t, txnResp.Succeeded)
+		require.Len(t, txnResp.Responses, 1)
+		assert.Empty(t, txnResp.Responses[0].GetResponseRange().Kvs)
+	})
+
+	lease, err := client.Grant(ctx, 60)
+	require.NoError(t, err)
+	_, err = client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+
+	t.Run("ignore value", func(t *testing.T) {
+		txnResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue(), clientv3.WithLease(lease.ID))).Commit()
+		require.NoError(t, err)
+
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-1", string(resp.Kvs[0].Value))
+		assert.Equal(t, int64(lease.ID), resp.Kvs[0].Lease)
+		assert.Equal(t, txnResp.Header.Revision, resp.Kvs[0].ModRevision, "the meta revision advances")
+	})
+
+	t.Run("ignore lease", func(t *testing.T) {
+		txnResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-2", clientv3.WithIgnoreLease())).Commit()
+		require.NoError(t, err)
+
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-2", string(resp.Kvs[0].Value))
+		assert.Equal(t, int64(lease.ID), resp.Kvs[0].Lease)
+		assert.Equal(t, txnResp.Header.Revision, resp.Kvs[0].ModRevision)
+	})
+
+	t.Run("conditional", func(t *testing.T) {
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		cmp := clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)
+
+		txnResp, err := client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue())).Commit()
+		require.NoError(t, err)
+		assert.True(t, txnResp.Succeeded)
+
+		txnResp, err = client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue())).Else(clientv3.OpGet(key)).Commit()
+		require.NoError(t, err)
+		assert.False(t, txnResp.Succeeded, "the comparison is stale")
+		assert.Equal(t, "value-2", string(txnResp.Responses[0].GetResponseRange().Kvs[0].Value))
+	})
+
+	t.Run("concurrent write", func(t *testing.T) {
+		// Write the key after its value was read, but before the member applies the txn
+		member := s.members.GetMemberForKey(key)
+		kv := member.KV
+		defer func() { member.KV = kv }()
+		member.KV = &txnHookKVClient{KVClient: kv, onTxn: func() {
+			member.KV = kv
+			_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "concurrent")).Commit()
+			require.NoError(t, err)
+		}}
+
+		// The client's comparison holds, so neither branch may be applied
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(key), "!=", "other")).
+			Then(clientv3.OpPut(key, "", clientv3.WithIgnoreValue())).
+			Else(clientv3.OpPut(key, "failure")).
+			Commit()
+		assert.Equal(t, codes.Aborted, status.Code(err))
+
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "concurrent", string(resp.Kvs[0].Value))
+	})
+}
+
+func TestTxnCreateIfNotExists(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+	member := s.members.GetMemberForKey(key)
+
+	getClockVersion := func() int64 {
+		resp, err := member.ClientV3.Get(ctx, "/meta")
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		return resp.Kvs[0].Version
+	}
+	createIfNotExists := func(value string) *clientv3.TxnResponse {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value)).
+			Else(clientv3.OpGet(key)).Commit()
+		require.NoError(t, err)
+		return resp
+	}
+
+	created := createIfNotExists("value-1")
+	assert.True(t, created.Succeeded)
+	clockVersion := getClockVersion()
+
+	t.Run("key is created at the txn revision", func(t *testing.T) {
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-1", string(resp.Kvs[0].Value))
+		assert.Equal(t, created.Header.Revision, resp.Kvs[0].ModRevision)
+	})
+
+	t.Run("existing key takes the else branch", func(t *testing.T) {
+		resp := createIfNotExists("value-2")
+		assert.False(t, resp.Succeeded)
+		assert.Greater(t, resp.Header.Revision, created.Header.Revision)
+
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "value-1", string(kvs[0].Value))
+		assert.Equal(t, created.Header.Revision, kvs[0].ModRevision)
+
+		// The clock is written once, by the branch that was taken
+		assert.Equal(t, clockVersion+1, getClockVersion())
+	})
+
+	t.Run("deleted key can be created again", func(t *testing.T) {
+		_, err := client.Txn(ctx).Then(clientv3.OpDelete(key)).Commit()
+		require.NoError(t, err)
+
+		resp := createIfNotExists("value-3")
+		assert.True(t, resp.Succeeded)
+	})
+}
+
+func TestTxnCreateRevisionExistence(t *testing.T) {
+	client, _ := startServer(t)
+
+	ifExists := func(key, value string) *clientv3.TxnResponse {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+			Then(clientv3.OpPut(key, value)).
+			Commit()
+		require.NoError(t, err)
+		return resp
+	}
+	ifNotExists := func(key, value string) *clientv3.TxnResponse {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value)).
+			Commit()
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Cover keys on both members
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		t.Run(key, func(t *testing.T) {
+			assert.False(t, ifExists(key, "value-1").Succeeded)
+			resp, err := client.Get(ctx, key)
+			require.NoError(t, err)
+			assert.Len(t, resp.Kvs, 0)
+
+			assert.True(t, ifNotExists(key, "value-1").Succeeded)
+			assert.False(t, ifNotExists(key, "value-2").Succeeded)
+			assert.True(t, ifExists(key, "value-3").Succeeded)
+
+			resp, err = client.Get(ctx, key)
+			require.NoError(t, err)
+			require.Len(t, resp.Kvs, 1)
+			assert.Equal(t, "value-3", string(resp.Kvs[0].Value))
+		})
+	}
+
+	t.Run("nonzero create revision", func(t *testing.T) {
+		_, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision("key-0"), "=", 2)).
+			Then(clientv3.OpPut("key-0", "value")).
+			Commit()
+		assert.Error(t, err)
+	})
+}
+
+func TestTxnCompareLease(t *testing.T) {
+	client, _ := startServer(t)
+	lease, err := client.Grant(ctx, 60)
+	require.NoError(t, err)
+
+	// Spread keys across both members, since every member must evaluate the lease ID the same way
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "initial", clientv3.WithLease(lease.ID))).Commit()
+		require.NoError(t, err)
+
+		resp, err := client.Txn(ctx).If(clientv3.Compare(clientv3.LeaseValue(key), "=", lease.ID)).Then(clientv3.OpPut(key, "attached", clientv3.WithLease(lease.ID))).Commit()
+		require.NoError(t, err)
+		assert.True(t, resp.Succeeded, key)
+
+		resp, err = client.Txn(ctx).If(clientv3.Compare(clientv3.LeaseValue(key), "=", lease.ID+1)).Then(clientv3.OpPut(key, "other")).Commit()
+		require.NoError(t, err)
+		assert.False(t, resp.Succeeded, key)
+
+		get, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, get.Kvs, 1)
+		assert.Equal(t, "attached", string(get.Kvs[0].Value))
+		assert.Equal(t, lease.ID, clientv3.LeaseID(get.Kvs[0].Lease))
+	}
+}
+
+func TestTxModRevisionComparisonIncorrectRev(t *testing.T) {
+	const key = "key"
+	client, _ := startServer(t)
+
+	// Create
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+
+	// Update
+	txnResp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision-1)).
+		Then(clientv3.OpPut(key, "value-2")).Commit()
+	require.NoError(t, err)
+	assert.False(t, txnResp.Succeeded)
+	assert.Zero(t, txnResp.Header.Revision)
+}
+
+func TestTxModRevisionComparisonIncorrectRevWithGet(t *testing.T) {
+	const key = "key"
+	client, _ := startServer(t)
+
+	// Create
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+
+	// Update
+	txnResp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision-1)).
+		Then(clientv3.OpPut(key, "value-2")).
+		Else(clientv3.OpGet(key)).Commit()
+	require.NoError(t, err)
+	assert.False(t, txnResp.Succeeded)
+	assert.Zero(t, txnResp.Header.Revision)
+	require.NotNil(t, txnResp.Responses[0].GetResponseRange())
+	require.Equal(t, "value-1", string(txnResp.Responses[0].GetResponseRange().Kvs[0].Value))
+}
+
+func TestCompaction(t *testing.T) {
+	const key = "key"
+	client, _ := startServer(t)
+
+	// Create and update a key
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+
+	updateResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-2")).Commit()
+	require.NoError(t, err)
+
+	// Compact
+	_, err = client.Compact(ctx, updateResp.Header.Revision)
+	require.NoError(t, err)
+
+	// Try to get older rev
+	_, err = client.Get(ctx, key, clientv3.WithRev(createResp.Header.Revision))
+	require.Equal(t, rpctypes.ErrCompacted, err)
+}
+
+func TestCompactionConcurrentWrites(t *testing.T) {
+	const key = "pinned"
+	client, s := startServer(t)
+
+	// Write to another member until the test is done
+	var other string
+	for i := 0; other == ""; i++ {
+		if k := fmt.Sprintf("key-%d", i); s.members.GetMemberForKey(k) != s.members.GetMemberForKey(key) {
+			other = k
+		}
+	}
+	writeCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; writeCtx.Err() == nil; j++ {
+				client.Txn(writeCtx).Then(clientv3.OpPut(other, fmt.Sprintf("value-%d", j))).Commit()
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer cancel()
+
+	var revs []int64
+	for i := 0; i < 5; i++ {
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i))).Commit()
+		require.NoError(t, err)
+		revs = append(revs, resp.Header.Revision)
+	}
+	rev := revs[len(revs)-1]
+	_, err := client.Compact(ctx, rev)
+	require.NoError(t, err)
+
+	t.Run("consistent", func(t *testing.T) {
+		// Every member can serve the compaction revision
+		resp, err := client.Get(ctx, "", clientv3.WithPrefix(), clientv3.WithRev(rev))
+		require.NoError(t, err)
+		assert.Contains(t, testutil.GetKeys(testutil.NewItems(resp.Kvs)), key)
+
+		resp, err = client.Get(ctx, key, clientv3.WithRev(rev))
+		require.NoError(t, err)
+		assert.Equal(t, "value-4", string(resp.Kvs[0].Value))
+
+		_, err = client.Get(ctx, key, clientv3.WithRev(revs[len(revs)-2]))
+		assert.Equal(t, rpctypes.ErrCompacted, err)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		_, err := client.Compact(ctx, rev)
+		require.NoError(t, err)
+	})
+
+	t.Run("future revision", func(t *testing.T) {
+		_, err := client.Compact(ctx, rev+1000000)
+		assert.Equal(t, rpctypes.ErrFutureRev, err)
+	})
+}
+
+func TestCompactionPhysical(t *testing.T) {
+	client, s := startServer(t)
+
+	var mut sync.Mutex
+	physical := map[string]bool{}
+	record := func(endpoint string) func(*etcdserverpb.CompactionRequest) {
+		return func(req *etcdserverpb.CompactionRequest) {
+			mut.Lock()
+			defer mut.Unlock()
+			physical[endpoint] = req.Physical
+		}
+	}
+	for _, cs := range append(s.members.Members(), s.coordinator.ClientSet) {
+		cs.KV = &compactHookKVClient{KVClient: cs.KV, onCompact: record(cs.Endpoint)}
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []clientv3.CompactOption
+	}{
+		{name: "logical"},
+		{name: "physical", opts: []clientv3.CompactOption{clientv3.WithCompactPhysical()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+			require.NoError(t, err)
+			_, err = client.Compact(ctx, resp.Header.Revision, tc.opts...)
+			require.NoError(t, err)
+
+			require.Len(t, physical, 3, "every member and the coordinator are compacted")
+			for endpoint, p := range physical {
+				assert.Equal(t, len(tc.opts) > 0, p, endpoint)
+			}
+		})
+	}
+}
+
+type compactHookKVClient struct {
+	etcdserverpb.KVClient
+	onCompact func(*etcdserverpb.CompactionRequest)
+}
+
+func (c *compactHookKVClient) Compact(ctx context.Context, req *etcdserverpb.CompactionRequest, opts ...grpc.CallOption) (*etcdserverpb.CompactionResponse, error) {
+	c.onCompact(req)
+	return c.KVClient.Compact(ctx, req, opts...)
+}
+
+func TestRangeFreshestRead(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+	freshCtx := metadata.AppendToOutgoingContext(ctx, freshestReadHeader, "true")
+
+	resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+	rev := resp.Header.Revision
+
+	t.Run("caught up", func(t *testing.T) {
+		resp, err := client.Get(freshCtx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-1", string(resp.Kvs[0].Value))
+		assert.Equal(t, rev, resp.Header.Revision)
+	})
+
+	// Simulate a write that the coordinator's clock hasn't caught up with, e.g. after it regressed
+	member := s.members.GetMemberForKey(key)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(rev+10))
+	_, err = member.ClientV3.Txn(ctx).Then(clientv3.OpPut(key, "value-2"+string(buf)), clientv3.OpPut("/meta", string(buf))).Commit()
+	require.NoError(t, err)
+
+	t.Run("normal", func(t *testing.T) {
+		resp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-1", string(resp.Kvs[0].Value), "the clock hasn't reached the write")
+		assert.Equal(t, rev, resp.Header.Revision)
+	})
+
+	t.Run("freshest", func(t *testing.T) {
+		resp, err := client.Get(freshCtx, key)
+		require.NoError(t, err)
+		require.Len(t, resp.Kvs, 1)
+		assert.Equal(t, "value-2", string(resp.Kvs[0].Value))
+		assert.Equal(t, rev+10, resp.Kvs[0].ModRevision)
+		assert.Equal(t, rev+10, resp.Header.Revision)
+	})
+
+	t.Run("with revision", func(t *testing.T) {
+		_, err := s.Range(metadata.NewIncomingContext(ctx, metadata.Pairs(freshestReadHeader, "true")), &etcdserverpb.RangeRequest{Key: []byte(key), Revision: rev})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestRangeCompactedMember(t *testing.T) {
+	client, s := startServer(t)
+
+	var revs []int64
+	for i := 0; i < 10; i++ {
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+		require.NoError(t, err)
+		revs = append(revs, resp.Header.Revision)
+	}
+
+	// Compact one member directly at its current revision
+	member := s.members.Members()[0]
+	resp, err := member.ClientV3.Get(ctx, "any")
+	require.NoError(t, err)
+	_, err = member.ClientV3.Compact(ctx, resp.Header.Revision)
+	require.NoError(t, err)
+
+	t.Run("too old", func(t *testing.T) {
+		_, err := client.Get(ctx, "key-", clientv3.WithPrefix(), clientv3.WithRev(revs[0]))
+		assert.Equal(t, rpctypes.ErrCompacted, err)
+	})
+
+	t.Run("current", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), resp.Count)
+	})
+}
+
+func TestTxnCompactedComparison(t *testing.T) {
+	const key = "key"
+	client, s := startServer(t)
+
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = client.Txn(ctx).Then(clientv3.OpPut(key, fmt.Sprintf("value-%d", i+2))).Commit()
+		require.NoError(t, err)
+	}
+
+	// Compact the key's member directly at its current revision
+	member := s.members.GetMemberForKey(key)
+	resp, err := member.ClientV3.Get(ctx, key)
+	require.NoError(t, err)
+	_, err = member.ClientV3.Compact(ctx, resp.Header.Revision)
+	require.NoError(t, err)
+
+	t.Run("compacted", func(t *testing.T) {
+		// The key has changed since the compared revision, so the comparison fails like etcd's would
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision)).
+			Then(clientv3.OpPut(key, "value-3")).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		assert.False(t, txnResp.Succeeded)
+		require.Len(t, txnResp.Responses, 1)
+		kvs := txnResp.Responses[0].GetResponseRange().Kvs
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "value-6", string(kvs[0].Value))
+	})
+
+	t.Run("current", func(t *testing.T) {
+		getResp, err := client.Get(ctx, key)
+		require.NoError(t, err)
+		txnResp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", getResp.Kvs[0].ModRevision)).
+			Then(clientv3.OpPut(key, "value-3")).
+			Commit()
+		require.NoError(t, err)
+		assert.True(t, txnResp.Succeeded)
+	})
+}
+
+func TestRangeMemberTimeout(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{MemberTimeout: time.Millisecond * 200})
+
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key-1", "value")).Commit()
+	require.NoError(t, err)
+
+	member := s.members.Members()[1]
+	member.KV = &slowKVClient{KVClient: member.KV, delay: time.Second * 10}
+
+	// Call the server directly since clients retry timeouts until their own deadline
+	start := time.Now()
+	_, err = s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("key-"), RangeEnd: []byte(clientv3.GetPrefixRangeEnd("key-"))})
+	assert.ErrorIs(t, err, rpctypes.ErrGRPCTimeout)
+	assert.Less(t, time.Since(start), time.Second*5)
+}
+
+func TestRangeCanceled(t *testing.T) {
+	_, s := startServer(t)
+
+	var clients []*blockingKVClient
+	for _, member := range s.members.Members() {
+		c := &blockingKVClient{KVClient: member.KV, started: make(chan struct{}), canceled: make(chan time.Time, 1)}
+		member.KV = c
+		clients = append(clients, c)
+	}
+
+	rangeCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Range(rangeCtx, &etcdserverpb.RangeRequest{Key: []byte("key-"), RangeEnd: []byte(clientv3.GetPrefixRangeEnd("key-"))})
+		done <- err
+	}()
+	for _, c := range clients {
+		<-c.started
+	}
+
+	canceledAt := time.Now()
+	cancel()
+	for _, c := range clients {
+		select {
+		case observed := <-c.canceled:
+			assert.Less(t, observed.Sub(canceledAt), time.Second)
+		case <-time.After(time.Second * 5):
+			t.Fatal("member call didn't observe the cancellation")
+		}
+	}
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestRangePartial(t *testing.T) {
+	client, s := startServer(t)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+		require.NoError(t, err)
+	}
+
+	failing := s.members.Members()[1]
+	failing.KV = &failingKVClient{KVClient: failing.KV}
+	kv := etcdserverpb.NewKVClient(client.ActiveConnection())
+	req := &etcdserverpb.RangeRequest{Key: []byte("key-"), RangeEnd: []byte(clientv3.GetPrefixRangeEnd("key-"))}
+
+	t.Run("fail closed by default", func(t *testing.T) {
+		_, err := kv.Range(ctx, req)
+		assert.Error(t, err)
+	})
+
+	t.Run("error names the failing member", func(t *testing.T) {
+		_, err := s.Range(ctx, req)
+		assert.ErrorContains(t, err, failing.Endpoint)
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		var trailer metadata.MD
+		ctx := metadata.AppendToOutgoingContext(ctx, partialRangeHeader, "true")
+		resp, err := kv.Range(ctx, req, grpc.Trailer(&trailer))
+		require.NoError(t, err)
+
+		var expected []string
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if s.members.GetMemberForKey(key) != failing {
+				expected = append(expected, key)
+			}
+		}
+		sort.Strings(expected)
+		require.NotEmpty(t, expected)
+		assert.Equal(t, expected, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+		assert.Equal(t, []string{failing.Endpoint}, trailer.Get(skippedMembersTrailer))
+	})
+}
+
+func TestRangePruning(t *testing.T) {
+	svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{}, membership.NewRangeSharder([]string{"m"}))
+	client := serve(t, svr, clientv3.Config{})
+	s := svr.(*server)
+
+	for _, key := range []string{"a-1", "a-2", "z-1"} {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		require.NoError(t, err)
+	}
+	members := s.members.Members()
+	assert.Equal(t, members[0], s.members.GetMemberForKey("a-1"))
+	assert.Equal(t, members[1], s.members.GetMemberForKey("z-1"))
+
+	// Ranges that don't intersect the failing member's keys shouldn't query it
+	members[1].KV = &failingKVClient{KVClient: members[1].KV}
+
+	resp, err := client.Get(ctx, "a-", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 2)
+	assert.Equal(t, int64(2), resp.Count)
+
+	_, err = s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("a-"), RangeEnd: []byte("\x00")})
+	assert.Error(t, err)
+}
+
+func TestRangeSingleMember(t *testing.T) {
+	svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{}, membership.NewRangeSharder([]string{"m"}))
+	client := serve(t, svr, clientv3.Config{})
+	s := svr.(*server)
+
+	for _, key := range []string{"a-1", "a-2", "a-3", "z-1"} {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		require.NoError(t, err)
+	}
+	members := s.members.Members()
+	counters := make([]*countingKVClient, len(members))
+	for i, member := range members {
+		counters[i] = &countingKVClient{KVClient: member.KV}
+		member.KV = counters[i]
+	}
+
+	resp, err := client.Get(ctx, "a-", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(2))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a-3", "a-2"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+	assert.Equal(t, int64(3), resp.Count)
+	assert.True(t, resp.More)
+	for _, kv := range resp.Kvs {
+		assert.LessOrEqual(t, kv.ModRevision, resp.Header.Revision) // meta revisions, not member revisions
+	}
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&counters[0].ranges))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&counters[1].ranges))
+}
+
+// countingKVClient counts ranges.
+type countingKVClient struct {
+	etcdserverpb.KVClient
+	ranges int64 // atomic
+}
+
+func (c *countingKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	atomic.AddInt64(&c.ranges, 1)
+	return c.KVClient.Range(ctx, req, opts...)
+}
+
+func TestUnownedKey(t *testing.T) {
+	// Keys from "m" onward belong to a second member that hasn't been added
+	svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t)}, ServerConfig{}, membership.NewRangeSharder([]string{"m"}))
+	client := serve(t, svr, clientv3.Config{})
+
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("apple", "value")).Commit()
+	require.NoError(t, err)
+
+	_, err = client.Txn(ctx).Then(clientv3.OpPut("zebra", "value")).Commit()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.Get(ctx, "zebra")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = svr.(*server).freshestRead(ctx, &etcdserverpb.RangeRequest{Key: []byte("zebra")})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestRangeAllKeys(t *testing.T) {
+	sharders := map[string]membership.Sharder{
+		"hashed": nil,
+		"pruned": membership.NewRangeSharder([]string{"m"}),
+	}
+	for name, sharder := range sharders {
+		t.Run(name, func(t *testing.T) {
+			svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{}, sharder)
+			client := serve(t, svr, clientv3.Config{})
+			s := svr.(*server)
+
+			all := []string{"a-1", "a-2", "m-1", "z-1", "z-2"}
+			for _, key := range all {
+				_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+				require.NoError(t, err)
+			}
+			keys := func(resp *clientv3.GetResponse) []string {
+				var keys []string
+				for _, kv := range resp.Kvs {
+					keys = append(keys, string(kv.Key))
+				}
+				return keys
+			}
+
+			t.Run("whole keyspace", func(t *testing.T) {
+				resp, err := client.Get(ctx, "", clientv3.WithPrefix()) // key and end are "\x00"
+				require.NoError(t, err)
+				assert.Equal(t, all, keys(resp), "the clock's keys are hidden")
+				assert.Equal(t, int64(len(all)), resp.Count)
+
+				resp, err = client.Get(ctx, "", clientv3.WithFromKey()) // empty key, end is "\x00"
+				require.NoError(t, err)
+				assert.Equal(t, all, keys(resp))
+			})
+
+			t.Run("whole keyspace with limit", func(t *testing.T) {
+				resp, err := client.Get(ctx, "", clientv3.WithFromKey(), clientv3.WithLimit(2))
+				require.NoError(t, err)
+				assert.Equal(t, all[:2], keys(resp))
+				assert.True(t, resp.More)
+				assert.Equal(t, int64(len(all)), resp.Count)
+			})
+
+			t.Run("whole keyspace count", func(t *testing.T) {
+				resp, err := client.Get(ctx, "", clientv3.WithFromKey(), clientv3.WithCountOnly())
+				require.NoError(t, err)
+				assert.Equal(t, int64(len(all)), resp.Count)
+			})
+
+			t.Run("serializable", func(t *testing.T) {
+				var txns int32
+				for _, cs := range s.members.Members() {
+					kv := cs.KV
+					cs.KV = &txnHookKVClient{KVClient: kv, onTxn: func() { atomic.AddInt32(&txns, 1) }}
+					defer func(cs *membership.ClientSet) { cs.KV = kv }(cs)
+				}
+
+				resp, err := client.Get(ctx, "", clientv3.WithFromKey(), clientv3.WithSerializable())
+				require.NoError(t, err)
+				assert.Equal(t, all, keys(resp), "the clock's keys are hidden")
+				assert.Equal(t, int64(len(all)), resp.Count)
+
+				resp, err = client.Get(ctx, "", clientv3.WithFromKey(), clientv3.WithSerializable(), clientv3.WithLimit(2))
+				require.NoError(t, err)
+				assert.Equal(t, all[:2], keys(resp))
+				assert.Equal(t, int64(len(all)), resp.Count)
+
+				resp, err = client.Get(ctx, "", clientv3.WithFromKey(), clientv3.WithSerializable(), clientv3.WithCountOnly())
+				require.NoError(t, err)
+				assert.Equal(t, int64(len(all)), resp.Count)
+				assert.Zero(t, atomic.LoadInt32(&txns), "serializable ranges aren't sent as transactions")
+			})
+
+			t.Run("from key", func(t *testing.T) {
+				resp, err := client.Get(ctx, "m", clientv3.WithFromKey())
+				require.NoError(t, err)
+				assert.Equal(t, all[2:], keys(resp))
+			})
+
+			t.Run("prefix", func(t *testing.T) {
+				for prefix, expected := range map[string][]string{"a-": all[:2], "m-": all[2:3], "z-": all[3:], "q-": nil} {
+					resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+					require.NoError(t, err)
+					assert.Equal(t, expected, keys(resp), prefix)
+					assert.Equal(t, int64(len(expected)), resp.Count, prefix)
+				}
+			})
+
+			t.Run("end before key", func(t *testing.T) {
+				resp, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("z"), RangeEnd: []byte("a")})
+				require.NoError(t, err)
+				assert.Empty(t, resp.Kvs)
+				assert.Zero(t, resp.Count)
+			})
+
+			t.Run("empty key", func(t *testing.T) {
+				_, err := s.Range(ctx, &etcdserverpb.RangeRequest{RangeEnd: []byte("z")})
+				assert.Equal(t, rpctypes.ErrGRPCEmptyKey, err)
+			})
+		})
+	}
+}
+
+type failingKVClient struct {
+	etcdserverpb.KVClient
+}
+
+func (f *failingKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	return nil, errors.New("member is unavailable")
+}
+
+// blockingKVClient blocks ranges until they're canceled, and records when that happens.
+type blockingKVClient struct {
+	etcdserverpb.KVClient
+	started  chan struct{}
+	canceled chan time.Time
+}
+
+func (b *blockingKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	close(b.started)
+	<-ctx.Done()
+	b.canceled <- time.Now()
+	return nil, ctx.Err()
+}
+
+// slowLeaseClient delays lease grants, optionally failing them, and tracks how many are in flight at once.
+type slowLeaseClient struct {
+	etcdserverpb.LeaseClient
+	delay   time.Duration
+	tracker *concurrencyTracker
+	err     error
+}
+
+func (s *slowLeaseClient) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest, opts ...grpc.CallOption) (*etcdserverpb.LeaseGrantResponse, error) {
+	s.tracker.start()
+	defer s.tracker.done()
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.LeaseClient.LeaseGrant(ctx, req, opts...)
+}
+
+type concurrencyTracker struct {
+	mut             sync.Mutex
+	current, maxVal int64
+}
+
+func (c *concurrencyTracker) start() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.current++
+	if c.current > c.maxVal {
+		c.maxVal = c.current
+	}
+}
+
+func (c *concurrencyTracker) done() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.current--
+}
+
+func (c *concurrencyTracker) max() int64 {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.maxVal
+}
+
+type slowKVClient struct {
+	etcdserverpb.KVClient
+	delay time.Duration
+}
+
+func (s *slowKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.KVClient.Range(ctx, req, opts...)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRange(t *testing.T) {
+	client, _ := startServer(t)
+
+	n := 10
+	var creationRev int64
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i+1)
+		resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		require.NoError(t, err)
+		creationRev = resp.Header.Revision
+	}
+
+	t.Run("all", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")))
+		require.NoError(t, err)
+		assert.False(t, resp.More)
+		assert.Equal(t, int64(n), resp.Count)
+		assert.Equal(t, creationRev, resp.Header.Revision)
+		assert.Equal(t, []string{"key-1", "key-10", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7", "key-8", "key-9"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+	})
+
+	t.Run("at previous rev", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithRev(creationRev-3))
+		require.NoError(t, err)
+		assert.False(t, resp.More)
+		assert.Equal(t, int64(n-3), resp.Count)
+		assert.Equal(t, creationRev-3, resp.Header.Revision)
+		assert.Equal(t, []string{"key-1", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+	})
+
+	t.Run("paging over keys", func(t *testing.T) {
+		var kvs [][]*mvccpb.KeyValue
+		var counts []int64
+		var mores []bool
+		startKey := "key-"
+		for i := 0; i < 5; i++ {
+			resp, err := client.Get(ctx, startKey, clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithLimit(3))
+			require.NoError(t, err)
+
+			kvs = append(kvs, resp.Kvs)
+			counts = append(counts, resp.Count)
+			mores = append(mores, resp.More)
+			if len(resp.Kvs) > 0 {
+				startKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+			}
+		}
+		assert.Equal(t, []string{"key-1", "key-10", "key-2"}, testutil.GetKeys(testutil.NewItems(kvs[0])))
+		assert.Equal(t, []string{"key-3", "key-4", "key-5"}, testutil.GetKeys(testutil.NewItems(kvs[1])))
+		assert.Equal(t, []string{"key-6", "key-7", "key-8"}, testutil.GetKeys(testutil.NewItems(kvs[2])))
+		assert.Equal(t, []string{"key-9"}, testutil.GetKeys(testutil.NewItems(kvs[3])))
+		assert.Len(t, kvs[4], 0)
+		assert.Equal(t, []int64{10, 7, 4, 1, 0}, counts)
+		assert.Equal(t, []bool{true, true, true, false, false}, mores)
+	})
+}
+
+func TestRangeByteBudget(t *testing.T) {
+	budget := 1000
+	client, _ := startServerWithConfig(t, ServerConfig{MaxRangeResponseBytes: budget})
+
+	n := 30
+	var keys []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		keys = append(keys, key)
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, strings.Repeat("v", 100))).Commit()
+		require.NoError(t, err)
+	}
+	before := promtestutil.ToFloat64(rangeTruncationCount)
+
+	resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+	require.NoError(t, err)
+	assert.True(t, resp.More)
+	assert.Equal(t, int64(n), resp.Count, "the count includes truncated keys")
+	require.NotEmpty(t, resp.Kvs)
+	assert.Equal(t, keys[:len(resp.Kvs)], testutil.GetKeys(testutil.NewItems(resp.Kvs)), "the keys are a prefix of the range")
+	var size int
+	for _, kv := range resp.Kvs {
+		size += kv.Size()
+	}
+	assert.LessOrEqual(t, size, budget)
+	assert.Equal(t, before+1, promtestutil.ToFloat64(rangeTruncationCount))
+
+	t.Run("resume from the last key", func(t *testing.T) {
+		var seen []string
+		startKey := "key-"
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(ctx, startKey, clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")))
+			require.NoError(t, err)
+			seen = append(seen, testutil.GetKeys(testutil.NewItems(resp.Kvs))...)
+			if !resp.More {
+				break
+			}
+			startKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+		}
+		assert.Equal(t, keys, seen)
+	})
+
+	t.Run("count only", func(t *testing.T) {
+		resp, err := client.Get(ctx, "key-", clientv3.WithPrefix(), clientv3.WithCountOnly())
+		require.NoError(t, err)
+		assert.False(t, resp.More)
+		assert.Equal(t, int64(n), resp.Count)
+	})
+
+	t.Run("single member", func(t *testing.T) {
+		svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{MaxRangeResponseBytes: budget}, membership.NewRangeSharder([]string{"m"}))
+		client := serve(t, svr, clientv3.Config{})
+		for _, key := range keys {
+			_, err := client.Txn(ctx).Then(clientv3.OpPut(key, strings.Repeat("v", 100))).Commit()
+			require.NoError(t, err)
+		}
+		require.Len(t, svr.(*server).members.MembersForRange("key-", clientv3.GetPrefixRangeEnd("key-")), 1)
+
+		resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+		require.NoError(t, err)
+		assert.True(t, resp.More)
+		assert.Equal(t, int64(n), resp.Count)
+		require.NotEmpty(t, resp.Kvs)
+		assert.Equal(t, keys[:len(resp.Kvs)], testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+		var size int
+		for _, kv := range resp.Kvs {
+			size += kv.Size()
+		}
+		assert.LessOrEqual(t, size, budget)
+	})
+}
+
+func TestRangePagination(t *testing.T) {
+	client, s := startServerWithConfig(t, ServerConfig{MaxRangeResponseBytes: 2000})
+
+	n := 100
+	var keys []string
+	endpoints := map[string]struct{}{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		keys = append(keys, key)
+		endpoints[s.members.GetMemberForKey(key).Endpoint] = struct{}{}
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, strings.Repeat("v", i))).Commit()
+		require.NoError(t, err)
+	}
+	require.Len(t, endpoints, 2, "keys should be spread across both members")
+
+	for _, limit := range []int64{1, 7, 50, 0} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			var seen []string
+			var pages int
+			startKey := "key-"
+			for more := true; more; pages++ {
+				require.Less(t, pages, n+1, "pagination should make progress")
+				resp, err := client.Get(ctx, startKey, clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithLimit(limit))
+				require.NoError(t, err)
+				page := testutil.GetKeys(testutil.NewItems(resp.Kvs))
+				assert.True(t, sort.StringsAreSorted(page))
+				if limit > 0 {
+					assert.LessOrEqual(t, int64(len(page)), limit)
+				}
+
+				seen = append(seen, page...)
+				more = resp.More
+				if more {
+					require.NotEmpty(t, page)
+					startKey = page[len(page)-1] + "\x00"
+				}
+			}
+			assert.Equal(t, keys, seen, "every key should be seen exactly once")
+		})
+	}
+}
+
+func TestMergeRangeKvs(t *testing.T) {
+	newKvs := func() []*mvccpb.KeyValue {
+		// Results arrive in whatever order members respond
+		return []*mvccpb.KeyValue{
+			{Key: []byte("key-c"), ModRevision: 2, Version: 1, Value: []byte("a")},
+			{Key: []byte("key-a"), ModRevision: 3, Version: 2, Value: []byte("c")},
+			{Key: []byte("key-d"), ModRevision: 1, Version: 2, Value: []byte("b")},
+			{Key: []byte("key-b"), ModRevision: 4, Version: 1, Value: []byte("b")},
+		}
+	}
+	testCases := []struct {
+		name     string
+		target   etcdserverpb.RangeRequest_SortTarget
+		order    etcdserverpb.RangeRequest_SortOrder
+		expected []string
+	}{
+		{name: "default", expected: []string{"key-a", "key-b", "key-c", "key-d"}},
+		{name: "key descending", order: etcdserverpb.RangeRequest_DESCEND, expected: []string{"key-d", "key-c", "key-b", "key-a"}},
+		{name: "mod ascending by default", target: etcdserverpb.RangeRequest_MOD, expected: []string{"key-d", "key-c", "key-a", "key-b"}},
+		{name: "mod descending", target: etcdserverpb.RangeRequest_MOD, order: etcdserverpb.RangeRequest_DESCEND, expected: []string{"key-b", "key-a", "key-c", "key-d"}},
+		{name: "version ties broken by key", target: etcdserverpb.RangeRequest_VERSION, expected: []string{"key-b", "key-c", "key-a", "key-d"}},
+		{name: "value ties broken by key", target: etcdserverpb.RangeRequest_VALUE, order: etcdserverpb.RangeRequest_DESCEND, expected: []string{"key-a", "key-d", "key-b", "key-c"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kvs, dups := mergeRangeKvs(&etcdserverpb.RangeRequest{SortTarget: tc.target, SortOrder: tc.order}, newKvs())
+			assert.Zero(t, dups)
+			assert.Equal(t, tc.expected, testutil.GetKeys(testutil.NewItems(kvs)))
+		})
+	}
+
+	t.Run("duplicate keys", func(t *testing.T) {
+		kvs := append(newKvs(),
+			&mvccpb.KeyValue{Key: []byte("key-b"), ModRevision: 5, Value: []byte("newer")},
+			&mvccpb.KeyValue{Key: []byte("key-c"), ModRevision: 1, Value: []byte("older")},
+		)
+		kvs, dups := mergeRangeKvs(&etcdserverpb.RangeRequest{}, kvs)
+		assert.Equal(t, 2, dups)
+		assert.Equal(t, []string{"key-a", "key-b", "key-c", "key-d"}, testutil.GetKeys(testutil.NewItems(kvs)))
+		assert.Equal(t, "newer", string(kvs[1].Value))
+		assert.Equal(t, "a", string(kvs[2].Value))
+	})
+}
+
+func TestRangeConsistentSnapshot(t *testing.T) {
+	client, _ := startServer(t)
+
+	type write struct {
+		key, value string
+		rev        int64
+	}
+	type snapshot struct {
+		rev int64
+		kvs map[string]string
+	}
+
+	// A single writer guarantees that every write at or below the published revision has completed
+	var history []write
+	var published int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%d", i%20)
+			value := strconv.Itoa(i)
+			resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, value)).Commit()
+			if !assert.NoError(t, err) {
+				return
+			}
+			history = append(history, write{key: key, value: value, rev: resp.Header.Revision})
+			atomic.StoreInt64(&published, resp.Header.Revision)
+		}
+	}()
+
+	var snapshots []snapshot
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		rev := atomic.LoadInt64(&published)
+		if rev == 0 {
+			continue
+		}
+		resp, err := client.Get(ctx, "key-", clientv3.WithPrefix(), clientv3.WithRev(rev))
+		require.NoError(t, err)
+		snap := snapshot{rev: rev, kvs: map[string]string{}}
+		for _, kv := range resp.Kvs {
+			assert.LessOrEqual(t, kv.ModRevision, rev)
+			snap.kvs[string(kv.Key)] = string(kv.Value)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	require.NotEmpty(t, snapshots)
+
+	for _, snap := range snapshots {
+		expected := map[string]string{}
+		for _, w := range history {
+			if w.rev <= snap.rev {
+				expected[w.key] = w.value
+			}
+		}
+		assert.Equal(t, expected, snap.kvs, "snapshot at rev %d", snap.rev)
+	}
+}
+
+func TestRangeStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		strict  bool
+		sharder membership.Sharder
+	}{
+		{name: "strict=false", strict: false},
+		{name: "strict=true", strict: true},
+		{name: "single member", strict: true, sharder: membership.NewRangeSharder([]string{"m"})},
+	} {
+		strict := tc.strict
+		t.Run(tc.name, func(t *testing.T) {
+			svr := newShardedServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{StrictRanges: strict}, tc.sharder)
+			client, s := serve(t, svr, clientv3.Config{}), svr.(*server)
+			for i := 0; i < 4; i++ {
+				_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "")).Commit()
+				require.NoError(t, err)
+			}
+
+			// Allocate a revision for a write that lands on its member while the range reads it
+			const key = "key-pending"
+			member := s.members.GetMemberForKey(key)
+			pendingRev, err := s.clock.Tick(ctx)
+			require.NoError(t, err)
+			var once sync.Once
+			member.KV = &hookKVClient{KVClient: member.KV, onRange: func() {
+				once.Do(func() {
+					req := &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key)}}}}}
+					s.clock.MungeTxn(pendingRev, req)
+					_, err := member.KV.Txn(ctx, req)
+					require.NoError(t, err)
+				})
+			}}
+			before := promtestutil.ToFloat64(strictRangeRetries)
+
+			resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, resp.Header.Revision, pendingRev)
+			keys := testutil.GetKeys(testutil.NewItems(resp.Kvs))
+			if strict {
+				assert.Contains(t, keys, key)
+				assert.Equal(t, before+1, promtestutil.ToFloat64(strictRangeRetries))
+			} else {
+				assert.NotContains(t, keys, key, "the write landed after the member was resolved")
+			}
+		})
+	}
+}
+
+// hookKVClient calls onRange before each range.
+type hookKVClient struct {
+	etcdserverpb.KVClient
+	onRange func()
 }
 
-func TestWatchFromRev(t *testing.T) {
+func (h *hookKVClient) Range(ctx context.Context, req *etcdserverpb.RangeRequest, opts ...grpc.CallOption) (*etcdserverpb.RangeResponse, error) {
+	h.onRange()
+	return h.KVClient.Range(ctx, req, opts...)
+}
+
+func TestRangeCountOnly(t *testing.T) {
 	client, _ := startServer(t)
+	etcd, err := clientv3.New(clientv3.Config{Endpoints: []string{testutil.StartEtcd(t)}})
+	require.NoError(t, err)
+	defer etcd.Close()
 
-	// Create some events
 	n := 10
 	for i := 0; i < n; i++ {
 		key := fmt.Sprintf("key-%d", i)
-		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+		require.NoError(t, err)
+		_, err = etcd.Put(ctx, key, "value")
 		require.NoError(t, err)
 	}
 
-	watchCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	watch := client.Watch(watchCtx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithPrevKV(), clientv3.WithRev(5))
+	for _, tc := range []struct {
+		name, key string
+		opts      []clientv3.OpOption
+	}{
+		{name: "no limit", key: "key-", opts: []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly()}},
+		{name: "limit", key: "key-", opts: []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithLimit(3)}},
+		{name: "limit over count", key: "key-", opts: []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCountOnly(), clientv3.WithLimit(int64(n) + 1)}},
+		{name: "single key", key: "key-1", opts: []clientv3.OpOption{clientv3.WithCountOnly()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expected, err := etcd.Get(ctx, tc.key, tc.opts...)
+			require.NoError(t, err)
+			actual, err := client.Get(ctx, tc.key, tc.opts...)
+			require.NoError(t, err)
 
-	// Prove all events are eventually receieved
-	events := testutil.CollectEvents(t, watch, 5)
-	assert.Equal(t, testutil.NewSeq(2, 7), testutil.GetRevisions(events))
+			assert.Equal(t, expected.Count, actual.Count)
+			assert.Equal(t, expected.More, actual.More)
+			assert.Len(t, actual.Kvs, len(expected.Kvs))
+		})
+	}
 }
 
-func TestWatchCompacted(t *testing.T) {
-	client, _ := startServer(t)
+func TestRangeLogging(t *testing.T) {
+	client, s := startServer(t)
+	_, err := client.Txn(ctx).Then(clientv3.OpPut("key", "value")).Commit()
+	require.NoError(t, err)
 
-	watchCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
 
-	watch := client.Watch(watchCtx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithPrevKV(), clientv3.WithRev(-2))
-	event := <-watch
-	assert.EqualError(t, event.Err(), "etcdserver: mvcc: required revision has been compacted")
+	for i := 0; i < 10; i++ {
+		_, err := client.Get(ctx, "key")
+		require.NoError(t, err)
+		_, err = client.Get(ctx, "key", clientv3.WithPrefix())
+		require.NoError(t, err)
+	}
+	assert.Zero(t, logs.Len(), "successful requests shouldn't be logged at info level")
+
+	// Errors are still logged
+	member := s.members.GetMemberForKey("key")
+	member.KV = &failingKVClient{KVClient: member.KV}
+	_, err = client.Get(ctx, "key")
+	require.Error(t, err)
+	assert.NotZero(t, logs.Len())
 }
 
-func TestTxModRevisionComparisonHappyPath(t *testing.T) {
-	const key = "key"
-	client, _ := startServer(t)
+func TestRangeDuplicateKey(t *testing.T) {
+	client, s := startServer(t)
 
-	// Create
-	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
-	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "original")).Commit()
+		require.NoError(t, err)
+	}
 
-	// Update
-	txnResp, err := client.Txn(ctx).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision)).
-		Then(clientv3.OpPut(key, "value-2")).Commit()
+	// Copy a key to the member that doesn't own it, then update the original
+	const key = "key-1"
+	owner := s.members.GetMemberForKey(key)
+	other := s.members.Members()[0]
+	if other == owner {
+		other = s.members.Members()[1]
+	}
+	raw, err := owner.ClientV3.Get(ctx, key)
 	require.NoError(t, err)
-	assert.Equal(t, txnResp.Header.Revision, txnResp.Responses[0].GetResponsePut().Header.Revision)
-	assert.NotEqual(t, createResp.Header.Revision, txnResp.Header.Revision)
+	require.Len(t, raw.Kvs, 1)
+	_, err = other.ClientV3.Put(ctx, key, string(raw.Kvs[0].Value))
+	require.NoError(t, err)
+	_, err = client.Txn(ctx).Then(clientv3.OpPut(key, "updated")).Commit()
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(ctx, "key-", clientv3.WithPrefix(), clientv3.WithLimit(2))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"key-0", "key-1"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+		assert.Equal(t, "updated", string(resp.Kvs[1].Value))
+		assert.Equal(t, int64(4), resp.Count)
+		assert.True(t, resp.More)
+	}
 }
 
-func TestTxModRevisionComparisonIncorrectRev(t *testing.T) {
-	const key = "key"
-	client, _ := startServer(t)
+func TestRangeCompressed(t *testing.T) {
+	_, svr := startServer(t)
+	client := serve(t, svr, clientv3.Config{
+		DialOptions: []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name))},
+	})
 
-	// Create
-	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
-	require.NoError(t, err)
+	n := 20
+	value := strings.Repeat("compressible", 1024*64)
+	for i := 0; i < n; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), value)).Commit()
+		require.NoError(t, err)
+	}
 
-	// Update
-	txnResp, err := client.Txn(ctx).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision-1)).
-		Then(clientv3.OpPut(key, "value-2")).Commit()
+	resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
 	require.NoError(t, err)
-	assert.False(t, txnResp.Succeeded)
-	assert.Zero(t, txnResp.Header.Revision)
+	assert.Equal(t, int64(n), resp.Count)
+	require.Len(t, resp.Kvs, n)
+	for _, kv := range resp.Kvs {
+		assert.Equal(t, value, string(kv.Value))
+	}
 }
 
-func TestTxModRevisionComparisonIncorrectRevWithGet(t *testing.T) {
-	const key = "key"
-	client, _ := startServer(t)
+func TestRangeTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		// Tracers obtained before the first provider was set stay bound to it, so shut it down to stop recording
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
 
-	// Create
-	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	client, _ := startServer(t)
+	_, err := client.Get(ctx, "key-", clientv3.WithPrefix())
 	require.NoError(t, err)
 
-	// Update
-	txnResp, err := client.Txn(ctx).
-		If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision-1)).
-		Then(clientv3.OpPut(key, "value-2")).
-		Else(clientv3.OpGet(key)).Commit()
-	require.NoError(t, err)
-	assert.False(t, txnResp.Succeeded)
-	assert.Zero(t, txnResp.Header.Revision)
-	require.NotNil(t, txnResp.Responses[0].GetResponseRange())
-	require.Equal(t, "value-1", string(txnResp.Responses[0].GetResponseRange().Kvs[0].Value))
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	parentOf := func(span sdktrace.ReadOnlySpan) string {
+		for _, s := range recorder.Ended() {
+			if s.SpanContext().SpanID() == span.Parent().SpanID() {
+				return s.Name()
+			}
+		}
+		return ""
+	}
+
+	require.Len(t, spans["Range"], 1)
+	require.Len(t, spans["Clock.Now"], 1)
+	assert.Equal(t, "Range", parentOf(spans["Clock.Now"][0]))
+	require.Len(t, spans["Pool.IterateMembers"], 1)
+	assert.Equal(t, "Range", parentOf(spans["Pool.IterateMembers"][0]))
+	require.Len(t, spans["rangeWithClient"], 2)
+	require.Len(t, spans["Clock.ResolveMetaToMember"], 2)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "Pool.IterateMembers", parentOf(spans["rangeWithClient"][i]))
+		assert.Equal(t, "rangeWithClient", parentOf(spans["Clock.ResolveMetaToMember"][i]))
+	}
 }
 
-func TestCompaction(t *testing.T) {
+func TestReadOnlyTxn(t *testing.T) {
 	const key = "key"
-	client, _ := startServer(t)
+	client, s := startServer(t)
 
-	// Create and update a key
-	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-1")).Commit()
+	createResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
 	require.NoError(t, err)
 
-	updateResp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value-2")).Commit()
-	require.NoError(t, err)
+	member := s.members.GetMemberForKey(key)
+	getMemberRev := func() int64 {
+		resp, err := member.ClientV3.Get(ctx, key)
+		require.NoError(t, err)
+		return resp.Header.Revision
+	}
+	memberRevBefore := getMemberRev()
 
-	// Compact
-	_, err = client.Compact(ctx, updateResp.Header.Revision)
-	require.NoError(t, err)
+	t.Run("succeeded", func(t *testing.T) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", createResp.Header.Revision)).
+			Then(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		assert.True(t, resp.Succeeded)
+		assert.Equal(t, createResp.Header.Revision, resp.Header.Revision)
+		require.Len(t, resp.Responses, 1)
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "value", string(kvs[0].Value))
+		assert.Equal(t, createResp.Header.Revision, kvs[0].ModRevision)
+	})
 
-	// Try to get older rev
-	_, err = client.Get(ctx, key, clientv3.WithRev(createResp.Header.Revision))
-	require.EqualError(t, err, "etcdserver: mvcc: required revision has been compacted")
-}
+	t.Run("failed", func(t *testing.T) {
+		resp, err := client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(key), "=", "other")).
+			Then(clientv3.OpGet(key)).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		require.NoError(t, err)
+		assert.False(t, resp.Succeeded)
+		assert.Equal(t, createResp.Header.Revision, resp.Header.Revision)
+	})
 
-func TestRange(t *testing.T) {
-	client, _ := startServer(t)
+	t.Run("clocks have not advanced", func(t *testing.T) {
+		now, err := s.clock.Now(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, createResp.Header.Revision, now)
+		assert.Equal(t, memberRevBefore, getMemberRev())
+	})
 
-	n := 10
-	var creationRev int64
-	for i := 0; i < n; i++ {
-		key := fmt.Sprintf("key-%d", i+1)
-		resp, err := client.Txn(ctx).Then(clientv3.OpPut(key, "")).Commit()
+	t.Run("revision is current", func(t *testing.T) {
+		otherResp, err := client.Txn(ctx).Then(clientv3.OpPut("other-key", "value")).Commit()
 		require.NoError(t, err)
-		creationRev = resp.Header.Revision
-	}
 
-	t.Run("all", func(t *testing.T) {
-		resp, err := client.Get(ctx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")))
+		resp, err := client.Txn(ctx).Then(clientv3.OpGet(key)).Commit()
 		require.NoError(t, err)
-		assert.False(t, resp.More)
-		assert.Equal(t, int64(n), resp.Count)
-		assert.Equal(t, creationRev, resp.Header.Revision)
-		assert.Equal(t, []string{"key-1", "key-10", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7", "key-8", "key-9"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+		assert.Equal(t, otherResp.Header.Revision, resp.Header.Revision)
 	})
 
-	t.Run("at previous rev", func(t *testing.T) {
-		resp, err := client.Get(ctx, "key-", clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithRev(creationRev-3))
+	t.Run("reads are pinned to the revision", func(t *testing.T) {
+		// Write the key after the txn's revision was read, but before the member evaluates the txn
+		kv := member.KV
+		defer func() { member.KV = kv }()
+		var writeResp *clientv3.TxnResponse
+		member.KV = &txnHookKVClient{KVClient: kv, onTxn: func() {
+			member.KV = kv
+			var err error
+			writeResp, err = client.Txn(ctx).Then(clientv3.OpPut(key, "value-2")).Commit()
+			require.NoError(t, err)
+		}}
+
+		resp, err := client.Txn(ctx).Then(clientv3.OpGet(key)).Commit()
 		require.NoError(t, err)
-		assert.False(t, resp.More)
-		assert.Equal(t, int64(n-3), resp.Count)
-		assert.Equal(t, creationRev-3, resp.Header.Revision)
-		assert.Equal(t, []string{"key-1", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+		require.NotNil(t, writeResp)
+		assert.Less(t, resp.Header.Revision, writeResp.Header.Revision)
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "value", string(kvs[0].Value))
 	})
 
-	t.Run("paging over keys", func(t *testing.T) {
-		var kvs [][]*mvccpb.KeyValue
-		var counts []int64
-		var mores []bool
-		startKey := "key-"
-		for i := 0; i < 5; i++ {
-			resp, err := client.Get(ctx, startKey, clientv3.WithRange(clientv3.GetPrefixRangeEnd("key-")), clientv3.WithLimit(3))
-			require.NoError(t, err)
+	t.Run("explicit revision", func(t *testing.T) {
+		resp, err := client.Txn(ctx).Then(clientv3.OpGet(key, clientv3.WithRev(createResp.Header.Revision))).Commit()
+		require.NoError(t, err)
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		require.Len(t, kvs, 1)
+		assert.Equal(t, "value", string(kvs[0].Value))
+		assert.Equal(t, createResp.Header.Revision, kvs[0].ModRevision)
+	})
 
-			kvs = append(kvs, resp.Kvs)
-			counts = append(counts, resp.Count)
-			mores = append(mores, resp.More)
-			if len(resp.Kvs) > 0 {
-				startKey = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	t.Run("future revision", func(t *testing.T) {
+		now, err := s.clock.Now(ctx)
+		require.NoError(t, err)
+		_, err = client.Txn(ctx).Then(clientv3.OpGet(key, clientv3.WithRev(now+1))).Commit()
+		assert.Equal(t, rpctypes.ErrFutureRev, err)
+	})
+}
+
+// txnHookKVClient calls onTxn before each transaction.
+type txnHookKVClient struct {
+	etcdserverpb.KVClient
+	onTxn func()
+}
+
+func (h *txnHookKVClient) Txn(ctx context.Context, req *etcdserverpb.TxnRequest, opts ...grpc.CallOption) (*etcdserverpb.TxnResponse, error) {
+	h.onTxn()
+	return h.KVClient.Txn(ctx, req, opts...)
+}
+
+// BenchmarkTxn compares the coordinator load of read-only and mutating txns.
+func BenchmarkTxn(b *testing.B) {
+	const key = "key"
+	client, s := startServer(b)
+	_, err := client.Txn(ctx).Then(clientv3.OpPut(key, "value")).Commit()
+	require.NoError(b, err)
+
+	getCoordinatorRev := func() int64 {
+		resp, err := s.coordinator.ClientV3.Get(ctx, "/meta")
+		require.NoError(b, err)
+		return resp.Header.Revision
+	}
+
+	for _, bc := range []struct {
+		name string
+		op   clientv3.Op
+	}{
+		{name: "read-only", op: clientv3.OpGet(key)},
+		{name: "write", op: clientv3.OpPut(key, "value")},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			before := getCoordinatorRev()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := client.Txn(ctx).If(clientv3.Compare(clientv3.Value(key), "=", "value")).Then(bc.op).Commit()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(getCoordinatorRev()-before)/float64(b.N), "coordinator-writes/op")
+		})
+	}
+}
+
+// BenchmarkBulkPut compares the coordinator load of loading keys one at a time and with bulk puts.
+func BenchmarkBulkPut(b *testing.B) {
+	const keys, batch = 10000, 100
+	svr := newServer(b, &membership.GrpcContext{}, testutil.StartEtcd(b), []string{testutil.StartEtcd(b)}, ServerConfig{})
+	client := serve(b, svr, clientv3.Config{})
+	s := svr.(*server)
+
+	getCoordinatorRev := func() int64 {
+		resp, err := s.coordinator.ClientV3.Get(ctx, "/meta")
+		require.NoError(b, err)
+		return resp.Header.Revision
+	}
+
+	for _, batchSize := range []int{1, batch} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			before := getCoordinatorRev()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < keys; j += batchSize {
+					ops := make([]clientv3.Op, batchSize)
+					for k := range ops {
+						ops[k] = clientv3.OpPut(fmt.Sprintf("key-%d", j+k), "value")
+					}
+					if _, err := client.Txn(ctx).Then(ops...).Commit(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(getCoordinatorRev()-before)/float64(b.N), "coordinator-writes/op")
+		})
+	}
+}
+
+// BenchmarkRangeConcurrency measures range latency across many members with simulated network latency.
+func BenchmarkRangeConcurrency(b *testing.B) {
+	const members = 10
+	urls := make([]string, members)
+	for i := range urls {
+		urls[i] = testutil.StartEtcd(b)
+	}
+	svr := newServer(b, &membership.GrpcContext{}, testutil.StartEtcd(b), urls, ServerConfig{})
+	client := serve(b, svr, clientv3.Config{})
+	s := svr.(*server)
+
+	for i := 0; i < members*10; i++ {
+		_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("key-%d", i), "value")).Commit()
+		require.NoError(b, err)
+	}
+	for _, member := range s.members.Members() {
+		member.KV = &slowKVClient{KVClient: member.KV, delay: time.Millisecond * 5}
+	}
+
+	for _, concurrency := range []int{1, 4, 10} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			s.config.RangeConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				_, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLeaseGrant(b *testing.B) {
+	const members = 10
+	urls := make([]string, members)
+	for i := range urls {
+		urls[i] = testutil.StartEtcd(b)
+	}
+	svr := newServer(b, &membership.GrpcContext{}, testutil.StartEtcd(b), urls, ServerConfig{})
+	client := serve(b, svr, clientv3.Config{})
+	s := svr.(*server)
+	lease := etcdserverpb.NewLeaseClient(client.ActiveConnection())
+
+	for _, member := range s.members.Members() {
+		member.Lease = &slowLeaseClient{LeaseClient: member.Lease, delay: time.Millisecond * 5, tracker: &concurrencyTracker{}}
+	}
+
+	for _, concurrency := range []int{1, 4, 10} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			s.config.LeaseGrantConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				_, err := lease.LeaseGrant(ctx, &etcdserverpb.LeaseGrantRequest{TTL: 60})
+				if err != nil {
+					b.Fatal(err)
+				}
 			}
+		})
+	}
+}
+
+func BenchmarkRangePruning(b *testing.B) {
+	prefixes := []string{"a-", "b-", "c-", "d-"}
+	sharders := map[string]membership.Sharder{
+		"full-fan-out": nil,
+		"pruned":       membership.NewRangeSharder([]string{"b", "c", "d"}),
+	}
+	clients := map[string]*clientv3.Client{}
+	for name, sharder := range sharders {
+		urls := make([]string, len(prefixes))
+		for i := range urls {
+			urls[i] = testutil.StartEtcd(b)
 		}
-		assert.Equal(t, []string{"key-1", "key-10", "key-2"}, testutil.GetKeys(testutil.NewItems(kvs[0])))
-		assert.Equal(t, []string{"key-3", "key-4", "key-5"}, testutil.GetKeys(testutil.NewItems(kvs[1])))
-		assert.Equal(t, []string{"key-6", "key-7", "key-8"}, testutil.GetKeys(testutil.NewItems(kvs[2])))
-		assert.Equal(t, []string{"key-9"}, testutil.GetKeys(testutil.NewItems(kvs[3])))
-		assert.Len(t, kvs[4], 0)
-		assert.Equal(t, []int64{10, 7, 4, 1, 0}, counts)
-		assert.Equal(t, []bool{true, true, true, false, false}, mores)
+		svr := newShardedServer(b, &membership.GrpcContext{}, testutil.StartEtcd(b), urls, ServerConfig{}, sharder)
+		client := serve(b, svr, clientv3.Config{})
+
+		for _, prefix := range prefixes {
+			for i := 0; i < 10; i++ {
+				_, err := client.Txn(ctx).Then(clientv3.OpPut(fmt.Sprintf("%s%d", prefix, i), "value")).Commit()
+				require.NoError(b, err)
+			}
+		}
+		for _, member := range svr.(*server).members.Members() {
+			member.KV = &slowKVClient{KVClient: member.KV, delay: time.Millisecond * 5}
+		}
+		clients[name] = client
+	}
+
+	for name, client := range clients {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := client.Get(ctx, "a-", clientv3.WithPrefix())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	svr := newServer(t, &membership.GrpcContext{}, testutil.StartEtcd(t), []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}, ServerConfig{})
+	client, grpcServer := serveWithGRPCServer(t, svr, clientv3.Config{})
+
+	// Use the raw stream to observe exactly how it ends
+	stream, err := etcdserverpb.NewWatchClient(client.ActiveConnection()).Watch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: &etcdserverpb.WatchCreateRequest{
+		Key:      []byte("key-"),
+		RangeEnd: []byte(clientv3.GetPrefixRangeEnd("key-")),
+	}}}))
+	created, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, created.Created)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	require.NoError(t, svr.Shutdown(shutdownCtx, grpcServer))
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Canceled)
+	assert.Equal(t, created.WatchId, resp.WatchId)
+	assert.Equal(t, rpctypes.ErrStopped.Error(), resp.CancelReason)
+
+	// The stream ends cleanly rather than with a transport error
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+
+	t.Run("new requests are rejected", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.Get(ctx, "key-1")
+		assert.Error(t, err)
 	})
 }
 
@@ -308,39 +2916,135 @@ func TestReconstituteClockOnWrite(t *testing.T) {
 	assert.Equal(t, createResp.Header.Revision+1, secondCreateResp.Header.Revision)
 }
 
+func TestNamespaces(t *testing.T) {
+	coordinatorURL := testutil.StartEtcd(t)
+	memberURLs := []string{testutil.StartEtcd(t), testutil.StartEtcd(t)}
+	newClient := func(ns string) *clientv3.Client {
+		gc := &membership.GrpcContext{Scheme: membership.Scheme{Namespace: ns}}
+		return serve(t, newServer(t, gc, coordinatorURL, memberURLs, ServerConfig{}), clientv3.Config{})
+	}
+	a := newClient("/a")
+	b := newClient("/b")
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watch := a.Watch(watchCtx, "key-", clientv3.WithPrefix())
+
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err := b.Txn(ctx).Then(clientv3.OpPut(key, "b")).Commit()
+		require.NoError(t, err)
+
+		// Creating the key succeeds since it doesn't exist in a's namespace
+		resp, err := a.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", 0)).Then(clientv3.OpPut(key, "a")).Commit()
+		require.NoError(t, err)
+		assert.True(t, resp.Succeeded, key)
+	}
+
+	t.Run("range", func(t *testing.T) {
+		for client, val := range map[*clientv3.Client]string{a: "a", b: "b"} {
+			resp, err := client.Get(ctx, "key-", clientv3.WithPrefix())
+			require.NoError(t, err)
+			assert.Equal(t, []string{"key-0", "key-1", "key-2", "key-3"}, testutil.GetKeys(testutil.NewItems(resp.Kvs)))
+			for _, kv := range resp.Kvs {
+				assert.Equal(t, val, string(kv.Value))
+			}
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		for _, event := range testutil.CollectEvents(t, watch, 4) {
+			assert.Equal(t, "a", string(event.Value))
+		}
+	})
+
+	t.Run("members", func(t *testing.T) {
+		var keys []string
+		for _, url := range memberURLs {
+			member, err := clientv3.New(clientv3.Config{Endpoints: []string{url}})
+			require.NoError(t, err)
+			defer member.Close()
+			resp, err := member.Get(ctx, "/a", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+			require.NoError(t, err)
+			keys = append(keys, testutil.GetKeys(testutil.NewItems(resp.Kvs))...)
+		}
+		assert.Contains(t, keys, "/akey-0")
+		assert.Contains(t, keys, "/a/meta", "the clock is namespaced")
+	})
+}
+
 func startServer(t testing.TB) (*clientv3.Client, *server) {
+	return startServerWithConfig(t, ServerConfig{})
+}
+
+func startServerWithConfig(t testing.TB, config ServerConfig) (*clientv3.Client, *server) {
 	coordinatoorURL := testutil.StartEtcd(t)
 	member1URL := testutil.StartEtcd(t)
 	member2URL := testutil.StartEtcd(t)
 
+	svr := newServer(t, &membership.GrpcContext{}, coordinatoorURL, []string{member1URL, member2URL}, config)
+	return serve(t, svr, clientv3.Config{}), svr.(*server)
+}
+
+// serve serves the proxy on a random port and returns a client connected to it.
+func serve(t testing.TB, svr Server, clientConfig clientv3.Config) *clientv3.Client {
+	client, _ := serveWithGRPCServer(t, svr, clientConfig)
+	return client
+}
+
+// serveWithGRPCServer is serve but also returns the gRPC server.
+func serveWithGRPCServer(t testing.TB, svr Server, clientConfig clientv3.Config) (*clientv3.Client, *grpc.Server) {
 	lis, err := net.Listen("tcp", "localhost:0")
 	require.NoError(t, err)
-	t.Cleanup(func() {
-		lis.Close()
-	})
 
-	svr := newServer(t, coordinatoorURL, []string{member1URL, member2URL}, time.Second*5)
-	grpcServer := grpc.NewServer()
+	grpcServer, err := NewGRPCServer(GRPCServerConfig{
+		Insecure:           true,
+		UnaryInterceptors:  []grpc.UnaryServerInterceptor{svr.UnaryInterceptor()},
+		StreamInterceptors: []grpc.StreamServerInterceptor{svr.StreamInterceptor()},
+		Health:             svr.HealthServer(),
+	})
+	require.NoError(t, err)
 	etcdserverpb.RegisterKVServer(grpcServer, svr)
 	etcdserverpb.RegisterWatchServer(grpcServer, svr)
+	etcdserverpb.RegisterLeaseServer(grpcServer, svr)
+	etcdserverpb.RegisterMaintenanceServer(grpcServer, svr)
+	etcdserverpb.RegisterAuthServer(grpcServer, svr)
+	RegisterAdminServer(grpcServer, svr)
+	RegisterStreamingKVServer(grpcServer, svr)
 	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
 
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{"http://" + lis.Addr().String()},
-		DialTimeout: 2 * time.Second,
-	})
+	clientConfig.Endpoints = []string{"http://" + lis.Addr().String()}
+	clientConfig.DialTimeout = 2 * time.Second
+	client, err := clientv3.New(clientConfig)
 	require.NoError(t, err)
-	return client, svr.(*server)
+	return client, grpcServer
+}
+
+func newServer(t testing.TB, coordinatorGC *membership.GrpcContext, coordinatorURL string, memberURLs []string, config ServerConfig) Server {
+	return newShardedServer(t, coordinatorGC, coordinatorURL, memberURLs, config, nil)
 }
 
-func newServer(t testing.TB, coordinatorURL string, memberURLs []string, watchTimeout time.Duration) Server {
-	gc := &membership.GrpcContext{}
-	coordinator, err := membership.InitCoordinator(gc, coordinatorURL)
+// newShardedServer is newServer but places keys using the given sharder, or static partitions if nil.
+func newShardedServer(t testing.TB, coordinatorGC *membership.GrpcContext, coordinatorURL string, memberURLs []string, config ServerConfig, sharder membership.Sharder) Server {
+	return newServerWithClock(t, coordinatorGC, coordinatorURL, memberURLs, config, sharder, nil)
+}
+
+// newServerWithClock is newShardedServer but lets configureClock set the clock's options before anything uses it.
+func newServerWithClock(t testing.TB, coordinatorGC *membership.GrpcContext, coordinatorURL string, memberURLs []string, config ServerConfig, sharder membership.Sharder, configureClock func(*clock.Clock)) Server {
+	gc := &membership.GrpcContext{Scheme: coordinatorGC.Scheme}
+	coordinator, err := membership.InitCoordinator(coordinatorGC, coordinatorURL)
 	require.NoError(t, err)
 
-	clk := &clock.Clock{Coordinator: coordinator}
+	clk := &clock.Clock{Coordinator: coordinator, Scheme: gc.Scheme}
+	if configureClock != nil {
+		configureClock(clk)
+	}
 	watchMux := watch.NewMux(time.Second, 200, clk)
 	members := membership.NewPool(gc, watchMux)
+	if sharder != nil {
+		members = membership.NewShardedPool(gc, watchMux, sharder)
+	}
 	clk.Members = members
 
 	partitions := membership.NewStaticPartitions(len(memberURLs))
@@ -363,5 +3067,5 @@ func newServer(t testing.TB, coordinatorURL string, memberURLs []string, watchTi
 	})
 
 	require.NoError(t, clk.Init())
-	return NewServer(coordinator, members, clk)
+	return NewServer(coordinator, members, clk, config)
 }
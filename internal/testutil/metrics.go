@@ -0,0 +1,16 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// GetHistogramCount returns the number of observations recorded by a histogram.
+func GetHistogramCount(t testing.TB, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
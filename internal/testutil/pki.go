@@ -0,0 +1,93 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// PKI is a throwaway certificate authority and set of certs written to a temp dir.
+type PKI struct {
+	CAPath                        string
+	ServerCertPath, ServerKeyPath string
+	ClientCertPath, ClientKeyPath string
+	CAs                           *x509.CertPool
+	ClientCert                    tls.Certificate
+	ca                            *x509.Certificate
+	caKey                         *ecdsa.PrivateKey
+	dir                           string
+}
+
+func NewPKI(t testing.TB) *PKI {
+	p := &PKI{dir: t.TempDir(), CAs: x509.NewCertPool()}
+
+	var err error
+	p.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &p.caKey.PublicKey, p.caKey)
+	require.NoError(t, err)
+	p.ca, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	p.CAs.AddCert(p.ca)
+	p.CAPath = filepath.Join(p.dir, "ca.pem")
+	writePEM(t, p.CAPath, "CERTIFICATE", der)
+
+	p.ServerCertPath, p.ServerKeyPath = p.IssueCert(t, "server", "localhost")
+	p.ClientCertPath, p.ClientKeyPath = p.IssueCert(t, "client", "client")
+	p.ClientCert, err = tls.LoadX509KeyPair(p.ClientCertPath, p.ClientKeyPath)
+	require.NoError(t, err)
+	return p
+}
+
+// IssueCert signs a cert for the given DNS name and returns the paths to the cert and its key.
+func (p *PKI) IssueCert(t testing.TB, name, dnsName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(p.dir, name+".pem")
+	keyPath := filepath.Join(p.dir, name+"-key.pem")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDer)
+	return certPath, keyPath
+}
+
+func writePEM(t testing.TB, path, kind string, der []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+}
@@ -12,6 +12,12 @@ import (
 )
 
 func StartEtcd(t testing.TB) string {
+	url, _ := StartStoppableEtcd(t)
+	return url
+}
+
+// StartStoppableEtcd is StartEtcd but also returns a function that kills the etcd process.
+func StartStoppableEtcd(t testing.TB) (string, func()) {
 	peerPort := getAvailablePort(t)
 	clientPort := getAvailablePort(t)
 
@@ -32,7 +38,8 @@ func StartEtcd(t testing.TB) string {
 	})
 
 	require.NoError(t, cmd.Start())
-	return fmt.Sprintf("http://localhost:%d", clientPort)
+	stop := func() { require.NoError(t, cmd.Process.Kill()) }
+	return fmt.Sprintf("http://localhost:%d", clientPort), stop
 }
 
 func getAvailablePort(t testing.TB) int {
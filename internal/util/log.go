@@ -0,0 +1,37 @@
+package util
+
+import (
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// NewSampledCore samples entries below warn level such that only the first entries with a given message are
+// written each tick, and every thereafter-th entry after that. Warnings and errors are always written.
+func NewSampledCore(core zapcore.Core, tick time.Duration, first, thereafter int) zapcore.Core {
+	return zapcore.NewTee(
+		zapcore.NewSamplerWithOptions(&levelRangeCore{Core: core, min: zapcore.DebugLevel, max: zapcore.WarnLevel}, tick, first, thereafter),
+		&levelRangeCore{Core: core, min: zapcore.WarnLevel, max: zapcore.FatalLevel + 1},
+	)
+}
+
+// levelRangeCore only writes entries in [min, max).
+type levelRangeCore struct {
+	zapcore.Core
+	min, max zapcore.Level
+}
+
+func (l *levelRangeCore) Enabled(lvl zapcore.Level) bool {
+	return lvl >= l.min && lvl < l.max && l.Core.Enabled(lvl)
+}
+
+func (l *levelRangeCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level < l.min || ent.Level >= l.max {
+		return ce
+	}
+	return l.Core.Check(ent, ce)
+}
+
+func (l *levelRangeCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelRangeCore{Core: l.Core.With(fields), min: l.min, max: l.max}
+}
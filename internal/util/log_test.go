@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSampledCore(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	logger := zap.New(NewSampledCore(core, time.Minute, 2, 10)).With(zap.String("component", "test"))
+
+	for i := 0; i < 30; i++ {
+		logger.Info("info")
+		logger.Debug("debug")
+		logger.Error("error")
+	}
+
+	assert.Equal(t, 2+2, logs.FilterMessage("info").Len(), "first 2 plus every 10th of the remaining 28")
+	assert.Equal(t, 2+2, logs.FilterMessage("debug").Len())
+	assert.Equal(t, 30, logs.FilterMessage("error").Len())
+	assert.Equal(t, 38, logs.FilterField(zap.String("component", "test")).Len())
+}
+
+func TestSampledCoreLevel(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(NewSampledCore(core, time.Minute, 2, 10))
+
+	logger.Info("info")
+	logger.Warn("warn")
+	assert.Equal(t, 1, logs.Len())
+	assert.False(t, logger.Core().Enabled(zap.InfoLevel))
+}
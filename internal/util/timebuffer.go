@@ -31,13 +31,16 @@ type TimeBuffer[T any, TT BufferableEvent[T]] struct {
 	min, max   int64
 	cursor     *Element[TT]
 	ch         chan<- TT
+	done       chan struct{} // closed when Run returns, after which visible events are no longer sent to ch
 }
 
 func NewTimeBuffer[T any, TT BufferableEvent[T]](gapTimeout time.Duration, len int, ch chan<- TT) *TimeBuffer[T, TT] {
-	return &TimeBuffer[T, TT]{list: &List[TT]{}, gapTimeout: gapTimeout, len: len, min: -1, ch: ch}
+	return &TimeBuffer[T, TT]{list: &List[TT]{}, gapTimeout: gapTimeout, len: len, min: -1, ch: ch, done: make(chan struct{})}
 }
 
+// Run bridges timed out gaps until ctx is done. Once it returns, pushes no longer block on sending to the channel.
 func (t *TimeBuffer[T, TT]) Run(ctx context.Context) {
+	defer close(t.done)
 	ticker := time.NewTicker(t.gapTimeout)
 	defer ticker.Stop()
 	for {
@@ -62,10 +65,13 @@ func (t *TimeBuffer[T, TT]) LatestVisibleRev() int64 {
 
 func (t *TimeBuffer[T, TT]) Len() int { return t.len }
 
-func (t *TimeBuffer[T, TT]) Push(event TT) {
+// Push buffers the events atomically, so events that share a revision become visible together.
+func (t *TimeBuffer[T, TT]) Push(events ...TT) {
 	t.mut.Lock()
 	defer t.mut.Unlock()
-	t.pushUnlocked(event)
+	for _, event := range events {
+		t.pushUnlocked(event)
+	}
 	t.bridgeGapUnlocked()
 }
 
@@ -155,9 +161,9 @@ func (t *TimeBuffer[T, TT]) Range(start int64, query T) ([]TT, int64, int64) {
 }
 
 func (t *TimeBuffer[T, TT]) bridgeGapUnlocked() {
-	item := t.cursor // start at the oldest visible event and scan forwards
-	if item == nil {
-		item = t.list.First()
+	item := t.list.First() // start after the newest visible event and scan forwards
+	if t.cursor != nil {
+		item = t.cursor.Next()
 	}
 	for {
 		if item == nil {
@@ -166,12 +172,13 @@ func (t *TimeBuffer[T, TT]) bridgeGapUnlocked() {
 		event := item.Value
 
 		// Not a gap - keep scanning
-		if event.GetRevision() <= t.max {
+		if event.GetRevision() < t.max {
 			item = item.Next()
 			continue
 		}
 
-		isNextEvent := event.GetRevision() == t.max+1
+		// Events that share the newest visible revision (e.g. bulk puts) are part of the same write
+		isNextEvent := event.GetRevision() == t.max+1 || event.GetRevision() == t.max
 		age := event.GetAge()
 		hasTimedout := age > t.gapTimeout
 
@@ -195,7 +202,10 @@ func (t *TimeBuffer[T, TT]) bridgeGapUnlocked() {
 }
 
 func (t *TimeBuffer[T, TT]) advanceCursorUnlocked(item *Element[TT], event TT) {
-	t.ch <- event
+	select {
+	case t.ch <- event:
+	case <-t.done:
+	}
 	t.max = event.GetRevision()
 	t.cursor = item
 
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"math/rand"
 	"testing"
 	"time"
@@ -67,6 +68,25 @@ func TestTimeBufferPruningCursor(t *testing.T) {
 	assert.Equal(t, 2, b.Len())
 }
 
+// TestTimeBufferSameRevision proves that every event sharing a revision becomes visible.
+func TestTimeBufferSameRevision(t *testing.T) {
+	ch := make(chan *testEvent, 100)
+	b := NewTimeBuffer[struct{}](time.Second, 10, ch)
+
+	b.Push(newTestEvent(1))
+	b.Push(newTestEvent(3))
+	b.Push(newTestEvent(2), newTestEvent(2))
+	b.Push(newTestEvent(3))
+	b.Push(newTestEvent(4))
+	close(ch)
+
+	revs := []int64{}
+	for event := range ch {
+		revs = append(revs, event.Rev)
+	}
+	assert.Equal(t, []int64{1, 2, 2, 3, 3, 4}, revs)
+}
+
 // TestTimeBufferRange proves that ranges filter on start revision, the visibility window, and the query.
 func TestTimeBufferRange(t *testing.T) {
 	b := NewTimeBuffer[struct{}](time.Second, 10, make(chan<- *testEvent, 100))
@@ -85,6 +105,28 @@ func TestTimeBufferRange(t *testing.T) {
 	assert.Equal(t, []int64{3, 5, 6, 7}, testutil.GetRevisions(results))
 }
 
+// TestTimeBufferStopped proves that pushes don't block on the channel once Run has returned.
+func TestTimeBufferStopped(t *testing.T) {
+	b := NewTimeBuffer[struct{}](time.Second, 10, make(chan<- *testEvent)) // nothing receives from the channel
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Push(newTestEvent(1))
+		b.Push(newTestEvent(2))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("push blocked after the buffer stopped")
+	}
+	assert.Equal(t, int64(2), b.LatestVisibleRev())
+}
+
 type testEvent struct {
 	Rev       int64
 	Timestamp time.Time
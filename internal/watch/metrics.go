@@ -9,6 +9,18 @@ var (
 			Help: "Number of stale watch connections.",
 		})
 
+	failedWatchCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_failed_watch_count",
+			Help: "Number of watches rejected or canceled because a member watch they rely on was failing.",
+		})
+
+	duplicateEventCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_duplicate_watch_event_count",
+			Help: "Number of duplicate events dropped instead of being delivered to a watch.",
+		})
+
 	watchEventCount = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "metaetcd_watch_event_count",
@@ -21,6 +33,26 @@ var (
 			Help: "The total member watch connections currently being established.",
 		})
 
+	memberWatchCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metaetcd_member_watch_count",
+			Help: "Number of watch connections running against each member cluster.",
+		},
+		[]string{"endpoint"},
+	)
+
+	watchBufferFullCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_watch_buffer_full_total",
+			Help: "Number of times a watch response couldn't be sent because the client's buffer was full.",
+		})
+
+	slowWatchCancelCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metaetcd_slow_watch_cancel_total",
+			Help: "Number of watches canceled because they fell too far behind.",
+		})
+
 	watchesRunning = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "metaetcd_watches_running",
@@ -30,7 +62,12 @@ var (
 
 func init() {
 	prometheus.MustRegister(staleWatchCount)
+	prometheus.MustRegister(failedWatchCount)
+	prometheus.MustRegister(duplicateEventCount)
 	prometheus.MustRegister(watchEventCount)
 	prometheus.MustRegister(watchesDialing)
 	prometheus.MustRegister(watchesRunning)
+	prometheus.MustRegister(memberWatchCount)
+	prometheus.MustRegister(watchBufferFullCount)
+	prometheus.MustRegister(slowWatchCancelCount)
 }
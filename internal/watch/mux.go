@@ -2,11 +2,18 @@ package watch
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.etcd.io/etcd/pkg/v3/adt"
 	"go.uber.org/zap"
 
@@ -23,8 +30,23 @@ type Mux struct {
 	ch          chan *eventWrapper
 	tree        *util.GroupTree[*mvccpb.Event]
 	transformer EventTransformer
+
+	// mut protects the member and client watches tracked for State
+	mut     sync.Mutex
+	members map[*Status]struct{}
+	watches map[*clientWatch]struct{}
+
+	// CancelSlowWatches cancels watches whose response channel is full instead of waiting for the client to catch up.
+	CancelSlowWatches bool
+
+	// BatchWindow is how long to wait for more events before sending a watch response, so events that arrive
+	// together are sent in one response (in revision order). Disabled if 0, which sends each event as soon as it arrives.
+	BatchWindow time.Duration
 }
 
+// maxBatchLen bounds the number of events coalesced into a single watch response.
+const maxBatchLen = 1000
+
 func NewMux(gapTimeout time.Duration, bufferLen int, et EventTransformer) *Mux {
 	ch := make(chan *eventWrapper)
 	m := &Mux{
@@ -32,18 +54,22 @@ func NewMux(gapTimeout time.Duration, bufferLen int, et EventTransformer) *Mux {
 		ch:          ch,
 		tree:        util.NewGroupTree[*mvccpb.Event](),
 		transformer: et,
+		members:     map[*Status]struct{}{},
+		watches:     map[*clientWatch]struct{}{},
 	}
 	return m
 }
 
 func (m *Mux) Run(ctx context.Context) {
 	go m.buffer.Run(ctx)
-	go func() {
-		<-ctx.Done()
-		close(m.ch)
-	}()
-	for event := range m.ch {
-		m.tree.Broadcast(event.Key, event.Event)
+	for {
+		select {
+		case <-ctx.Done():
+			// Member watches may still be pushing events, which the buffer stops sending once its Run returns
+			return
+		case event := <-m.ch:
+			m.tree.Broadcast(event.Key, event.Event)
+		}
 	}
 }
 
@@ -63,8 +89,9 @@ func (m *Mux) StartWatch(ctx context.Context, client *clientv3.Client) (*Status,
 	// Don't use the provided context. It's for establishing a connection - this one is for running it.
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Status{
-		cancel: cancel,
-		done:   make(chan struct{}),
+		Endpoint: strings.Join(client.Endpoints(), ","),
+		cancel:   cancel,
+		done:     make(chan struct{}),
 	}
 
 	// Warm the buffer by starting the watch at (current revision) - (buffer length)
@@ -78,11 +105,23 @@ func (m *Mux) StartWatch(ctx context.Context, client *clientv3.Client) (*Status,
 	w := client.Watch(ctx, "", clientv3.WithPrefix(), clientv3.WithRev(startRev), clientv3.WithPrevKV())
 	watchesDialing.Dec()
 
+	m.mut.Lock()
+	m.members[s] = struct{}{}
+	m.mut.Unlock()
+
 	go func() {
 		watchesRunning.Inc()
 		defer watchesRunning.Dec()
 		defer close(s.done)
-		m.watchLoop(w)
+		defer func() {
+			m.mut.Lock()
+			delete(m.members, s)
+			m.mut.Unlock()
+		}()
+		memberWatchCount.WithLabelValues(s.Endpoint).Inc()
+		defer memberWatchCount.WithLabelValues(s.Endpoint).Dec()
+		m.watchLoop(w, s)
+		m.setMemberErr(s, errWatchClosed)
 		if ctx.Err() == nil {
 			zap.L().Sugar().Panicf("watch of client with endpoints '%+s' closed unexpectedly", client.Endpoints())
 		}
@@ -91,68 +130,424 @@ func (m *Mux) StartWatch(ctx context.Context, client *clientv3.Client) (*Status,
 	return s, nil
 }
 
-func (m *Mux) watchLoop(w clientv3.WatchChan) {
+func (m *Mux) watchLoop(w clientv3.WatchChan, s *Status) {
 	for msg := range w {
+		if err := msg.Err(); err != nil {
+			zap.L().Error("member watch failed", zap.String("endpoint", s.Endpoint), zap.Error(err))
+			m.setMemberErr(s, err)
+			continue
+		}
+		m.setMemberErr(s, nil)
+
 		meta, events, ok := m.transformer.MungeEvents(msg.Events)
 		if !ok {
 			continue
 		}
+		atomic.StoreInt64(&s.rev, meta)
 
-		for _, event := range events {
-			zap.L().Info("observed watch event", zap.Int64("metaRev", meta))
+		wrapped := make([]*eventWrapper, len(events))
+		for i, event := range events {
+			zap.L().Debug("observed watch event", zap.Int64("metaRev", meta))
 			watchEventCount.Inc()
-			m.buffer.Push(&eventWrapper{
+			wrapped[i] = &eventWrapper{
 				Event:     event,
 				Timestamp: time.Now(),
 				Key:       adt.NewStringAffinePoint(string(event.Kv.Key)),
-			})
+			}
 		}
+		m.buffer.Push(wrapped...)
+
+	}
+}
 
+// setMemberErr records the result of a member watch's latest response. Client watches that rely on a failing
+// member watch are canceled, since they would silently miss its events.
+func (m *Mux) setMemberErr(s *Status, err error) {
+	s.setErr(err)
+	if err == nil {
+		return
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for w := range m.watches {
+		for _, member := range w.members {
+			if member == s {
+				w.fail(s, err)
+				break
+			}
+		}
 	}
 }
 
-func (m *Mux) Watch(ctx context.Context, req *etcdserverpb.WatchCreateRequest, ch chan<- *etcdserverpb.WatchResponse) (func(), int64) {
+// Watch streams the events of the requested range to ch, starting with any buffered events.
+// members are the watches of the member clusters that can own keys in the range. If any of them are failing,
+// the watch isn't created and a *MemberWatchError is returned, since it would silently miss their events.
+// Watches are canceled if any of their member watches fail later.
+// The returned func blocks until the watch ends. It's nil when the start revision is no longer buffered,
+// in which case the lowest buffered revision is returned.
+func (m *Mux) Watch(ctx context.Context, req *etcdserverpb.WatchCreateRequest, ch chan<- *etcdserverpb.WatchResponse, members []*Status) (func(), int64, error) {
+	var failed []string
+	for _, s := range members {
+		if s.Err() != nil {
+			failed = append(failed, s.Endpoint)
+		}
+	}
+	if len(failed) > 0 {
+		failedWatchCount.Inc()
+		return nil, 0, &MemberWatchError{Endpoints: failed}
+	}
+
 	eventCh := make(chan *mvccpb.Event, m.buffer.Len())
-	i := adt.NewStringAffineInterval(string(req.Key), string(req.RangeEnd))
+	i := watchInterval(req.Key, req.RangeEnd)
+	w := &clientWatch{req: req, eventCh: eventCh, members: members, failed: make(chan struct{})}
+	for _, s := range members {
+		w.endpoints = append(w.endpoints, s.Endpoint)
+	}
 
 	// Start listening for new events
 	m.tree.Add(i, eventCh)
+	m.addWatch(w)
+	for _, s := range members {
+		// Members that failed before the watch was added couldn't cancel it
+		if err := s.Err(); err != nil {
+			w.fail(s, err)
+		}
+	}
 
-	ch <- &etcdserverpb.WatchResponse{WatchId: req.WatchId, Created: true, Header: &etcdserverpb.ResponseHeader{}}
+	select {
+	case ch <- &etcdserverpb.WatchResponse{WatchId: req.WatchId, Created: true, Header: &etcdserverpb.ResponseHeader{}}:
+	case <-ctx.Done():
+		go func() {
+			for range eventCh {
+			}
+		}()
+		m.tree.Remove(i, eventCh)
+		m.removeWatch(w)
+		close(eventCh)
+		return func() {}, 0, nil
+	}
 
-	// Backfill old events
-	events, min, max := m.buffer.Range(req.StartRevision, i)
+	// Backfill old events (the start revision is inclusive)
+	events, min, max := m.buffer.Range(req.StartRevision-1, i)
 	if min > req.StartRevision {
 		staleWatchCount.Inc()
-		return nil, min
-	}
-	for _, event := range events {
-		ch <- &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: req.WatchId, Events: []*mvccpb.Event{event.Event}}
+		m.tree.Remove(i, eventCh)
+		m.removeWatch(w)
+		return nil, min, nil
 	}
-
 	go func() {
 		<-ctx.Done()
 		m.tree.Remove(i, eventCh)
+		m.removeWatch(w)
 		close(eventCh)
 	}()
 
+	// Each logical change is delivered at most once per watch, even if it was observed by more than one member watch
+	dedupe := &eventDeduper{}
+	if req.Fragment && len(events) > 0 {
+		// The client can reassemble fragments, so send the backfill as one batch and let the server split it
+		resp := &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: req.WatchId}
+		for _, event := range events {
+			if !dedupe.Seen(event.Event) {
+				resp.Events = append(resp.Events, event.Event)
+			}
+		}
+		if !m.send(ctx, w, ch, resp) {
+			m.cancelSlowWatch(ctx, i, eventCh, ch, req.WatchId)
+			return func() {}, 0, nil
+		}
+	} else {
+		for _, event := range events {
+			if dedupe.Seen(event.Event) {
+				continue
+			}
+			if !m.send(ctx, w, ch, &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: req.WatchId, Events: []*mvccpb.Event{event.Event}}) {
+				m.cancelSlowWatch(ctx, i, eventCh, ch, req.WatchId)
+				return func() {}, 0, nil
+			}
+		}
+	}
+
 	// Map the event channel into the watch response channel
+	deliver := func(event *mvccpb.Event) bool {
+		if event.Kv.ModRevision <= max || event.Kv.ModRevision < req.StartRevision {
+			return false // already backfilled or before the watch's start revision
+		}
+		return !dedupe.Seen(event)
+	}
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		for event := range eventCh {
-			if event.Kv.ModRevision < max {
+		for {
+			var event *mvccpb.Event
+			select {
+			case e, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				event = e
+			case <-w.failed:
+				m.cancelWatch(ctx, i, eventCh, ch, req.WatchId, w.failReason, failedWatchCount)
+				return
+			}
+			if !deliver(event) {
 				continue
 			}
-			ch <- &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: req.WatchId, Events: []*mvccpb.Event{event}}
+			events := []*mvccpb.Event{event}
+			if m.BatchWindow > 0 {
+				events = m.batch(eventCh, events, deliver)
+			}
+			if !m.send(ctx, w, ch, &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: req.WatchId, Events: events}) {
+				m.cancelSlowWatch(ctx, i, eventCh, ch, req.WatchId)
+				return
+			}
 		}
 	}()
-	return func() { <-done }, 0
+	return func() { <-done }, 0, nil
+}
+
+// batch appends the events received within BatchWindow of the first one, until the batch is full or eventCh is closed.
+func (m *Mux) batch(eventCh <-chan *mvccpb.Event, events []*mvccpb.Event, deliver func(*mvccpb.Event) bool) []*mvccpb.Event {
+	timer := time.NewTimer(m.BatchWindow)
+	defer timer.Stop()
+	for len(events) < maxBatchLen {
+		select {
+		case event, ok := <-eventCh:
+			if !ok {
+				return events
+			}
+			if deliver(event) {
+				events = append(events, event)
+			}
+		case <-timer.C:
+			return events
+		}
+	}
+	return events
+}
+
+// eventDeduper identifies events that have already been delivered to a watch by their key and meta mod revision.
+// Events are delivered in revision order, so only the keys of the latest revision are remembered.
+type eventDeduper struct {
+	rev  int64
+	keys map[string]struct{}
+}
+
+// Seen returns true if an event with the same key and revision has already been passed to Seen.
+func (d *eventDeduper) Seen(event *mvccpb.Event) bool {
+	if event.Kv.ModRevision != d.rev {
+		d.rev = event.Kv.ModRevision
+		d.keys = map[string]struct{}{}
+	}
+	key := string(event.Kv.Key)
+	if _, ok := d.keys[key]; ok {
+		duplicateEventCount.Inc()
+		return true
+	}
+	d.keys[key] = struct{}{}
+	return false
 }
 
+// send returns false if the channel is full and slow watches should be canceled, or the watch ended while
+// waiting for room in the channel.
+func (m *Mux) send(ctx context.Context, w *clientWatch, ch chan<- *etcdserverpb.WatchResponse, resp *etcdserverpb.WatchResponse) bool {
+	select {
+	case ch <- resp:
+		w.delivered(resp)
+		return true
+	default:
+	}
+
+	watchBufferFullCount.Inc()
+	if m.CancelSlowWatches {
+		return false
+	}
+	select {
+	case ch <- resp:
+		w.delivered(resp)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// cancelSlowWatch stops sending events to a watch that fell behind.
+func (m *Mux) cancelSlowWatch(ctx context.Context, i adt.Interval, eventCh chan *mvccpb.Event, ch chan<- *etcdserverpb.WatchResponse, id int64) {
+	m.cancelWatch(ctx, i, eventCh, ch, id, "watch fell too far behind", slowWatchCancelCount)
+}
+
+// cancelWatch stops sending events to a watch, counts it, and tells the client why. If the watch already ended,
+// which also makes send fail, it's left to be removed as usual.
+func (m *Mux) cancelWatch(ctx context.Context, i adt.Interval, eventCh chan *mvccpb.Event, ch chan<- *etcdserverpb.WatchResponse, id int64, reason string, counter prometheus.Counter) {
+	// Keep draining until the watch is removed so broadcasts aren't blocked in the meantime
+	go func() {
+		for range eventCh {
+		}
+	}()
+	if ctx.Err() != nil {
+		return
+	}
+
+	counter.Inc()
+	zap.L().Warn("canceling watch", zap.Int64("watchID", id), zap.String("reason", reason))
+	m.tree.Remove(i, eventCh)
+
+	select {
+	case ch <- &etcdserverpb.WatchResponse{Header: &etcdserverpb.ResponseHeader{}, WatchId: id, Canceled: true, CancelReason: reason}:
+	case <-ctx.Done():
+	}
+}
+
+func (m *Mux) addWatch(w *clientWatch) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.watches[w] = struct{}{}
+}
+
+func (m *Mux) removeWatch(w *clientWatch) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	delete(m.watches, w)
+}
+
+// MuxState describes the member watches held by a Mux and the client watches it's serving.
+type MuxState struct {
+	Members []MemberWatchState `json:"members"`
+	Watches []WatchState       `json:"watches"`
+}
+
+// MemberWatchState describes the watch of a member cluster.
+type MemberWatchState struct {
+	Endpoint string `json:"endpoint"`
+
+	// Watches is the number of client watches that rely on this member watch.
+	Watches int `json:"watches"`
+
+	// Revision is the highest meta revision observed by the member watch.
+	Revision int64 `json:"revision"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// WatchState describes a client watch.
+type WatchState struct {
+	ID            int64    `json:"id"`
+	Key           string   `json:"key"`
+	RangeEnd      string   `json:"rangeEnd,omitempty"`
+	StartRevision int64    `json:"startRevision,omitempty"`
+	Members       []string `json:"members"`
+
+	// DeliveredRevision is the highest meta revision sent to the client, or 0 if no events have been sent.
+	DeliveredRevision int64 `json:"deliveredRevision"`
+
+	// Pending is the number of events waiting to be sent to the client. It stays high for watches that are stuck.
+	Pending int `json:"pending"`
+}
+
+// State returns a snapshot of the member and client watches, for debugging watches that appear to be stuck.
+// Members are sorted by endpoint and watches by ID. IDs are only unique within a client's watch stream.
+func (m *Mux) State() *MuxState {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	state := &MuxState{Members: []MemberWatchState{}, Watches: []WatchState{}}
+	counts := map[string]int{}
+	for w := range m.watches {
+		state.Watches = append(state.Watches, WatchState{
+			ID:                w.req.WatchId,
+			Key:               string(w.req.Key),
+			RangeEnd:          string(w.req.RangeEnd),
+			StartRevision:     w.req.StartRevision,
+			Members:           w.endpoints,
+			DeliveredRevision: atomic.LoadInt64(&w.rev),
+			Pending:           len(w.eventCh),
+		})
+		for _, endpoint := range w.endpoints {
+			counts[endpoint]++
+		}
+	}
+	for s := range m.members {
+		member := MemberWatchState{Endpoint: s.Endpoint, Watches: counts[s.Endpoint], Revision: atomic.LoadInt64(&s.rev)}
+		if err := s.Err(); err != nil {
+			member.Err = err.Error()
+		}
+		state.Members = append(state.Members, member)
+	}
+
+	sort.Slice(state.Members, func(i, j int) bool { return state.Members[i].Endpoint < state.Members[j].Endpoint })
+	sort.Slice(state.Watches, func(i, j int) bool {
+		a, b := state.Watches[i], state.Watches[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Key < b.Key
+	})
+	return state
+}
+
+// clientWatch tracks a watch started by Watch.
+type clientWatch struct {
+	req       *etcdserverpb.WatchCreateRequest
+	members   []*Status
+	endpoints []string
+	eventCh   chan *mvccpb.Event
+	rev       int64 // atomic
+
+	failed     chan struct{} // closed by fail
+	failOnce   sync.Once
+	failReason string // written before failed is closed
+}
+
+// fail cancels the watch because one of its member watches failed. Only the first failure is reported.
+func (w *clientWatch) fail(s *Status, err error) {
+	w.failOnce.Do(func() {
+		w.failReason = fmt.Sprintf("watch of member cluster %s failed: %s", s.Endpoint, err)
+		close(w.failed)
+	})
+}
+
+// delivered records the revision of the latest event sent to the client.
+func (w *clientWatch) delivered(resp *etcdserverpb.WatchResponse) {
+	if n := len(resp.Events); n > 0 {
+		atomic.StoreInt64(&w.rev, resp.Events[n-1].Kv.ModRevision)
+	}
+}
+
+// errWatchClosed is the error of member watches that have been closed.
+var errWatchClosed = errors.New("member watch is closed")
+
+// MemberWatchError is returned when a watch can't be created because some of the member watches it relies on are failing.
+type MemberWatchError struct {
+	Endpoints []string
+}
+
+func (e *MemberWatchError) Error() string {
+	return fmt.Sprintf("watches of member clusters %s are failing", strings.Join(e.Endpoints, ","))
+}
+
+// Status tracks a member watch started by StartWatch.
 type Status struct {
+	Endpoint string
+
 	cancel context.CancelFunc
 	done   chan struct{}
+	rev    int64 // atomic, highest meta revision observed
+
+	mut sync.Mutex
+	err error
+}
+
+// Err returns the error of the member watch's latest response, or nil if it succeeded.
+func (s *Status) Err() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.err
+}
+
+func (s *Status) setErr(err error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.err = err
 }
 
 func (s *Status) Close() {
@@ -160,6 +555,19 @@ func (s *Status) Close() {
 	<-s.done
 }
 
+// watchInterval returns the keys matched by a watch using etcd's range conventions. ADT treats an empty end as
+// greater than every key, so single keys are points and an end of "\x00" (every key >= start) is open ended.
+func watchInterval(key, end []byte) adt.Interval {
+	switch string(end) {
+	case "":
+		return adt.NewStringAffinePoint(string(key))
+	case "\x00":
+		return adt.NewStringAffineInterval(string(key), "")
+	default:
+		return adt.NewStringAffineInterval(string(key), string(end))
+	}
+}
+
 type eventWrapper struct {
 	*mvccpb.Event
 	Key       adt.Interval
@@ -0,0 +1,321 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/pkg/v3/adt"
+
+	etcdtestutil "github.com/Azure/metaetcd/internal/testutil"
+)
+
+func TestSlowWatch(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		m, ctx := startMux(t, false)
+		ch := make(chan *etcdserverpb.WatchResponse, 1)
+		before := testutil.ToFloat64(watchBufferFullCount)
+
+		future, _, _ := m.Watch(ctx, &etcdserverpb.WatchCreateRequest{Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1}, ch, nil)
+		require.NotNil(t, future)
+		pushEvents(m, 3)
+		require.Eventually(t, func() bool { return testutil.ToFloat64(watchBufferFullCount) > before }, time.Second*5, time.Millisecond*10)
+
+		// The slow receiver eventually gets every event
+		assert.True(t, (<-ch).Created)
+		for rev := int64(1); rev <= 3; rev++ {
+			resp := <-ch
+			require.Len(t, resp.Events, 1)
+			assert.Equal(t, rev, resp.Events[0].Kv.ModRevision)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		m, ctx := startMux(t, true)
+		ch := make(chan *etcdserverpb.WatchResponse, 1)
+		before := testutil.ToFloat64(slowWatchCancelCount)
+
+		future, _, _ := m.Watch(ctx, &etcdserverpb.WatchCreateRequest{WatchId: 7, Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1}, ch, nil)
+		require.NotNil(t, future)
+		pushEvents(m, 3)
+		require.Eventually(t, func() bool { return testutil.ToFloat64(slowWatchCancelCount) > before }, time.Second*5, time.Millisecond*10)
+
+		assert.True(t, (<-ch).Created)
+		resp := <-ch
+		assert.True(t, resp.Canceled)
+		assert.Equal(t, int64(7), resp.WatchId)
+		future() // returns once the watch is canceled
+
+		// Later events aren't blocked by the canceled watch
+		pushEvents(m, 3)
+	})
+
+	t.Run("watch ends while blocked", func(t *testing.T) {
+		m, ctx := startMux(t, false)
+		watchCtx, cancel := context.WithCancel(ctx)
+		ch := make(chan *etcdserverpb.WatchResponse, 1)
+
+		future, _, _ := m.Watch(watchCtx, &etcdserverpb.WatchCreateRequest{Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1}, ch, nil)
+		require.NotNil(t, future)
+		before := testutil.ToFloat64(watchBufferFullCount)
+		pushEvents(m, 3)
+		require.Eventually(t, func() bool { return testutil.ToFloat64(watchBufferFullCount) > before }, time.Second*5, time.Millisecond*10)
+
+		// Nothing receives from ch, so the watch only stops because its context is done
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			future()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for the watch to stop")
+		}
+		require.Eventually(t, func() bool { return len(m.State().Watches) == 0 }, time.Second*5, time.Millisecond*10)
+
+		// Other watches aren't blocked by the stopped watch
+		other := make(chan *etcdserverpb.WatchResponse, 1000)
+		future, _, _ = m.Watch(ctx, &etcdserverpb.WatchCreateRequest{Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 4}, other, nil)
+		require.NotNil(t, future)
+		assert.True(t, (<-other).Created)
+		pushEvents(m, 300)
+		for rev := int64(4); rev <= 303; rev++ {
+			resp := <-other
+			require.Len(t, resp.Events, 1)
+			assert.Equal(t, rev, resp.Events[0].Kv.ModRevision)
+		}
+	})
+}
+
+func TestMemberWatchCount(t *testing.T) {
+	m, ctx := startMux(t, false)
+	m.transformer = &nopTransformer{}
+	url := etcdtestutil.StartEtcd(t)
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{url}})
+	require.NoError(t, err)
+	defer client.Close()
+
+	status, err := m.StartWatch(ctx, client)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return testutil.ToFloat64(memberWatchCount.WithLabelValues(url)) == 1 }, time.Second*5, time.Millisecond*10)
+
+	status.Close()
+	assert.Equal(t, float64(0), testutil.ToFloat64(memberWatchCount.WithLabelValues(url)))
+	assert.ErrorIs(t, status.Err(), errWatchClosed)
+}
+
+func TestFailingMemberWatch(t *testing.T) {
+	m, ctx := startMux(t, false)
+	healthy := &Status{Endpoint: "healthy"}
+	failing := &Status{Endpoint: "failing", err: errors.New("test error")}
+	req := &etcdserverpb.WatchCreateRequest{Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1}
+
+	ch := make(chan *etcdserverpb.WatchResponse, 1)
+	future, _, err := m.Watch(ctx, req, ch, []*Status{healthy, failing})
+	require.Nil(t, future)
+	memberErr := &MemberWatchError{}
+	require.ErrorAs(t, err, &memberErr)
+	assert.Equal(t, []string{"failing"}, memberErr.Endpoints)
+	assert.Empty(t, ch, "the watch shouldn't be created")
+
+	// The watch can be created once the member watch recovers
+	failing.setErr(nil)
+	future, _, err = m.Watch(ctx, req, ch, []*Status{healthy, failing})
+	require.NoError(t, err)
+	require.NotNil(t, future)
+	assert.True(t, (<-ch).Created)
+
+	// It's canceled when the member watch fails again
+	before := testutil.ToFloat64(failedWatchCount)
+	m.setMemberErr(failing, errors.New("test error"))
+	resp := <-ch
+	assert.True(t, resp.Canceled)
+	assert.Equal(t, "watch of member cluster failing failed: test error", resp.CancelReason)
+	future()
+	assert.Equal(t, before+1, testutil.ToFloat64(failedWatchCount))
+
+	// Watches that don't rely on the failing member watch aren't affected
+	future, _, err = m.Watch(ctx, req, ch, []*Status{healthy})
+	require.NoError(t, err)
+	require.NotNil(t, future)
+	assert.True(t, (<-ch).Created)
+	m.setMemberErr(failing, errors.New("test error"))
+	pushEvents(m, 1)
+	select {
+	case resp := <-ch:
+		assert.False(t, resp.Canceled)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestWatchDeduplication(t *testing.T) {
+	m, ctx := startMux(t, false)
+	event := func(key string, rev int64) *eventWrapper {
+		return &eventWrapper{
+			Event:     &mvccpb.Event{Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: rev}},
+			Timestamp: time.Now(),
+			Key:       adt.NewStringAffinePoint(key),
+		}
+	}
+
+	// The same change is observed twice, like when a key's events are received from more than one member
+	m.buffer.Push(event("key-1", 1), event("key-1", 1), event("key-2", 1))
+	require.Eventually(t, func() bool { return m.buffer.LatestVisibleRev() == 1 }, time.Second*5, time.Millisecond*10)
+
+	ch := make(chan *etcdserverpb.WatchResponse, 100)
+	for id, end := range map[int64]string{1: "key.", 2: "key-2"} {
+		future, _, err := m.Watch(ctx, &etcdserverpb.WatchCreateRequest{WatchId: id, Key: []byte("key-"), RangeEnd: []byte(end), StartRevision: 1}, ch, nil)
+		require.NoError(t, err)
+		require.NotNil(t, future)
+	}
+	m.buffer.Push(event("key-1", 2), event("key-1", 2))
+	m.buffer.Push(event("key-1", 3))
+
+	events := map[int64][]string{}
+	count := 0
+	for count < 7 {
+		resp := <-ch
+		for _, e := range resp.Events {
+			events[resp.WatchId] = append(events[resp.WatchId], fmt.Sprintf("%s@%d", e.Kv.Key, e.Kv.ModRevision))
+			count++
+		}
+	}
+	assert.Equal(t, []string{"key-1@1", "key-2@1", "key-1@2", "key-1@3"}, events[1])
+	assert.Equal(t, []string{"key-1@1", "key-1@2", "key-1@3"}, events[2])
+	assert.Never(t, func() bool { return len(ch) > 0 && len((<-ch).Events) > 0 }, time.Millisecond*100, time.Millisecond*10)
+}
+
+func TestWatchBatching(t *testing.T) {
+	m, ctx := startMux(t, false)
+	m.BatchWindow = time.Millisecond * 200
+	ch := make(chan *etcdserverpb.WatchResponse, 100)
+
+	future, _, err := m.Watch(ctx, &etcdserverpb.WatchCreateRequest{Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1}, ch, nil)
+	require.NoError(t, err)
+	require.NotNil(t, future)
+	assert.True(t, (<-ch).Created)
+	pushEvents(m, 10)
+
+	var revs []int64
+	var responses int
+	for len(revs) < 10 {
+		resp := <-ch
+		responses++
+		for _, event := range resp.Events {
+			revs = append(revs, event.Kv.ModRevision)
+		}
+	}
+	assert.Equal(t, etcdtestutil.NewSeq(1, 11), revs)
+	assert.Less(t, responses, 10, "events that arrive together are sent in fewer responses")
+}
+
+func TestMuxState(t *testing.T) {
+	m, ctx := startMux(t, false)
+	a := &Status{Endpoint: "member-a", rev: 3}
+	b := &Status{Endpoint: "member-b"}
+	m.members[a] = struct{}{}
+	m.members[b] = struct{}{}
+	pushEvents(m, 3)
+	require.Eventually(t, func() bool { return m.buffer.LatestVisibleRev() == 3 }, time.Second*5, time.Millisecond*10)
+
+	ch := make(chan *etcdserverpb.WatchResponse, 100)
+	watchCtx, cancel := context.WithCancel(ctx)
+	for _, req := range []*etcdserverpb.WatchCreateRequest{
+		{WatchId: 1, Key: []byte("key-"), RangeEnd: []byte("key."), StartRevision: 1},
+		{WatchId: 2, Key: []byte("key-2"), StartRevision: 1},
+		{WatchId: 3, Key: []byte("other"), StartRevision: 1},
+	} {
+		reqCtx, members := ctx, []*Status{a}
+		if req.WatchId == 1 {
+			members = append(members, b)
+		}
+		if req.WatchId == 3 {
+			reqCtx = watchCtx
+		}
+		future, _, err := m.Watch(reqCtx, req, ch, members)
+		require.NoError(t, err)
+		require.NotNil(t, future)
+	}
+	require.Eventually(t, func() bool { return m.State().Watches[0].DeliveredRevision == 3 }, time.Second*5, time.Millisecond*10)
+	b.setErr(errors.New("test error")) // after the watches are created, since failing members are rejected
+
+	state := m.State()
+	assert.Equal(t, []MemberWatchState{
+		{Endpoint: "member-a", Watches: 3, Revision: 3},
+		{Endpoint: "member-b", Watches: 1, Err: "test error"},
+	}, state.Members)
+	assert.Equal(t, []WatchState{
+		{ID: 1, Key: "key-", RangeEnd: "key.", StartRevision: 1, Members: []string{"member-a", "member-b"}, DeliveredRevision: 3},
+		{ID: 2, Key: "key-2", StartRevision: 1, Members: []string{"member-a"}, DeliveredRevision: 2},
+		{ID: 3, Key: "other", StartRevision: 1, Members: []string{"member-a"}},
+	}, state.Watches)
+
+	t.Run("canceled watches are removed", func(t *testing.T) {
+		cancel()
+		require.Eventually(t, func() bool { return len(m.State().Watches) == 2 }, time.Second*5, time.Millisecond*10)
+		assert.Equal(t, 2, m.State().Members[0].Watches)
+	})
+}
+
+func startMux(t *testing.T, cancelSlowWatches bool) (*Mux, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	m := NewMux(time.Second, 100, nil)
+	m.CancelSlowWatches = cancelSlowWatches
+	go m.Run(ctx)
+	return m, ctx
+}
+
+func pushEvents(m *Mux, n int) {
+	latest := m.buffer.LatestVisibleRev()
+	for i := 1; i <= n; i++ {
+		key := fmt.Sprintf("key-%d", latest+int64(i))
+		m.buffer.Push(&eventWrapper{
+			Event:     &mvccpb.Event{Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: latest + int64(i)}},
+			Timestamp: time.Now(),
+			Key:       adt.NewStringAffinePoint(key),
+		})
+	}
+}
+
+type nopTransformer struct{}
+
+func (*nopTransformer) MungeEvents([]*clientv3.Event) (int64, []*mvccpb.Event, bool) {
+	return 0, nil, false
+}
+
+func TestWatchInterval(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		start, end string
+		matches    []string
+		misses     []string
+	}{
+		{name: "single key", start: "b", matches: []string{"b"}, misses: []string{"a", "b\x00", "c"}},
+		{name: "range", start: "b", end: "d", matches: []string{"b", "c"}, misses: []string{"a", "d"}},
+		{name: "open ended", start: "b", end: "\x00", matches: []string{"b", "zzz"}, misses: []string{"a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tree := adt.NewIntervalTree()
+			tree.Insert(watchInterval([]byte(tc.start), []byte(tc.end)), nil)
+			for _, key := range tc.matches {
+				assert.Len(t, tree.Stab(adt.NewStringAffinePoint(key)), 1, key)
+			}
+			for _, key := range tc.misses {
+				assert.Empty(t, tree.Stab(adt.NewStringAffinePoint(key)), key)
+			}
+		})
+	}
+}
@@ -18,55 +18,143 @@ import (
 	"github.com/coreos/etcd/etcdserver/etcdserverpb"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/Azure/metaetcd/internal/clock"
 	"github.com/Azure/metaetcd/internal/membership"
 	"github.com/Azure/metaetcd/internal/proxysvr"
+	"github.com/Azure/metaetcd/internal/util"
 	"github.com/Azure/metaetcd/internal/watch"
 )
 
 func main() {
 	var (
-		listenAddr               string
-		coordinator              string
-		membersStr               string
-		clientCertPath           string
-		clientCertKeyPath        string
-		serverCertPath           string
-		serverCertKeyPath        string
-		caPath                   string
-		watchTimeout             time.Duration
-		pprofPort                int
-		metricsPort              int
-		watchBufferLen           int
-		grpcSvrKeepaliveMaxIdle  time.Duration
-		grpcSvrKeepaliveInterval time.Duration
-		grpcSvrKeepaliveTimeout  time.Duration
-		grpcContext              membership.GrpcContext
+		listenAddr        string
+		coordinator       string
+		membersStr        string
+		clientCertPath    string
+		clientCertKeyPath string
+		coordinatorUser   string
+		caPath            string
+		watchTimeout      time.Duration
+		pprofPort         int
+		metricsPort       int
+		watchBufferLen    int
+		maxResolveDepth   int
+		virtualNodes      int
+		rangeSplitsStr    string
+		cancelSlowWatches bool
+		watchBatchWindow  time.Duration
+		adminRPC          bool
+		shutdownTimeout   time.Duration
+		hwmInterval       int64
+		tickTimeout       time.Duration
+		memberLagInterval time.Duration
+		logSampleFirst    int
+		logSampleRate     int
+		methodRateLimits  string
+		tlsCipherSuites   string
+		sniCerts          string
+		bypassPrefixes    string
+		clockBypass       []string
+		auditLog          string
+		grpcContext       membership.GrpcContext
+		grpcSvrConfig     proxysvr.GRPCServerConfig
+		svrConfig         proxysvr.ServerConfig
 	)
 	flag.StringVar(&listenAddr, "listen-addr", "127.0.0.1:2379", "address to serve the etcd proxy server on")
-	flag.StringVar(&coordinator, "coordinator", "", "URL of the coordinator cluster")
+	flag.StringVar(&coordinator, "coordinator", "", "comma-separated URLs of the coordinator cluster's members")
 	flag.StringVar(&membersStr, "members", "", "comma-separated list of member clusters")
 	flag.StringVar(&clientCertPath, "client-cert", "", "cert used when connecting to the coordinator and member clusters")
 	flag.StringVar(&clientCertKeyPath, "client-cert-key", "", "key of --client-cert")
-	flag.StringVar(&serverCertPath, "server-cert", "", "cert presented to etcd proxy clients (optional)")
-	flag.StringVar(&serverCertKeyPath, "server-cert-key", "", "key of --server-cert (optional)")
+	flag.StringVar(&coordinatorUser, "coordinator-user", "", "username:password used to authenticate with the coordinator cluster when auth is enabled (optional)")
+	flag.StringVar(&grpcSvrConfig.CertPath, "server-cert", "", "cert presented to etcd proxy clients. required unless --insecure is set")
+	flag.StringVar(&grpcSvrConfig.KeyPath, "server-cert-key", "", "key of --server-cert")
+	flag.BoolVar(&grpcSvrConfig.Insecure, "insecure", false, "serve etcd proxy clients over plaintext instead of TLS. can't be combined with --server-cert")
+	flag.StringVar(&grpcSvrConfig.ClientAuth, "client-auth", "require-and-verify", "how to verify etcd proxy client certs: none, request, require, verify-if-given, or require-and-verify")
+	flag.StringVar(&sniCerts, "server-sni-certs", "", "comma-separated cert:key pairs presented instead of --server-cert to etcd proxy clients that request one of their names with SNI (optional)")
+	flag.DurationVar(&grpcSvrConfig.CertReloadInterval, "server-cert-reload-interval", 0, "how often new connections check the server cert, key, and --ca-cert files for changes and reload them. disabled if 0")
+	flag.StringVar(&grpcSvrConfig.TLSMinVersion, "tls-min-version", "1.2", "oldest TLS version accepted from etcd proxy clients: 1.0, 1.1, 1.2, or 1.3")
+	flag.StringVar(&tlsCipherSuites, "tls-cipher-suites", "", "comma-separated cipher suites allowed for etcd proxy clients using TLS 1.2 or older e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Go's defaults are used if empty")
 	flag.StringVar(&caPath, "ca-cert", "", "cert used to verify incoming and outgoing identities")
 	flag.DurationVar(&watchTimeout, "watch-timeout", time.Second*10, "how long to wait before a watch message is considered missing")
 	flag.IntVar(&watchBufferLen, "watch-buffer-len", 1000, "how many watch events to buffer")
+	flag.IntVar(&virtualNodes, "virtual-nodes", 0, "place keys on members using a consistent hash ring with this many virtual nodes per member. static partitions are used if 0")
+	flag.StringVar(&rangeSplitsStr, "range-splits", "", "place keys on members by key range, split at these comma-separated keys. the nth member owns the keys from the (n-1)th split up to the nth. must have one fewer split than members")
+	flag.IntVar(&maxResolveDepth, "max-member-rev-depth", 1000, "how many member reads to allow when mapping a meta cluster revision to a member revision")
+	flag.StringVar(&grpcContext.Scheme.Namespace, "namespace", "", "prefix added to every key on the coordinator and member clusters, so metaetcd instances with different namespaces can share clusters (optional)")
+	flag.StringVar(&grpcContext.Scheme.MetaKey, "meta-key", membership.DefaultMetaKey, "key that holds the clock on the coordinator and member clusters. metaetcd instances that share clusters need different keys")
+	flag.DurationVar(&memberLagInterval, "member-lag-interval", time.Second*15, "how often to compare the meta revision stored by each member cluster with the clock, for the metaetcd_member_meta_rev_lag metric. disabled if 0")
+	flag.Int64Var(&hwmInterval, "clock-high-water-mark-interval", 1000, "how many revisions to reserve each time the clock's high-water mark is written to member clusters. disabled if 0")
+	flag.DurationVar(&tickTimeout, "clock-tick-timeout", 0, "how long the coordinator has to allocate a revision for each write before the write fails with UNAVAILABLE. disabled if 0")
 	logLevel := zap.LevelFlag("v", zap.WarnLevel, "log level")
-	flag.IntVar(&pprofPort, "pprof-port", 0, "port to serve pprof on. disabled if 0")
+	flag.IntVar(&logSampleFirst, "log-sampling-initial", 100, "how many info and debug entries with the same message to log each second before sampling")
+	flag.IntVar(&logSampleRate, "log-sampling-thereafter", 100, "log 1 in n of the info and debug entries with the same message after --log-sampling-initial each second. warnings and errors are never sampled. disabled if 0")
+	flag.IntVar(&pprofPort, "pprof-port", 0, "port to serve pprof and other debugging endpoints on (localhost only). disabled if 0")
 	flag.IntVar(&metricsPort, "metrics-port", 9090, "port to serve Prometheus metrics on. disabled if 0")
-	flag.DurationVar(&grpcSvrKeepaliveMaxIdle, "grpc-server-keepalive-max-idle", time.Second*5, "")
-	flag.DurationVar(&grpcSvrKeepaliveInterval, "grpc-server-keepalive-interval", time.Second*10, "")
-	flag.DurationVar(&grpcSvrKeepaliveTimeout, "grpc-server-keepalive-timeout", time.Second*20, "")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveMaxIdle, "grpc-server-keepalive-max-idle", time.Second*5, "")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveInterval, "grpc-server-keepalive-interval", time.Second*10, "")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveTimeout, "grpc-server-keepalive-timeout", time.Second*20, "")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveMaxAge, "grpc-server-keepalive-max-age", 0, "close client connections after roughly this long (with jitter) so clients rebalance across proxies. disabled if 0")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveMaxAgeGrace, "grpc-server-keepalive-max-age-grace", 0, "how long in-flight requests have to complete after --grpc-server-keepalive-max-age. unlimited if 0")
+	flag.DurationVar(&grpcSvrConfig.KeepaliveMinTime, "grpc-server-keepalive-min-time", time.Second*5, "minimum interval between client pings. clients that ping more often are disconnected")
+	flag.BoolVar(&grpcSvrConfig.KeepalivePermitWithoutStream, "grpc-server-keepalive-permit-without-stream", false, "allow clients to ping when they have no active streams")
+	flag.BoolVar(&grpcSvrConfig.EnableReflection, "grpc-reflection", false, "serve the gRPC reflection service (for debugging with grpcurl)")
 	flag.DurationVar(&grpcContext.GrpcKeepaliveInterval, "grpc-client-keepalive-interval", time.Second*5, "")
 	flag.DurationVar(&grpcContext.GrpcKeepaliveTimeout, "grpc-client-keepalive-timeout", time.Second*20, "")
+	flag.DurationVar(&grpcContext.DialTimeout, "grpc-client-dial-timeout", time.Second*5, "how long to wait for connections to the coordinator and member clusters")
+	flag.DurationVar(&grpcContext.AutoSyncInterval, "grpc-client-auto-sync-interval", 0, "how often to update the endpoints of each cluster from its member list, for clusters whose membership changes. disabled if 0")
+	flag.StringVar(&grpcContext.Balancer, "grpc-client-balancer", "", "grpc balancer of connections to single-endpoint clusters without auth (e.g. round_robin or pick_first). defaults to etcd's round robin balancer")
+	flag.IntVar(&svrConfig.DefragConcurrency, "defrag-concurrency", 1, "how many clusters to defragment at once")
+	flag.BoolVar(&svrConfig.RequireAuth, "require-auth", false, "reject requests without a token issued by the Authenticate RPC")
+	flag.DurationVar(&svrConfig.AuthTokenTTL, "auth-token-ttl", time.Minute*5, "how long an auth token remains valid after its last use")
+	flag.DurationVar(&svrConfig.HealthCheckInterval, "health-check-interval", time.Second*5, "how often to probe the coordinator and member clusters for the gRPC health service")
+	flag.DurationVar(&svrConfig.HealthCheckTimeout, "health-check-timeout", time.Second*2, "")
+	flag.IntVar(&svrConfig.HealthCheckFailureThreshold, "health-check-failure-threshold", 2, "how many consecutive health checks a member cluster must fail before requests for its keys fail fast")
+	flag.DurationVar(&svrConfig.MemberStatsInterval, "member-stats-interval", time.Minute, "how often to count the keys and read the database size of each member cluster, one at a time, for the metaetcd_member_key_count and metaetcd_member_db_size_bytes metrics. disabled if 0")
+	flag.IntVar(&svrConfig.MinHealthyMembers, "min-healthy-members", 0, "how many member clusters must be healthy to report SERVING. defaults to a majority if 0")
+	flag.IntVar(&svrConfig.MaxWatchResponseBytes, "max-watch-response-bytes", 1.5*1024*1024, "size above which watch responses are fragmented for clients that request it")
+	flag.IntVar(&svrConfig.WatchResponseBufferLen, "watch-response-buffer-len", 100, "how many watch responses to buffer for each client stream")
+	flag.DurationVar(&svrConfig.WatchSendTimeout, "watch-send-timeout", time.Minute, "how long a watch response can wait for the client to receive it before the watch stream is closed. disabled if 0")
+	flag.DurationVar(&svrConfig.MemberTimeout, "member-timeout", 0, "how long each member cluster has to serve its part of a range. disabled if 0")
+	flag.BoolVar(&svrConfig.SerializableReadsWithoutCoordinator, "serializable-reads-without-coordinator", false, "serve serializable single-key gets from their member cluster's latest revision while the coordinator is unavailable, instead of failing them")
+	flag.BoolVar(&svrConfig.StrictRanges, "strict-ranges", false, "re-read member clusters that receive writes at or before a range's revision while it's in progress. see the README for the latency cost")
+	flag.BoolVar(&svrConfig.PartialRanges, "partial-ranges", false, "return the keys of available members when a range fails on some of them, instead of failing the entire range")
+	flag.IntVar(&svrConfig.RangeStreamChunkSize, "range-stream-chunk-size", 1000, "how many keys each response of the streaming range RPC holds")
+	flag.IntVar(&svrConfig.MaxTxnOps, "max-txn-ops", 128, "the member clusters' --max-txn-ops. larger transactions, counting the op that updates the clock, are rejected before they're sent. disabled if 0")
+	flag.IntVar(&svrConfig.LeaseGrantConcurrency, "lease-grant-concurrency", 0, "how many member clusters a lease grant is sent to at once. unbounded if 0")
+	flag.IntVar(&svrConfig.RangeConcurrency, "range-concurrency", 0, "how many member clusters a range queries at once. unbounded if 0")
+	flag.IntVar(&svrConfig.MaxRangeResponseBytes, "max-range-response-bytes", 0, "approximate maximum size of the keys returned by a range. larger ranges are truncated and set more so clients can continue from the last key. unlimited if 0")
+	flag.IntVar(&svrConfig.MemberRetries, "member-retries", 3, "how many times to retry member cluster requests that fail with transient errors (e.g. no leader). disabled if 0")
+	flag.DurationVar(&svrConfig.MemberRetryBackoff, "member-retry-backoff", time.Millisecond*50, "maximum delay before the first retry of a member cluster request, doubled for each retry")
+	flag.DurationVar(&svrConfig.MemberRetryMaxBackoff, "member-retry-max-backoff", time.Second*2, "")
+	flag.StringVar(&bypassPrefixes, "clock-bypass-prefixes", "", "comma-separated key prefixes whose writes don't tick the meta clock, for high-churn keys that don't need global ordering. see the README for the guarantees they lose")
+	flag.StringVar(&auditLog, "audit-log", "", "file that a JSON line is appended to for every mutation, including the authenticated user and affected keys (optional)")
+	flag.IntVar(&svrConfig.AuditBufferLen, "audit-buffer-len", 1000, "number of audit records buffered while --audit-log is written before they're dropped")
+	flag.BoolVar(&svrConfig.LeaseIndex, "lease-index", false, "track which member clusters hold keys attached to each lease, so lease ttl requests that list keys only query those clusters. only safe when no other proxies attach keys to the same leases")
+	flag.DurationVar(&svrConfig.LeaseIndexTTL, "lease-index-ttl", time.Minute*10, "how long --lease-index remembers which member clusters hold a lease's keys after it was last written or listed")
+	flag.BoolVar(&svrConfig.CancelFutureWatches, "cancel-future-watches", false, "cancel watches that start after the current revision, rather than waiting for it like etcd")
+	flag.IntVar(&svrConfig.MaxWatchesPerStream, "max-watches-per-stream", 0, "maximum number of watches created on a single watch stream. unlimited if 0")
+	flag.IntVar(&svrConfig.MaxWatches, "max-watches", 0, "maximum number of watches across every watch stream. unlimited if 0")
+	flag.Float64Var(&grpcSvrConfig.RateLimit.Rate, "rate-limit", 0, "maximum requests per second across all clients. streams count when opened. disabled if 0")
+	flag.IntVar(&grpcSvrConfig.RateLimit.Burst, "rate-limit-burst", 0, "maximum requests allowed at once by --rate-limit. defaults to the rate")
+	flag.StringVar(&methodRateLimits, "method-rate-limits", "", "comma-separated per-method limits of the form method=rate[:burst] e.g. /etcdserverpb.KV/Txn=100:200")
+	flag.BoolVar(&adminRPC, "admin-rpc", false, "serve administrative RPCs such as clock reconstitution. requires --require-auth or verified client certs")
+	flag.BoolVar(&cancelSlowWatches, "cancel-slow-watches", false, "cancel watches when their client falls behind, instead of waiting for it to catch up")
+	flag.DurationVar(&watchBatchWindow, "watch-batch-window", 0, "how long to wait for more events before sending a watch response, so events that arrive together share one response. disabled if 0")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", time.Second*30, "how long to wait for in-flight requests before stopping forcefully")
 	flag.Parse()
 
 	logCfg := zap.NewProductionConfig()
 	logCfg.Level.SetLevel(*logLevel)
-	logger, err := logCfg.Build()
+	logCfg.Sampling = nil
+	var logOpts []zap.Option
+	if logSampleRate > 0 {
+		logOpts = append(logOpts, zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return util.NewSampledCore(core, time.Second, logSampleFirst, logSampleRate)
+		}))
+	}
+	logger, err := logCfg.Build(logOpts...)
 	if err != nil {
 		panic(err)
 	}
@@ -76,6 +164,36 @@ func main() {
 
 	members := strings.Split(membersStr, ",")
 
+	grpcSvrConfig.SNICerts, err = proxysvr.ParseCertKeyPairs(sniCerts)
+	if err != nil {
+		zap.L().Sugar().Panicf("invalid --server-sni-certs: %s", err)
+	}
+
+	if tlsCipherSuites != "" {
+		grpcSvrConfig.TLSCipherSuites = strings.Split(tlsCipherSuites, ",")
+	}
+	if bypassPrefixes != "" {
+		clockBypass = strings.Split(bypassPrefixes, ",")
+	}
+
+	if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			zap.L().Sugar().Panicf("failed to open --audit-log: %s", err)
+		}
+		defer f.Close()
+		svrConfig.AuditSink = proxysvr.NewJSONLinesAuditSink(f)
+	}
+
+	grpcSvrConfig.MethodRateLimits, err = proxysvr.ParseMethodRateLimits(methodRateLimits)
+	if err != nil {
+		zap.L().Sugar().Panicf("invalid --method-rate-limits: %s", err)
+	}
+
+	if adminRPC && !svrConfig.RequireAuth && (grpcSvrConfig.CertPath == "" || grpcSvrConfig.ClientAuth != "require-and-verify") {
+		zap.L().Sugar().Panicf("--admin-rpc requires --require-auth or --server-cert with --client-auth=require-and-verify")
+	}
+
 	lis, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		zap.L().Sugar().Panicf("failed to start listener: %s", err)
@@ -99,15 +217,33 @@ func main() {
 		}()
 	}
 
-	coordClient, err := membership.InitCoordinator(&grpcContext, coordinator)
+	coordGrpcContext := grpcContext
+	coordGrpcContext.Username, coordGrpcContext.Password, _ = strings.Cut(coordinatorUser, ":")
+	coordClient, err := membership.InitCoordinator(&coordGrpcContext, strings.Split(coordinator, ",")...)
 	if err != nil {
 		zap.L().Sugar().Panicf("failed to create client for coordinator cluster: %s", err)
 	}
 
-	clk := &clock.Clock{Coordinator: coordClient}
+	clk := &clock.Clock{Coordinator: coordClient, Scheme: grpcContext.Scheme, MaxResolveDepth: maxResolveDepth, HighWaterMarkInterval: hwmInterval, TickTimeout: tickTimeout, BypassPrefixes: clockBypass}
 	watchMux := watch.NewMux(watchTimeout, watchBufferLen, clk)
-	pool := membership.NewPool(&grpcContext, watchMux)
+	watchMux.CancelSlowWatches = cancelSlowWatches
+	watchMux.BatchWindow = watchBatchWindow
+	var pool *membership.Pool
+	switch {
+	case rangeSplitsStr != "":
+		splits := strings.Split(rangeSplitsStr, ",")
+		if len(splits) != len(members)-1 {
+			zap.L().Sugar().Panicf("expected %d range splits for %d members, got %d", len(members)-1, len(members), len(splits))
+		}
+		pool = membership.NewShardedPool(&grpcContext, watchMux, membership.NewRangeSharder(splits))
+	case virtualNodes > 0:
+		pool = membership.NewRingPool(&grpcContext, watchMux, virtualNodes)
+	default:
+		pool = membership.NewPool(&grpcContext, watchMux)
+	}
 	clk.Members = pool
+	http.Handle(proxysvr.KeyMemberPath, proxysvr.KeyMemberHandler(pool)) // served on the pprof port
+	http.Handle(proxysvr.WatchMuxPath, proxysvr.WatchMuxHandler(watchMux))
 
 	if err := clk.Init(); err != nil {
 		zap.L().Sugar().Panicf("failed to initialize clock: %s", err)
@@ -120,8 +256,16 @@ func main() {
 			zap.L().Sugar().Panicf("failed to add member %q to the pool: %s", memberURL, err)
 		}
 	}
+	if err := pool.Validate(); err != nil {
+		zap.L().Sugar().Panicf("invalid member pool: %s", err)
+	}
 
-	grpcServer, err := proxysvr.NewGRPCServer(caPath, serverCertPath, serverCertKeyPath, grpcSvrKeepaliveMaxIdle, grpcSvrKeepaliveInterval, grpcSvrKeepaliveTimeout)
+	svr := proxysvr.NewServer(coordClient, pool, clk, svrConfig)
+	grpcSvrConfig.CAPath = caPath
+	grpcSvrConfig.UnaryInterceptors = append(grpcSvrConfig.UnaryInterceptors, svr.UnaryInterceptor())
+	grpcSvrConfig.StreamInterceptors = append(grpcSvrConfig.StreamInterceptors, svr.StreamInterceptor())
+	grpcSvrConfig.Health = svr.HealthServer()
+	grpcServer, err := proxysvr.NewGRPCServer(grpcSvrConfig)
 	if err != nil {
 		zap.L().Sugar().Panicf("failed to construct grpc server: %s", err)
 	}
@@ -131,7 +275,11 @@ func main() {
 	go func() {
 		<-shutdownSig
 		zap.L().Warn("gracefully shutting down...")
-		grpcServer.GracefulStop()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := svr.Shutdown(ctx, grpcServer); err != nil {
+			zap.L().Error("failed to shut down gracefully", zap.Error(err))
+		}
 	}()
 
 	var wg sync.WaitGroup
@@ -146,10 +294,41 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Add(-1)
-		svr := proxysvr.NewServer(coordClient, pool, clk)
+		svr.RunHealthChecks(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Add(-1)
+		svr.RunAuditSink(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Add(-1)
+		svr.RunMemberStats(ctx)
+	}()
+
+	if memberLagInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			clk.MonitorMemberLag(ctx, memberLagInterval)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Add(-1)
 		etcdserverpb.RegisterKVServer(grpcServer, svr)
 		etcdserverpb.RegisterWatchServer(grpcServer, svr)
 		etcdserverpb.RegisterLeaseServer(grpcServer, svr)
+		etcdserverpb.RegisterMaintenanceServer(grpcServer, svr)
+		etcdserverpb.RegisterAuthServer(grpcServer, svr)
+		proxysvr.RegisterStreamingKVServer(grpcServer, svr)
+		if adminRPC {
+			proxysvr.RegisterAdminServer(grpcServer, svr)
+		}
 		zap.L().Info("initialized - ready to proxy requests")
 		grpcServer.Serve(lis)
 		zap.L().Warn("grpc server gracefully shut down")